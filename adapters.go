@@ -1,8 +1,15 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/tracing"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
 )
 
 // ServerAdapter represents a apply middleware type for http server.
@@ -17,13 +24,130 @@ func ServerApply(h http.Handler, adapters ...ServerAdapter) http.Handler {
 	return h
 }
 
+// requestIDHeader is the header which has the ID of the request.
+const requestIDHeader = "X-Request-Id"
+
+// requestInfo is the information of the request which is filled while
+// serving it, such as the authenticated user and the error code.
+type requestInfo struct {
+	id        string
+	user      string
+	errorCode string
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFromContext returns the requestInfo in the context. If there is no
+// requestInfo, it returns a new one so that callers can always fill it.
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return new(requestInfo)
+}
+
+// RequestServerAdapter assigns an ID to every request and puts the logger which
+// logs with the ID into the context. The ID is taken from X-Request-Id if it is set.
+func RequestServerAdapter(logger *logging.Logger) ServerAdapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(requestIDHeader)
+			if id == "" || len(id) > 128 {
+				id = uuid.New().String()
+			}
+			w.Header().Set(requestIDHeader, id)
+			ctx := context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id: id})
+			ctx = logging.NewContext(ctx, logger.With("request_id", id))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 // AccessLogServerAdapter logs access log
 func AccessLogServerAdapter() ServerAdapter {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
 			wrapped := newResponse(w)
 			next.ServeHTTP(wrapped, r)
-			log.Println(r.Method, wrapped.statusCode, r.URL.String())
+
+			ctx := r.Context()
+			info := requestInfoFromContext(ctx)
+			fields := []interface{}{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", wrapped.statusCode,
+				"bytes", wrapped.size,
+				"duration", time.Since(start),
+				"remote_addr", r.RemoteAddr,
+				"user_agent", r.UserAgent(),
+			}
+			if info.user != "" {
+				fields = append(fields, "user", info.user)
+			}
+			if name, dgst := repositoryOf(r.URL.Path); name != "" {
+				fields = append(fields, "repository", name)
+				if dgst != "" {
+					fields = append(fields, "digest", dgst)
+				}
+			}
+			if info.errorCode != "" {
+				fields = append(fields, "error_code", info.errorCode)
+			}
+			logging.FromContext(ctx).Info("access", fields...)
+		})
+	}
+}
+
+// repositoryOf returns the repository name of the path, and the digest
+// if the path ends with a digest.
+func repositoryOf(path string) (name, dgst string) {
+	m := repositoryPath.FindStringSubmatchIndex(path)
+	if m == nil {
+		return "", ""
+	}
+	name = path[m[2]:m[3]]
+	if d, err := digest.Parse(path[m[1]:]); err == nil {
+		dgst = d.String()
+	}
+	return name, dgst
+}
+
+// TracingServerAdapter starts the span of every request with t. The span is a child
+// of the span in the traceparent header if it is set.
+func TracingServerAdapter(t *tracing.Tracer) ServerAdapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracing.NewContext(r.Context(), t)
+			remote, _ := tracing.Extract(r.Header)
+			route := routeOf(r)
+			ctx, span := tracing.StartWithRemote(ctx, remote, r.Method+" "+route, tracing.KindServer,
+				"http.method", r.Method,
+				"http.route", route,
+				"http.target", r.URL.Path,
+				"request_id", requestInfoFromContext(ctx).id,
+			)
+			defer span.Finish()
+			ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("trace_id", span.TraceID.String()))
+
+			wrapped := newResponse(w)
+			next.ServeHTTP(wrapped, r.WithContext(ctx))
+			span.SetAttributes("http.status_code", wrapped.statusCode)
+			if wrapped.statusCode >= http.StatusInternalServerError {
+				span.SetError(fmt.Errorf("%d %s", wrapped.statusCode, http.StatusText(wrapped.statusCode)))
+			}
+		})
+	}
+}
+
+// HandlerSpanServerAdapter starts the span of the handler which serves the request.
+// It must be the last adapter, so that the span is separated from other adapters.
+func HandlerSpanServerAdapter() ServerAdapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := tracing.Start(r.Context(), "handler."+routeOf(r))
+			defer span.Finish()
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/json"
+	e "errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/auth"
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/grammar"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/ocilayout"
+	"github.com/Code-Hex/container-registry/internal/quota"
+	"github.com/Code-Hex/container-registry/internal/replication"
+	"github.com/Code-Hex/container-registry/internal/retention"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/Code-Hex/go-router-simple"
+)
+
+// ReplicationStatus a handler to show the replication status of every target.
+//
+// perform a GET request to a path in the following format: /admin/replication
+func ReplicationStatus(rep *replication.Replicator) http.Handler {
+	type Targets struct {
+		Targets []replication.Status `json:"targets"`
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&Targets{
+			Targets: rep.Status(),
+		})
+	})
+}
+
+// CreateAPIToken a handler to create an API token of a robot account or a user.
+//
+// perform a POST request to a path in the following format: /admin/tokens
+// The body is a json such as:
+//
+//	{"kind": "robot", "name": "ci", "scopes": ["repository:team-a/app:pull,push"], "expiresIn": "720h"}
+//
+// The token is only shown in the response, it can never be retrieved again.
+func CreateAPIToken(store *auth.TokenStore) http.Handler {
+	type Request struct {
+		Kind      string   `json:"kind"`
+		Name      string   `json:"name"`
+		User      string   `json:"user"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn string   `json:"expiresIn"`
+	}
+	type Response struct {
+		Token string `json:"token"`
+		*auth.APIToken
+	}
+	badRequest := func(err error) error {
+		return errors.Wrap(err,
+			errors.WithCodeUnsupported(),
+			errors.WithStatusCode(http.StatusBadRequest),
+		)
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return badRequest(err)
+		}
+		t := auth.APIToken{
+			Kind: req.Kind,
+			Name: req.Name,
+			User: req.User,
+		}
+		for _, scope := range req.Scopes {
+			a, err := auth.ParseScope(scope)
+			if err != nil {
+				return badRequest(err)
+			}
+			t.Scopes = append(t.Scopes, a)
+		}
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil {
+				return badRequest(err)
+			}
+			t.ExpiresAt = time.Now().Add(d).UTC()
+		}
+		secret, created, err := store.Create(t)
+		if err != nil {
+			return badRequest(err)
+		}
+		created.Hash = ""
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(w).Encode(&Response{
+			Token:    secret,
+			APIToken: created,
+		})
+	})
+}
+
+// ListAPITokens a handler to list API tokens. Tokens themselves are never listed.
+//
+// perform a GET request to a path in the following format: /admin/tokens
+func ListAPITokens(store *auth.TokenStore) http.Handler {
+	type Tokens struct {
+		Tokens []auth.APIToken `json:"tokens"`
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		tokens := store.List()
+		for i := range tokens {
+			tokens[i].Hash = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&Tokens{Tokens: tokens})
+	})
+}
+
+// RevokeAPIToken a handler to revoke an API token.
+//
+// perform a DELETE request to a path in the following format: /admin/tokens/<id>
+func RevokeAPIToken(store *auth.TokenStore) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		id := router.ParamFromContext(r.Context(), "id")
+		if err := store.Revoke(id); err != nil {
+			if e.Is(err, auth.ErrTokenNotFound) {
+				return errors.Wrap(err, errors.WithStatusCode(http.StatusNotFound))
+			}
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+// ListQuotas a handler to list quotas with the usage.
+//
+// perform a GET request to a path in the following format: /admin/quotas
+func ListQuotas(m *quota.Manager) http.Handler {
+	type Quotas struct {
+		Quotas []quota.Quota `json:"quotas"`
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		quotas := m.List()
+		if quotas == nil {
+			quotas = []quota.Quota{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&Quotas{Quotas: quotas})
+	})
+}
+
+// GetQuota a handler to show the quota with the usage.
+//
+// perform a GET request to a path in the following format: /admin/quotas/<kind>/<name>
+// <kind> is "repository" or "namespace".
+func GetQuota(m *quota.Manager) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		q, err := m.Get(router.ParamFromContext(ctx, "kind"), router.ParamFromContext(ctx, "name"))
+		if err != nil {
+			return quotaError(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(q)
+	})
+}
+
+// SetQuota a handler to set the limit of the quota in bytes.
+//
+// perform a PUT request to a path in the following format: /admin/quotas/<kind>/<name>
+// The body is a json such as:
+//
+//	{"limit": 10737418240}
+func SetQuota(m *quota.Manager) http.Handler {
+	type Request struct {
+		Limit int64 `json:"limit"`
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return quotaError(err)
+		}
+		ctx := r.Context()
+		q, err := m.Set(router.ParamFromContext(ctx, "kind"), router.ParamFromContext(ctx, "name"), req.Limit)
+		if err != nil {
+			return quotaError(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(q)
+	})
+}
+
+// DeleteQuota a handler to remove the quota.
+//
+// perform a DELETE request to a path in the following format: /admin/quotas/<kind>/<name>
+func DeleteQuota(m *quota.Manager) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		if err := m.Delete(router.ParamFromContext(ctx, "kind"), router.ParamFromContext(ctx, "name")); err != nil {
+			return quotaError(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+func quotaError(err error) error {
+	if e.Is(err, quota.ErrNotFound) {
+		return errors.Wrap(err, errors.WithStatusCode(http.StatusNotFound))
+	}
+	return errors.Wrap(err,
+		errors.WithCodeUnsupported(),
+		errors.WithStatusCode(http.StatusBadRequest),
+	)
+}
+
+// RetentionReport a handler to show what retention policies would delete now, without deleting anything.
+//
+// perform a GET request to a path in the following format: /admin/retention
+func RetentionReport(engine *retention.Engine) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		report, err := engine.Execute(r.Context(), true)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(report)
+	})
+}
+
+// RunRetention a handler to apply retention policies and collect garbage now.
+//
+// perform a POST request to a path in the following format: /admin/retention
+// The dry run is performed if the query has dryRun=true.
+func RunRetention(engine *retention.Engine) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		dryRun := r.URL.Query().Get("dryRun") == "true"
+		report, err := engine.Execute(r.Context(), dryRun)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(report)
+	})
+}
+
+// ListTrash a handler to list deleted tags, manifests and blobs in the trash.
+//
+// perform a GET request to a path in the following format: /admin/trash?repository=<name>
+// Every entry is listed if <name> is not specified.
+func ListTrash(s *storage.Local) http.Handler {
+	type Entries struct {
+		Entries []storage.TrashEntry `json:"entries"`
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
+		entries, err := s.ListTrash(r.URL.Query().Get("repository"))
+		if err != nil {
+			return err
+		}
+		if entries == nil {
+			entries = []storage.TrashEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&Entries{Entries: entries})
+	})
+}
+
+// RestoreTrash a handler to restore the entry in the trash to the repository.
+//
+// perform a POST request to a path in the following format: /admin/trash/<id>/restore
+// Restored contents are emitted as push events.
+func RestoreTrash(s *storage.Local, sink notifications.Sink) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(withActor(r))
+		entry, err := s.RestoreTrash(router.ParamFromContext(r.Context(), "id"))
+		if err != nil {
+			return err
+		}
+		for _, target := range restoredTargets(entry) {
+			sink.Write(newEvent(r, notifications.ActionPush, target))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(entry)
+	})
+}
+
+// restoredTargets returns targets of push events for the restored entry.
+func restoredTargets(e *storage.TrashEntry) []notifications.Target {
+	if e.Kind == storage.TrashKindBlob {
+		return []notifications.Target{{
+			Size:       e.Size,
+			Digest:     e.Digest,
+			Repository: e.Repository,
+			URL:        "/v2/" + e.Repository + "/blobs/" + e.Digest,
+		}}
+	}
+	var targets []notifications.Target
+	for _, tag := range e.Tags {
+		targets = append(targets, notifications.Target{
+			Size:       e.Size,
+			Digest:     e.Digest,
+			Repository: e.Repository,
+			Tag:        tag,
+			URL:        "/v2/" + e.Repository + "/manifests/" + tag,
+		})
+	}
+	if len(targets) == 0 {
+		targets = append(targets, notifications.Target{
+			Size:       e.Size,
+			Digest:     e.Digest,
+			Repository: e.Repository,
+			URL:        "/v2/" + e.Repository + "/manifests/" + e.Digest,
+		})
+	}
+	return targets
+}
+
+// PurgeTrash a handler to remove the entry from the trash permanently.
+//
+// perform a DELETE request to a path in the following format: /admin/trash/<id>
+func PurgeTrash(s *storage.Local) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
+		if _, err := s.PurgeTrash(router.ParamFromContext(r.Context(), "id")); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+var (
+	namePattern      = regexp.MustCompile(`^` + grammar.Name + `$`)
+	tagPattern       = regexp.MustCompile(`^` + grammar.Tag + `$`)
+	referencePattern = regexp.MustCompile(`^(?:` + grammar.Tag + `|` + grammar.Digest + `)$`)
+)
+
+// CopyManifest a handler to tag the manifest of a repository in the same or
+// another repository, without pulling and pushing it.
+//
+// perform a POST request to a path in the following format: /admin/copy
+// The body is a json such as:
+//
+//	{"source": "staging/app", "reference": "v1.2.0", "repository": "prod/app", "tags": ["v1.2.0", "latest"]}
+//
+// "reference" is a tag or a digest of the source. "repository" defaults to the
+// source to retag the manifest, and "tags" defaults to the tag of "reference".
+// Manifests of the index, configs, layers and referrers are linked to the
+// repository, and they are emitted as push events with the tags.
+func CopyManifest(s *storage.Local, quotas *quota.Manager, sink notifications.Sink) http.Handler {
+	type Request struct {
+		Source     string   `json:"source"`
+		Reference  string   `json:"reference"`
+		Repository string   `json:"repository"`
+		Tags       []string `json:"tags"`
+	}
+	badRequest := func(err error) error {
+		return errors.Wrap(err,
+			errors.WithCodeUnsupported(),
+			errors.WithStatusCode(http.StatusBadRequest),
+		)
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return badRequest(err)
+		}
+		if req.Repository == "" {
+			req.Repository = req.Source
+		}
+		if len(req.Tags) == 0 {
+			if tag := tagOf(req.Reference); tag != "" {
+				req.Tags = []string{tag}
+			}
+		}
+		switch {
+		case !namePattern.MatchString(req.Source):
+			return badRequest(fmt.Errorf("invalid source %q", req.Source))
+		case !namePattern.MatchString(req.Repository):
+			return badRequest(fmt.Errorf("invalid repository %q", req.Repository))
+		case !referencePattern.MatchString(req.Reference):
+			return badRequest(fmt.Errorf("invalid reference %q", req.Reference))
+		case len(req.Tags) == 0:
+			return badRequest(fmt.Errorf("tags are required to copy the digest"))
+		}
+		for _, tag := range req.Tags {
+			if !tagPattern.MatchString(tag) {
+				return badRequest(fmt.Errorf("invalid tag %q", tag))
+			}
+		}
+
+		s := s.WithContext(withActor(r))
+		_, contents, err := s.ManifestContents(req.Source, req.Reference)
+		if err != nil {
+			return err
+		}
+		var n int64
+		for _, c := range contents {
+			if _, err := s.CheckBlobByReference(req.Repository, c.Digest); err != nil {
+				n += c.Size
+			}
+		}
+		if err := quotas.Check(req.Repository, "", n); err != nil {
+			return err
+		}
+		result, err := s.CopyManifest(req.Source, req.Reference, req.Repository, req.Tags)
+		if err != nil {
+			return err
+		}
+		for _, target := range copiedTargets(req.Repository, req.Tags, result) {
+			sink.Write(newEvent(r, notifications.ActionPush, target))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(result)
+	})
+}
+
+// copiedTargets returns targets of push events for linked contents and tags,
+// which are in the same order as a client pushes them.
+func copiedTargets(name string, tags []string, result *storage.CopyResult) []notifications.Target {
+	return append(contentTargets(result.Contents), tagTargets(name, result.Digest, result.Size, tags)...)
+}
+
+// contentTargets returns targets of push events for the contents.
+func contentTargets(contents []storage.Content) []notifications.Target {
+	var targets []notifications.Target
+	for _, c := range contents {
+		kind := "blobs"
+		if c.Manifest {
+			kind = "manifests"
+		}
+		targets = append(targets, notifications.Target{
+			Size:       c.Size,
+			Digest:     c.Digest,
+			Repository: c.Repository,
+			URL:        "/v2/" + c.Repository + "/" + kind + "/" + c.Digest,
+		})
+	}
+	return targets
+}
+
+// tagTargets returns targets of push events for tags of the manifest.
+func tagTargets(name, dgst string, size int64, tags []string) []notifications.Target {
+	var targets []notifications.Target
+	for _, tag := range tags {
+		targets = append(targets, notifications.Target{
+			Size:       size,
+			Digest:     dgst,
+			Repository: name,
+			Tag:        tag,
+			URL:        "/v2/" + name + "/manifests/" + tag,
+		})
+	}
+	return targets
+}
+
+// ExportImages a handler to export images as a tar archive of the OCI image layout.
+//
+// perform a GET request to a path in the following format: /admin/export?image=<name>:<tag>&image=<name>@<digest>
+// The archive has every manifest of indexes, config, layer and referrer of the
+// images, and it is streamed as it is read from the storage.
+func ExportImages(s *storage.Local) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
+		var images []ocilayout.Image
+		for _, image := range r.URL.Query()["image"] {
+			img := ocilayout.ParseImage(image)
+			if !namePattern.MatchString(img.Repository) || !referencePattern.MatchString(img.Reference) {
+				return errors.Wrap(fmt.Errorf("invalid image %q", image),
+					errors.WithCodeUnsupported(),
+					errors.WithStatusCode(http.StatusBadRequest),
+					errors.WithDetail(map[string]interface{}{"image": image}),
+				)
+			}
+			images = append(images, img)
+		}
+		if len(images) == 0 {
+			return errors.Wrap(fmt.Errorf("images are required"),
+				errors.WithCodeUnsupported(),
+				errors.WithStatusCode(http.StatusBadRequest),
+			)
+		}
+		exporter, err := ocilayout.NewExporter(s, images)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", `attachment; filename="images.tar"`)
+		tw := ocilayout.NewTarWriter(w)
+		if err := exporter.Export(tw); err == nil {
+			err = tw.Close()
+		}
+		if err != nil {
+			// the archive is partially sent, so the connection is aborted to
+			// tell the client that it is broken rather than to send the error.
+			logging.FromContext(r.Context()).Error("failed to export images", "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		return nil
+	})
+}
+
+// ImportImages a handler to import images of an OCI image layout or an archive
+// of "docker save", which is a tar archive compressed by gzip optionally.
+//
+// perform a POST request to a path in the following format: /admin/import?repository=<name>
+// Images are imported into repositories of their names unless <name> is specified.
+// Put contents and tags are emitted as push events, as if the images are pushed.
+func ImportImages(s *storage.Local, quotas *quota.Manager, sink notifications.Sink) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(withActor(r))
+		importer := ocilayout.NewImporter(s)
+		importer.Repository = r.URL.Query().Get("repository")
+		if importer.Repository != "" && !namePattern.MatchString(importer.Repository) {
+			return errors.Wrap(fmt.Errorf("invalid repository %q", importer.Repository),
+				errors.WithCodeNameInvalid(),
+				errors.WithDetail(map[string]interface{}{"repository": importer.Repository}),
+			)
+		}
+		importer.Check = quotas.Check
+		result, err := importer.Import(r.Body)
+		if err != nil {
+			return err
+		}
+		targets := contentTargets(result.Contents)
+		for _, img := range result.Images {
+			targets = append(targets, tagTargets(img.Repository, img.Digest, img.Size, img.Tags)...)
+		}
+		for _, target := range targets {
+			sink.Write(newEvent(r, notifications.ActionPush, target))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(result)
+	})
+}
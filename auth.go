@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	e "errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Code-Hex/container-registry/internal/auth"
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/grammar"
+	"github.com/Code-Hex/container-registry/internal/tracing"
+)
+
+// tokenPath is the path of the built-in token endpoint.
+const tokenPath = "/token"
+
+var repositoryPath = regexp.MustCompile(
+	fmt.Sprintf(`^/v2/(%s)/(?:blobs|manifests|tags|_history)/`, grammar.Name),
+)
+
+// requiredAccess returns the access which is required to serve the request.
+// It returns nil if the request only needs to be authenticated.
+func requiredAccess(r *http.Request) []auth.Access {
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		return []auth.Access{{
+			Type:    auth.TypeRegistry,
+			Name:    auth.ResourceAdmin,
+			Actions: []string{auth.ActionAll},
+		}}
+	}
+	if r.URL.Path == catalogPath {
+		return []auth.Access{{
+			Type:    auth.TypeRegistry,
+			Name:    auth.ResourceCatalog,
+			Actions: []string{auth.ActionAll},
+		}}
+	}
+	m := repositoryPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return nil
+	}
+	action := auth.ActionPush
+	switch r.Method {
+	case GET, http.MethodHead:
+		action = auth.ActionPull
+	case DELETE:
+		action = auth.ActionDelete
+	}
+	return []auth.Access{{
+		Type:    auth.TypeRepository,
+		Name:    m[1],
+		Actions: []string{action},
+	}}
+}
+
+// AuthServerAdapter authorizes every request except for the token endpoint and
+// the health endpoints with c.
+// If the request is not authorized, it responds the challenge to authenticate.
+func AuthServerAdapter(c auth.Controller) ServerAdapter {
+	return func(next http.Handler) http.Handler {
+		return Handler(func(w http.ResponseWriter, r *http.Request) error {
+			switch r.URL.Path {
+			case tokenPath, healthzPath, readyzPath:
+				next.ServeHTTP(w, r)
+				return nil
+			}
+			_, span := tracing.Start(r.Context(), "auth.Authorized")
+			ctx, err := c.Authorized(r, requiredAccess(r)...)
+			span.SetError(err)
+			span.Finish()
+			if err != nil {
+				var ch auth.Challenge
+				if e.As(err, &ch) {
+					ch.SetHeaders(w)
+				}
+				return err
+			}
+			requestInfoFromContext(ctx).user = auth.UserFromContext(ctx)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return nil
+		})
+	}
+}
+
+// IssueToken a handler to issue a token which has the requested scopes.
+//
+// perform a GET request with the basic authentication to a path in the following format:
+// /token?service=<service>&scope=<scope>
+// The POST request of the OAuth2 password grant is also supported.
+//
+// see: https://docs.docker.com/registry/spec/auth/token/
+// see: https://docs.docker.com/registry/spec/auth/oauth/
+func IssueToken(issuer *auth.Issuer) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		var (
+			username, password string
+			scopes             []string
+		)
+		if r.Method == POST {
+			if err := r.ParseForm(); err != nil {
+				return errors.Wrap(err, errors.WithStatusCode(http.StatusBadRequest))
+			}
+			if grantType := r.PostForm.Get("grant_type"); grantType != "password" {
+				return errors.Wrap(
+					fmt.Errorf("unsupported grant_type %q", grantType),
+					errors.WithCodeUnsupported(),
+					errors.WithStatusCode(http.StatusBadRequest),
+				)
+			}
+			username, password = r.PostForm.Get("username"), r.PostForm.Get("password")
+			scopes = strings.Fields(r.PostForm.Get("scope"))
+		} else {
+			username, password, _ = r.BasicAuth()
+			for _, s := range r.URL.Query()["scope"] {
+				scopes = append(scopes, strings.Fields(s)...)
+			}
+		}
+		requested := make([]auth.Access, 0, len(scopes))
+		for _, s := range scopes {
+			a, err := auth.ParseScope(s)
+			if err != nil {
+				return errors.Wrap(err, errors.WithStatusCode(http.StatusBadRequest))
+			}
+			requested = append(requested, a)
+		}
+		token, err := issuer.Issue(username, password, requested)
+		if err != nil {
+			if e.Is(err, auth.ErrInvalidCredentials) {
+				return errors.Wrap(err, errors.WithCodeUnauthorized())
+			}
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(token)
+	})
+}
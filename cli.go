@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminClient sends requests to the admin API of the running registry for subcommands,
+// so that the registry emits events and keeps quotas for what subcommands change.
+type adminClient struct {
+	url      string
+	username string
+	password string
+	token    string
+}
+
+// newAdminClient defines flags of the admin API on fs. Secrets can be given by
+// REGISTRY_PASSWORD and REGISTRY_TOKEN not to leave them in the shell history.
+func newAdminClient(fs *flag.FlagSet) *adminClient {
+	c := new(adminClient)
+	fs.StringVar(&c.url, "url", "http://localhost:5080", "URL of the registry")
+	fs.StringVar(&c.username, "username", "", "username of the admin")
+	fs.StringVar(&c.password, "password", "", "password of the admin (default $REGISTRY_PASSWORD)")
+	fs.StringVar(&c.token, "token", "", "API token which is sent as the bearer token (default $REGISTRY_TOKEN)")
+	return c
+}
+
+// do sends the request to the path and decodes the json response into v if it is not nil.
+func (c *adminClient) do(ctx context.Context, method, path string, body io.Reader, v interface{}) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// send sends the request to the path and returns the response whose status is successful.
+// The caller must close the body.
+func (c *adminClient) send(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	password, token := c.password, c.token
+	if password == "" {
+		password = os.Getenv("REGISTRY_PASSWORD")
+	}
+	if token == "" {
+		token = os.Getenv("REGISTRY_TOKEN")
+	}
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case c.username != "":
+		req.SetBasicAuth(c.username, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Code    string          `json:"code"`
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if len(e.Detail) > 0 {
+		return nil, fmt.Errorf("%s: %s %s", e.Code, e.Message, e.Detail)
+	}
+	return nil, fmt.Errorf("%s: %s", e.Code, e.Message)
+}
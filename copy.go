@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Code-Hex/container-registry/internal/ocilayout"
+	"github.com/Code-Hex/container-registry/internal/storage"
+)
+
+// copyCommand runs "registry copy" and returns the exit code.
+//
+//	registry copy [flags] <source>:<tag>|<source>@<digest> <repository>[:<tag>[,<tag>...]]
+//
+// The tag of the destination defaults to the tag of the source, so that
+// "registry copy staging/app:v1 prod/app" promotes the image, and
+// "registry copy app:v1 app:stable" retags it. It is performed on the admin
+// API of the running registry.
+func copyCommand(args []string) int {
+	fs := flag.NewFlagSet("copy", flag.ContinueOnError)
+	c := newAdminClient(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: registry copy [flags] <source>:<tag>|<source>@<digest> <repository>[:<tag>[,<tag>...]]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	if len(args) != 2 {
+		fs.Usage()
+		return 2
+	}
+	src, dst := ocilayout.ParseImage(args[0]), ocilayout.ParseImage(args[1])
+	if src.Reference == "" || strings.Contains(args[1], "@") {
+		fs.Usage()
+		return 2
+	}
+	req := map[string]interface{}{
+		"source":     src.Repository,
+		"reference":  src.Reference,
+		"repository": dst.Repository,
+	}
+	if dst.Reference != "" {
+		req["tags"] = strings.Split(dst.Reference, ",")
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "copy: %v\n", err)
+		return 1
+	}
+	var res storage.CopyResult
+	if err := c.do(context.Background(), POST, "/admin/copy", bytes.NewReader(body), &res); err != nil {
+		fmt.Fprintf(os.Stderr, "copy: %v\n", err)
+		return 1
+	}
+	fmt.Printf("copied %s@%s to %s (%d contents linked)\n", src.Repository, res.Digest, args[1], len(res.Contents))
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/auth"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// newEvent creates an event which is caused by the request.
+func newEvent(r *http.Request, action string, target notifications.Target) notifications.Event {
+	return notifications.Event{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
+		Action:    action,
+		Target:    target,
+		Request: notifications.Request{
+			ID:        requestInfoFromContext(r.Context()).id,
+			Addr:      r.RemoteAddr,
+			Host:      r.Host,
+			Method:    r.Method,
+			UserAgent: r.UserAgent(),
+		},
+		Actor: notifications.Actor{
+			Name: auth.UserFromContext(r.Context()),
+		},
+	}
+}
+
+// withActor returns the context of the request which has the user and the
+// client address, so that the storage records them in the tag history.
+func withActor(r *http.Request) context.Context {
+	return storage.WithActor(r.Context(), storage.Actor{
+		Name: auth.UserFromContext(r.Context()),
+		Addr: r.RemoteAddr,
+	})
+}
+
+// tagOf returns the reference if it is a tag, otherwise returns empty string.
+func tagOf(reference string) string {
+	if _, err := digest.Parse(reference); err == nil {
+		return ""
+	}
+	return reference
+}
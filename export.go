@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Code-Hex/container-registry/internal/ocilayout"
+)
+
+// exportCommand runs "registry export" and returns the exit code.
+//
+//	registry export [flags] -o <directory>|<file>.tar|- <image>...
+//
+// Images such as "team-a/app:v1" and "team-a/app@sha256:..." are exported from
+// the admin API of the running registry as the OCI image layout, which is
+// extracted into the directory unless the output is a tar file or "-".
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	c := newAdminClient(fs)
+	output := fs.String("o", "", `output directory, tar file whose name ends with ".tar", or "-" for the standard output`)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: registry export [flags] -o <directory>|<file>.tar|- <image>...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *output == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	query := url.Values{"image": fs.Args()}
+	if err := export(context.Background(), c, "/admin/export?"+query.Encode(), *output); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func export(ctx context.Context, c *adminClient, path, output string) error {
+	resp, err := c.send(ctx, GET, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case output == "-":
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	case strings.HasSuffix(output, ".tar"):
+		// the archive is renamed after it is received completely, so that
+		// broken archives are never left by aborted exports.
+		tmp := filepath.Join(filepath.Dir(output), "."+filepath.Base(output))
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, resp.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return os.Rename(tmp, output)
+	}
+	w, err := ocilayout.NewDirWriter(output)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(output, ocilayout.IndexFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := ocilayout.Extract(resp.Body, w); err != nil {
+		return err
+	}
+	// index.json is the last file, so the layout is incomplete without it.
+	if _, err := os.Stat(filepath.Join(output, ocilayout.IndexFile)); err != nil {
+		return fmt.Errorf("the archive is incomplete: %w", err)
+	}
+	return w.Close()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Code-Hex/container-registry/internal/auth"
+	"github.com/Code-Hex/container-registry/internal/config"
+	"github.com/Code-Hex/container-registry/internal/duration"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/replication"
+	"github.com/Code-Hex/container-registry/internal/tlsutil"
+	"github.com/Code-Hex/container-registry/internal/tracing"
+)
+
+// deprecatedFlags maps flags of json files to the sections of the
+// configuration which replace them.
+var deprecatedFlags = map[string]string{
+	"replication-config":   "replication",
+	"notifications-config": "notifications",
+	"auth-token-config":    "auth.token",
+	"auth-basic-config":    "auth.basic",
+	"auth-policy":          "auth.policy",
+}
+
+// loadConfig loads the configuration. Values are overridden in the order of
+// defaults, the file which is specified by -config, environment variables and flags.
+func loadConfig(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	var (
+		configFile = fs.String("config", "", "YAML configuration file")
+		addr       = fs.String("addr", "", "address to listen (default localhost:5080)")
+		root       = fs.String("root", "", "directory to store images (default testdata)")
+		logLevel   = fs.String("log-level", "", "minimum level of logs: debug, info, warn or error (default info)")
+		logFormat  = fs.String("log-format", "", "format of logs: text or json (default text)")
+
+		proxyURL      = fs.String("proxy-url", "", "run as a pull-through cache of the upstream registry URL")
+		proxyUsername = fs.String("proxy-username", "", "username for the upstream registry")
+		proxyPassword = fs.String("proxy-password", "", "password for the upstream registry")
+		proxyTTL      = fs.Duration("proxy-ttl", 0, "duration while tags fetched from the upstream are fresh (default 10m)")
+
+		// deprecated: the json files are sections of -config.
+		replicationConfig   = fs.String("replication-config", "", "deprecated: use replication of -config. json file which configures targets to replicate pushed images")
+		notificationsConfig = fs.String("notifications-config", "", "deprecated: use notifications of -config. json file which configures webhook endpoints to notify events")
+		tokenConfig         = fs.String("auth-token-config", "", "deprecated: use auth.token of -config. json file which configures the token authentication")
+		basicConfig         = fs.String("auth-basic-config", "", "deprecated: use auth.basic of -config. json file which configures the basic authentication")
+		policyFile          = fs.String("auth-policy", "", "deprecated: use auth.policy of -config. json file which configures access control rules of repositories")
+
+		tracingExporter = fs.String("tracing-exporter", "", "export traces to otlp or stdout")
+		tracingEndpoint = fs.String("tracing-endpoint", "", "OTLP/HTTP traces endpoint such as http://localhost:4318/v1/traces")
+
+		tlsCert             = fs.String("tls-cert", "", "certificate file to serve TLS, which is reloaded on change")
+		tlsKey              = fs.String("tls-key", "", "key file to serve TLS, which is reloaded on change")
+		tlsDev              = fs.String("tls-dev", "", "directory to write a self-signed CA and a certificate for development")
+		tlsClientCA         = fs.String("tls-client-ca", "", "CA file to verify client certificates of mutual TLS")
+		tlsClientAuth       = fs.String("tls-client-auth", "", "whether client certificates are optional or required (optional, require)")
+		tlsClientIdentities = fs.String("tls-client-identities", "", "json file which maps subjects of client certificates to usernames")
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := config.Default()
+	if *configFile != "" {
+		if err := cfg.LoadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	// only flags which are set override the configuration, and each flag
+	// overrides only its own field of sections.
+	proxy := func() *config.Proxy {
+		if cfg.Proxy == nil {
+			cfg.Proxy = new(config.Proxy)
+		}
+		return cfg.Proxy
+	}
+	tracingConfig := func() *tracing.Config {
+		if cfg.Tracing == nil {
+			cfg.Tracing = new(tracing.Config)
+		}
+		return cfg.Tracing
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if section, ok := deprecatedFlags[f.Name]; ok {
+			fmt.Fprintf(fs.Output(), "-%s is deprecated, use %s of -config instead. the json file replaces the whole section.\n", f.Name, section)
+		}
+		switch f.Name {
+		case "addr":
+			cfg.HTTP.Addr = *addr
+		case "root":
+			cfg.Storage.Root = *root
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = logging.Format(*logFormat)
+		case "proxy-url":
+			proxy().URL = *proxyURL
+		case "proxy-username":
+			proxy().Username = *proxyUsername
+		case "proxy-password":
+			proxy().Password = *proxyPassword
+		case "proxy-ttl":
+			proxy().TTL = duration.Duration(*proxyTTL)
+		case "replication-config":
+			cfg.Replication, err = replication.LoadConfig(*replicationConfig)
+		case "notifications-config":
+			cfg.Notifications, err = notifications.LoadConfig(*notificationsConfig)
+		case "auth-token-config":
+			cfg.Auth.Token, err = auth.LoadTokenConfig(*tokenConfig)
+		case "auth-basic-config":
+			cfg.Auth.Basic, err = auth.LoadBasicConfig(*basicConfig)
+		case "auth-policy":
+			cfg.Auth.Policy, err = auth.LoadPolicy(*policyFile)
+		case "tracing-exporter":
+			tracingConfig().Exporter = *tracingExporter
+		case "tracing-endpoint":
+			tracingConfig().Endpoint = *tracingEndpoint
+		case "tls-cert":
+			cfg.HTTP.TLS.Cert = *tlsCert
+		case "tls-key":
+			cfg.HTTP.TLS.Key = *tlsKey
+		case "tls-dev":
+			cfg.HTTP.TLS.Dev = *tlsDev
+		case "tls-client-ca":
+			cfg.HTTP.TLS.ClientCA = *tlsClientCA
+		case "tls-client-auth":
+			cfg.HTTP.TLS.ClientAuth = tlsutil.ClientAuth(*tlsClientAuth)
+		case "tls-client-identities":
+			cfg.HTTP.TLS.ClientIdentities, err = auth.LoadIdentities(*tlsClientIdentities)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// configCommand runs "registry config <subcommand>" and returns the exit code.
+//
+//	registry config check <file>
+//
+// check validates the file with environment variables without starting the server.
+func configCommand(args []string) int {
+	if len(args) != 2 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: registry config check <file>")
+		return 2
+	}
+	filename := args[1]
+	cfg := config.Default()
+	err := cfg.LoadFile(filename)
+	if err == nil {
+		err = cfg.ApplyEnv(os.Environ())
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid configuration:\n%v\n", filename, err)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", filename)
+	return 0
+}
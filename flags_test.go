@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/duration"
+)
+
+func TestLoadConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registry.yml")
+	content := "http:\n  addr: \":5000\"\nstorage:\n  root: /from/file\nlog:\n  accessLog: false\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("REGISTRY_STORAGE_ROOT", "/from/env")
+	defer os.Unsetenv("REGISTRY_STORAGE_ROOT")
+
+	fs := flag.NewFlagSet("registry", flag.ContinueOnError)
+	cfg, err := loadConfig(fs, []string{"-config", filename, "-addr", ":6000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTP.Addr != ":6000" {
+		t.Errorf("flag should override: %q", cfg.HTTP.Addr)
+	}
+	if cfg.Storage.Root != "/from/env" {
+		t.Errorf("env should override: %q", cfg.Storage.Root)
+	}
+	if cfg.Log.AccessLog {
+		t.Error("file should override")
+	}
+
+	fs = flag.NewFlagSet("registry", flag.ContinueOnError)
+	if _, err := loadConfig(fs, []string{"-tls-cert", "cert.pem"}); err == nil {
+		t.Error("want error for invalid configuration")
+	}
+}
+
+func TestLoadConfig_Proxy(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registry.yml")
+	content := "proxy:\n  url: https://registry-1.docker.io\n  username: alice\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("REGISTRY_PROXY_PASSWORD", "secret")
+	defer os.Unsetenv("REGISTRY_PROXY_PASSWORD")
+
+	fs := flag.NewFlagSet("registry", flag.ContinueOnError)
+	cfg, err := loadConfig(fs, []string{"-config", filename, "-proxy-ttl", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := cfg.Proxy
+	if p.URL != "https://registry-1.docker.io" || p.Username != "alice" || p.Password != "secret" || p.TTL != duration.Duration(time.Minute) {
+		t.Errorf("the flag must override only its own field: %+v", p)
+	}
+}
+
+func TestLoadConfig_Deprecated(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "registry.yml")
+	content := "replication:\n  targets:\n  - name: site-a\n    url: https://site-a.example.com\n"
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := filepath.Join(dir, "replication.json")
+	if err := ioutil.WriteFile(jsonFile, []byte(`{"targets":[{"name":"site-b","url":"https://site-b.example.com"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	fs := flag.NewFlagSet("registry", flag.ContinueOnError)
+	fs.SetOutput(&out)
+	cfg, err := loadConfig(fs, []string{"-config", filename, "-replication-config", jsonFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets := cfg.Replication.Targets; len(targets) != 1 || targets[0].Name != "site-b" {
+		t.Errorf("the json file should replace the section: %+v", targets)
+	}
+	if !strings.Contains(out.String(), "-replication-config is deprecated") {
+		t.Errorf("want the warning, but got %q", out.String())
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	valid := filepath.Join(t.TempDir(), "valid.yml")
+	if err := ioutil.WriteFile(valid, []byte("http:\n  addr: \":5000\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(t.TempDir(), "invalid.yml")
+	if err := ioutil.WriteFile(invalid, []byte("storage:\n  driver: s3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := configCommand([]string{"check", valid}); code != 0 {
+		t.Errorf("want 0, but got %d", code)
+	}
+	if code := configCommand([]string{"check", invalid}); code != 1 {
+		t.Errorf("want 1, but got %d", code)
+	}
+	if code := configCommand([]string{"check"}); code != 2 {
+		t.Errorf("want 2, but got %d", code)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
-	"log"
+	"context"
 	"net/http"
 
 	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/tracing"
 )
 
 // Response is a wrapper of http.ResponseWriter
@@ -12,6 +14,8 @@ type Response struct {
 	http.ResponseWriter
 	statusCode int
 	committed  bool
+	// size is the number of bytes of the body which is written.
+	size int64
 }
 
 func newResponse(w http.ResponseWriter) *Response {
@@ -34,6 +38,15 @@ func (r *Response) WriteHeader(statusCode int) {
 	r.ResponseWriter.WriteHeader(r.statusCode)
 }
 
+// Write wraps http.ResponseWriter.Write and
+// counts the number of bytes which are written.
+func (r *Response) Write(b []byte) (int, error) {
+	r.committed = true
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
 // Handler handles http handler and error which is caused in it.
 type Handler func(w http.ResponseWriter, r *http.Request) error
 
@@ -42,9 +55,24 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		return
 	}
-	log.Println("error:", err)
-	if err := errors.ServeJSON(w, err); err != nil {
-		log.Println(err)
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	wrapped, ok := err.(*errors.Error)
+	if !ok {
+		wrapped = errors.Wrap(err)
+	}
+	requestInfoFromContext(ctx).errorCode = wrapped.Code
+	tracing.SpanFromContext(ctx).SetError(err)
+	logger := logging.FromContext(ctx)
+	level := logging.LevelDebug
+	if wrapped.StatusCode >= http.StatusInternalServerError {
+		level = logging.LevelError
+	}
+	logger.Log(level, "request failed", "error", err, "error_code", wrapped.Code)
+	if err := errors.ServeJSON(w, wrapped); err != nil {
+		logger.Error("failed to write error response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Code-Hex/container-registry/internal/ocilayout"
+)
+
+// importCommand runs "registry import" and returns the exit code.
+//
+//	registry import [flags] <directory>|<file>|-
+//
+// The OCI image layout or the archive of "docker save" is imported by the admin
+// API of the running registry. Directories are sent as tar archives, and files
+// and the standard input are sent as they are, which may be compressed by gzip.
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	c := newAdminClient(fs)
+	repository := fs.String("repository", "", "repository which every image is imported into (default repositories of their names)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: registry import [flags] <directory>|<file>|-")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := "/admin/import"
+	if *repository != "" {
+		path += "?repository=" + url.QueryEscape(*repository)
+	}
+	body, err := openArchive(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	defer body.Close()
+	var res ocilayout.ImportResult
+	if err := c.do(context.Background(), POST, path, body, &res); err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 1
+	}
+	for _, img := range res.Images {
+		fmt.Printf("imported %s@%s %s\n", img.Repository, img.Digest, strings.Join(img.Tags, ","))
+	}
+	return 0
+}
+
+// openArchive opens the file, or archives the directory on the fly.
+func openArchive(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return os.Open(name)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archiveDir(pw, name))
+	}()
+	return pr, nil
+}
+
+// archiveDir writes regular files and symbolic links in the directory to w as a tar archive.
+func archiveDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
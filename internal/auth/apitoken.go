@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	regerrors "github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/google/uuid"
+)
+
+// APITokenPrefix is the prefix of API tokens, which distinguishes them from passwords.
+const APITokenPrefix = "crt_"
+
+// RobotPrefix is the prefix of usernames of robot accounts.
+const RobotPrefix = "robot$"
+
+// Kinds of API tokens.
+const (
+	// KindRobot is the token of a robot account, which can only do
+	// what the scopes allow.
+	KindRobot = "robot"
+	// KindPersonal is the personal access token of a user, which can do
+	// what both the scopes and the user are allowed.
+	KindPersonal = "personal"
+)
+
+// lastUsedInterval is the interval to persist the last used time of tokens.
+const lastUsedInterval = time.Minute
+
+// ErrTokenNotFound is returned if the API token does not exist.
+var ErrTokenNotFound = errors.New("token not found")
+
+// APIToken is a long-lived credential which is limited to the scopes.
+// The token itself is never stored, only the hash of it is stored.
+type APIToken struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Name is the name of the robot account, or the description of the
+	// personal access token.
+	Name string `json:"name"`
+	// User is the owner of the personal access token.
+	User       string    `json:"user,omitempty"`
+	Scopes     []Access  `json:"scopes"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+
+	Hash string `json:"hash,omitempty"`
+}
+
+// Username returns the name to log in with the token.
+func (t *APIToken) Username() string {
+	if t.Kind == KindRobot {
+		return RobotPrefix + t.Name
+	}
+	return t.User
+}
+
+// Expired reports whether the token is expired at now.
+func (t *APIToken) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)
+}
+
+// IsAPIToken reports whether s looks like an API token.
+func IsAPIToken(s string) bool {
+	return strings.HasPrefix(s, APITokenPrefix)
+}
+
+// TokenStore stores API tokens in a json file.
+type TokenStore struct {
+	filename string
+
+	mu        sync.Mutex
+	tokens    map[string]*APIToken // keyed by ID
+	persisted map[string]time.Time // last used time which is persisted, keyed by ID
+}
+
+// NewTokenStore loads tokens from the file. The file is created when a token is created.
+func NewTokenStore(filename string) (*TokenStore, error) {
+	s := &TokenStore{
+		filename:  filename,
+		tokens:    make(map[string]*APIToken),
+		persisted: make(map[string]time.Time),
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*APIToken
+	if err := json.Unmarshal(b, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	for _, t := range tokens {
+		s.tokens[t.ID] = t
+		s.persisted[t.ID] = t.LastUsedAt
+	}
+	return s, nil
+}
+
+// Create creates the token and returns the secret of it, which can never be
+// retrieved again.
+func (s *TokenStore) Create(t APIToken) (string, *APIToken, error) {
+	switch t.Kind {
+	case KindRobot:
+		if t.Name == "" {
+			return "", nil, errors.New("robot account must have name")
+		}
+	case KindPersonal:
+		if t.User == "" {
+			return "", nil, errors.New("personal access token must have user")
+		}
+	default:
+		return "", nil, fmt.Errorf("unknown kind %q", t.Kind)
+	}
+	if len(t.Scopes) == 0 {
+		return "", nil, errors.New("token must have scopes")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := APITokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	t.ID = uuid.New().String()
+	t.CreatedAt = time.Now().UTC()
+	t.LastUsedAt = time.Time{}
+	t.Hash = hashToken(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.Kind == KindRobot {
+		for _, v := range s.tokens {
+			if v.Kind == KindRobot && v.Name == t.Name {
+				return "", nil, fmt.Errorf("robot account %q already exists", t.Name)
+			}
+		}
+	}
+	s.tokens[t.ID] = &t
+	if err := s.save(); err != nil {
+		delete(s.tokens, t.ID)
+		return "", nil, err
+	}
+	created := t
+	return secret, &created, nil
+}
+
+// List returns every token which is ordered by the created time.
+func (s *TokenStore) List() []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, *t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Revoke deletes the token.
+func (s *TokenStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+	delete(s.persisted, id)
+	return nil
+}
+
+// Authenticate returns the token of the secret if the token is valid for the username.
+// The last used time of the token is updated.
+func (s *TokenStore) Authenticate(username, secret string) (*APIToken, error) {
+	hash := hashToken(secret)
+	now := time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.Hash != hash {
+			continue
+		}
+		if t.Expired(now) || (username != "" && username != t.Username()) {
+			return nil, ErrInvalidCredentials
+		}
+		t.LastUsedAt = now
+		if now.Sub(s.persisted[t.ID]) >= lastUsedInterval {
+			// the last used time is best effort, so the error is ignored.
+			if err := s.save(); err == nil {
+				s.persisted[t.ID] = now
+			}
+		}
+		found := *t
+		return &found, nil
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// Grant returns the subset of requested which the token allows.
+// For personal access tokens, authz must also allow the user.
+func (s *TokenStore) Grant(t *APIToken, authz Authorizer, requested []Access) []Access {
+	var allowed []Access
+	for _, a := range requested {
+		var actions []string
+		for _, action := range a.Actions {
+			if granted(t.Scopes, a.Type, a.Name, action) {
+				actions = append(actions, action)
+			}
+		}
+		if len(actions) > 0 {
+			allowed = append(allowed, Access{Type: a.Type, Name: a.Name, Actions: actions})
+		}
+	}
+	if t.Kind == KindPersonal && authz != nil {
+		allowed = authz.Authorize(t.User, allowed)
+	}
+	return allowed
+}
+
+// save writes tokens via a temporary file. The caller must hold the lock.
+func (s *TokenStore) save() error {
+	tokens := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.filename), 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(s.filename), "."+filepath.Base(s.filename))
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// APITokenController is a Controller which authenticates requests with API tokens.
+// Requests which do not have API tokens are passed to Next.
+//
+// The token is accepted as the password of the basic authentication, so that
+// "docker login" works, or as the bearer token.
+type APITokenController struct {
+	Store *TokenStore
+	// Authorizer authorizes owners of personal access tokens.
+	Authorizer Authorizer
+	Next       Controller
+}
+
+var _ Controller = (*APITokenController)(nil)
+
+// Authorized implements Controller.
+func (c *APITokenController) Authorized(r *http.Request, access ...Access) (context.Context, error) {
+	username, secret, ok := r.BasicAuth()
+	if !ok || !IsAPIToken(secret) {
+		authz := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authz, "Bearer "+APITokenPrefix) {
+			return c.Next.Authorized(r, access...)
+		}
+		username, secret = "", strings.TrimPrefix(authz, "Bearer ")
+	}
+	t, err := c.Store.Authenticate(username, secret)
+	if err != nil {
+		// ask to authenticate in the way of the next controller.
+		anonymous := r.Clone(r.Context())
+		anonymous.Header.Del("Authorization")
+		if _, err := c.Next.Authorized(anonymous, access...); err != nil {
+			return nil, err
+		}
+		return nil, regerrors.Wrap(err, regerrors.WithCodeUnauthorized())
+	}
+	allowed := c.Store.Grant(t, c.Authorizer, access)
+	for _, a := range access {
+		for _, action := range a.Actions {
+			if !granted(allowed, a.Type, a.Name, action) {
+				return nil, regerrors.Wrap(
+					fmt.Errorf("%s is not granted to the token %s", a.Scope(), t.ID),
+					regerrors.WithCodeDenied(),
+					regerrors.WithDetail(a),
+				)
+			}
+		}
+	}
+	return WithUser(r.Context(), t.Username()), nil
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	regerrors "github.com/Code-Hex/container-registry/internal/errors"
+)
+
+func TestTokenStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "_auth", "tokens.json")
+	s, err := NewTokenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes := []Access{{Type: TypeRepository, Name: "team-a/app", Actions: []string{ActionPull, ActionPush}}}
+	if _, _, err := s.Create(APIToken{Kind: KindRobot, Scopes: scopes}); err == nil {
+		t.Fatal("robot account without name is created")
+	}
+	secret, robot, err := s.Create(APIToken{Kind: KindRobot, Name: "ci", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsAPIToken(secret) || robot.Hash == "" || robot.Hash == secret {
+		t.Fatalf("unexpected token: %q, %+v", secret, robot)
+	}
+	if _, _, err := s.Create(APIToken{Kind: KindRobot, Name: "ci", Scopes: scopes}); err == nil {
+		t.Fatal("duplicated robot account is created")
+	}
+	expired, _, err := s.Create(APIToken{
+		Kind:      KindPersonal,
+		User:      "alice",
+		Scopes:    scopes,
+		ExpiresAt: time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Authenticate("robot$ci", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != robot.ID || got.LastUsedAt.IsZero() {
+		t.Errorf("unexpected token: %+v", got)
+	}
+	if _, err := s.Authenticate("alice", secret); err != ErrInvalidCredentials {
+		t.Errorf("token is used by other user: %v", err)
+	}
+	if _, err := s.Authenticate("alice", expired); err != ErrInvalidCredentials {
+		t.Errorf("expired token is used: %v", err)
+	}
+
+	// tokens are persisted with the last used time.
+	reloaded, err := NewTokenStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := reloaded.List()
+	if len(tokens) != 2 || tokens[0].ID != robot.ID || tokens[0].LastUsedAt.IsZero() {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+	if err := reloaded.Revoke(robot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.Revoke(robot.ID); err != ErrTokenNotFound {
+		t.Fatalf("want %v, but got %v", ErrTokenNotFound, err)
+	}
+	if _, err := reloaded.Authenticate("robot$ci", secret); err != ErrInvalidCredentials {
+		t.Fatalf("revoked token is used: %v", err)
+	}
+}
+
+func TestTokenStore_Grant(t *testing.T) {
+	s, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes := []Access{{Type: TypeRepository, Name: "team-a/app", Actions: []string{ActionPull, ActionPush}}}
+	requested := []Access{{Type: TypeRepository, Name: "team-a/app", Actions: []string{ActionPull, ActionPush, ActionDelete}}}
+	readOnly := &Roles{}
+
+	robot := &APIToken{Kind: KindRobot, Name: "ci", Scopes: scopes}
+	if got := s.Grant(robot, readOnly, requested); len(got) != 1 || len(got[0].Actions) != 2 {
+		t.Errorf("robot should be granted by scopes: %+v", got)
+	}
+	pat := &APIToken{Kind: KindPersonal, User: "alice", Scopes: scopes}
+	if got := s.Grant(pat, readOnly, requested); len(got) != 1 || len(got[0].Actions) != 1 || got[0].Actions[0] != ActionPull {
+		t.Errorf("personal access token should be limited by the user: %+v", got)
+	}
+}
+
+func TestAPITokenController(t *testing.T) {
+	s, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes := []Access{{Type: TypeRepository, Name: "team-a/app", Actions: []string{ActionPull}}}
+	secret, _, err := s.Create(APIToken{Kind: KindRobot, Name: "ci", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &APITokenController{
+		Store: s,
+		Next:  NewBasicController("registry", Users{}, AllowAuthenticated),
+	}
+	pull := func(name string) Access {
+		return Access{Type: TypeRepository, Name: name, Actions: []string{ActionPull}}
+	}
+
+	cases := []struct {
+		name     string
+		setAuth  func(r *http.Request)
+		access   Access
+		wantCode string
+	}{
+		{name: "basic", setAuth: func(r *http.Request) { r.SetBasicAuth("robot$ci", secret) }, access: pull("team-a/app")},
+		{name: "bearer", setAuth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+secret) }, access: pull("team-a/app")},
+		{name: "out of scopes", setAuth: func(r *http.Request) { r.SetBasicAuth("robot$ci", secret) }, access: pull("team-b/app"), wantCode: "DENIED"},
+		{name: "invalid token", setAuth: func(r *http.Request) { r.SetBasicAuth("robot$ci", APITokenPrefix+"x") }, access: pull("team-a/app"), wantCode: "UNAUTHORIZED"},
+		{name: "next controller", setAuth: func(r *http.Request) { r.SetBasicAuth("alice", "password") }, access: pull("team-a/app"), wantCode: "UNAUTHORIZED"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v2/team-a/app/manifests/latest", nil)
+			tc.setAuth(r)
+			ctx, err := c.Authorized(r, tc.access)
+			if tc.wantCode == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := UserFromContext(ctx); got != "robot$ci" {
+					t.Errorf("want robot$ci, but got %q", got)
+				}
+				return
+			}
+			var e *regerrors.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Fatalf("want %s, but got %v", tc.wantCode, err)
+			}
+		})
+	}
+}
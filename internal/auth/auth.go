@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Resource types of the access.
+const (
+	TypeRepository = "repository"
+	TypeRegistry   = "registry"
+)
+
+// Actions on the resource.
+const (
+	ActionPull   = "pull"
+	ActionPush   = "push"
+	ActionDelete = "delete"
+	ActionAll    = "*"
+)
+
+// Access represents actions on a resource, such as "repository:foo/bar:pull,push".
+//
+// see: https://docs.docker.com/registry/spec/auth/scope/
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// ParseScope parses the scope in the form of "<type>:<name>:<actions>".
+// The name may contain ":" such as "localhost:5000/foo".
+func ParseScope(scope string) (Access, error) {
+	i := strings.Index(scope, ":")
+	j := strings.LastIndex(scope, ":")
+	if i < 0 || i == j {
+		return Access{}, fmt.Errorf("invalid scope %q", scope)
+	}
+	return Access{
+		Type:    scope[:i],
+		Name:    scope[i+1 : j],
+		Actions: strings.Split(scope[j+1:], ","),
+	}, nil
+}
+
+// Scope returns the access in the form of "<type>:<name>:<actions>".
+func (a Access) Scope() string {
+	return a.Type + ":" + a.Name + ":" + strings.Join(a.Actions, ",")
+}
+
+// Allows reports whether a grants the action on the resource.
+func (a Access) Allows(typ, name, action string) bool {
+	if a.Type != typ || a.Name != name {
+		return false
+	}
+	for _, v := range a.Actions {
+		if v == action || v == ActionAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Controller authenticates the request and checks whether the request
+// has the access. It returns the context which has the authenticated user.
+//
+// If the request is not allowed, the returned error wraps a Challenge.
+type Controller interface {
+	Authorized(r *http.Request, access ...Access) (context.Context, error)
+}
+
+// Challenge is an error which asks the client to authenticate.
+type Challenge interface {
+	error
+	// SetHeaders sets WWW-Authenticate header.
+	SetHeaders(w http.ResponseWriter)
+}
+
+// ErrInvalidCredentials is returned if the username or password is wrong.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Authenticator authenticates users with the password.
+type Authenticator interface {
+	Authenticate(username, password string) error
+}
+
+// Authorizer decides actions which are granted to the user. user is empty
+// if the user is anonymous. It returns the subset of requested.
+type Authorizer interface {
+	Authorize(user string, requested []Access) []Access
+}
+
+// AuthorizerFunc is an adapter to use ordinary functions as Authorizer.
+type AuthorizerFunc func(user string, requested []Access) []Access
+
+// Authorize implements Authorizer.
+func (f AuthorizerFunc) Authorize(user string, requested []Access) []Access {
+	return f(user, requested)
+}
+
+// AllowAuthenticated grants every requested access to authenticated users
+// except the admin API, which must be granted by a Policy. Nothing is granted
+// to anonymous users.
+var AllowAuthenticated Authorizer = AuthorizerFunc(func(user string, requested []Access) []Access {
+	if user == "" {
+		return nil
+	}
+	return withoutAdmin(requested)
+})
+
+// withoutAdmin returns the access except the admin API.
+func withoutAdmin(requested []Access) []Access {
+	var granted []Access
+	for _, a := range requested {
+		if a.Type == TypeRegistry && a.Name == ResourceAdmin {
+			continue
+		}
+		granted = append(granted, a)
+	}
+	return granted
+}
+
+// Users is an Authenticator which has bcrypt hashed passwords keyed by username.
+type Users map[string]string
+
+// Authenticate implements Authenticator.
+func (u Users) Authenticate(username, password string) error {
+	hash, ok := u[username]
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
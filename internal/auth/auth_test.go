@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseScope(t *testing.T) {
+	cases := []struct {
+		scope   string
+		want    Access
+		wantErr bool
+	}{
+		{
+			scope: "repository:foo/bar:pull,push",
+			want:  Access{Type: "repository", Name: "foo/bar", Actions: []string{"pull", "push"}},
+		},
+		{
+			scope: "repository:localhost:5000/foo:pull",
+			want:  Access{Type: "repository", Name: "localhost:5000/foo", Actions: []string{"pull"}},
+		},
+		{
+			scope: "registry:catalog:*",
+			want:  Access{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		},
+		{scope: "repository", wantErr: true},
+		{scope: "repository:foo", wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := ParseScope(c.scope)
+		if (err != nil) != c.wantErr {
+			t.Fatalf("%q: unexpected error: %v", c.scope, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: want %+v, but got %+v", c.scope, c.want, got)
+		}
+		if got.Scope() != c.scope {
+			t.Errorf("want %q, but got %q", c.scope, got.Scope())
+		}
+	}
+}
+
+func TestAllowAuthenticated(t *testing.T) {
+	requested := []Access{
+		{Type: TypeRepository, Name: "foo", Actions: []string{ActionPull, ActionPush}},
+		{Type: TypeRegistry, Name: ResourceCatalog, Actions: []string{ActionAll}},
+		{Type: TypeRegistry, Name: ResourceAdmin, Actions: []string{ActionAll}},
+	}
+	if got := AllowAuthenticated.Authorize("", requested); len(got) != 0 {
+		t.Errorf("anonymous is granted: %+v", got)
+	}
+	if got := AllowAuthenticated.Authorize("alice", requested); !reflect.DeepEqual(requested[:2], got) {
+		t.Errorf("want %+v, but got %+v", requested[:2], got)
+	}
+}
+
+func TestToken(t *testing.T) {
+	ecKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	claims := &Claims{
+		Issuer:    "issuer",
+		Subject:   "alice",
+		Audience:  "registry",
+		ExpiresAt: now.Add(time.Minute).Unix(),
+		NotBefore: now.Unix(),
+		Access:    []Access{{Type: "repository", Name: "foo", Actions: []string{"pull"}}},
+	}
+	t.Run("ES256", func(t *testing.T) {
+		token, err := signToken(ecKey, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := verifyToken(token, ecKey.Public(), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, claims) {
+			t.Errorf("want %+v, but got %+v", claims, got)
+		}
+		if _, err := verifyToken(token, ecKey.Public(), now.Add(time.Hour)); err == nil {
+			t.Error("expired token is verified")
+		}
+		if _, err := verifyToken(token, rsaKey.Public(), now); err == nil {
+			t.Error("token is verified with the other key")
+		}
+		parts := strings.Split(token, ".")
+		forged, _ := signToken(ecKey, &Claims{Subject: "mallory"})
+		if _, err := verifyToken(parts[0]+"."+strings.Split(forged, ".")[1]+"."+parts[2], ecKey.Public(), now); err == nil {
+			t.Error("tampered token is verified")
+		}
+	})
+	t.Run("RS256", func(t *testing.T) {
+		token, err := signToken(rsaKey, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyToken(token, rsaKey.Public(), now); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTokenController(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := NewIssuer("issuer", "registry", key, Users{"alice": string(hash)}, AllowAuthenticated)
+	c := NewTokenController("", "registry", "issuer", issuer.PublicKey())
+
+	if _, err := issuer.Issue("alice", "wrong", nil); err != ErrInvalidCredentials {
+		t.Fatalf("want %v, but got %v", ErrInvalidCredentials, err)
+	}
+	pull := Access{Type: TypeRepository, Name: "foo", Actions: []string{ActionPull}}
+	push := Access{Type: TypeRepository, Name: "foo", Actions: []string{ActionPush}}
+	token, err := issuer.Issue("alice", "password", []Access{pull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous, err := issuer.Issue("", "", []Access{pull})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		token     string
+		access    Access
+		wantError string
+	}{
+		{name: "no token", access: pull, wantError: `Bearer realm="http://example.com/token",service="registry",scope="repository:foo:pull"`},
+		{name: "invalid token", token: "invalid", access: pull, wantError: `error="invalid_token"`},
+		{name: "anonymous", token: anonymous.Token, access: pull, wantError: `error="insufficient_scope"`},
+		{name: "insufficient", token: token.Token, access: push, wantError: `error="insufficient_scope"`},
+		{name: "granted", token: token.Token, access: pull},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/v2/foo/manifests/latest", nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			ctx, err := c.Authorized(r, tc.access)
+			if tc.wantError == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := UserFromContext(ctx); got != "alice" {
+					t.Errorf("want alice, but got %q", got)
+				}
+				return
+			}
+			ch, ok := err.(interface{ Unwrap() error }).Unwrap().(Challenge)
+			if !ok {
+				t.Fatalf("want challenge, but got %v", err)
+			}
+			w := httptest.NewRecorder()
+			ch.SetHeaders(w)
+			if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, tc.wantError) {
+				t.Errorf("want %q in %q", tc.wantError, got)
+			}
+		})
+	}
+}
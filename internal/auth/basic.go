@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+)
+
+// Role is the set of actions which users can do.
+type Role string
+
+const (
+	// RoleReadOnly can only pull images.
+	RoleReadOnly Role = "read-only"
+	// RoleReadWrite can do everything except the admin API.
+	RoleReadWrite Role = "read-write"
+	// RoleAdmin can do everything.
+	RoleAdmin Role = "admin"
+)
+
+// Roles is an Authorizer which grants actions by the role of users.
+type Roles struct {
+	// Users are roles keyed by username.
+	Users map[string]Role `json:"users,omitempty"`
+	// Default is the role of users which are not in Users.
+	// If empty, RoleReadOnly is used.
+	Default Role `json:"default,omitempty"`
+}
+
+var _ Authorizer = (*Roles)(nil)
+
+// Authorize implements Authorizer.
+func (r *Roles) Authorize(user string, requested []Access) []Access {
+	if user == "" {
+		return nil
+	}
+	role, ok := r.Users[user]
+	if !ok {
+		role = r.Default
+	}
+	switch role {
+	case RoleAdmin:
+		return requested
+	case RoleReadWrite:
+		return withoutAdmin(requested)
+	}
+	var granted []Access
+	for _, a := range requested {
+		if a.Type == TypeRepository && a.Allows(a.Type, a.Name, ActionPull) {
+			granted = append(granted, Access{Type: a.Type, Name: a.Name, Actions: []string{ActionPull}})
+		}
+	}
+	return granted
+}
+
+func (r *Roles) validate() error {
+	for user, role := range r.Users {
+		if !role.valid() {
+			return fmt.Errorf("unknown role %q of %q", role, user)
+		}
+	}
+	if r.Default != "" && !r.Default.valid() {
+		return fmt.Errorf("unknown default role %q", r.Default)
+	}
+	return nil
+}
+
+func (r Role) valid() bool {
+	return r == RoleReadOnly || r == RoleReadWrite || r == RoleAdmin
+}
+
+// BasicConfig is the configuration of the basic authentication.
+type BasicConfig struct {
+	// Realm is shown to users by clients.
+	Realm string `json:"realm"`
+	// Htpasswd is the htpasswd file of users.
+	Htpasswd string `json:"htpasswd"`
+	// Roles maps users to roles.
+	Roles Roles `json:"roles"`
+}
+
+// LoadBasicConfig loads the configuration from json file.
+func LoadBasicConfig(filename string) (*BasicConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c BasicConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate validates the configuration.
+func (c *BasicConfig) Validate() error {
+	if c.Htpasswd == "" {
+		return fmt.Errorf("htpasswd must be specified")
+	}
+	return c.Roles.validate()
+}
+
+// BasicController is a Controller which authenticates users with the basic authentication.
+type BasicController struct {
+	Realm         string
+	Authenticator Authenticator
+	Authorizer    Authorizer
+}
+
+var _ Controller = (*BasicController)(nil)
+
+// NewBasicController creates BasicController.
+func NewBasicController(realm string, authn Authenticator, authz Authorizer) *BasicController {
+	return &BasicController{
+		Realm:         realm,
+		Authenticator: authn,
+		Authorizer:    authz,
+	}
+}
+
+// Authorized implements Controller. It returns UNAUTHORIZED if the user is not
+// authenticated, and DENIED if the user does not have the access.
+func (c *BasicController) Authorized(r *http.Request, access ...Access) (context.Context, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errors.Wrap(
+			&basicChallenge{realm: c.Realm, err: "authentication required"},
+			errors.WithCodeUnauthorized(),
+		)
+	}
+	if err := c.Authenticator.Authenticate(username, password); err != nil {
+		return nil, errors.Wrap(
+			&basicChallenge{realm: c.Realm, err: err.Error()},
+			errors.WithCodeUnauthorized(),
+		)
+	}
+	allowed := c.Authorizer.Authorize(username, access)
+	for _, a := range access {
+		for _, action := range a.Actions {
+			if !granted(allowed, a.Type, a.Name, action) {
+				return nil, errors.Wrap(
+					fmt.Errorf("%s is not granted to %q", a.Scope(), username),
+					errors.WithCodeDenied(),
+					errors.WithDetail(a),
+				)
+			}
+		}
+	}
+	return WithUser(r.Context(), username), nil
+}
+
+// basicChallenge asks the client to authenticate with the basic authentication.
+type basicChallenge struct {
+	realm string
+	err   string
+}
+
+var _ Challenge = (*basicChallenge)(nil)
+
+func (c *basicChallenge) Error() string {
+	return c.err
+}
+
+// SetHeaders implements Challenge.
+func (c *basicChallenge) SetHeaders(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", c.realm))
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	regerrors "github.com/Code-Hex/container-registry/internal/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, filename string, users map[string]string) {
+	t.Helper()
+	var b []byte
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, user+":"+string(hash)+"\n"...)
+	}
+	if err := ioutil.WriteFile(filename, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, filename, map[string]string{"alice": "password"})
+	h, err := NewHtpasswd(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Authenticate("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Authenticate("alice", "wrong"); err != ErrInvalidCredentials {
+		t.Fatalf("want %v, but got %v", ErrInvalidCredentials, err)
+	}
+	if err := h.Authenticate("bob", "password"); err != ErrInvalidCredentials {
+		t.Fatalf("want %v, but got %v", ErrInvalidCredentials, err)
+	}
+
+	// reloaded on change
+	writeHtpasswd(t, filename, map[string]string{"bob": "password"})
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filename, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Authenticate("bob", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Authenticate("alice", "password"); err != ErrInvalidCredentials {
+		t.Fatalf("removed user is authenticated: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHtpasswd(filename); err == nil {
+		t.Fatal("want error for non-bcrypt hash")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	roles := &Roles{Users: map[string]Role{"alice": RoleReadWrite, "carol": RoleAdmin}}
+	requested := []Access{{Type: TypeRepository, Name: "foo", Actions: []string{ActionPull, ActionPush}}}
+	admin := []Access{{Type: TypeRegistry, Name: ResourceAdmin, Actions: []string{ActionAll}}}
+
+	if got := roles.Authorize("", requested); len(got) != 0 {
+		t.Errorf("anonymous is granted: %+v", got)
+	}
+	if got := roles.Authorize("alice", requested); len(got) != 1 || len(got[0].Actions) != 2 {
+		t.Errorf("read-write user is not granted: %+v", got)
+	}
+	got := roles.Authorize("bob", requested)
+	if len(got) != 1 || len(got[0].Actions) != 1 || got[0].Actions[0] != ActionPull {
+		t.Errorf("read-only user should only pull: %+v", got)
+	}
+	if got := roles.Authorize("alice", admin); len(got) != 0 {
+		t.Errorf("read-write user is granted the admin API: %+v", got)
+	}
+	if got := roles.Authorize("carol", append(admin, requested...)); len(got) != 2 {
+		t.Errorf("admin is not granted: %+v", got)
+	}
+}
+
+func TestBasicController(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, filename, map[string]string{"alice": "password", "bob": "password"})
+	h, err := NewHtpasswd(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewBasicController("registry", h, &Roles{Users: map[string]Role{"alice": RoleReadWrite}})
+	push := Access{Type: TypeRepository, Name: "foo", Actions: []string{ActionPush}}
+
+	cases := []struct {
+		name     string
+		username string
+		password string
+		wantCode string
+	}{
+		{name: "no credentials", wantCode: "UNAUTHORIZED"},
+		{name: "wrong password", username: "alice", password: "wrong", wantCode: "UNAUTHORIZED"},
+		{name: "read-only", username: "bob", password: "password", wantCode: "DENIED"},
+		{name: "read-write", username: "alice", password: "password"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/v2/foo/manifests/latest", nil)
+			if tc.username != "" {
+				r.SetBasicAuth(tc.username, tc.password)
+			}
+			ctx, err := c.Authorized(r, push)
+			if tc.wantCode == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := UserFromContext(ctx); got != tc.username {
+					t.Errorf("want %q, but got %q", tc.username, got)
+				}
+				return
+			}
+			var e *regerrors.Error
+			if !errors.As(err, &e) || e.Code != tc.wantCode {
+				t.Fatalf("want %s, but got %v", tc.wantCode, err)
+			}
+			var ch Challenge
+			if got := errors.As(err, &ch); got != (tc.wantCode == "UNAUTHORIZED") {
+				t.Errorf("unexpected challenge: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	regerrors "github.com/Code-Hex/container-registry/internal/errors"
+)
+
+// ClientCertController is a Controller which authenticates requests with
+// verified client certificates of mutual TLS. Requests which do not have
+// certificates are passed to Next. If Next is nil, they are unauthorized.
+type ClientCertController struct {
+	// Identities maps subjects of certificates such as "CN=ci,O=example" to
+	// usernames. If the subject is not in Identities, the common name is used.
+	Identities map[string]string
+	Authorizer Authorizer
+	Next       Controller
+}
+
+var _ Controller = (*ClientCertController)(nil)
+
+// LoadIdentities loads the mapping of subjects to usernames from json file.
+func LoadIdentities(filename string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var identities map[string]string
+	if err := json.Unmarshal(b, &identities); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	return identities, nil
+}
+
+// Authorized implements Controller.
+func (c *ClientCertController) Authorized(r *http.Request, access ...Access) (context.Context, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		if c.Next != nil {
+			return c.Next.Authorized(r, access...)
+		}
+		return nil, regerrors.Wrap(
+			errors.New("client certificate is required"),
+			regerrors.WithCodeUnauthorized(),
+		)
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	user, ok := c.Identities[cert.Subject.String()]
+	if !ok {
+		user = cert.Subject.CommonName
+	}
+	if user == "" {
+		return nil, regerrors.Wrap(
+			fmt.Errorf("no identity for %q", cert.Subject),
+			regerrors.WithCodeUnauthorized(),
+		)
+	}
+	allowed := c.Authorizer.Authorize(user, access)
+	for _, a := range access {
+		for _, action := range a.Actions {
+			if !granted(allowed, a.Type, a.Name, action) {
+				return nil, regerrors.Wrap(
+					fmt.Errorf("%s is not granted to %q", a.Scope(), user),
+					regerrors.WithCodeDenied(),
+					regerrors.WithDetail(a),
+				)
+			}
+		}
+	}
+	return WithUser(r.Context(), user), nil
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	regerrors "github.com/Code-Hex/container-registry/internal/errors"
+)
+
+func TestClientCertController(t *testing.T) {
+	c := &ClientCertController{
+		Identities: map[string]string{"CN=deploy,O=example": "robot$deploy"},
+		Authorizer: &Policy{Rules: []Rule{
+			{Users: []string{"ci"}, Repositories: []string{"*"}, Actions: []string{ActionPull}},
+			{Users: []string{"robot$deploy"}, Repositories: []string{"*"}, Actions: []string{"*"}},
+		}},
+	}
+	withCert := func(subject pkix.Name) *http.Request {
+		r := httptest.NewRequest(http.MethodPut, "/v2/app/manifests/latest", nil)
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}},
+		}
+		return r
+	}
+	push := Access{Type: TypeRepository, Name: "app", Actions: []string{ActionPush}}
+
+	ctx, err := c.Authorized(withCert(pkix.Name{CommonName: "deploy", Organization: []string{"example"}}), push)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := UserFromContext(ctx); got != "robot$deploy" {
+		t.Errorf("want robot$deploy, but got %q", got)
+	}
+
+	var e *regerrors.Error
+	if _, err := c.Authorized(withCert(pkix.Name{CommonName: "ci"}), push); !errors.As(err, &e) || e.Code != "DENIED" {
+		t.Errorf("want DENIED, but got %v", err)
+	}
+	if _, err := c.Authorized(httptest.NewRequest(http.MethodGet, "/v2/", nil)); !errors.As(err, &e) || e.Code != "UNAUTHORIZED" {
+		t.Errorf("want UNAUTHORIZED, but got %v", err)
+	}
+}
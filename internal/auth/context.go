@@ -0,0 +1,18 @@
+// Package auth authenticates and authorizes users of the registry.
+package auth
+
+import "context"
+
+type userKey struct{}
+
+// WithUser returns a copy of ctx which has the authenticated user name.
+func WithUser(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userKey{}, name)
+}
+
+// UserFromContext returns the authenticated user name. It returns empty
+// string if the request is not authenticated.
+func UserFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(userKey{}).(string)
+	return name
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd is an Authenticator which uses the htpasswd file. Only bcrypt
+// hashed passwords are supported, which are generated by "htpasswd -B".
+//
+// The file is reloaded when it is changed.
+type Htpasswd struct {
+	filename string
+
+	mu      sync.Mutex
+	users   map[string][]byte
+	modTime time.Time
+	size    int64
+	// verified caches sha256 of passwords which are verified, because bcrypt
+	// is too slow to run on every request of the basic authentication.
+	verified map[string][sha256.Size]byte
+}
+
+var _ Authenticator = (*Htpasswd)(nil)
+
+// NewHtpasswd loads the htpasswd file.
+func NewHtpasswd(filename string) (*Htpasswd, error) {
+	h := &Htpasswd{filename: filename}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.load(fi); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Authenticate implements Authenticator.
+func (h *Htpasswd) Authenticate(username, password string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.reloadIfChanged(); err != nil {
+		// keep serving with the users which are loaded previously.
+		log.Printf("auth: failed to reload %q: %v", h.filename, err)
+	}
+	hash, ok := h.users[username]
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	sum := sha256.Sum256([]byte(password))
+	if v, ok := h.verified[username]; ok && subtle.ConstantTimeCompare(v[:], sum[:]) == 1 {
+		return nil
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	h.verified[username] = sum
+	return nil
+}
+
+func (h *Htpasswd) reloadIfChanged() error {
+	fi, err := os.Stat(h.filename)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(h.modTime) && fi.Size() == h.size {
+		return nil
+	}
+	return h.load(fi)
+}
+
+func (h *Htpasswd) load(fi os.FileInfo) error {
+	b, err := ioutil.ReadFile(h.filename)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse %q: %w", h.filename, err)
+	}
+	h.users = users
+	h.verified = make(map[string][sha256.Size]byte)
+	h.modTime = fi.ModTime()
+	h.size = fi.Size()
+	return nil
+}
+
+func parseHtpasswd(b []byte) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: malformed entry", n)
+		}
+		username, hash := line[:i], line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: only bcrypt is supported: %w", n, err)
+		}
+		users[username] = []byte(hash)
+	}
+	return users, sc.Err()
+}
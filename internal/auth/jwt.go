@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Claims is the payload of the token.
+//
+// see: https://docs.docker.com/registry/spec/auth/jwt/
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	ID        string   `json:"jti"`
+	Access    []Access `json:"access"`
+}
+
+type jwtHeader struct {
+	Type      string `json:"typ"`
+	Algorithm string `json:"alg"`
+}
+
+// leeway is the allowed clock skew between the issuer and the registry.
+const leeway = time.Minute
+
+// GenerateKey generates an ECDSA P-256 key to sign tokens.
+func GenerateKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// LoadPrivateKey loads ECDSA P-256 or RSA private key from the PEM file.
+func LoadPrivateKey(filename string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%q has no PEM data", filename)
+	}
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	if _, err := algorithm(key); err != nil {
+		return nil, err
+	}
+	return key.(crypto.Signer), nil
+}
+
+// algorithm returns the JWS algorithm of the key.
+func algorithm(key interface{}) (string, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return algorithm(&k.PublicKey)
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 curve is supported")
+		}
+		return "ES256", nil
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return "RS256", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// signToken returns the JWT which is signed with the key.
+func signToken(key crypto.Signer, claims *Claims) (string, error) {
+	alg, err := algorithm(key)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(&jwtHeader{Type: "JWT", Algorithm: alg})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed length concatenation of r and s instead of ASN.1.
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	default:
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + encodeSegment(sig), nil
+}
+
+// verifyToken verifies the signature and the lifetime of the token.
+func verifyToken(token string, key crypto.PublicKey, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	b, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(b, &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	// never trust the algorithm in the header, it must be the one of our key.
+	alg, err := algorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	if header.Algorithm != alg {
+		return nil, fmt.Errorf("unexpected algorithm %q", header.Algorithm)
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return nil, errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	}
+
+	b, err = decodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(leeway)) {
+		return nil, errors.New("token is expired")
+	}
+	if now.Add(leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+	return &claims, nil
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+// Actions of the rule which are not the actions on repositories.
+const (
+	// ActionCatalog allows to list repositories on /v2/_catalog.
+	ActionCatalog = "catalog"
+	// ActionAdmin allows to use the admin API.
+	ActionAdmin = "admin"
+)
+
+// Names of resources whose type is TypeRegistry.
+const (
+	ResourceCatalog = "catalog"
+	ResourceAdmin   = "admin"
+)
+
+// Rule allows users to do actions on repositories.
+type Rule struct {
+	// Users are names of users. "*" matches every authenticated user.
+	Users []string `json:"users,omitempty"`
+	// Groups are names of groups which are defined in the policy.
+	Groups []string `json:"groups,omitempty"`
+	// Repositories are glob patterns of repository names such as "team-a/*".
+	// The syntax is the one of path.Match, so "*" does not match "/".
+	Repositories []string `json:"repositories,omitempty"`
+	// Actions are allowed actions, which are "pull", "push", "delete",
+	// "catalog", "admin" or "*".
+	Actions []string `json:"actions"`
+}
+
+// Policy is an Authorizer which allows only the access which is allowed by
+// any of rules. Everything else is denied.
+type Policy struct {
+	// Groups are members keyed by group name.
+	Groups map[string][]string `json:"groups,omitempty"`
+	Rules  []Rule              `json:"rules"`
+}
+
+var _ Authorizer = (*Policy)(nil)
+
+// LoadPolicy loads the policy from json file.
+func LoadPolicy(filename string) (*Policy, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %q: %w", filename, err)
+	}
+	return &p, nil
+}
+
+// Validate validates rules of the policy.
+func (p *Policy) Validate() error {
+	for i, r := range p.Rules {
+		for _, g := range r.Groups {
+			if _, ok := p.Groups[g]; !ok {
+				return fmt.Errorf("rules[%d]: unknown group %q", i, g)
+			}
+		}
+		for _, pattern := range r.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rules[%d]: invalid pattern %q: %w", i, pattern, err)
+			}
+		}
+		for _, action := range r.Actions {
+			switch action {
+			case ActionPull, ActionPush, ActionDelete, ActionCatalog, ActionAdmin, ActionAll:
+			default:
+				return fmt.Errorf("rules[%d]: unknown action %q", i, action)
+			}
+		}
+	}
+	return nil
+}
+
+// Authorize implements Authorizer.
+func (p *Policy) Authorize(user string, requested []Access) []Access {
+	if user == "" {
+		return nil
+	}
+	var granted []Access
+	for _, a := range requested {
+		var actions []string
+		for _, action := range a.Actions {
+			if p.Allowed(user, a.Type, a.Name, action) {
+				actions = append(actions, action)
+			}
+		}
+		if len(actions) > 0 {
+			granted = append(granted, Access{Type: a.Type, Name: a.Name, Actions: actions})
+		}
+	}
+	return granted
+}
+
+// Allowed reports whether the user is allowed to do the action on the resource.
+func (p *Policy) Allowed(user, typ, name, action string) bool {
+	action, ok := ruleAction(typ, name, action)
+	if !ok {
+		return false
+	}
+	for _, r := range p.Rules {
+		if !p.matchUser(r, user) || !hasAction(r.Actions, action) {
+			continue
+		}
+		if typ != TypeRepository || matchRepository(r.Repositories, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleAction converts the action on the resource to the action of rules.
+func ruleAction(typ, name, action string) (string, bool) {
+	switch typ {
+	case TypeRepository:
+		return action, action != ActionAll
+	case TypeRegistry:
+		switch name {
+		case ResourceCatalog:
+			return ActionCatalog, true
+		case ResourceAdmin:
+			return ActionAdmin, true
+		}
+	}
+	return "", false
+}
+
+func (p *Policy) matchUser(r Rule, user string) bool {
+	for _, u := range r.Users {
+		if u == "*" || u == user {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, member := range p.Groups[g] {
+			if member == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasAction(actions []string, action string) bool {
+	for _, a := range actions {
+		if a == action || a == ActionAll {
+			return true
+		}
+	}
+	return false
+}
+
+func matchRepository(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Intersect returns an Authorizer which grants the access only if it is
+// granted by every authorizer.
+func Intersect(authorizers ...Authorizer) Authorizer {
+	return AuthorizerFunc(func(user string, requested []Access) []Access {
+		granted := requested
+		for _, authz := range authorizers {
+			granted = authz.Authorize(user, granted)
+		}
+		return granted
+	})
+}
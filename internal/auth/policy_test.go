@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	regerrors "github.com/Code-Hex/container-registry/internal/errors"
+)
+
+func testPolicy() *Policy {
+	return &Policy{
+		Groups: map[string][]string{
+			"team-a": {"alice"},
+		},
+		Rules: []Rule{
+			{Groups: []string{"team-a"}, Repositories: []string{"team-a/*"}, Actions: []string{ActionPull, ActionPush, ActionDelete}},
+			{Users: []string{"*"}, Repositories: []string{"base/*"}, Actions: []string{ActionPull}},
+			{Users: []string{"admin"}, Actions: []string{ActionCatalog, ActionAdmin}},
+		},
+	}
+}
+
+func TestPolicy_Allowed(t *testing.T) {
+	p := testPolicy()
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user   string
+		typ    string
+		name   string
+		action string
+		want   bool
+	}{
+		{"alice", TypeRepository, "team-a/app", ActionPush, true},
+		{"alice", TypeRepository, "team-a/app", ActionDelete, true},
+		{"alice", TypeRepository, "team-a/app/nested", ActionPull, false},
+		{"alice", TypeRepository, "team-b/app", ActionPull, false},
+		{"alice", TypeRepository, "base/ubuntu", ActionPull, true},
+		{"bob", TypeRepository, "base/ubuntu", ActionPull, true},
+		{"bob", TypeRepository, "base/ubuntu", ActionPush, false},
+		{"bob", TypeRegistry, ResourceCatalog, ActionAll, false},
+		{"admin", TypeRegistry, ResourceCatalog, ActionAll, true},
+		{"admin", TypeRegistry, ResourceAdmin, ActionAll, true},
+		{"admin", TypeRepository, "base/ubuntu", ActionPull, true},
+	}
+	for _, c := range cases {
+		if got := p.Allowed(c.user, c.typ, c.name, c.action); got != c.want {
+			t.Errorf("%s %s:%s:%s: want %v, but got %v", c.user, c.typ, c.name, c.action, c.want, got)
+		}
+	}
+	if got := p.Authorize("", []Access{{Type: TypeRepository, Name: "base/ubuntu", Actions: []string{ActionPull}}}); len(got) != 0 {
+		t.Errorf("anonymous is granted: %+v", got)
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	cases := []Rule{
+		{Groups: []string{"unknown"}, Actions: []string{ActionPull}},
+		{Users: []string{"*"}, Repositories: []string{"["}, Actions: []string{ActionPull}},
+		{Users: []string{"*"}, Actions: []string{"write"}},
+	}
+	for _, r := range cases {
+		p := &Policy{Rules: []Rule{r}}
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v: want error", r)
+		}
+	}
+}
+
+func TestTokenController_Denied(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := testPolicy()
+	issuer := NewIssuer("issuer", "registry", key, Users{}, policy)
+	c := NewTokenController("", "registry", "issuer", issuer.PublicKey())
+	c.Authorizer = policy
+
+	push := func(name string) Access {
+		return Access{Type: TypeRepository, Name: name, Actions: []string{ActionPush}}
+	}
+	token, err := signToken(key, &Claims{
+		Issuer:    "issuer",
+		Audience:  "registry",
+		Subject:   "alice",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPut, "/v2/team-b/app/manifests/latest", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	var e *regerrors.Error
+	if _, err := c.Authorized(r, push("team-b/app")); !errors.As(err, &e) || e.Code != "DENIED" {
+		t.Fatalf("want DENIED, but got %v", err)
+	}
+	// alice can get a new token which has the scope.
+	if _, err := c.Authorized(r, push("team-a/app")); !errors.As(err, &e) || e.Code != "UNAUTHORIZED" {
+		t.Fatalf("want UNAUTHORIZED, but got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/google/uuid"
+)
+
+// DefaultExpiration is the default lifetime of tokens.
+const DefaultExpiration = 5 * time.Minute
+
+// TokenConfig is the configuration of the token authentication.
+type TokenConfig struct {
+	// Realm is the URL of the token endpoint. If empty, "/token" of this
+	// registry is used.
+	Realm string `json:"realm,omitempty"`
+	// Service is the name of this registry, which is the audience of tokens.
+	Service string `json:"service"`
+	// Issuer is the name of the token issuer.
+	Issuer string `json:"issuer"`
+	// PrivateKey is the PEM file of the key to sign tokens. If empty,
+	// the key is generated on every start.
+	PrivateKey string `json:"privateKey,omitempty"`
+	// Expiration is the lifetime of tokens such as "5m".
+	Expiration string `json:"expiration,omitempty"`
+	// Users are bcrypt hashed passwords keyed by username.
+	Users Users `json:"users,omitempty"`
+}
+
+// LoadTokenConfig loads the configuration from json file.
+func LoadTokenConfig(filename string) (*TokenConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c TokenConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate validates the configuration.
+func (c *TokenConfig) Validate() error {
+	if c.Service == "" || c.Issuer == "" {
+		return fmt.Errorf("service and issuer must be specified")
+	}
+	if c.Expiration != "" {
+		if _, err := time.ParseDuration(c.Expiration); err != nil {
+			return fmt.Errorf("invalid expiration: %w", err)
+		}
+	}
+	return nil
+}
+
+// Token is the response of the token endpoint.
+//
+// see: https://docs.docker.com/registry/spec/auth/token/#token-response-fields
+type Token struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// Issuer issues tokens which are signed by the key.
+type Issuer struct {
+	Issuer     string
+	Service    string
+	Expiration time.Duration
+
+	Authenticator Authenticator
+	Authorizer    Authorizer
+	// APITokens authenticates users whose password is an API token if it is not nil.
+	APITokens *TokenStore
+
+	key crypto.Signer
+}
+
+// NewIssuer creates Issuer. key is used to sign tokens.
+func NewIssuer(issuer, service string, key crypto.Signer, authn Authenticator, authz Authorizer) *Issuer {
+	return &Issuer{
+		Issuer:        issuer,
+		Service:       service,
+		Expiration:    DefaultExpiration,
+		Authenticator: authn,
+		Authorizer:    authz,
+		key:           key,
+	}
+}
+
+// PublicKey returns the key to verify tokens.
+func (i *Issuer) PublicKey() crypto.PublicKey {
+	return i.key.Public()
+}
+
+// Issue authenticates the user and issues a token which has the granted
+// subset of requested. If username is empty, the token is issued for anonymous.
+func (i *Issuer) Issue(username, password string, requested []Access) (*Token, error) {
+	var access []Access
+	switch {
+	case i.APITokens != nil && IsAPIToken(password):
+		t, err := i.APITokens.Authenticate(username, password)
+		if err != nil {
+			return nil, err
+		}
+		username = t.Username()
+		access = i.APITokens.Grant(t, i.Authorizer, requested)
+	case username != "":
+		if err := i.Authenticator.Authenticate(username, password); err != nil {
+			return nil, err
+		}
+		fallthrough
+	default:
+		access = i.Authorizer.Authorize(username, requested)
+	}
+	now := time.Now()
+	claims := &Claims{
+		Issuer:    i.Issuer,
+		Subject:   username,
+		Audience:  i.Service,
+		ExpiresAt: now.Add(i.Expiration).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        uuid.New().String(),
+		Access:    access,
+	}
+	if claims.Access == nil {
+		claims.Access = []Access{}
+	}
+	token, err := signToken(i.key, claims)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(i.Expiration / time.Second),
+		IssuedAt:    now.UTC(),
+	}, nil
+}
+
+// TokenController is a Controller which verifies bearer tokens.
+type TokenController struct {
+	// Realm is the URL of the token endpoint. If empty, "/token" of the
+	// requested host is used.
+	Realm   string
+	Service string
+	Issuer  string
+	// Authorizer is used to tell whether the access which is not in the token
+	// is denied or the client should get a new token. If nil, the client is
+	// always asked to get a new token.
+	Authorizer Authorizer
+
+	key crypto.PublicKey
+	now func() time.Time
+}
+
+var _ Controller = (*TokenController)(nil)
+
+// NewTokenController creates TokenController which verifies tokens with key.
+func NewTokenController(realm, service, issuer string, key crypto.PublicKey) *TokenController {
+	return &TokenController{
+		Realm:   realm,
+		Service: service,
+		Issuer:  issuer,
+		key:     key,
+		now:     time.Now,
+	}
+}
+
+// Authorized implements Controller.
+func (c *TokenController) Authorized(r *http.Request, access ...Access) (context.Context, error) {
+	ch := &tokenChallenge{
+		realm:   c.realm(r),
+		service: c.Service,
+		access:  access,
+	}
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		ch.err = "authentication required"
+		return nil, ch.wrap()
+	}
+	claims, err := verifyToken(strings.TrimPrefix(authz, "Bearer "), c.key, c.now())
+	if err != nil {
+		ch.code, ch.err = "invalid_token", err.Error()
+		return nil, ch.wrap()
+	}
+	if claims.Issuer != c.Issuer || claims.Audience != c.Service {
+		ch.code, ch.err = "invalid_token", "token is issued for other service"
+		return nil, ch.wrap()
+	}
+	for _, a := range access {
+		for _, action := range a.Actions {
+			if granted(claims.Access, a.Type, a.Name, action) {
+				continue
+			}
+			if c.denied(claims.Subject, a.Type, a.Name, action) {
+				return nil, errors.Wrap(
+					fmt.Errorf("%s is not granted to %q", a.Scope(), claims.Subject),
+					errors.WithCodeDenied(),
+					errors.WithDetail(a),
+				)
+			}
+			ch.code, ch.err = "insufficient_scope", fmt.Sprintf("%s is not granted", a.Scope())
+			return nil, ch.wrap()
+		}
+	}
+	return WithUser(r.Context(), claims.Subject), nil
+}
+
+// denied reports whether the authenticated user would never be granted the action.
+func (c *TokenController) denied(user, typ, name, action string) bool {
+	// robot accounts are authorized by the scopes of API tokens, not by the Authorizer.
+	if c.Authorizer == nil || user == "" || strings.HasPrefix(user, RobotPrefix) {
+		return false
+	}
+	requested := []Access{{Type: typ, Name: name, Actions: []string{action}}}
+	return !granted(c.Authorizer.Authorize(user, requested), typ, name, action)
+}
+
+func (c *TokenController) realm(r *http.Request) string {
+	if c.Realm != "" {
+		return c.Realm
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + "/token"
+}
+
+func granted(access []Access, typ, name, action string) bool {
+	for _, a := range access {
+		if a.Allows(typ, name, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenChallenge asks the client to get a token from the realm.
+//
+// see: https://docs.docker.com/registry/spec/auth/token/#how-to-authenticate
+type tokenChallenge struct {
+	realm   string
+	service string
+	access  []Access
+	code    string // error code of RFC 6750
+	err     string
+}
+
+var _ Challenge = (*tokenChallenge)(nil)
+
+func (c *tokenChallenge) Error() string {
+	return c.err
+}
+
+// SetHeaders implements Challenge.
+func (c *tokenChallenge) SetHeaders(w http.ResponseWriter) {
+	v := fmt.Sprintf("Bearer realm=%q,service=%q", c.realm, c.service)
+	if len(c.access) > 0 {
+		scopes := make([]string, len(c.access))
+		for i, a := range c.access {
+			scopes[i] = a.Scope()
+		}
+		v += fmt.Sprintf(",scope=%q", strings.Join(scopes, " "))
+	}
+	if c.code != "" {
+		v += fmt.Sprintf(",error=%q", c.code)
+	}
+	w.Header().Set("WWW-Authenticate", v)
+}
+
+func (c *tokenChallenge) wrap() error {
+	opts := []errors.WrapOption{errors.WithCodeUnauthorized()}
+	if len(c.access) > 0 {
+		opts = append(opts, errors.WithDetail(c.access))
+	}
+	return errors.Wrap(c, opts...)
+}
@@ -0,0 +1,272 @@
+// Package client implements a client for registries which implement the distribution spec.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/tracing"
+)
+
+// Client is a client for a registry.
+//
+// Client handles the Docker token authentication. When the registry responds
+// 401 with "WWW-Authenticate: Bearer ...", Client obtains a token from the realm
+// and retries the request with it.
+type Client struct {
+	// URL is the base URL of the registry. e.g. https://registry-1.docker.io
+	URL string
+	// Username and Password are used for the token endpoint or Basic authentication.
+	Username string
+	Password string
+	// HTTPClient is used to send requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]*token // keyed by scope
+}
+
+type token struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// repositoryName converts the name to the one on the registry.
+//
+// Docker Hub stores official images under "library/" namespace.
+func (c *Client) repositoryName(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return name
+	}
+	switch u.Hostname() {
+	case "registry-1.docker.io", "index.docker.io", "docker.io":
+		return "library/" + name
+	}
+	return name
+}
+
+// NewRequest creates a request for /v2/<name>/<path> on the registry.
+func (c *Client) NewRequest(ctx context.Context, method, name, path string, body io.Reader) (*http.Request, error) {
+	return c.NewRequestURL(ctx, method, "/v2/"+c.repositoryName(name)+"/"+path, body)
+}
+
+// NewRequestURL creates a request for the URL which may be relative to the registry,
+// such as the Location header of an upload session.
+func (c *Client) NewRequestURL(ctx context.Context, method, rawurl string, body io.Reader) (*http.Request, error) {
+	base, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, base.ResolveReference(ref).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// Do sends the request for the repository. If the registry responds 401,
+// Do authenticates with "repository:<name>:<actions>" scope and retries it.
+//
+// To retry the request which has a body, req.GetBody must be set.
+// http.NewRequest sets it for *bytes.Reader, *bytes.Buffer and *strings.Reader.
+func (c *Client) Do(req *http.Request, name, actions string) (*http.Response, error) {
+	ctx, span := tracing.StartWithRemote(req.Context(), tracing.SpanContext{}, "HTTP "+req.Method, tracing.KindClient,
+		"http.method", req.Method, "http.url", req.URL.String())
+	defer span.Finish()
+	tracing.Inject(ctx, req.Header)
+
+	scope := "repository:" + c.repositoryName(name) + ":" + actions
+	if tok := c.cachedToken(scope); tok != "" {
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttributes("http.status_code", resp.StatusCode)
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("cannot retry %s %s with the body", req.Method, req.URL)
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		// request the scope we need, not the one in the challenge which may lack push.
+		params["scope"] = scope
+		tok, err := c.fetchToken(req.Context(), params)
+		if err != nil {
+			return nil, err
+		}
+		retry.Header.Set("Authorization", "Bearer "+tok)
+	case "basic":
+		retry.SetBasicAuth(c.Username, c.Password)
+	default:
+		return nil, fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	return c.httpClient().Do(retry)
+}
+
+// Get sends a GET request to /v2/<name>/<path> on the registry with pull scope.
+func (c *Client) Get(ctx context.Context, name, path string, header http.Header) (*http.Response, error) {
+	req, err := c.NewRequest(ctx, http.MethodGet, name, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return c.Do(req, name, "pull")
+}
+
+func (c *Client) cachedToken(scope string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tok, ok := c.tokens[scope]
+	if !ok || time.Now().After(tok.expiresAt) {
+		return ""
+	}
+	return tok.value
+}
+
+// fetchToken obtains a token from the realm in the challenge.
+//
+// see: https://docs.docker.com/registry/spec/auth/token/
+func (c *Client) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", fmt.Errorf("invalid realm %q in the challenge", params["realm"])
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", params["scope"])
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded %s", resp.Status)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	tok := tr.Token
+	if tok == "" {
+		tok = tr.AccessToken
+	}
+	if tok == "" {
+		return "", fmt.Errorf("token endpoint did not return a token")
+	}
+	// The spec says the default is 60 seconds.
+	expiresIn := 60 * time.Second
+	if tr.ExpiresIn > 0 {
+		expiresIn = time.Duration(tr.ExpiresIn) * time.Second
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]*token)
+	}
+	c.tokens[params["scope"]] = &token{
+		value: tok,
+		// leave a margin so that the token does not expire in flight.
+		expiresAt: time.Now().Add(expiresIn * 9 / 10),
+	}
+	return tok, nil
+}
+
+// parseChallenge parses WWW-Authenticate header such as
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	header = strings.TrimSpace(header)
+	idx := strings.IndexByte(header, ' ')
+	if idx == -1 {
+		return header, params
+	}
+	scheme, rest := header[:idx], header[idx+1:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end == -1 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		wantScheme string
+		wantParams map[string]string
+	}{
+		{
+			name:       "bearer",
+			header:     `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/alpine:pull",
+			},
+		},
+		{
+			name:       "basic",
+			header:     `Basic realm="registry"`,
+			wantScheme: "Basic",
+			wantParams: map[string]string{
+				"realm": "registry",
+			},
+		},
+		{
+			name:       "unquoted",
+			header:     `Bearer realm=https://example.com/token, service=example`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{
+				"realm":   "https://example.com/token",
+				"service": "example",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, params := parseChallenge(tt.header)
+			if scheme != tt.wantScheme {
+				t.Errorf("scheme want %q, but got %q", tt.wantScheme, scheme)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("params want %v, but got %v", tt.wantParams, params)
+			}
+		})
+	}
+}
+
+func TestClient_Get_Bearer(t *testing.T) {
+	const token = "secret-token"
+	var tokenRequests int
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if got := r.URL.Query().Get("scope"); got != "repository:library/alpine:pull" {
+			t.Errorf("unexpected scope %q", got)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      token,
+			"expires_in": 300,
+		})
+	})
+	mux.HandleFunc("/v2/library/alpine/manifests/latest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="test",scope="repository:library/alpine:pull"`, srv.URL,
+			))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("{}"))
+	})
+
+	c := &Client{
+		URL:      srv.URL,
+		Username: "user",
+		Password: "pass",
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(context.Background(), "library/alpine", "manifests/latest", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Fatalf("want the token to be cached, but requested %d times", tokenRequests)
+	}
+}
+
+func TestClient_repositoryName(t *testing.T) {
+	tests := []struct {
+		url  string
+		name string
+		want string
+	}{
+		{url: "https://registry-1.docker.io", name: "alpine", want: "library/alpine"},
+		{url: "https://registry-1.docker.io", name: "codehex/app", want: "codehex/app"},
+		{url: "https://ghcr.io", name: "alpine", want: "alpine"},
+	}
+	for _, tt := range tests {
+		c := &Client{URL: tt.url}
+		if got := c.repositoryName(tt.name); got != tt.want {
+			t.Errorf("repositoryName(%q) on %q = %q, want %q", tt.name, tt.url, got, tt.want)
+		}
+	}
+}
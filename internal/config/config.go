@@ -0,0 +1,376 @@
+// Package config loads the configuration of the registry from a YAML file,
+// environment variables and flags.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/auth"
+	"github.com/Code-Hex/container-registry/internal/duration"
+	"github.com/Code-Hex/container-registry/internal/immutable"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/quota"
+	"github.com/Code-Hex/container-registry/internal/ratelimit"
+	"github.com/Code-Hex/container-registry/internal/replication"
+	"github.com/Code-Hex/container-registry/internal/retention"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/Code-Hex/container-registry/internal/tlsutil"
+	"github.com/Code-Hex/container-registry/internal/tracing"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Drivers of the storage.
+const (
+	DriverFilesystem = "filesystem"
+)
+
+// Config is the configuration of the registry.
+//
+// Keys of the YAML file are the json tags of fields. Every scalar field can be
+// overridden by the environment variable which is named by the path to it,
+// such as REGISTRY_HTTP_ADDR or REGISTRY_HTTP_TLS_CERT.
+type Config struct {
+	HTTP    HTTP    `json:"http"`
+	Storage Storage `json:"storage"`
+	Auth    Auth    `json:"auth"`
+	Limits  Limits  `json:"limits"`
+	Log     Log     `json:"log"`
+	Metrics Metrics `json:"metrics"`
+	Admin   Admin   `json:"admin"`
+
+	// features which are enabled if they are not nil.
+	Proxy         *Proxy                `json:"proxy,omitempty"`
+	ImmutableTags *immutable.Config     `json:"immutableTags,omitempty"`
+	Replication   *replication.Config   `json:"replication,omitempty"`
+	Notifications *notifications.Config `json:"notifications,omitempty"`
+	Quota         *quota.Config         `json:"quota,omitempty"`
+	Retention     *retention.Config     `json:"retention,omitempty"`
+	Trash         *Trash                `json:"trash,omitempty"`
+	Tracing       *tracing.Config       `json:"tracing,omitempty"`
+}
+
+// HTTP is the configuration of the server.
+type HTTP struct {
+	// Addr is the address to listen.
+	Addr              string            `json:"addr"`
+	ReadHeaderTimeout duration.Duration `json:"readHeaderTimeout,omitempty"`
+	IdleTimeout       duration.Duration `json:"idleTimeout,omitempty"`
+	// ShutdownDelay is the delay between becoming not ready and starting the shutdown,
+	// so that load balancers stop sending new requests before the listener is closed.
+	ShutdownDelay duration.Duration `json:"shutdownDelay,omitempty"`
+	// ShutdownTimeout is the deadline to finish in-flight requests and flush queues.
+	ShutdownTimeout duration.Duration `json:"shutdownTimeout,omitempty"`
+	TLS             TLS               `json:"tls"`
+}
+
+// TLS is the configuration of TLS. TLS is enabled if Cert and Key, or Dev is set.
+type TLS struct {
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// Dev is the directory to write a self-signed CA and a certificate.
+	Dev string `json:"dev,omitempty"`
+	// ClientCA is the CA to verify client certificates of mutual TLS.
+	ClientCA   string             `json:"clientCA,omitempty"`
+	ClientAuth tlsutil.ClientAuth `json:"clientAuth,omitempty"`
+	// ClientIdentities maps subjects of client certificates to usernames.
+	ClientIdentities map[string]string `json:"clientIdentities,omitempty"`
+}
+
+// Enabled reports whether TLS is enabled.
+func (t *TLS) Enabled() bool {
+	return t.Dev != "" || t.Cert != "" || t.Key != ""
+}
+
+// Storage is the configuration of the storage.
+type Storage struct {
+	Driver string `json:"driver"`
+	// Root is the directory of the filesystem driver.
+	Root string `json:"root"`
+}
+
+// Auth is the configuration of the authentication and the authorization.
+// Token and Basic are exclusive.
+type Auth struct {
+	Token  *auth.TokenConfig `json:"token,omitempty"`
+	Basic  *auth.BasicConfig `json:"basic,omitempty"`
+	Policy *auth.Policy      `json:"policy,omitempty"`
+}
+
+// Limits is the configuration of limits of requests.
+type Limits struct {
+	// MaxManifestSize is the maximum size of manifests in bytes.
+	MaxManifestSize int64 `json:"maxManifestSize,omitempty"`
+	// Rate enables the rate limiting if it is not nil.
+	Rate *ratelimit.Config `json:"rate,omitempty"`
+}
+
+// Log is the configuration of logging.
+type Log struct {
+	// AccessLog enables the access log.
+	AccessLog bool `json:"accessLog"`
+	// Level is the minimum level of logs (debug, info, warn, error).
+	Level string `json:"level"`
+	// Format is the output format of logs (text, json).
+	Format logging.Format `json:"format"`
+}
+
+// Metrics is the configuration of the Prometheus metrics.
+type Metrics struct {
+	// Enabled serves metrics on /metrics.
+	Enabled bool `json:"enabled"`
+}
+
+// Admin is the configuration of the admin API.
+type Admin struct {
+	// Images serves /admin/copy, /admin/export and /admin/import, which read and
+	// write images of every repository. They are only authorized for the admin
+	// if the authentication is enabled, and anyone can use them otherwise.
+	Images bool `json:"images"`
+}
+
+// Proxy is the configuration of the pull-through cache.
+type Proxy struct {
+	URL      string            `json:"url"`
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	TTL      duration.Duration `json:"ttl,omitempty"`
+}
+
+// DefaultPurgeInterval is the default interval of purging the trash.
+const DefaultPurgeInterval = time.Hour
+
+// Trash is the configuration of the trash. Deleted tags, manifests and blobs
+// are kept in the trash for Retention, then purged.
+type Trash struct {
+	Retention duration.Duration `json:"retention"`
+	// PurgeInterval is the interval of purging the trash. If zero, DefaultPurgeInterval is used.
+	PurgeInterval duration.Duration `json:"purgeInterval,omitempty"`
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		HTTP: HTTP{
+			Addr:              "localhost:5080",
+			ReadHeaderTimeout: duration.Duration(30 * time.Second),
+			IdleTimeout:       duration.Duration(2 * time.Minute),
+			ShutdownTimeout:   duration.Duration(30 * time.Second),
+			TLS: TLS{
+				ClientAuth: tlsutil.ClientAuthOptional,
+			},
+		},
+		Storage: Storage{
+			Driver: DriverFilesystem,
+			Root:   "testdata",
+		},
+		Limits: Limits{
+			MaxManifestSize: storage.DefaultMaxManifestSize,
+		},
+		Log: Log{
+			AccessLog: true,
+			Level:     "info",
+			Format:    logging.FormatText,
+		},
+		Metrics: Metrics{
+			Enabled: true,
+		},
+	}
+}
+
+// LoadFile loads the YAML file onto c. Fields which are not in the file are kept.
+func (c *Config) LoadFile(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := c.load(b); err != nil {
+		return fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	return nil
+}
+
+func (c *Config) load(b []byte) error {
+	var v interface{}
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	// decode via json so that fields are decoded with json tags and
+	// json.Unmarshaler as well as other json configuration files.
+	j, err := json.Marshal(jsonify(v))
+	if err != nil {
+		return err
+	}
+	if string(j) == "null" {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(string(j)))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// jsonify converts maps which are decoded from YAML so that they can be encoded as json.
+func jsonify(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonify(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonify(e)
+		}
+	}
+	return v
+}
+
+// Validate returns every problem of the configuration.
+func (c *Config) Validate() error {
+	var errs Errors
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		check("http.addr", err)
+	}
+	if c.HTTP.ShutdownDelay < 0 {
+		check("http.shutdownDelay", fmt.Errorf("must not be negative"))
+	}
+	if c.HTTP.ShutdownTimeout <= 0 {
+		check("http.shutdownTimeout", fmt.Errorf("must be positive"))
+	}
+	check("http.tls", c.HTTP.TLS.validate())
+
+	switch c.Storage.Driver {
+	case DriverFilesystem:
+		if c.Storage.Root == "" {
+			check("storage.root", fmt.Errorf("must be specified"))
+		}
+	default:
+		check("storage.driver", fmt.Errorf("unsupported driver %q", c.Storage.Driver))
+	}
+
+	if c.Auth.Token != nil && c.Auth.Basic != nil {
+		check("auth", fmt.Errorf("token and basic are exclusive"))
+	}
+	if c.Auth.Token != nil {
+		check("auth.token", c.Auth.Token.Validate())
+		if c.Auth.Token.PrivateKey != "" {
+			check("auth.token.privateKey", fileExists(c.Auth.Token.PrivateKey))
+		}
+	}
+	if c.Auth.Basic != nil {
+		check("auth.basic", c.Auth.Basic.Validate())
+		if c.Auth.Basic.Htpasswd != "" {
+			check("auth.basic.htpasswd", fileExists(c.Auth.Basic.Htpasswd))
+		}
+	}
+	if c.Auth.Policy != nil {
+		check("auth.policy", c.Auth.Policy.Validate())
+	}
+
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		check("log.level", err)
+	}
+	check("log.format", c.Log.Format.Validate())
+
+	if c.Limits.MaxManifestSize <= 0 {
+		check("limits.maxManifestSize", fmt.Errorf("must be positive"))
+	}
+	if c.Limits.Rate != nil {
+		check("limits.rate", c.Limits.Rate.Validate())
+	}
+
+	if c.Proxy != nil {
+		if u, err := url.Parse(c.Proxy.URL); err != nil {
+			check("proxy.url", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			check("proxy.url", fmt.Errorf("must be http or https url"))
+		}
+	}
+	if c.ImmutableTags != nil {
+		check("immutableTags", c.ImmutableTags.Validate())
+	}
+	if c.Replication != nil {
+		check("replication", c.Replication.Validate())
+	}
+	if c.Notifications != nil {
+		check("notifications", c.Notifications.Validate())
+	}
+	if c.Quota != nil {
+		check("quota", c.Quota.Validate())
+	}
+	if c.Retention != nil {
+		check("retention", c.Retention.Validate())
+	}
+	if c.Trash != nil {
+		if c.Trash.Retention <= 0 {
+			check("trash.retention", fmt.Errorf("must be positive"))
+		}
+		if c.Trash.PurgeInterval < 0 {
+			check("trash.purgeInterval", fmt.Errorf("must not be negative"))
+		}
+	}
+	if c.Tracing != nil {
+		check("tracing", c.Tracing.Validate())
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (t *TLS) validate() error {
+	if t.Dev != "" && (t.Cert != "" || t.Key != "") {
+		return fmt.Errorf("dev can not be used with cert and key")
+	}
+	if t.Dev == "" && (t.Cert == "") != (t.Key == "") {
+		return fmt.Errorf("both cert and key must be specified")
+	}
+	for _, f := range []string{t.Cert, t.Key, t.ClientCA} {
+		if f == "" {
+			continue
+		}
+		if err := fileExists(f); err != nil {
+			return err
+		}
+	}
+	if t.ClientCA != "" {
+		if !t.Enabled() {
+			return fmt.Errorf("clientCA requires TLS")
+		}
+		switch t.ClientAuth {
+		case tlsutil.ClientAuthOptional, tlsutil.ClientAuthRequire:
+		default:
+			return fmt.Errorf("unknown clientAuth %q", t.ClientAuth)
+		}
+	}
+	return nil
+}
+
+func fileExists(filename string) error {
+	_, err := os.Stat(filename)
+	return err
+}
+
+// Errors is the list of problems of the configuration.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
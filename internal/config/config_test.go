@@ -0,0 +1,186 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/duration"
+)
+
+const testYAML = `
+http:
+  addr: ":5000"
+  idleTimeout: 1m
+storage:
+  root: /var/lib/registry
+auth:
+  basic:
+    realm: registry
+    htpasswd: %s
+    roles:
+      users:
+        alice: read-write
+  policy:
+    rules:
+      - users: ["*"]
+        repositories: ["base/*"]
+        actions: [pull]
+limits:
+  maxManifestSize: 1024
+proxy:
+  url: https://registry-1.docker.io
+  ttl: 5m
+notifications:
+  endpoints:
+    - name: ci
+      url: https://ci.example.com/hook
+      timeout: 3s
+quota:
+  namespaces:
+    team-a: 10737418240
+retention:
+  interval: 12h
+  policies:
+    - repositories: ["team-a/*"]
+      keepLast: 10
+      maxAge: 30d
+      keep: ["latest"]
+trash:
+  retention: 168h
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestConfig_LoadFile(t *testing.T) {
+	htpasswd := writeFile(t, "htpasswd", "")
+	filename := writeFile(t, "registry.yml", strings.Replace(testYAML, "%s", htpasswd, 1))
+
+	c := Default()
+	if err := c.LoadFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Addr != ":5000" || time.Duration(c.HTTP.IdleTimeout) != time.Minute {
+		t.Errorf("unexpected http: %+v", c.HTTP)
+	}
+	// defaults are kept
+	if c.Storage.Driver != DriverFilesystem || !c.Log.AccessLog {
+		t.Errorf("defaults are overwritten: %+v, %+v", c.Storage, c.Log)
+	}
+	if c.Storage.Root != "/var/lib/registry" || c.Limits.MaxManifestSize != 1024 {
+		t.Errorf("unexpected config: %+v, %+v", c.Storage, c.Limits)
+	}
+	if c.Auth.Basic == nil || c.Auth.Basic.Roles.Users["alice"] != "read-write" {
+		t.Errorf("unexpected auth: %+v", c.Auth.Basic)
+	}
+	if c.Auth.Policy == nil || len(c.Auth.Policy.Rules) != 1 {
+		t.Errorf("unexpected policy: %+v", c.Auth.Policy)
+	}
+	if c.Proxy == nil || time.Duration(c.Proxy.TTL) != 5*time.Minute {
+		t.Errorf("unexpected proxy: %+v", c.Proxy)
+	}
+	if c.Notifications == nil || len(c.Notifications.Endpoints) != 1 {
+		t.Errorf("unexpected notifications: %+v", c.Notifications)
+	}
+	if c.Quota == nil || c.Quota.Namespaces["team-a"] != 10<<30 {
+		t.Errorf("unexpected quota: %+v", c.Quota)
+	}
+	if c.Retention == nil || len(c.Retention.Policies) != 1 || c.Retention.Policies[0].MaxAge != duration.Duration(30*24*time.Hour) {
+		t.Errorf("unexpected retention: %+v", c.Retention)
+	}
+	if c.Trash == nil || time.Duration(c.Trash.Retention) != 7*24*time.Hour {
+		t.Errorf("unexpected trash: %+v", c.Trash)
+	}
+
+	if err := Default().LoadFile(writeFile(t, "unknown.yml", "htp:\n  addr: :5000\n")); err == nil {
+		t.Error("want error for unknown field")
+	}
+}
+
+func TestConfig_ApplyEnv(t *testing.T) {
+	c := Default()
+	err := c.ApplyEnv([]string{
+		"REGISTRY_HTTP_ADDR=:6000",
+		"REGISTRY_HTTP_IDLETIMEOUT=10s",
+		"REGISTRY_LOG_ACCESSLOG=false",
+		"REGISTRY_LOG_FORMAT=json",
+		"REGISTRY_LIMITS_MAXMANIFESTSIZE=2048",
+		"REGISTRY_PROXY_URL=https://example.com",
+		"REGISTRY_LIMITS_RATE_MANIFESTS_RATE=2.5",
+		"REGISTRY_RETENTION_INTERVAL=24h",
+		"REGISTRY_TRASH_RETENTION=7d",
+		"REGISTRY_ADMIN_IMAGES=true",
+		"PATH=/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Addr != ":6000" || time.Duration(c.HTTP.IdleTimeout) != 10*time.Second {
+		t.Errorf("unexpected http: %+v", c.HTTP)
+	}
+	if c.Log.AccessLog || c.Log.Format != "json" || c.Limits.MaxManifestSize != 2048 {
+		t.Errorf("unexpected config: %+v, %+v", c.Log, c.Limits)
+	}
+	if c.Proxy == nil || c.Proxy.URL != "https://example.com" {
+		t.Errorf("proxy is not enabled: %+v", c.Proxy)
+	}
+	if c.Limits.Rate == nil || c.Limits.Rate.Manifests.Rate != 2.5 {
+		t.Errorf("rate limiting is not enabled: %+v", c.Limits.Rate)
+	}
+	if c.Retention == nil || time.Duration(c.Retention.Interval) != 24*time.Hour {
+		t.Errorf("retention is not enabled: %+v", c.Retention)
+	}
+	if c.Trash == nil || time.Duration(c.Trash.Retention) != 7*24*time.Hour {
+		t.Errorf("trash is not enabled: %+v", c.Trash)
+	}
+	if !c.Admin.Images {
+		t.Error("the admin API of images is not enabled")
+	}
+	if c.Auth.Token != nil {
+		t.Errorf("token auth is enabled without env: %+v", c.Auth.Token)
+	}
+
+	err = Default().ApplyEnv([]string{
+		"REGISTRY_HTTP_IDLETIMEOUT=forever",
+		"REGISTRY_LOG_ACCESSLOG=maybe",
+	})
+	if errs, ok := err.(Errors); !ok || len(errs) != 2 {
+		t.Errorf("want 2 errors, but got %v", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c := Default()
+	c.HTTP.Addr = "localhost"
+	c.HTTP.TLS.Cert = "cert.pem"
+	c.Storage.Driver = "s3"
+	c.Limits.MaxManifestSize = 0
+	c.Proxy = &Proxy{URL: "ftp://example.com"}
+	c.Log.Level = "verbose"
+	c.Log.Format = "xml"
+	err := c.Validate()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("want Errors, but got %v", err)
+	}
+	for _, field := range []string{"http.addr", "http.tls", "storage.driver", "limits.maxManifestSize", "proxy.url", "log.level", "log.format"} {
+		if !strings.Contains(errs.Error(), field+":") {
+			t.Errorf("want error of %s in %q", field, errs)
+		}
+	}
+	if err := Default().Validate(); err != nil {
+		t.Errorf("default is invalid: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of environment variables which override the configuration.
+const EnvPrefix = "REGISTRY"
+
+// ApplyEnv overrides scalar fields with environment variables such as
+// REGISTRY_HTTP_ADDR=:5000. Optional sections such as REGISTRY_PROXY_URL
+// are enabled by setting their fields.
+//
+// environ is in the form of os.Environ.
+func (c *Config) ApplyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv, EnvPrefix+"_") {
+			continue
+		}
+		env[kv[:i]] = kv[i+1:]
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	var errs Errors
+	applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, env, &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+type setter interface {
+	Set(string) error
+}
+
+func applyEnv(v reflect.Value, prefix string, env map[string]string, errs *Errors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + "_" + strings.ToUpper(name)
+		field := v.Field(i)
+
+		if s, ok := field.Addr().Interface().(setter); ok {
+			if value, ok := env[key]; ok {
+				if err := s.Set(value); err != nil {
+					*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+				}
+			}
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			applyEnv(field, key, env, errs)
+			continue
+		case reflect.Ptr:
+			if field.Type().Elem().Kind() != reflect.Struct || !hasPrefix(env, key+"_") {
+				continue
+			}
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			applyEnv(field.Elem(), key, env, errs)
+			continue
+		}
+
+		value, ok := env[key]
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			field.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			field.SetFloat(f)
+		default:
+			*errs = append(*errs, fmt.Errorf("%s: can not be set by the environment variable", key))
+		}
+	}
+}
+
+func hasPrefix(env map[string]string, prefix string) bool {
+	for k := range env {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package duration
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDuration(t *testing.T) {
+	var v struct {
+		Interval Duration `json:"interval"`
+		MaxAge   Duration `json:"maxAge"`
+	}
+	if err := json.Unmarshal([]byte(`{"interval":"12h","maxAge":"30d"}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Interval != Duration(12*time.Hour) || v.MaxAge != Duration(30*24*time.Hour) {
+		t.Errorf("unexpected durations: %+v", v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"interval":"12h0m0s","maxAge":"720h0m0s"}`; string(b) != want {
+		t.Errorf("want %s, but got %s", want, b)
+	}
+
+	var d Duration
+	if err := d.Set("5s"); err != nil || d != Duration(5*time.Second) {
+		t.Errorf("unexpected duration: %v, %v", d, err)
+	}
+	for _, s := range []string{"xd", "forever", ""} {
+		if err := d.Set(s); err == nil {
+			t.Errorf("want error for %q", s)
+		}
+	}
+}
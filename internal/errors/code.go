@@ -142,3 +142,40 @@ func WithCodeBlobUploadInvalid() WrapOption {
 		e.StatusCode = http.StatusNotFound
 	}
 }
+
+// WithCodeUnauthorized is returned if a request requires authentication.
+func WithCodeUnauthorized() WrapOption {
+	return func(e *Error) {
+		e.Code = "UNAUTHORIZED"
+		e.Message = "authentication required"
+		e.StatusCode = http.StatusUnauthorized
+	}
+}
+
+// WithCodeDenied is returned if the access to the resource is denied.
+func WithCodeDenied() WrapOption {
+	return func(e *Error) {
+		e.Code = "DENIED"
+		e.Message = "requested access to the resource is denied"
+		e.StatusCode = http.StatusForbidden
+	}
+}
+
+// WithCodeUnavailable is returned if the registry can not serve the request for now,
+// such as while it is shutting down.
+func WithCodeUnavailable() WrapOption {
+	return func(e *Error) {
+		e.Code = "UNAVAILABLE"
+		e.Message = "service unavailable"
+		e.StatusCode = http.StatusServiceUnavailable
+	}
+}
+
+// WithCodeTooManyRequests is returned if the client sends too many requests.
+func WithCodeTooManyRequests() WrapOption {
+	return func(e *Error) {
+		e.Code = "TOOMANYREQUESTS"
+		e.Message = "too many requests"
+		e.StatusCode = http.StatusTooManyRequests
+	}
+}
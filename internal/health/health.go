@@ -0,0 +1,151 @@
+// Package health reports whether the registry is alive and ready to serve traffic.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of checks and reports.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// checkTimeout is the timeout of each check.
+const checkTimeout = 5 * time.Second
+
+// Check returns an error if the component is not healthy.
+type Check func(ctx context.Context) error
+
+// Result is the result of a check.
+type Result struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the result of every check.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs checks of liveness and readiness.
+type Checker struct {
+	mu        sync.Mutex
+	liveness  []namedCheck
+	readiness []namedCheck
+
+	shuttingDown int32
+}
+
+// AddLiveness adds the check to both of liveness and readiness.
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness = append(c.liveness, namedCheck{name, check})
+}
+
+// AddReadiness adds the check only to readiness.
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness = append(c.readiness, namedCheck{name, check})
+}
+
+// Shutdown marks the server as shutting down, after that it is never ready.
+func (c *Checker) Shutdown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether Shutdown is called.
+func (c *Checker) ShuttingDown() bool {
+	return atomic.LoadInt32(&c.shuttingDown) == 1
+}
+
+func (c *Checker) checkShutdown(context.Context) error {
+	if c.ShuttingDown() {
+		return fmt.Errorf("shutting down")
+	}
+	return nil
+}
+
+// Live runs the liveness checks.
+func (c *Checker) Live(ctx context.Context) *Report {
+	c.mu.Lock()
+	checks := append([]namedCheck(nil), c.liveness...)
+	c.mu.Unlock()
+	return run(ctx, checks)
+}
+
+// Ready runs the liveness checks, the readiness checks and the check of shutdown.
+func (c *Checker) Ready(ctx context.Context) *Report {
+	c.mu.Lock()
+	checks := append([]namedCheck(nil), c.liveness...)
+	checks = append(checks, c.readiness...)
+	c.mu.Unlock()
+	checks = append(checks, namedCheck{"shutdown", c.checkShutdown})
+	return run(ctx, checks)
+}
+
+// run runs checks concurrently.
+func run(ctx context.Context, checks []namedCheck) *Report {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c namedCheck) {
+			defer wg.Done()
+			if err := c.check(ctx); err != nil {
+				results[i] = Result{Status: StatusFail, Error: err.Error()}
+				return
+			}
+			results[i] = Result{Status: StatusOK}
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := &Report{Status: StatusOK, Checks: map[string]Result{}}
+	for i, c := range checks {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+// LivenessHandler serves the report of liveness.
+func (c *Checker) LivenessHandler() http.Handler {
+	return reportHandler(c.Live)
+}
+
+// ReadinessHandler serves the report of readiness.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return reportHandler(c.Ready)
+}
+
+// reportHandler serves the report as json. It responds 503 if any check fails.
+func reportHandler(fn func(ctx context.Context) *Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := fn(r.Context())
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != StatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
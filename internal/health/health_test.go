@@ -0,0 +1,92 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestChecker(t *testing.T) {
+	var storageErr error
+	c := new(Checker)
+	c.AddLiveness("storage", func(context.Context) error { return storageErr })
+	c.AddReadiness("upstream", func(context.Context) error { return nil })
+
+	tests := []struct {
+		name       string
+		setup      func()
+		handler    http.Handler
+		wantStatus int
+		want       Report
+	}{
+		{
+			name:       "live",
+			handler:    c.LivenessHandler(),
+			wantStatus: http.StatusOK,
+			want: Report{Status: StatusOK, Checks: map[string]Result{
+				"storage": {Status: StatusOK},
+			}},
+		},
+		{
+			name:       "ready",
+			handler:    c.ReadinessHandler(),
+			wantStatus: http.StatusOK,
+			want: Report{Status: StatusOK, Checks: map[string]Result{
+				"storage":  {Status: StatusOK},
+				"upstream": {Status: StatusOK},
+				"shutdown": {Status: StatusOK},
+			}},
+		},
+		{
+			name:       "not ready while shutting down",
+			setup:      c.Shutdown,
+			handler:    c.ReadinessHandler(),
+			wantStatus: http.StatusServiceUnavailable,
+			want: Report{Status: StatusFail, Checks: map[string]Result{
+				"storage":  {Status: StatusOK},
+				"upstream": {Status: StatusOK},
+				"shutdown": {Status: StatusFail, Error: "shutting down"},
+			}},
+		},
+		{
+			name:       "still live while shutting down",
+			handler:    c.LivenessHandler(),
+			wantStatus: http.StatusOK,
+			want: Report{Status: StatusOK, Checks: map[string]Result{
+				"storage": {Status: StatusOK},
+			}},
+		},
+		{
+			name:       "not live if a check fails",
+			setup:      func() { storageErr = errors.New("read-only file system") },
+			handler:    c.LivenessHandler(),
+			wantStatus: http.StatusServiceUnavailable,
+			want: Report{Status: StatusFail, Checks: map[string]Result{
+				"storage": {Status: StatusFail, Error: "read-only file system"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("want status %d, but got %d", tt.wantStatus, w.Code)
+			}
+			var got Report
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("want %+v, but got %+v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Package immutable defines rules of tags which can never be changed once they are pushed,
+// such as release tags like v1.2.3.
+package immutable
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// semverPattern matches semantic versions which can be tags, with an optional "v" prefix.
+// Build metadata is not matched, because "+" is not allowed in tags.
+//
+// see: https://semver.org/
+var semverPattern = regexp.MustCompile(
+	`^v?(?:0|[1-9][0-9]*)\.(?:0|[1-9][0-9]*)\.(?:0|[1-9][0-9]*)(?:-[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?$`,
+)
+
+// Rule makes tags which match it immutable. A tag matches the rule if the
+// repository matches any of Repositories, and the tag matches any of Tags or is
+// a semantic version if Semver is true.
+type Rule struct {
+	// Repositories are glob patterns of repository names such as "team-a/*".
+	// The syntax is the one of path.Match. If empty, every repository matches.
+	Repositories []string `json:"repositories,omitempty"`
+	// Tags are regular expressions which match the whole tag, such as "release-.*".
+	Tags []string `json:"tags,omitempty"`
+	// Semver matches tags which are semantic versions such as "v1.2.3" and "1.2.3-rc.1".
+	Semver bool `json:"semver,omitempty"`
+
+	// tags are Tags which are compiled by Validate.
+	tags []*regexp.Regexp
+}
+
+// compileTags compiles patterns of tags, which match the whole tag.
+func compileTags(patterns []string) ([]*regexp.Regexp, error) {
+	ret := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag pattern %q: %w", pattern, err)
+		}
+		ret[i] = re
+	}
+	return ret, nil
+}
+
+// Config is the configuration of immutable tags.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Validate validates rules, and compiles patterns of tags for Match.
+func (c *Config) Validate() error {
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		for _, pattern := range r.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rules[%d]: invalid pattern %q: %w", i, pattern, err)
+			}
+		}
+		tags, err := compileTags(r.Tags)
+		if err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		r.tags = tags
+		if len(r.Tags) == 0 && !r.Semver {
+			return fmt.Errorf("rules[%d]: tags or semver must be specified", i)
+		}
+	}
+	return nil
+}
+
+// Match returns the rule which makes the tag of the repository immutable.
+// It returns nil if the tag is mutable. It is safe to call on nil Config.
+func (c *Config) Match(repository, tag string) *Rule {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Rules {
+		if r := &c.Rules[i]; r.matchRepository(repository) && r.matchTag(tag) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *Rule) matchRepository(name string) bool {
+	if len(r.Repositories) == 0 {
+		return true
+	}
+	for _, pattern := range r.Repositories {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchTag(tag string) bool {
+	if r.Semver && semverPattern.MatchString(tag) {
+		return true
+	}
+	tags := r.tags
+	if len(tags) != len(r.Tags) {
+		// the rule is not validated.
+		tags, _ = compileTags(r.Tags)
+	}
+	for _, re := range tags {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package immutable
+
+import "testing"
+
+func TestConfig_Match(t *testing.T) {
+	c := &Config{Rules: []Rule{
+		{Repositories: []string{"team-a/*"}, Semver: true},
+		{Tags: []string{"release-.*", "stable"}},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		repository, tag string
+		want            *Rule
+	}{
+		{"team-a/app", "v1.2.3", &c.Rules[0]},
+		{"team-a/app", "1.2.3-rc.1", &c.Rules[0]},
+		{"team-a/app", "v1.2", nil},
+		{"team-a/app", "01.2.3", nil},
+		{"team-a/app", "latest", nil},
+		{"team-a/sub/app", "v1.2.3", nil},
+		{"team-b/app", "v1.2.3", nil},
+		{"team-b/app", "release-2020", &c.Rules[1]},
+		{"team-b/app", "stable", &c.Rules[1]},
+		{"team-b/app", "unstable", nil},
+		{"team-b/app", "pre-release-2020", nil},
+	}
+	for _, tc := range cases {
+		if got := c.Match(tc.repository, tc.tag); got != tc.want {
+			t.Errorf("%s:%s: want %v, but got %v", tc.repository, tc.tag, tc.want, got)
+		}
+	}
+
+	// rules which are not validated compile patterns on every match.
+	unvalidated := &Config{Rules: []Rule{{Tags: []string{"stable|lts"}}}}
+	if got := unvalidated.Match("app", "lts"); got != &unvalidated.Rules[0] {
+		t.Errorf("want the rule, but got %v", got)
+	}
+
+	var nilConfig *Config
+	if got := nilConfig.Match("app", "v1.0.0"); got != nil {
+		t.Errorf("want nil, but got %v", got)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cases := []struct {
+		c       Config
+		wantErr bool
+	}{
+		{Config{}, false},
+		{Config{Rules: []Rule{{Semver: true}}}, false},
+		{Config{Rules: []Rule{{Repositories: []string{"team-a/*"}}}}, true},
+		{Config{Rules: []Rule{{Tags: []string{"("}}}}, true},
+		{Config{Rules: []Rule{{Repositories: []string{"["}, Semver: true}}}, true},
+	}
+	for i, tc := range cases {
+		if err := tc.c.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("#%d: want error %v, but got %v", i, tc.wantErr, err)
+		}
+	}
+}
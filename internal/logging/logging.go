@@ -0,0 +1,265 @@
+// Package logging implements leveled and structured logging which
+// is written as JSON or logfmt text, and propagated through context.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of logs.
+type Level int
+
+// Levels of logs.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel parses the name of the level such as "info".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown level %q (debug, info, warn, error)", s)
+}
+
+// Format is the output format of logs.
+type Format string
+
+// Formats of logs.
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// Validate validates the format.
+func (f Format) Validate() error {
+	switch f {
+	case FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q (text, json)", f)
+}
+
+// Logger writes structured logs. Fields are given as alternating keys and values
+// such as logger.Info("pushed", "repository", name, "size", size).
+//
+// A Logger is safe for concurrent use, and loggers which are derived by With
+// share the output with the parent.
+type Logger struct {
+	out    *output
+	level  Level
+	format Format
+	fields []interface{}
+}
+
+type output struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// New creates a Logger which writes logs at level or above to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out:    &output{w: w},
+		level:  level,
+		format: format,
+	}
+}
+
+// Default is the logger which is used if the context has no logger.
+var Default = New(os.Stderr, LevelInfo, FormatText)
+
+// now is replaced in tests.
+var now = time.Now
+
+// With returns a Logger which adds the fields to every log.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{
+		out:    l.out,
+		level:  l.level,
+		format: l.format,
+		fields: fields,
+	}
+}
+
+// Enabled reports whether logs at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes a log at LevelDebug.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+
+// Info writes a log at LevelInfo.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.Log(LevelInfo, msg, kv...) }
+
+// Warn writes a log at LevelWarn.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.Log(LevelWarn, msg, kv...) }
+
+// Error writes a log at LevelError.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log writes a log at level.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields,
+		"time", now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg,
+	)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	var buf bytes.Buffer
+	if l.format == FormatJSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeText(&buf, fields)
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+// Writer returns a writer which writes every line as a log at level.
+// It is used to redirect the standard logger by log.SetOutput.
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.Log(level, line)
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// pairs iterates keys and values. A key without the value is logged with "!MISSING".
+func pairs(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "!MISSING"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		fn(key, value)
+	}
+}
+
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.Seconds()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	first := true
+	pairs(fields, func(key string, value interface{}) {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(normalize(value))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(v)
+	})
+	buf.WriteByte('}')
+}
+
+// writeText writes fields in logfmt such as `level=info msg="hello world"`.
+func writeText(buf *bytes.Buffer, fields []interface{}) {
+	first := true
+	pairs(fields, func(key string, value interface{}) {
+		if !first {
+			buf.WriteByte(' ')
+		}
+		first = false
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		var s string
+		switch v := normalize(value).(type) {
+		case string:
+			s = v
+		case float64:
+			s = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			s = fmt.Sprint(v)
+		}
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	})
+}
+
+type contextKey struct{}
+
+// NewContext returns a context which has the logger.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger in the context. If there is no logger, Default is returned.
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return Default
+}
@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	now = func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{
+			format: FormatText,
+			want: `time=2021-01-02T03:04:05Z level=info msg="hello world" request_id=abc size=10 err="not found"` + "\n" +
+				`time=2021-01-02T03:04:05Z level=error msg=failed request_id=abc duration=1.5 odd=!MISSING` + "\n",
+		},
+		{
+			format: FormatJSON,
+			want: `{"time":"2021-01-02T03:04:05Z","level":"info","msg":"hello world","request_id":"abc","size":10,"err":"not found"}` + "\n" +
+				`{"time":"2021-01-02T03:04:05Z","level":"error","msg":"failed","request_id":"abc","duration":1.5,"odd":"!MISSING"}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			var buf bytes.Buffer
+			l := New(&buf, LevelInfo, tt.format).With("request_id", "abc")
+			l.Debug("ignored")
+			l.Info("hello world", "size", 10, "err", errors.New("not found"))
+			l.Error("failed", "duration", 1500*time.Millisecond, "odd")
+			if got := buf.String(); got != tt.want {
+				t.Errorf("want:\n%s\nbut got:\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "": LevelInfo, "WARN": LevelWarn, "error": LevelError} {
+		got, err := ParseLevel(s)
+		if err != nil || got != want {
+			t.Errorf("%q: want %v, but got %v (%v)", s, want, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("want error for unknown level")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != Default {
+		t.Error("want Default if context has no logger")
+	}
+	l := New(&bytes.Buffer{}, LevelDebug, FormatText)
+	if got := FromContext(NewContext(context.Background(), l)); got != l {
+		t.Error("want logger in context")
+	}
+}
+
+func TestLogger_Writer(t *testing.T) {
+	var buf bytes.Buffer
+	std := log.New(New(&buf, LevelInfo, FormatJSON).Writer(LevelWarn), "", 0)
+	std.Printf("proxy: %s", "stale")
+	if want := `"level":"warn","msg":"proxy: stale"}` + "\n"; !bytes.HasSuffix(buf.Bytes(), []byte(want)) {
+		t.Errorf("want suffix %q, but got %q", want, buf.String())
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	reg := NewRegistry()
+	c := NewCounterVec("test_requests_total", "Number of requests.", "method")
+	g := NewGaugeVec("test_sessions", "Number of \"sessions\".")
+	h := NewHistogramVec("test_duration_seconds", "Duration.", []float64{1, 0.5}, "path")
+	f := NewGaugeFunc("test_func", "Gauge\nfunc.", func() float64 { return 42 })
+	reg.MustRegister(c, g, h, f)
+
+	c.Inc("GET")
+	c.Add(2, "GET")
+	c.Inc(`P"O\ST`)
+	g.Add(3)
+	g.Add(-1)
+	h.Observe(0.5, "/")
+	h.Observe(0.7, "/")
+	h.Observe(3, "/")
+
+	var buf bytes.Buffer
+	if _, err := reg.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{path="/",le="0.5"} 1
+test_duration_seconds_bucket{path="/",le="1"} 2
+test_duration_seconds_bucket{path="/",le="+Inf"} 3
+test_duration_seconds_sum{path="/"} 4.2
+test_duration_seconds_count{path="/"} 3
+# HELP test_func Gauge\nfunc.
+# TYPE test_func gauge
+test_func 42
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET"} 3
+test_requests_total{method="P\"O\\ST"} 1
+# HELP test_sessions Number of "sessions".
+# TYPE test_sessions gauge
+test_sessions 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("want:\n%s\nbut got:\n%s", want, got)
+	}
+}
+
+func TestRegistry_MustRegister(t *testing.T) {
+	reg := NewRegistry()
+	reg.MustRegister(NewCounterVec("dup", "help"))
+	defer func() {
+		if recover() == nil {
+			t.Error("want panic on duplicated name")
+		}
+	}()
+	reg.MustRegister(NewGaugeVec("dup", "help"))
+}
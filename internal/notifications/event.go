@@ -0,0 +1,99 @@
+// Package notifications emits registry events such as push, pull and delete
+// and delivers them to sinks such as webhook endpoints.
+package notifications
+
+import (
+	"strings"
+	"time"
+)
+
+// EventsMediaType is the media type of the envelope which is delivered to endpoints.
+const EventsMediaType = "application/vnd.docker.distribution.events.v1+json"
+
+// Actions of the event.
+const (
+	ActionPush   = "push"
+	ActionPull   = "pull"
+	ActionDelete = "delete"
+)
+
+// Event represents something which happened on the registry.
+//
+// The format follows the notification of docker/distribution.
+// see: https://docs.docker.com/registry/notifications/
+type Event struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Target    Target    `json:"target"`
+	Request   Request   `json:"request"`
+	Actor     Actor     `json:"actor"`
+}
+
+// Target is the manifest or blob which the event is about.
+type Target struct {
+	MediaType  string `json:"mediaType,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	URL        string `json:"url,omitempty"`
+}
+
+// IsManifest reports whether the target is a manifest.
+func (t *Target) IsManifest() bool {
+	return strings.Contains(t.URL, "/manifests/") || isManifestMediaType(t.MediaType)
+}
+
+func isManifestMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.image.index.v1+json":
+		return true
+	}
+	return false
+}
+
+// Request is the request which caused the event.
+type Request struct {
+	ID        string `json:"id,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Method    string `json:"method"`
+	UserAgent string `json:"useragent,omitempty"`
+}
+
+// Actor is the user who caused the event.
+type Actor struct {
+	Name string `json:"name,omitempty"`
+}
+
+// Envelope is the body which is delivered to endpoints.
+type Envelope struct {
+	Events []Event `json:"events"`
+}
+
+// Sink receives events. Write must not block for long, because
+// it is called while handling requests.
+type Sink interface {
+	Write(e Event)
+}
+
+// Broadcaster writes events to every sink.
+type Broadcaster []Sink
+
+// Write implements Sink.
+func (b Broadcaster) Write(e Event) {
+	for _, s := range b {
+		s.Write(e)
+	}
+}
+
+// Discard is a Sink which discards every event.
+var Discard Sink = discard{}
+
+type discard struct{}
+
+func (discard) Write(Event) {}
@@ -0,0 +1,253 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/duration"
+	"github.com/Code-Hex/container-registry/internal/logging"
+)
+
+// SignatureHeader is the header which has HMAC-SHA256 signature of the body,
+// in the form of "sha256=<hex>". It is set if the endpoint has a secret.
+const SignatureHeader = "X-Registry-Signature"
+
+// Default values of the endpoint.
+const (
+	DefaultTimeout    = 5 * time.Second
+	DefaultMaxRetries = 5
+	DefaultBackoff    = time.Second
+	DefaultQueueSize  = 1024
+
+	// maxBatchSize is the maximum number of events delivered in a request.
+	maxBatchSize = 32
+)
+
+// Endpoint is the configuration of a webhook endpoint.
+type Endpoint struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret is the key to sign the body. If empty, the body is not signed.
+	Secret string `json:"secret,omitempty"`
+	// Headers are added to every request, such as Authorization.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout is the timeout of a request.
+	Timeout duration.Duration `json:"timeout,omitempty"`
+	// MaxRetries is the number of retries before the events are dropped.
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// Backoff is the delay before the first retry. The delay is doubled on every retry.
+	Backoff duration.Duration `json:"backoff,omitempty"`
+	// QueueSize is the number of events which can be queued. If the queue is full,
+	// new events are dropped, so that requests are never blocked by slow endpoints.
+	QueueSize int `json:"queueSize,omitempty"`
+}
+
+// Config is the configuration of the notifications.
+type Config struct {
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// LoadConfig loads the configuration from json file.
+func LoadConfig(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	for _, e := range c.Endpoints {
+		if e.Name == "" || e.URL == "" {
+			return fmt.Errorf("endpoint must have name and url")
+		}
+	}
+	return nil
+}
+
+// Webhook is a Sink which delivers events to the endpoint as json.
+type Webhook struct {
+	Endpoint
+	client *http.Client
+	queue  chan Event
+
+	mu      sync.Mutex
+	dropped int
+}
+
+var _ Sink = (*Webhook)(nil)
+
+// NewWebhook creates a Webhook. Call Run to deliver queued events.
+func NewWebhook(e Endpoint) *Webhook {
+	if e.Timeout <= 0 {
+		e.Timeout = duration.Duration(DefaultTimeout)
+	}
+	if e.MaxRetries <= 0 {
+		e.MaxRetries = DefaultMaxRetries
+	}
+	if e.Backoff <= 0 {
+		e.Backoff = duration.Duration(DefaultBackoff)
+	}
+	if e.QueueSize <= 0 {
+		e.QueueSize = DefaultQueueSize
+	}
+	return &Webhook{
+		Endpoint: e,
+		client:   &http.Client{Timeout: time.Duration(e.Timeout)},
+		queue:    make(chan Event, e.QueueSize),
+	}
+}
+
+// Write implements Sink. The event is dropped if the queue is full.
+func (w *Webhook) Write(e Event) {
+	select {
+	case w.queue <- e:
+	default:
+		w.mu.Lock()
+		w.dropped++
+		w.mu.Unlock()
+		logging.Default.Warn("notifications: queue is full, dropped the event", "endpoint", w.Name, "event", e.ID)
+	}
+}
+
+// Dropped returns the number of events which are dropped.
+func (w *Webhook) Dropped() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// Run delivers queued events until ctx is canceled.
+func (w *Webhook) Run(ctx context.Context) {
+	for {
+		var events []Event
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-w.queue:
+			events = append(events, e)
+		}
+		// deliver events which are already queued together.
+	batch:
+		for len(events) < maxBatchSize {
+			select {
+			case e := <-w.queue:
+				events = append(events, e)
+			default:
+				break batch
+			}
+		}
+		w.deliver(ctx, events)
+	}
+}
+
+// Flush delivers every queued event. It returns when the queue is empty or ctx is done.
+func (w *Webhook) Flush(ctx context.Context) {
+	for {
+		var events []Event
+	batch:
+		for len(events) < maxBatchSize {
+			select {
+			case e := <-w.queue:
+				events = append(events, e)
+			default:
+				break batch
+			}
+		}
+		if len(events) == 0 || ctx.Err() != nil {
+			return
+		}
+		w.deliver(ctx, events)
+	}
+}
+
+func (w *Webhook) deliver(ctx context.Context, events []Event) {
+	body, err := json.Marshal(&Envelope{Events: events})
+	if err != nil {
+		logging.FromContext(ctx).Error("notifications: failed to encode events", "endpoint", w.Name, "error", err)
+		return
+	}
+	backoff := time.Duration(w.Backoff)
+	for attempt := 0; ; attempt++ {
+		err := w.send(ctx, body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.MaxRetries {
+			w.mu.Lock()
+			w.dropped += len(events)
+			w.mu.Unlock()
+			logging.FromContext(ctx).Error("notifications: gave up delivering events", "endpoint", w.Name, "events", len(events), "error", err)
+			return
+		}
+		if ctx.Err() != nil {
+			w.requeue(events)
+			return
+		}
+		logging.FromContext(ctx).Warn("notifications: failed to deliver events", "endpoint", w.Name, "attempt", attempt+1, "error", err)
+		select {
+		case <-ctx.Done():
+			w.requeue(events)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// requeue puts back events which are interrupted by the cancellation,
+// so that Flush can deliver them on shutdown.
+func (w *Webhook) requeue(events []Event) {
+	for _, e := range events {
+		w.Write(e)
+	}
+}
+
+func (w *Webhook) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", EventsMediaType)
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns HMAC-SHA256 signature of the body in the form of "sha256=<hex>".
+// Receivers can verify the body by comparing it with SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
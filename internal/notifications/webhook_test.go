@@ -0,0 +1,93 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/duration"
+)
+
+func TestWebhook(t *testing.T) {
+	const secret = "secret"
+	var (
+		mu       sync.Mutex
+		attempts int
+		received []Event
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := r.Header.Get(SignatureHeader), Sign(secret, body); got != want {
+			t.Errorf("signature: want %q, but got %q", want, got)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("unexpected authorization header: %q", got)
+		}
+		var env Envelope
+		if err := json.Unmarshal(body, &env); err != nil {
+			t.Error(err)
+		}
+		received = append(received, env.Events...)
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(Endpoint{
+		Name:    "test",
+		URL:     srv.URL,
+		Secret:  secret,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Backoff: duration.Duration(time.Millisecond),
+	})
+	w.Write(Event{ID: "1", Action: ActionPush, Target: Target{Repository: "a"}})
+	w.Write(Event{ID: "2", Action: ActionDelete, Target: Target{Repository: "a"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w.Flush(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 2 {
+		t.Errorf("want 2 attempts, but got %d", attempts)
+	}
+	if len(received) != 2 || received[0].ID != "1" || received[1].ID != "2" {
+		t.Errorf("unexpected events: %+v", received)
+	}
+}
+
+func TestWebhook_Drop(t *testing.T) {
+	w := NewWebhook(Endpoint{Name: "test", URL: "http://127.0.0.1:0", QueueSize: 1})
+	w.Write(Event{ID: "1"})
+	w.Write(Event{ID: "2"})
+	if got := w.Dropped(); got != 1 {
+		t.Errorf("want 1 dropped event, but got %d", got)
+	}
+}
+
+func TestTarget_IsManifest(t *testing.T) {
+	cases := []struct {
+		target Target
+		want   bool
+	}{
+		{Target{URL: "/v2/a/manifests/latest"}, true},
+		{Target{MediaType: "application/vnd.oci.image.manifest.v1+json"}, true},
+		{Target{URL: "/v2/a/blobs/sha256:abc"}, false},
+	}
+	for _, c := range cases {
+		if got := c.target.IsManifest(); got != c.want {
+			t.Errorf("%+v: want %v, but got %v", c.target, c.want, got)
+		}
+	}
+}
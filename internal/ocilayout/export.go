@@ -0,0 +1,145 @@
+package ocilayout
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Image is the image in the repository, which is referred to by a tag or a digest.
+type Image struct {
+	Repository string
+	Reference  string
+}
+
+// String returns the image such as "team-a/app:v1" or "team-a/app@sha256:...".
+func (i Image) String() string {
+	if _, err := digest.Parse(i.Reference); err == nil {
+		return i.Repository + "@" + i.Reference
+	}
+	return i.Repository + ":" + i.Reference
+}
+
+// ParseImage parses the image such as "team-a/app:v1" or "team-a/app@sha256:...".
+// The reference is empty if it is not specified. A port of the domain such as
+// "localhost:5080/app" is not a tag.
+func ParseImage(s string) Image {
+	if i := strings.Index(s, "@"); i >= 0 {
+		return Image{Repository: s[:i], Reference: s[i+1:]}
+	}
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		return Image{Repository: s[:i], Reference: s[i+1:]}
+	}
+	return Image{Repository: s}
+}
+
+// Exporter writes images of the storage as a layout.
+type Exporter struct {
+	local *storage.Local
+	index ocispec.Index
+	blobs []storage.Content
+}
+
+// NewExporter resolves images and every content which they need: manifests of
+// indexes, configs, layers and referrers. It returns the error before anything
+// is written if any of them is missing, so that the caller can report it.
+func NewExporter(local *storage.Local, images []Image) (*Exporter, error) {
+	e := &Exporter{
+		local: local,
+		index: ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Manifests: []ocispec.Descriptor{},
+		},
+	}
+	seen := make(map[string]bool)
+	for _, img := range images {
+		raw, dgst, err := local.FindRawManifestByImage(img.Repository, img.Reference)
+		if err != nil {
+			return nil, err
+		}
+		_, contents, err := local.ManifestContents(img.Repository, dgst)
+		if err != nil {
+			return nil, err
+		}
+		desc := ocispec.Descriptor{
+			MediaType: mediaTypeOf(raw),
+			Digest:    digest.Digest(dgst),
+			Size:      int64(len(raw)),
+		}
+		if _, err := digest.Parse(img.Reference); err != nil {
+			desc.Annotations = map[string]string{
+				ocispec.AnnotationRefName: img.Reference,
+				annotationImageName:       img.String(),
+			}
+		}
+		e.index.Manifests = append(e.index.Manifests, desc)
+		for _, c := range contents {
+			if seen[c.Digest] {
+				continue
+			}
+			seen[c.Digest] = true
+			e.blobs = append(e.blobs, c)
+		}
+	}
+	return e, nil
+}
+
+// mediaTypeOf returns the media type of the manifest, which is the same as the
+// Content-Type of the manifest on the registry API.
+func mediaTypeOf(raw []byte) string {
+	var m registry.Manifest
+	if err := json.Unmarshal(raw, &m); err == nil && m.MediaType != "" {
+		return m.MediaType
+	}
+	return registry.PredictDockerContentType("manifest.json")
+}
+
+// Index returns the index of the layout.
+func (e *Exporter) Index() *ocispec.Index {
+	return &e.index
+}
+
+// Size returns the total size of blobs.
+func (e *Exporter) Size() int64 {
+	var n int64
+	for _, b := range e.blobs {
+		n += b.Size
+	}
+	return n
+}
+
+// Export writes the layout to w. It does not close w.
+func (e *Exporter) Export(w Writer) error {
+	layout, err := json.Marshal(&ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := w.WriteFile(ocispec.ImageLayoutFile, int64(len(layout)), bytes.NewReader(layout)); err != nil {
+		return err
+	}
+	for _, b := range e.blobs {
+		if err := e.writeBlob(w, b); err != nil {
+			return err
+		}
+	}
+	index, err := json.Marshal(&e.index)
+	if err != nil {
+		return err
+	}
+	return w.WriteFile(IndexFile, int64(len(index)), bytes.NewReader(index))
+}
+
+func (e *Exporter) writeBlob(w Writer, b storage.Content) error {
+	f, err := e.local.FindBlobByImage(b.Repository, b.Digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.WriteFile(blobPath(digest.Digest(b.Digest)), b.Size, f)
+}
@@ -0,0 +1,154 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestExporter(t *testing.T) {
+	l := &storage.Local{Root: t.TempDir()}
+	layer := digest.FromString("layer")
+	if _, err := l.PutBlobByDigest("team/app", layer.String(), strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"digest":"` + layer.String() + `"}]}`
+	if _, _, err := l.CreateManifest(strings.NewReader(manifest), "team/app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	_, signature, err := l.PutManifest(strings.NewReader(`{"schemaVersion":2,"subject":{"digest":"`+digest.FromString(manifest).String()+`"}}`), "team/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same blob in another repository is written once.
+	if _, err := l.PutBlobByDigest("other", layer.String(), strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.CreateManifest(strings.NewReader(manifest), "other", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewExporter(l, []Image{
+		{Repository: "team/app", Reference: "v1"},
+		{Repository: "other", Reference: digest.FromString(manifest).String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := NewTarWriter(&buf)
+	if err := e.Export(tw); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// oci-layout is first and index.json is last in the archive.
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+	if len(names) != 5 || names[0] != ocispec.ImageLayoutFile || names[4] != IndexFile {
+		t.Errorf("unexpected files: %v", names)
+	}
+	dir := t.TempDir()
+	dw, err := NewDirWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(&buf, dw); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dgst := range []string{layer.String(), digest.FromString(manifest).String(), signature} {
+		d := digest.Digest(dgst)
+		b, err := ioutil.ReadFile(filepath.Join(dir, "blobs", "sha256", d.Hex()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest.FromBytes(b) != d {
+			t.Errorf("%s: unexpected content %q", dgst, b)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("unexpected index: %s", b)
+	}
+	desc := index.Manifests[0]
+	if desc.MediaType != ocispec.MediaTypeImageManifest ||
+		desc.Size != int64(len(manifest)) ||
+		desc.Annotations[ocispec.AnnotationRefName] != "v1" ||
+		desc.Annotations[annotationImageName] != "team/app:v1" {
+		t.Errorf("unexpected descriptor: %+v", desc)
+	}
+	if len(index.Manifests[1].Annotations) != 0 {
+		t.Errorf("the image of the digest has no name: %+v", index.Manifests[1])
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := NewExporter(l, []Image{{Repository: "team/app", Reference: "unknown"}}); err == nil {
+		t.Error("want error for the unknown tag")
+	}
+}
+
+func TestValidName(t *testing.T) {
+	cases := map[string]bool{
+		"oci-layout": true,
+		"index.json": true,
+		"blobs/sha256/" + digest.FromString("a").Hex(): true,
+		"blobs/sha256/../../etc/passwd":                false,
+		"../index.json":                                false,
+		"blobs/sha256":                                 false,
+	}
+	for name, want := range cases {
+		if got := validName(name); got != want {
+			t.Errorf("%q: want %v, but got %v", name, want, got)
+		}
+	}
+}
+
+func TestParseImage(t *testing.T) {
+	cases := []struct {
+		image string
+		want  Image
+	}{
+		{"app", Image{Repository: "app"}},
+		{"team/app:v1", Image{Repository: "team/app", Reference: "v1"}},
+		{"team/app@sha256:abc", Image{Repository: "team/app", Reference: "sha256:abc"}},
+		{"localhost:5080/app", Image{Repository: "localhost:5080/app"}},
+		{"localhost:5080/app:v1", Image{Repository: "localhost:5080/app", Reference: "v1"}},
+	}
+	for _, c := range cases {
+		if got := ParseImage(c.image); got != c.want {
+			t.Errorf("%s: want %+v, but got %+v", c.image, c.want, got)
+		}
+	}
+}
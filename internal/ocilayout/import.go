@@ -0,0 +1,663 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/grammar"
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerManifestFile is the file of "docker save" archives which lists images.
+const dockerManifestFile = "manifest.json"
+
+var (
+	namePattern = regexp.MustCompile(`^` + grammar.Name + `$`)
+	tagPattern  = regexp.MustCompile(`^` + grammar.Tag + `$`)
+)
+
+// manifestMediaTypes are media types of manifests which may refer to other contents.
+var manifestMediaTypes = map[string]bool{
+	ocispec.MediaTypeImageManifest:                              true,
+	ocispec.MediaTypeImageIndex:                                 true,
+	"application/vnd.docker.distribution.manifest.v2+json":      true,
+	"application/vnd.docker.distribution.manifest.list.v2+json": true,
+}
+
+// ImportedImage is the image which is imported.
+type ImportedImage struct {
+	Repository string   `json:"repository"`
+	Digest     string   `json:"digest"`
+	Size       int64    `json:"size"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// ImportResult is the result of Import.
+type ImportResult struct {
+	Images []ImportedImage `json:"images"`
+	// Contents are contents which did not exist in repositories and are put,
+	// in the order that contents are put before manifests which refer to them.
+	Contents []storage.Content `json:"contents"`
+}
+
+// Importer puts images of OCI image layouts and archives of "docker save" into
+// the storage, in the same way as they are pushed.
+type Importer struct {
+	local *storage.Local
+
+	// Repository is the repository which every image is imported into. If it
+	// is empty, images are imported into repositories of their names.
+	Repository string
+	// Check is called before every content is put, such as to check quotas.
+	Check func(name, dgst string, size int64) error
+}
+
+// NewImporter creates an Importer.
+func NewImporter(local *storage.Local) *Importer {
+	return &Importer{local: local}
+}
+
+func invalid(err error) error {
+	return errors.Wrap(err,
+		errors.WithCodeManifestInvalid(),
+		errors.WithDetail(map[string]interface{}{"reason": err.Error()}),
+	)
+}
+
+// Import reads the tar archive which may be compressed by gzip, and imports
+// images in it. The archive is extracted into a temporary directory first,
+// because index.json and manifest.json may be anywhere in the archive.
+func (im *Importer) Import(r io.Reader) (*ImportResult, error) {
+	dir, err := ioutil.TempDir("", "registry-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := extractAll(r, dir); err != nil {
+		return nil, invalid(err)
+	}
+	run := &importRun{
+		Importer: im,
+		dir:      dir,
+		result:   &ImportResult{Images: []ImportedImage{}, Contents: []storage.Content{}},
+		put:      make(map[string]bool),
+	}
+	switch {
+	case exists(filepath.Join(dir, ocispec.ImageLayoutFile)) && exists(filepath.Join(dir, IndexFile)):
+		err = run.importLayout()
+	case exists(filepath.Join(dir, dockerManifestFile)):
+		err = run.importDockerArchive()
+	default:
+		err = invalid(fmt.Errorf("the archive is neither an OCI image layout nor an archive of docker save"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return run.result, nil
+}
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// cleanPath returns the path in the archive, which never goes out of the root.
+func cleanPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// extractAll extracts regular files of the archive into dir. Links are replaced
+// with hard links to their targets, and other files such as devices are skipped.
+func extractAll(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	r = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	links := make(map[string]string) // name to target
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(filename, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeFile(filename, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if path.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("absolute link %q in the archive", hdr.Name)
+			}
+			links[name] = cleanPath(path.Join(path.Dir(name), hdr.Linkname))
+		case tar.TypeLink:
+			links[name] = cleanPath(hdr.Linkname)
+		}
+	}
+	// links may point to other links, so they are resolved until nothing changes.
+	for len(links) > 0 {
+		resolved := 0
+		for name, target := range links {
+			if _, ok := links[target]; ok {
+				continue
+			}
+			filename := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(dir, filepath.FromSlash(target)), filename); err != nil {
+				return err
+			}
+			delete(links, name)
+			resolved++
+		}
+		if resolved == 0 {
+			return fmt.Errorf("links in the archive are circular")
+		}
+	}
+	return nil
+}
+
+func writeFile(filename string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importRun is an execution of Import.
+type importRun struct {
+	*Importer
+	dir    string
+	result *ImportResult
+	put    map[string]bool // keyed by repository and digest such as "app@sha256:..."
+}
+
+// file returns the path of the file in the archive.
+func (r *importRun) file(name string) string {
+	return filepath.Join(r.dir, filepath.FromSlash(cleanPath(name)))
+}
+
+// imageOf returns the image which the name is imported as. The reference is
+// the tag, or empty if the image has no tag.
+func (r *importRun) imageOf(name string) (Image, error) {
+	img := ParseImage(name)
+	if r.Repository != "" {
+		img.Repository = r.Repository
+	}
+	if _, err := digest.Parse(img.Reference); err == nil {
+		img.Reference = ""
+	}
+	if img.Repository == "" {
+		err := fmt.Errorf("the image has no name, so the repository must be specified")
+		return img, errors.Wrap(err,
+			errors.WithCodeNameInvalid(),
+			errors.WithDetail(map[string]interface{}{"reason": err.Error()}),
+		)
+	}
+	if !namePattern.MatchString(img.Repository) {
+		return img, errors.Wrap(fmt.Errorf("invalid repository %q", img.Repository),
+			errors.WithCodeNameInvalid(),
+			errors.WithDetail(map[string]interface{}{"name": name}),
+		)
+	}
+	if img.Reference != "" && !tagPattern.MatchString(img.Reference) {
+		return img, errors.Wrap(fmt.Errorf("invalid tag %q", img.Reference),
+			errors.WithCodeTagInvalid(),
+			errors.WithDetail(map[string]interface{}{"name": name}),
+		)
+	}
+	return img, nil
+}
+
+// addImage adds the image to the result, merging tags of the same manifest.
+func (r *importRun) addImage(img Image, dgst string, size int64) {
+	for i, imported := range r.result.Images {
+		if imported.Repository == img.Repository && imported.Digest == dgst {
+			if img.Reference != "" {
+				r.result.Images[i].Tags = append(imported.Tags, img.Reference)
+			}
+			return
+		}
+	}
+	imported := ImportedImage{Repository: img.Repository, Digest: dgst, Size: size}
+	if img.Reference != "" {
+		imported.Tags = []string{img.Reference}
+	}
+	r.result.Images = append(r.result.Images, imported)
+}
+
+// check calls Check unless the content already exists in the repository.
+func (r *importRun) check(name, dgst string, size int64) (bool, error) {
+	if _, err := r.local.CheckBlobByReference(name, dgst); err == nil {
+		return false, nil
+	}
+	if r.Check != nil {
+		if err := r.Check(name, dgst, size); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// putBlob puts the file as the blob of the descriptor. The digest is verified by the storage.
+func (r *importRun) putBlob(name, filename string, desc ocispec.Descriptor) error {
+	key := name + "@" + desc.Digest.String()
+	if r.put[key] {
+		return nil
+	}
+	r.put[key] = true
+	missing, err := r.check(name, desc.Digest.String(), desc.Size)
+	if err != nil || !missing {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrap(err,
+				errors.WithCodeManifestBlobUnknown(),
+				errors.WithDetail(map[string]interface{}{"digest": desc.Digest}),
+			)
+		}
+		return err
+	}
+	defer f.Close()
+	size, err := r.local.PutBlobByDigest(name, desc.Digest.String(), f)
+	if err != nil {
+		return err
+	}
+	if size != desc.Size {
+		return errors.Wrap(fmt.Errorf("size of %q is %d, but the descriptor has %d", desc.Digest, size, desc.Size),
+			errors.WithCodeSizeInvalid(),
+			errors.WithDetail(map[string]interface{}{"digest": desc.Digest, "size": size}),
+		)
+	}
+	r.result.Contents = append(r.result.Contents, storage.Content{
+		Repository: name,
+		Digest:     desc.Digest.String(),
+		Size:       size,
+	})
+	return nil
+}
+
+// putManifest puts the manifest, and tags it by the tag if it is not empty.
+func (r *importRun) putManifest(name, tag string, raw []byte) (string, error) {
+	dgst := digest.FromBytes(raw).String()
+	key := name + "@" + dgst
+	missing := false
+	if !r.put[key] {
+		var err error
+		if missing, err = r.check(name, dgst, int64(len(raw))); err != nil {
+			return "", err
+		}
+		r.put[key] = true
+	}
+	var err error
+	switch {
+	case tag != "":
+		_, _, err = r.local.CreateManifest(bytes.NewReader(raw), name, tag)
+	case missing:
+		_, _, err = r.local.PutManifest(bytes.NewReader(raw), name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if missing {
+		r.result.Contents = append(r.result.Contents, storage.Content{
+			Repository: name,
+			Digest:     dgst,
+			Size:       int64(len(raw)),
+			Manifest:   true,
+		})
+	}
+	return dgst, nil
+}
+
+// importLayout imports images in index.json of the OCI image layout.
+func (r *importRun) importLayout() error {
+	b, err := ioutil.ReadFile(r.file(IndexFile))
+	if err != nil {
+		return err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return invalid(fmt.Errorf("%s: %w", IndexFile, err))
+	}
+	manifests := make(map[string][]string) // digests of manifests to repositories
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[annotationImageName]
+		if name == "" {
+			// the reference name is a tag usually, but some tools write the full name.
+			name = desc.Annotations[ocispec.AnnotationRefName]
+			if img := ParseImage(name); img.Reference == "" {
+				name = ":" + name
+			}
+			if name == ":" {
+				name = "@" + desc.Digest.String()
+			}
+		}
+		img, err := r.imageOf(name)
+		if err != nil {
+			return err
+		}
+		if err := r.putTree(img.Repository, desc, manifests); err != nil {
+			return err
+		}
+		if img.Reference != "" {
+			raw, err := r.readManifest(desc)
+			if err != nil {
+				return err
+			}
+			if _, err := r.putManifest(img.Repository, img.Reference, raw); err != nil {
+				return err
+			}
+		}
+		r.addImage(img, desc.Digest.String(), desc.Size)
+	}
+	return r.importReferrers(manifests)
+}
+
+// readManifest reads the manifest of the descriptor and verifies it.
+func (r *importRun) readManifest(desc ocispec.Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.Wrap(err, errors.WithCodeDigestInvalid())
+	}
+	raw, err := ioutil.ReadFile(r.file(blobPath(desc.Digest)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(err,
+				errors.WithCodeManifestBlobUnknown(),
+				errors.WithDetail(map[string]interface{}{"digest": desc.Digest}),
+			)
+		}
+		return nil, err
+	}
+	if digest.FromBytes(raw) != desc.Digest || int64(len(raw)) != desc.Size {
+		return nil, errors.Wrap(fmt.Errorf("manifest %q does not match the descriptor", desc.Digest),
+			errors.WithCodeManifestUnverified(),
+			errors.WithDetail(map[string]interface{}{"digest": desc.Digest}),
+		)
+	}
+	return raw, nil
+}
+
+// putTree puts the content of the descriptor into the repository. Contents
+// which the manifest refers to are put before the manifest. Put manifests are
+// recorded to manifests to find referrers.
+func (r *importRun) putTree(name string, desc ocispec.Descriptor, manifests map[string][]string) error {
+	if !manifestMediaTypes[desc.MediaType] {
+		if err := desc.Digest.Validate(); err != nil {
+			return errors.Wrap(err, errors.WithCodeDigestInvalid())
+		}
+		return r.putBlob(name, r.file(blobPath(desc.Digest)), desc)
+	}
+	raw, err := r.readManifest(desc)
+	if err != nil {
+		return err
+	}
+	var m struct {
+		Config    *ocispec.Descriptor  `json:"config"`
+		Layers    []ocispec.Descriptor `json:"layers"`
+		Manifests []ocispec.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return invalid(fmt.Errorf("%s: %w", desc.Digest, err))
+	}
+	children := m.Layers
+	if m.Config != nil && m.Config.Digest != "" {
+		children = append([]ocispec.Descriptor{*m.Config}, children...)
+	}
+	children = append(children, m.Manifests...)
+	for _, child := range children {
+		if err := r.putTree(name, child, manifests); err != nil {
+			return err
+		}
+	}
+	if _, err := r.putManifest(name, "", raw); err != nil {
+		return err
+	}
+	manifests[desc.Digest.String()] = append(manifests[desc.Digest.String()], name)
+	return nil
+}
+
+// importReferrers imports manifests in the layout whose subjects are imported,
+// such as signatures, which are not listed in index.json.
+func (r *importRun) importReferrers(manifests map[string][]string) error {
+	type referrer struct {
+		desc    ocispec.Descriptor
+		subject string
+	}
+	var referrers []referrer
+	err := filepath.Walk(filepath.Join(r.dir, "blobs"), func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || fi.Size() > storage.DefaultMaxManifestSize {
+			return err
+		}
+		raw, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var m struct {
+			MediaType string              `json:"mediaType"`
+			Subject   *ocispec.Descriptor `json:"subject"`
+		}
+		if json.Unmarshal(raw, &m) != nil || m.Subject == nil {
+			return nil
+		}
+		if m.MediaType == "" {
+			m.MediaType = ocispec.MediaTypeImageManifest
+		}
+		referrers = append(referrers, referrer{
+			desc: ocispec.Descriptor{
+				MediaType: m.MediaType,
+				Digest:    digest.FromBytes(raw),
+				Size:      int64(len(raw)),
+			},
+			subject: m.Subject.Digest.String(),
+		})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sort.Slice(referrers, func(i, j int) bool { return referrers[i].desc.Digest < referrers[j].desc.Digest })
+	// referrers of referrers are imported by the next pass.
+	for imported := true; imported; {
+		imported = false
+		for _, ref := range referrers {
+			for _, name := range manifests[ref.subject] {
+				if r.put[name+"@"+ref.desc.Digest.String()] {
+					continue
+				}
+				if err := r.putTree(name, ref.desc, manifests); err != nil {
+					return err
+				}
+				imported = true
+			}
+		}
+	}
+	return nil
+}
+
+// dockerImage is an image in manifest.json of "docker save" archives.
+type dockerImage struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// importDockerArchive converts images of the "docker save" archive into OCI
+// image manifests, and imports them. Layers are imported as they are, so that
+// their digests match diff IDs of the config if they are not compressed.
+func (r *importRun) importDockerArchive() error {
+	b, err := ioutil.ReadFile(r.file(dockerManifestFile))
+	if err != nil {
+		return err
+	}
+	var images []dockerImage
+	if err := json.Unmarshal(b, &images); err != nil {
+		return invalid(fmt.Errorf("%s: %w", dockerManifestFile, err))
+	}
+	for _, image := range images {
+		names := image.RepoTags
+		if len(names) == 0 {
+			names = []string{""}
+		}
+		var imgs []Image
+		for _, name := range names {
+			img, err := r.imageOf(name)
+			if err != nil {
+				return err
+			}
+			imgs = append(imgs, img)
+		}
+		raw, err := r.convertDockerImage(imgs, image)
+		if err != nil {
+			return err
+		}
+		for _, img := range imgs {
+			dgst, err := r.putManifest(img.Repository, img.Reference, raw)
+			if err != nil {
+				return err
+			}
+			r.addImage(img, dgst, int64(len(raw)))
+		}
+	}
+	return nil
+}
+
+// convertDockerImage puts the config and layers of the image into repositories
+// of images, and returns the manifest of them.
+func (r *importRun) convertDockerImage(imgs []Image, image dockerImage) ([]byte, error) {
+	config, err := ioutil.ReadFile(r.file(image.Config))
+	if err != nil {
+		return nil, invalid(fmt.Errorf("config of the image: %w", err))
+	}
+	var c struct {
+		RootFS struct {
+			DiffIDs []digest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil, invalid(fmt.Errorf("%s: %w", image.Config, err))
+	}
+	if len(c.RootFS.DiffIDs) != len(image.Layers) {
+		return nil, invalid(fmt.Errorf("%s: the config has %d diff IDs, but the image has %d layers",
+			image.Config, len(c.RootFS.DiffIDs), len(image.Layers)))
+	}
+	m := &registry.Manifest{
+		SchemaVersion: 2,
+		MediaType:     ocispec.MediaTypeImageManifest,
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []ocispec.Descriptor{},
+	}
+	for i, layer := range image.Layers {
+		desc, diffID, err := describeLayer(r.file(layer))
+		if err != nil {
+			return nil, invalid(fmt.Errorf("%s: %w", layer, err))
+		}
+		if diffID != c.RootFS.DiffIDs[i] {
+			return nil, errors.Wrap(fmt.Errorf("%s: the diff ID is %s, but the config has %s", layer, diffID, c.RootFS.DiffIDs[i]),
+				errors.WithCodeDigestInvalid(),
+				errors.WithDetail(map[string]interface{}{"layer": layer, "diffID": diffID}),
+			)
+		}
+		m.Layers = append(m.Layers, desc)
+	}
+	for _, img := range imgs {
+		if err := r.putBlob(img.Repository, r.file(image.Config), m.Config); err != nil {
+			return nil, err
+		}
+		for i, layer := range image.Layers {
+			if err := r.putBlob(img.Repository, r.file(layer), m.Layers[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(m)
+}
+
+// describeLayer returns the descriptor of the layer file, and its diff ID which
+// is the digest of the uncompressed content.
+func describeLayer(filename string) (ocispec.Descriptor, digest.Digest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(2)
+	compressed := bytes.Equal(magic, []byte{0x1f, 0x8b})
+	digester := sha256.New()
+	size, err := io.Copy(digester, br)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.NewDigest(digest.SHA256, digester),
+		Size:      size,
+	}
+	if !compressed {
+		return desc, desc.Digest, nil
+	}
+	desc.MediaType = ocispec.MediaTypeImageLayerGzip
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	defer gz.Close()
+	digester.Reset()
+	if _, err := io.Copy(digester, gz); err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	return desc, digest.NewDigest(digest.SHA256, digester), nil
+}
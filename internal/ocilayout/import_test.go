@@ -0,0 +1,249 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestImporter_Layout(t *testing.T) {
+	src := &storage.Local{Root: t.TempDir()}
+	layer := digest.FromString("layer")
+	if _, err := src.PutBlobByDigest("team/app", layer.String(), strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":"` + layer.String() + `","size":5}]}`
+	_, image, err := src.PutManifest(strings.NewReader(manifest), "team/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + image + `","size":` + fmt.Sprint(len(manifest)) + `}]}`
+	if _, _, err := src.CreateManifest(strings.NewReader(index), "team/app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	_, signature, err := src.PutManifest(strings.NewReader(`{"schemaVersion":2,"subject":{"digest":"`+image+`"}}`), "team/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewExporter(src, []Image{{Repository: "team/app", Reference: "v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := NewTarWriter(&buf)
+	if err := e.Export(tw); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	dst := &storage.Local{Root: t.TempDir()}
+	result, err := NewImporter(dst).Import(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportedImage{{Repository: "team/app", Digest: digest.FromString(index).String(), Size: int64(len(index)), Tags: []string{"v1"}}}
+	if !reflect.DeepEqual(want, result.Images) {
+		t.Errorf("want %+v, but got %+v", want, result.Images)
+	}
+	// the layer, the image, the index and the signature.
+	if len(result.Contents) != 4 || result.Contents[0].Digest != layer.String() || !result.Contents[3].Manifest {
+		t.Errorf("unexpected contents: %+v", result.Contents)
+	}
+	for _, dgst := range []string{layer.String(), image, signature} {
+		if _, err := dst.CheckBlobByReference("team/app", dgst); err != nil {
+			t.Errorf("%s is not imported: %v", dgst, err)
+		}
+	}
+	if _, dgst, err := dst.FindRawManifestByImage("team/app", "v1"); err != nil || dgst != want[0].Digest {
+		t.Errorf("unexpected tag: %s, %v", dgst, err)
+	}
+
+	// the repository can be overridden, and existing contents are not put again.
+	importer := NewImporter(dst)
+	importer.Repository = "vendor/app"
+	importer.Check = func(name, dgst string, size int64) error {
+		if name != "vendor/app" {
+			t.Errorf("unexpected repository: %s", name)
+		}
+		return nil
+	}
+	if _, err := importer.Import(bytes.NewReader(archive)); err != nil {
+		t.Fatal(err)
+	}
+	result, err = NewImporter(dst).Import(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Contents) != 0 {
+		t.Errorf("unexpected contents: %+v", result.Contents)
+	}
+	if _, err := dst.StatTag("vendor/app", "v1"); err != nil {
+		t.Error(err)
+	}
+
+	importer = NewImporter(&storage.Local{Root: t.TempDir()})
+	importer.Check = func(name, dgst string, size int64) error {
+		return fmt.Errorf("denied")
+	}
+	if _, err := importer.Import(bytes.NewReader(archive)); err == nil {
+		t.Error("want the error of Check")
+	}
+}
+
+type tarEntry struct {
+	name, link string
+	body       []byte
+}
+
+func writeTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: e.name, Size: int64(len(e.body)), Mode: 0644}
+		if e.link != "" {
+			hdr = &tar.Header{Typeflag: tar.TypeSymlink, Name: e.name, Linkname: e.link, Mode: 0777}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImporter_DockerArchive(t *testing.T) {
+	layer := writeTar(t, []tarEntry{{name: "etc/hello", body: []byte("hello")}})
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(writeTar(t, []tarEntry{{name: "etc/world", body: []byte("world")}}))
+	gw.Close()
+	diffIDs := []digest.Digest{digest.FromBytes(layer), digest.FromBytes(layer), digest.FromBytes(writeTar(t, []tarEntry{{name: "etc/world", body: []byte("world")}}))}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configName := digest.FromBytes(config).Hex() + ".json"
+	manifest := func(tags ...string) []byte {
+		b, err := json.Marshal([]map[string]interface{}{{
+			"Config":   configName,
+			"RepoTags": tags,
+			"Layers":   []string{"a/layer.tar", "b/layer.tar", "c/layer.tar"},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	archive := func(manifest []byte) []byte {
+		return writeTar(t, []tarEntry{
+			{name: "manifest.json", body: manifest},
+			{name: configName, body: config},
+			{name: "a/layer.tar", body: layer},
+			// "docker save" links the same layers.
+			{name: "b/layer.tar", link: "../a/layer.tar"},
+			{name: "c/layer.tar", body: gzipped.Bytes()},
+		})
+	}
+
+	l := &storage.Local{Root: t.TempDir()}
+	result, err := NewImporter(l).Import(bytes.NewReader(archive(manifest("team/app:v1", "team/app:latest"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 1 || !reflect.DeepEqual(result.Images[0].Tags, []string{"v1", "latest"}) {
+		t.Fatalf("unexpected images: %+v", result.Images)
+	}
+	m, err := l.FindManifestByImage("team/app", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &registry.Manifest{
+		SchemaVersion: 2,
+		MediaType:     ocispec.MediaTypeImageManifest,
+		Config:        ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))},
+			{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))},
+			{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromBytes(gzipped.Bytes()), Size: int64(gzipped.Len())},
+		},
+	}
+	if !reflect.DeepEqual(want, m) {
+		t.Errorf("want %+v, but got %+v", want, m)
+	}
+	for _, desc := range append(m.Layers, m.Config) {
+		if _, err := l.CheckBlobByReference("team/app", desc.Digest.String()); err != nil {
+			t.Errorf("%s is not imported: %v", desc.Digest, err)
+		}
+	}
+
+	if _, err := NewImporter(l).Import(bytes.NewReader(archive(manifest()))); err == nil {
+		t.Error("want error for the image without the name and the repository")
+	}
+	importer := NewImporter(l)
+	importer.Repository = "vendor/app"
+	result, err = importer.Import(bytes.NewReader(archive(manifest())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 1 || result.Images[0].Repository != "vendor/app" || len(result.Images[0].Tags) != 0 {
+		t.Errorf("unexpected images: %+v", result.Images)
+	}
+
+	diffIDs[0] = digest.FromString("tampered")
+	config, _ = json.Marshal(map[string]interface{}{"rootfs": map[string]interface{}{"diff_ids": diffIDs}})
+	configName = digest.FromBytes(config).Hex() + ".json"
+	if _, err := NewImporter(l).Import(bytes.NewReader(archive(manifest("team/app:tampered")))); err == nil {
+		t.Error("want error for the layer which does not match the diff ID")
+	}
+	if _, err := l.StatTag("team/app", "tampered"); err == nil {
+		t.Error("the tampered image is imported")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	archive := writeTar(t, []tarEntry{
+		{name: "../../escaped", body: []byte("a")},
+		{name: "./link", link: "../../../escaped"},
+	})
+	if err := extractAll(bytes.NewReader(archive), dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"escaped", "link"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped")); err == nil {
+		t.Error("the file is extracted out of the directory")
+	}
+	circular := writeTar(t, []tarEntry{{name: "a", link: "b"}, {name: "b", link: "a"}})
+	if err := extractAll(bytes.NewReader(circular), t.TempDir()); err == nil {
+		t.Error("want error for circular links")
+	}
+}
@@ -0,0 +1,175 @@
+// Package ocilayout exports images of the storage as OCI image layouts, which
+// are directories or tar archives to move images without the registry, and
+// imports images of them and archives of "docker save".
+//
+// see: https://github.com/opencontainers/image-spec/blob/v1.0.1/image-layout.md
+package ocilayout
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexFile is the name of the file which has the index of the layout.
+const IndexFile = "index.json"
+
+// annotationImageName is the annotation of the full name of the image such as
+// "team-a/app:v1", which is understood by containerd as well.
+const annotationImageName = "io.containerd.image.name"
+
+// blobPath returns the path of the blob in the layout.
+func blobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// Writer writes files of the layout. Names are slash separated paths such as
+// "blobs/sha256/<hex>", and files are written in the order that oci-layout is
+// first and index.json is last.
+type Writer interface {
+	WriteFile(name string, size int64, r io.Reader) error
+	Close() error
+}
+
+// validName reports whether the name is a file of the layout, so that
+// archives can never write files out of the directory.
+func validName(name string) bool {
+	if name == ocispec.ImageLayoutFile || name == IndexFile {
+		return true
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] != "blobs" {
+		return false
+	}
+	_, err := digest.Parse(parts[1] + ":" + parts[2])
+	return err == nil
+}
+
+type dirWriter struct {
+	dir string
+}
+
+// NewDirWriter returns the writer which writes files into the directory.
+// Existing files are overwritten.
+func NewDirWriter(dir string) (Writer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirWriter{dir: dir}, nil
+}
+
+func (d *dirWriter) WriteFile(name string, size int64, r io.Reader) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid file of the layout: %q", name)
+	}
+	filename := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	// files are renamed after they are written completely, so that broken
+	// files are never left by interruptions.
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("%q: want %d bytes, but got %d bytes", name, size, n)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (d *dirWriter) Close() error { return nil }
+
+type tarWriter struct {
+	tw   *tar.Writer
+	dirs map[string]bool
+	now  time.Time
+}
+
+// NewTarWriter returns the writer which writes files as a tar archive to w.
+// Close must be called to finish the archive, but it does not close w.
+func NewTarWriter(w io.Writer) Writer {
+	return &tarWriter{
+		tw:   tar.NewWriter(w),
+		dirs: make(map[string]bool),
+		now:  time.Now(),
+	}
+}
+
+func (t *tarWriter) WriteFile(name string, size int64, r io.Reader) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid file of the layout: %q", name)
+	}
+	// some tools expect directories to be in archives.
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if t.dirs[dir] {
+			break
+		}
+		t.dirs[dir] = true
+		err := t.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir + "/",
+			Mode:     0755,
+			ModTime:  t.now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  t.now,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.tw, r)
+	return err
+}
+
+func (t *tarWriter) Close() error { return t.tw.Close() }
+
+// Extract writes files of the layout in the tar archive to w. Directories are
+// skipped, and other files which are not the layout are errors.
+func Extract(r io.Reader, w Writer) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return fmt.Errorf("unsupported file in the archive: %q", hdr.Name)
+		}
+		if err := w.WriteFile(path.Clean(strings.TrimPrefix(hdr.Name, "./")), hdr.Size, tr); err != nil {
+			return err
+		}
+	}
+}
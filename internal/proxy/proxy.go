@@ -0,0 +1,249 @@
+// Package proxy implements the pull-through cache for an upstream registry.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/client"
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultTTL is the default duration while tags fetched from the upstream are fresh.
+const DefaultTTL = 10 * time.Minute
+
+// manifestAccept is the media types which are accepted on fetching manifests.
+// Indexes are accepted so that upstreams serve multi-arch tags as they are.
+var manifestAccept = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+}
+
+// Blob is the content of a blob. *os.File satisfies this interface.
+type Blob interface {
+	io.ReadCloser
+	// Name returns the filename which is used to predict the content type.
+	Name() string
+}
+
+// Proxy serves content from the local storage, and fetches it from the
+// upstream registry if it is missing or the tag is stale.
+type Proxy struct {
+	Local  *storage.Local
+	Client *client.Client
+	// TTL is the duration while tags fetched from the upstream are
+	// served from the local storage without asking the upstream.
+	TTL time.Duration
+}
+
+// New creates a new Proxy for the upstream registry.
+func New(local *storage.Local, client *client.Client, ttl time.Duration) *Proxy {
+	return &Proxy{
+		Local:  local,
+		Client: client,
+		TTL:    ttl,
+	}
+}
+
+// FindRawManifestByImage finds manifest in the local storage. If it is missing or
+// the tag is older than TTL, the manifest is fetched from the upstream and stored.
+// It returns the json as it is and the digest of it.
+//
+// If the upstream is unavailable, a stale manifest in the local storage is served.
+func (p *Proxy) FindRawManifestByImage(ctx context.Context, name, ref string) ([]byte, string, error) {
+	if _, err := digest.Parse(ref); err == nil {
+		// content addressed manifests never change.
+		if raw, dgst, err := p.Local.WithContext(ctx).FindRawManifestByImage(name, ref); err == nil {
+			return raw, dgst, nil
+		}
+	} else if fi, err := p.Local.WithContext(ctx).StatTag(name, ref); err == nil && time.Since(fi.ModTime()) < p.TTL {
+		return p.Local.WithContext(ctx).FindRawManifestByImage(name, ref)
+	}
+
+	raw, dgst, err := p.fetchManifest(ctx, name, ref)
+	if err == nil {
+		return raw, dgst, nil
+	}
+	if raw, dgst, lerr := p.Local.WithContext(ctx).FindRawManifestByImage(name, ref); lerr == nil {
+		logging.FromContext(ctx).Warn("proxy: serving stale manifest",
+			"repository", name, "reference", ref, "error", err)
+		return raw, dgst, nil
+	}
+	return nil, "", err
+}
+
+func (p *Proxy) fetchManifest(ctx context.Context, name, ref string) ([]byte, string, error) {
+	resp, err := p.Client.Get(ctx, name, "manifests/"+ref, http.Header{
+		"Accept": manifestAccept,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, errors.WithCodeManifestUnknown()); err != nil {
+		return nil, "", err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := digest.Parse(ref); err == nil {
+		if got := digest.FromBytes(body).String(); got != ref {
+			err := fmt.Errorf("upstream manifest digest %q does not match %q", got, ref)
+			return nil, "", errors.Wrap(err,
+				errors.WithCodeDigestInvalid(),
+				errors.WithStatusCode(http.StatusBadGateway),
+			)
+		}
+		_, dgst, err := p.Local.WithContext(ctx).PutManifest(bytes.NewReader(body), name)
+		return body, dgst, err
+	}
+	_, dgst, err := p.Local.WithContext(ctx).CreateManifest(bytes.NewReader(body), name, ref)
+	return body, dgst, err
+}
+
+// FindBlobByImage finds blob in the local storage. If it is missing, the blob is
+// fetched from the upstream. The fetched content is written to the local storage
+// while the caller reads it, and stored once it is read until EOF and verified.
+func (p *Proxy) FindBlobByImage(ctx context.Context, name, dgst string) (Blob, error) {
+	f, err := p.Local.WithContext(ctx).FindBlobByImage(name, dgst)
+	if err == nil {
+		return f, nil
+	}
+
+	resp, err := p.Client.Get(ctx, name, "blobs/"+dgst, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp, errors.WithCodeBlobUnknown()); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	sessionID := p.Local.IssueSession()
+	pr, pw := io.Pipe()
+	b := &blob{
+		body:      resp.Body,
+		pw:        pw,
+		w:         &failSafeWriter{w: pw},
+		done:      make(chan error, 1),
+		local:     p.Local,
+		name:      name,
+		digest:    dgst,
+		sessionID: sessionID,
+		filename:  "layer.tar.gz",
+		logger:    logging.FromContext(ctx),
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		b.filename = "layer.json"
+	}
+	go func() {
+		_, err := p.Local.PutBlobByReference(sessionID, name, pr)
+		// unblock the writer if storing is failed in the middle.
+		pr.CloseWithError(err)
+		b.done <- err
+	}()
+	return b, nil
+}
+
+// checkResponse converts the error response from the upstream.
+func checkResponse(resp *http.Response, notFound errors.WrapOption) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errors.Wrap(fmt.Errorf("upstream responded %s", resp.Status), notFound)
+	}
+	return errors.Wrap(
+		fmt.Errorf("upstream responded %s", resp.Status),
+		errors.WithStatusCode(http.StatusBadGateway),
+	)
+}
+
+// blob is the content which is streamed from the upstream.
+type blob struct {
+	body io.ReadCloser
+	pw   *io.PipeWriter
+	w    *failSafeWriter
+	done chan error
+	eof  bool
+
+	local     *storage.Local
+	name      string
+	digest    string
+	sessionID string
+	filename  string
+	// logger is the logger of the request, because the blob is stored on Close.
+	logger *logging.Logger
+
+	closeOnce sync.Once
+}
+
+// Name implements Blob.
+func (b *blob) Name() string { return b.filename }
+
+func (b *blob) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 {
+		b.w.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// Close closes the upstream response. If the whole content has been read,
+// it is verified and stored in the local storage. Otherwise it is discarded.
+func (b *blob) Close() error {
+	b.closeOnce.Do(func() {
+		b.body.Close()
+		if !b.eof {
+			b.pw.CloseWithError(fmt.Errorf("proxy: aborted to read %s", b.digest))
+			<-b.done
+			b.local.CancelSession(b.sessionID, b.name)
+			return
+		}
+		b.pw.Close()
+		err := <-b.done
+		if err == nil && b.w.err == nil {
+			err = b.local.EnsurePutBlobBySession(b.sessionID, b.name, b.digest)
+		} else if err == nil {
+			err = b.w.err
+		}
+		if err != nil {
+			b.logger.Error("proxy: failed to store blob", "repository", b.name, "digest", b.digest, "error", err)
+			b.local.CancelSession(b.sessionID, b.name)
+		}
+	})
+	return nil
+}
+
+// failSafeWriter stops writing after the first error, so that
+// the client still receives the content if storing it is failed.
+type failSafeWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (f *failSafeWriter) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return len(p), nil
+	}
+	_, f.err = f.w.Write(p)
+	return len(p), nil
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/client"
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// upstream is the fake upstream registry which serves the contents by paths
+// such as "/v2/app/manifests/latest", and counts the requests of them.
+type upstream struct {
+	mu       sync.Mutex
+	contents map[string]string
+	requests map[string]int
+	accept   []string
+	down     bool
+}
+
+func newUpstream(t *testing.T, contents map[string]string) (*upstream, *httptest.Server) {
+	t.Helper()
+	u := &upstream{contents: contents, requests: make(map[string]int)}
+	srv := httptest.NewServer(u)
+	t.Cleanup(srv.Close)
+	return u, srv
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.requests[r.URL.Path]++
+	u.accept = r.Header["Accept"]
+	if u.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	content, ok := u.contents[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(content))
+}
+
+func (u *upstream) set(path, content string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.contents[path] = content
+}
+
+func (u *upstream) setDown(down bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.down = down
+}
+
+func (u *upstream) count(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[path]
+}
+
+func TestProxy_FindRawManifestByImage(t *testing.T) {
+	manifest := `{"schemaVersion":2}`
+	u, srv := newUpstream(t, map[string]string{"/v2/app/manifests/latest": manifest})
+	p := New(&storage.Local{Root: t.TempDir()}, &client.Client{URL: srv.URL}, time.Hour)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		raw, dgst, err := p.FindRawManifestByImage(ctx, "app", "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != manifest || dgst != digest.FromString(manifest).String() {
+			t.Errorf("unexpected manifest: %s, %s", raw, dgst)
+		}
+	}
+	// the tag is fresh, so the second pull is served from the cache.
+	if got := u.count("/v2/app/manifests/latest"); got != 1 {
+		t.Errorf("want 1 request to the upstream, but got %d", got)
+	}
+	u.mu.Lock()
+	accept := strings.Join(u.accept, ",")
+	u.mu.Unlock()
+	for _, mediaType := range []string{"application/vnd.docker.distribution.manifest.list.v2+json", ocispec.MediaTypeImageIndex} {
+		if !strings.Contains(accept, mediaType) {
+			t.Errorf("%s is not accepted: %s", mediaType, accept)
+		}
+	}
+
+	// the stale tag is fetched again.
+	index := `{"schemaVersion":2,"manifests":[]}`
+	u.set("/v2/app/manifests/latest", index)
+	p.TTL = 0
+	if raw, _, err := p.FindRawManifestByImage(ctx, "app", "latest"); err != nil || string(raw) != index {
+		t.Errorf("want the new manifest, but got %s, %v", raw, err)
+	}
+	if got := u.count("/v2/app/manifests/latest"); got != 2 {
+		t.Errorf("want 2 requests to the upstream, but got %d", got)
+	}
+
+	// the stale tag is served if the upstream is down.
+	u.setDown(true)
+	if raw, _, err := p.FindRawManifestByImage(ctx, "app", "latest"); err != nil || string(raw) != index {
+		t.Errorf("want the stale manifest, but got %s, %v", raw, err)
+	}
+	u.setDown(false)
+
+	// manifests which do not match the digest are not stored.
+	want := digest.FromString(`{"schemaVersion":2,"config":{}}`).String()
+	u.set("/v2/app/manifests/"+want, manifest)
+	_, _, err := p.FindRawManifestByImage(ctx, "app", want)
+	if e, ok := err.(*errors.Error); !ok || e.StatusCode != http.StatusBadGateway {
+		t.Errorf("want %d, but got %v", http.StatusBadGateway, err)
+	}
+	if _, _, err := p.Local.FindRawManifestByImage("app", want); err == nil {
+		t.Error("the manifest which does not match the digest is stored")
+	}
+}
+
+func TestProxy_FindBlobByImage(t *testing.T) {
+	layer := "layer"
+	dgst := digest.FromString(layer).String()
+	u, srv := newUpstream(t, map[string]string{"/v2/app/blobs/" + dgst: layer})
+	p := New(&storage.Local{Root: t.TempDir()}, &client.Client{URL: srv.URL}, time.Hour)
+	ctx := context.Background()
+
+	read := func() string {
+		t.Helper()
+		b, err := p.FindBlobByImage(ctx, "app", dgst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		got, err := ioutil.ReadAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(got)
+	}
+	if got := read(); got != layer {
+		t.Fatalf("want %q, but got %q", layer, got)
+	}
+	u.setDown(true)
+	if got := read(); got != layer {
+		t.Errorf("cached blob: want %q, but got %q", layer, got)
+	}
+	if got := u.count("/v2/app/blobs/" + dgst); got != 1 {
+		t.Errorf("want 1 request to the upstream, but got %d", got)
+	}
+}
+
+func TestProxy_FindBlobByImage_Partial(t *testing.T) {
+	layer := strings.Repeat("layer", 1024)
+	dgst := digest.FromString(layer).String()
+	_, srv := newUpstream(t, map[string]string{"/v2/app/blobs/" + dgst: layer})
+	local := &storage.Local{Root: t.TempDir()}
+	p := New(local, &client.Client{URL: srv.URL}, time.Hour)
+
+	b, err := p.FindBlobByImage(context.Background(), "app", dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	// the content which is not read until EOF is discarded with the session.
+	if _, err := local.CheckBlobByReference("app", dgst); err == nil {
+		t.Error("the partial blob is stored")
+	}
+	fis, err := ioutil.ReadDir(filepath.Join(local.Root, "app"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(fis) != 0 {
+		t.Errorf("the session is left: %v", fis[0].Name())
+	}
+}
@@ -0,0 +1,491 @@
+// Package quota limits the storage usage of repositories and namespaces.
+//
+// The usage is the total size of unique blobs and manifests, so a blob which is
+// shared by repositories in a namespace is counted once for the namespace.
+// Manager receives events of pushed and deleted contents as a notifications.Sink
+// to keep the usage up to date without walking the storage, and walks it in the
+// background for changes which are made without events.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	e "errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/grammar"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/storage"
+)
+
+// Kinds of quotas.
+const (
+	KindRepository = "repository"
+	KindNamespace  = "namespace"
+)
+
+// DefaultRefreshInterval is the default interval of counting the usage of every
+// repository again.
+const DefaultRefreshInterval = time.Hour
+
+var namePattern = regexp.MustCompile(`^` + grammar.Name + `$`)
+
+// Config is the configuration of quotas. Limits are in bytes.
+type Config struct {
+	// Repositories maps names of repositories to limits.
+	Repositories map[string]int64 `json:"repositories,omitempty"`
+	// Namespaces maps namespaces such as "team-a" to limits. A namespace contains
+	// repositories whose names start with it followed by "/".
+	Namespaces map[string]int64 `json:"namespaces,omitempty"`
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	for kind, limits := range map[string]map[string]int64{
+		KindRepository: c.Repositories,
+		KindNamespace:  c.Namespaces,
+	} {
+		for name, limit := range limits {
+			if err := validate(name, limit); err != nil {
+				return fmt.Errorf("%s %q: %w", kind, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validate(name string, limit int64) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid name")
+	}
+	if limit <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	return nil
+}
+
+// Quota is the limit and the usage of a repository or a namespace.
+type Quota struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Limit int64  `json:"limit"`
+	Usage int64  `json:"usage"`
+}
+
+// match reports whether the repository is counted in the quota.
+func (q *Quota) match(repository string) bool {
+	if q.Kind == KindNamespace {
+		return strings.HasPrefix(repository, q.Name+"/")
+	}
+	return repository == q.Name
+}
+
+// ErrNotFound is returned if the quota is not set.
+var ErrNotFound = e.New("quota not found")
+
+// Manager keeps the usage of repositories and checks pushes against quotas.
+type Manager struct {
+	// RefreshInterval is the interval of counting the usage of every repository
+	// again by Run.
+	RefreshInterval time.Duration
+
+	local    *storage.Local
+	filename string
+	wake     chan struct{}
+
+	mu       sync.Mutex
+	limits   map[string]map[string]int64    // keyed by kind and name
+	counters map[string]map[string]*counter // keyed by kind and name
+	usage    map[string]map[string]int64    // keyed by repository and digest
+	pending  map[string]bool                // repositories to be refreshed by Run
+}
+
+// counter keeps the usage of a quota, so that checks do not count contents of
+// every repository.
+type counter struct {
+	usage int64
+	// refs are the number of repositories which have the content by digest.
+	refs map[string]int
+}
+
+func (c *counter) add(dgst string, size int64) {
+	c.refs[dgst]++
+	if c.refs[dgst] == 1 {
+		c.usage += size
+	}
+}
+
+func (c *counter) remove(dgst string, size int64) {
+	c.refs[dgst]--
+	if c.refs[dgst] <= 0 {
+		delete(c.refs, dgst)
+		c.usage -= size
+	}
+}
+
+var _ notifications.Sink = (*Manager)(nil)
+
+// New creates a Manager which walks the storage to count the usage.
+//
+// Quotas which are set by Set and Delete are saved to the file. Once the file
+// exists, it takes precedence over c, which only has the initial quotas.
+func New(local *storage.Local, filename string, c *Config) (*Manager, error) {
+	m := &Manager{
+		RefreshInterval: DefaultRefreshInterval,
+		local:           local,
+		filename:        filename,
+		wake:            make(chan struct{}, 1),
+		limits: map[string]map[string]int64{
+			KindRepository: {},
+			KindNamespace:  {},
+		},
+		counters: map[string]map[string]*counter{
+			KindRepository: {},
+			KindNamespace:  {},
+		},
+		usage:   make(map[string]map[string]int64),
+		pending: make(map[string]bool),
+	}
+	b, err := ioutil.ReadFile(filename)
+	switch {
+	case err == nil:
+		var saved Config
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+		}
+		c = &saved
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	if c != nil {
+		for name, limit := range c.Repositories {
+			m.limits[KindRepository][name] = limit
+		}
+		for name, limit := range c.Namespaces {
+			m.limits[KindNamespace][name] = limit
+		}
+	}
+	if err := m.refreshAll(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// add counts the content. The caller must hold the lock.
+func (m *Manager) add(name, dgst string, size int64) {
+	contents, ok := m.usage[name]
+	if !ok {
+		contents = make(map[string]int64)
+		m.usage[name] = contents
+	}
+	if _, ok := contents[dgst]; ok {
+		return
+	}
+	contents[dgst] = size
+	for _, c := range m.countersOf(name) {
+		c.add(dgst, size)
+	}
+}
+
+// remove stops counting the content. The caller must hold the lock.
+func (m *Manager) remove(name, dgst string) {
+	size, ok := m.usage[name][dgst]
+	if !ok {
+		return
+	}
+	delete(m.usage[name], dgst)
+	if len(m.usage[name]) == 0 {
+		delete(m.usage, name)
+	}
+	for _, c := range m.countersOf(name) {
+		c.remove(dgst, size)
+	}
+}
+
+// countersOf returns counters of quotas which the repository is counted in.
+// The caller must hold the lock.
+func (m *Manager) countersOf(name string) []*counter {
+	var counters []*counter
+	for _, q := range m.quotasOf(name) {
+		counters = append(counters, m.counters[q.Kind][q.Name])
+	}
+	return counters
+}
+
+// newCounter counts the usage of the quota from contents which are already
+// counted. The caller must hold the lock.
+func (m *Manager) newCounter(q *Quota) *counter {
+	c := &counter{refs: make(map[string]int)}
+	for name, contents := range m.usage {
+		if !q.match(name) {
+			continue
+		}
+		for dgst, size := range contents {
+			c.add(dgst, size)
+		}
+	}
+	return c
+}
+
+// quotasOf returns quotas which the repository is counted in. The caller must hold the lock.
+func (m *Manager) quotasOf(name string) []*Quota {
+	var quotas []*Quota
+	for _, kind := range []string{KindRepository, KindNamespace} {
+		for n, limit := range m.limits[kind] {
+			q := &Quota{Kind: kind, Name: n, Limit: limit}
+			if q.match(name) {
+				quotas = append(quotas, q)
+			}
+		}
+	}
+	return quotas
+}
+
+// Check returns DENIED error if pushing n bytes of the content to the repository
+// exceeds any quota. The content is not counted again if dgst is already in the
+// quota. dgst may be empty if it is not known yet, such as for chunks of uploads.
+//
+// It does nothing if m is nil, so that handlers can check quotas regardless of
+// whether they are enabled.
+func (m *Manager) Check(name, dgst string, n int64) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, q := range m.quotasOf(name) {
+		c := m.counters[q.Kind][q.Name]
+		usage := c.usage
+		if dgst != "" && c.refs[dgst] > 0 {
+			continue
+		}
+		if usage+n <= q.Limit {
+			continue
+		}
+		err := fmt.Errorf("quota of %s %q is exceeded", q.Kind, q.Name)
+		return errors.Wrap(err,
+			errors.WithCodeDenied(),
+			errors.WithDetail(map[string]interface{}{
+				"kind":      q.Kind,
+				"name":      q.Name,
+				"limit":     q.Limit,
+				"usage":     usage,
+				"requested": n,
+			}),
+		)
+	}
+	return nil
+}
+
+// Write implements notifications.Sink. It updates the usage by pushes and deletes.
+// Repositories whose manifests are deleted by tags are refreshed by Run, so
+// that requests are never blocked by walking the storage.
+func (m *Manager) Write(ev notifications.Event) {
+	name, dgst := ev.Target.Repository, ev.Target.Digest
+	switch ev.Action {
+	case notifications.ActionPush:
+		if dgst == "" {
+			return
+		}
+		fi, err := m.local.CheckBlobByReference(name, dgst)
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.add(name, dgst, fi.Size())
+		m.mu.Unlock()
+	case notifications.ActionDelete:
+		if dgst == "" {
+			// the manifest is deleted by the tag, so the digest is not known.
+			m.mu.Lock()
+			m.pending[name] = true
+			m.mu.Unlock()
+			select {
+			case m.wake <- struct{}{}:
+			default:
+			}
+			return
+		}
+		m.mu.Lock()
+		m.remove(name, dgst)
+		m.mu.Unlock()
+	}
+}
+
+// Run refreshes repositories which are requested by Write, and every repository
+// by RefreshInterval for changes which are made without events, until ctx is canceled.
+func (m *Manager) Run(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	ticker := time.NewTicker(m.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+			m.mu.Lock()
+			pending := m.pending
+			m.pending = make(map[string]bool)
+			m.mu.Unlock()
+			for name := range pending {
+				if err := m.Refresh(name); err != nil {
+					logger.Error("quota: failed to refresh the usage", "repository", name, "error", err)
+				}
+			}
+		case <-ticker.C:
+			if err := m.refreshAll(); err != nil {
+				logger.Error("quota: failed to refresh the usage", "error", err)
+			}
+		}
+	}
+}
+
+// Refresh counts the usage of the repository again, for changes which are made
+// without events such as garbage collection.
+func (m *Manager) Refresh(name string) error {
+	contents := make(map[string]int64)
+	err := m.local.WalkContents(name, func(c storage.Content) error {
+		contents[c.Digest] = c.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dgst := range m.usage[name] {
+		if _, ok := contents[dgst]; !ok {
+			m.remove(name, dgst)
+		}
+	}
+	for dgst, size := range contents {
+		m.add(name, dgst, size)
+	}
+	return nil
+}
+
+// refreshAll counts the usage of every repository again.
+func (m *Manager) refreshAll() error {
+	usage := make(map[string]map[string]int64)
+	err := m.local.WalkContents("", func(c storage.Content) error {
+		contents, ok := usage[c.Repository]
+		if !ok {
+			contents = make(map[string]int64)
+			usage[c.Repository] = contents
+		}
+		contents[c.Digest] = c.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage = usage
+	for kind, limits := range m.limits {
+		for name := range limits {
+			m.counters[kind][name] = m.newCounter(&Quota{Kind: kind, Name: name})
+		}
+	}
+	return nil
+}
+
+// List returns every quota with the usage in the order of kinds and names.
+func (m *Manager) List() []Quota {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var quotas []Quota
+	for _, kind := range []string{KindRepository, KindNamespace} {
+		names := make([]string, 0, len(m.limits[kind]))
+		for name := range m.limits[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			quotas = append(quotas, Quota{
+				Kind:  kind,
+				Name:  name,
+				Limit: m.limits[kind][name],
+				Usage: m.counters[kind][name].usage,
+			})
+		}
+	}
+	return quotas
+}
+
+// Get returns the quota with the usage.
+func (m *Manager) Get(kind, name string) (*Quota, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limit, ok := m.limits[kind][name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &Quota{Kind: kind, Name: name, Limit: limit, Usage: m.counters[kind][name].usage}, nil
+}
+
+// Set sets the limit of the quota and saves quotas to the file.
+func (m *Manager) Set(kind, name string, limit int64) (*Quota, error) {
+	if err := validate(name, limit); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limits, ok := m.limits[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown kind %q", kind)
+	}
+	q := &Quota{Kind: kind, Name: name, Limit: limit}
+	c, ok := m.counters[kind][name]
+	if !ok {
+		c = m.newCounter(q)
+	}
+	limits[name] = limit
+	m.counters[kind][name] = c
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+	q.Usage = c.usage
+	return q, nil
+}
+
+// Delete removes the quota and saves quotas to the file.
+func (m *Manager) Delete(kind, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.limits[kind][name]; !ok {
+		return ErrNotFound
+	}
+	delete(m.limits[kind], name)
+	delete(m.counters[kind], name)
+	return m.save()
+}
+
+// save writes quotas via a temporary file. The caller must hold the lock.
+func (m *Manager) save() error {
+	b, err := json.MarshalIndent(&Config{
+		Repositories: m.limits[KindRepository],
+		Namespaces:   m.limits[KindNamespace],
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.filename), 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(m.filename), "."+filepath.Base(m.filename))
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.filename)
+}
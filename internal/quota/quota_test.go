@@ -0,0 +1,211 @@
+package quota
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func putBlob(t *testing.T, m *Manager, name, content string) string {
+	t.Helper()
+	dgst := digest.FromString(content).String()
+	if _, err := m.local.PutBlobByDigest(name, dgst, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	m.Write(notifications.Event{
+		Action: notifications.ActionPush,
+		Target: notifications.Target{Repository: name, Digest: dgst},
+	})
+	return dgst
+}
+
+func TestManager(t *testing.T) {
+	local := &storage.Local{Root: t.TempDir()}
+	// contents which exist before the manager is created are counted as well.
+	content := "0123456789"
+	if _, err := local.PutBlobByDigest("team-a/app", digest.FromString(content).String(), strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "quotas.json")
+	m, err := New(local, filename, &Config{
+		Namespaces: map[string]int64{"team-a": 25},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := putBlob(t, m, "team-a/app", "shared")
+	putBlob(t, m, "team-a/web", "shared")
+	want := []Quota{{Kind: KindNamespace, Name: "team-a", Limit: 25, Usage: 16}}
+	if got := m.List(); !reflect.DeepEqual(want, got) {
+		t.Errorf("shared blobs must be counted once: want %+v, but got %+v", want, got)
+	}
+
+	if err := m.Check("team-a/web", "", 10); err == nil {
+		t.Error("want error which exceeds the quota")
+	} else if e, ok := err.(*errors.Error); !ok || e.Code != "DENIED" {
+		t.Errorf("want DENIED, but got %v", err)
+	}
+	if err := m.Check("team-a/web", shared, 10); err != nil {
+		t.Errorf("want no error for the blob which is already counted, but got %v", err)
+	}
+	if err := m.Check("team-b/app", "", 100); err != nil {
+		t.Errorf("want no error for other namespaces, but got %v", err)
+	}
+
+	if _, err := m.Set(KindRepository, "team-b/app", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check("team-b/app", "", 6); err == nil {
+		t.Error("want error which exceeds the quota of the repository")
+	}
+
+	// deletes decrease the usage.
+	if err := local.DeleteBlobByImage("team-a/app", shared); err != nil {
+		t.Fatal(err)
+	}
+	m.Write(notifications.Event{
+		Action: notifications.ActionDelete,
+		Target: notifications.Target{Repository: "team-a/app", Digest: shared},
+	})
+	if err := local.DeleteBlobByImage("team-a/web", shared); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Refresh("team-a/web"); err != nil {
+		t.Fatal(err)
+	}
+	q, err := m.Get(KindNamespace, "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Usage != int64(len(content)) {
+		t.Errorf("want usage %d, but got %d", len(content), q.Usage)
+	}
+
+	// quotas are saved to the file, which takes precedence over the configuration.
+	if err := m.Delete(KindNamespace, "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(KindNamespace, "team-a"); err != ErrNotFound {
+		t.Errorf("want %v, but got %v", ErrNotFound, err)
+	}
+	m, err = New(local, filename, &Config{
+		Namespaces: map[string]int64{"team-a": 25},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Quota{{Kind: KindRepository, Name: "team-b/app", Limit: 5}}
+	if got := m.List(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %+v, but got %+v", want, got)
+	}
+}
+
+func TestManager_Run(t *testing.T) {
+	local := &storage.Local{Root: t.TempDir()}
+	m, err := New(local, filepath.Join(t.TempDir(), "quotas.json"), &Config{
+		Repositories: map[string]int64{"app": 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"schemaVersion":2}`
+	if _, _, err := local.CreateManifest(strings.NewReader(manifest), "app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	m.Write(notifications.Event{
+		Action: notifications.ActionPush,
+		Target: notifications.Target{Repository: "app", Digest: digest.FromString(manifest).String(), Tag: "latest"},
+	})
+	usage := func() int64 {
+		q, err := m.Get(KindRepository, "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q.Usage
+	}
+	if got := usage(); got != int64(len(manifest)) {
+		t.Fatalf("want usage %d, but got %d", len(manifest), got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the manifest which is deleted by the tag is refreshed in the background.
+	if err := local.DeleteManifestByImage("app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	m.Write(notifications.Event{
+		Action: notifications.ActionDelete,
+		Target: notifications.Target{Repository: "app", Tag: "latest"},
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for usage() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the usage is not refreshed: %d", usage())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestManager_CheckNamespace(t *testing.T) {
+	m, err := New(&storage.Local{Root: t.TempDir()}, filepath.Join(t.TempDir(), "quotas.json"), &Config{
+		Namespaces:   map[string]int64{"team": 10},
+		Repositories: map[string]int64{"team/db": 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := putBlob(t, m, "team/app", "12345678")
+	// the blob which is already in the namespace does not use the quota.
+	if err := m.Check("team/web", dgst, 8); err != nil {
+		t.Errorf("want no error, but got %v", err)
+	}
+	if err := m.Check("team/web", digest.FromString("87654321").String(), 8); err == nil {
+		t.Error("want error for the new blob which exceeds the quota")
+	}
+	// the quota of the repository does not count blobs of other repositories.
+	if err := m.Check("team/db", dgst, 11); err == nil {
+		t.Error("want error which exceeds the quota of the repository")
+	}
+}
+
+func TestManager_CheckNil(t *testing.T) {
+	var m *Manager
+	if err := m.Check("app", "", 1<<40); err != nil {
+		t.Errorf("want no error, but got %v", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cases := []struct {
+		c       Config
+		wantErr bool
+	}{
+		{Config{}, false},
+		{Config{Repositories: map[string]int64{"team-a/app": 1 << 30}, Namespaces: map[string]int64{"team-a": 1 << 40}}, false},
+		{Config{Repositories: map[string]int64{"team-a/app": 0}}, true},
+		{Config{Namespaces: map[string]int64{"Team A": 1}}, true},
+	}
+	for i, tc := range cases {
+		if err := tc.c.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("#%d: want error %v, but got %v", i, tc.wantErr, err)
+		}
+	}
+}
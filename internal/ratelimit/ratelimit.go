@@ -0,0 +1,164 @@
+// Package ratelimit limits rates of requests and bytes by token buckets.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is the rate of a token bucket.
+type Limit struct {
+	// Rate is the number of tokens which are refilled per second.
+	Rate float64 `json:"rate"`
+	// Burst is the capacity of the bucket. If zero, it is Rate.
+	Burst float64 `json:"burst,omitempty"`
+}
+
+// Enabled reports whether the limit is set.
+func (l Limit) Enabled() bool { return l.Rate > 0 }
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+func (l Limit) validate() error {
+	if l.Rate < 0 || math.IsNaN(l.Rate) || math.IsInf(l.Rate, 0) {
+		return fmt.Errorf("rate must be a positive number")
+	}
+	if l.Burst < 0 || math.IsNaN(l.Burst) || math.IsInf(l.Burst, 0) {
+		return fmt.Errorf("burst must be a positive number")
+	}
+	if l.Rate == 0 && l.Burst > 0 {
+		return fmt.Errorf("burst requires rate")
+	}
+	return nil
+}
+
+// Config is the configuration of the rate limiting. Limits are applied to each
+// client IP, authenticated user and repository. Limits which are not set are disabled.
+type Config struct {
+	// Manifests limits requests of manifests per second.
+	Manifests Limit `json:"manifests"`
+	// BlobBytes limits bytes of blobs which are pulled and pushed per second.
+	BlobBytes Limit `json:"blobBytes"`
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	if err := c.Manifests.validate(); err != nil {
+		return fmt.Errorf("manifests: %w", err)
+	}
+	if err := c.BlobBytes.validate(); err != nil {
+		return fmt.Errorf("blobBytes: %w", err)
+	}
+	return nil
+}
+
+// sweepInterval is the interval to remove buckets which are full,
+// so that buckets of clients which are gone do not pile up.
+const sweepInterval = time.Minute
+
+var now = time.Now
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// Limiter has a token bucket of the limit for each key.
+type Limiter struct {
+	limit Limit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweptAt time.Time
+}
+
+// NewLimiter creates a Limiter.
+func NewLimiter(l Limit) *Limiter {
+	return &Limiter{
+		limit:   l,
+		buckets: make(map[string]*bucket),
+		sweptAt: now(),
+	}
+}
+
+// refill returns the bucket of the key which is refilled until t.
+func (l *Limiter) refill(key string, t time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.limit.burst(), updatedAt: t}
+		l.buckets[key] = b
+		return b
+	}
+	if elapsed := t.Sub(b.updatedAt).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.limit.burst(), b.tokens+elapsed*l.limit.Rate)
+		b.updatedAt = t
+	}
+	return b
+}
+
+func (l *Limiter) sweep(t time.Time) {
+	if t.Sub(l.sweptAt) < sweepInterval {
+		return
+	}
+	l.sweptAt = t
+	for key := range l.buckets {
+		if b := l.refill(key, t); b.tokens >= l.limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Allow takes n tokens from every bucket of keys if all of them have enough tokens.
+// Otherwise it takes nothing and returns the duration until they will have.
+// n is capped to the burst, so that large requests can be allowed eventually.
+//
+// n may be zero to check only that buckets do not owe tokens which are charged.
+func (l *Limiter) Allow(n float64, keys ...string) (retryAfter time.Duration) {
+	if n > l.limit.burst() {
+		n = l.limit.burst()
+	}
+	t := now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(t)
+	var wait float64
+	for _, key := range keys {
+		b := l.refill(key, t)
+		if b.tokens < n || b.tokens < 0 {
+			wait = math.Max(wait, (n-b.tokens)/l.limit.Rate)
+		}
+	}
+	if wait > 0 {
+		return time.Duration(wait * float64(time.Second))
+	}
+	for _, key := range keys {
+		l.buckets[key].tokens -= n
+	}
+	return 0
+}
+
+// Charge takes n tokens from every bucket of keys, even if they do not have enough tokens.
+// It is used for the cost which is known after the request such as the size of
+// the response. Buckets which owe tokens are not allowed until they are refilled.
+func (l *Limiter) Charge(n float64, keys ...string) {
+	t := now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		l.refill(key, t).tokens -= n
+	}
+}
+
+// Len returns the number of buckets.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func fakeNow(t *testing.T) func(d time.Duration) {
+	t.Helper()
+	cur := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return cur }
+	t.Cleanup(func() { now = orig })
+	return func(d time.Duration) { cur = cur.Add(d) }
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	advance := fakeNow(t)
+	l := NewLimiter(Limit{Rate: 2, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		if d := l.Allow(1, "ip:a"); d != 0 {
+			t.Fatalf("#%d: want allowed, but retry after %v", i, d)
+		}
+	}
+	if got, want := l.Allow(1, "ip:a"), 500*time.Millisecond; got != want {
+		t.Errorf("want retry after %v, but got %v", want, got)
+	}
+	// other keys have their own buckets.
+	if d := l.Allow(1, "ip:b"); d != 0 {
+		t.Errorf("want allowed, but retry after %v", d)
+	}
+
+	advance(500 * time.Millisecond)
+	if d := l.Allow(1, "ip:a"); d != 0 {
+		t.Errorf("want allowed after refill, but retry after %v", d)
+	}
+}
+
+func TestLimiter_AllowEveryKey(t *testing.T) {
+	fakeNow(t)
+	l := NewLimiter(Limit{Rate: 1})
+
+	if d := l.Allow(1, "ip:a", "repository:x"); d != 0 {
+		t.Fatalf("want allowed, but retry after %v", d)
+	}
+	// the repository is exhausted, so the bucket of ip:b must not be taken.
+	if d := l.Allow(1, "ip:b", "repository:x"); d == 0 {
+		t.Fatal("want rejected")
+	}
+	if d := l.Allow(1, "ip:b"); d != 0 {
+		t.Errorf("want allowed, but retry after %v", d)
+	}
+}
+
+func TestLimiter_Charge(t *testing.T) {
+	advance := fakeNow(t)
+	l := NewLimiter(Limit{Rate: 100, Burst: 100})
+
+	if d := l.Allow(0, "user:alice"); d != 0 {
+		t.Fatalf("want allowed, but retry after %v", d)
+	}
+	l.Charge(300, "user:alice")
+	if got, want := l.Allow(0, "user:alice"), 2*time.Second; got != want {
+		t.Errorf("want retry after %v, but got %v", want, got)
+	}
+	advance(2 * time.Second)
+	if d := l.Allow(0, "user:alice"); d != 0 {
+		t.Errorf("want allowed after refill, but retry after %v", d)
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	advance := fakeNow(t)
+	l := NewLimiter(Limit{Rate: 1})
+	l.Allow(1, "ip:a")
+	l.Allow(1, "ip:b")
+	if got := l.Len(); got != 2 {
+		t.Fatalf("want 2 buckets, but got %d", got)
+	}
+	advance(sweepInterval)
+	l.Allow(1, "ip:c")
+	if got := l.Len(); got != 1 {
+		t.Errorf("want full buckets to be removed, but got %d buckets", got)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cases := []struct {
+		c       Config
+		wantErr bool
+	}{
+		{Config{}, false},
+		{Config{Manifests: Limit{Rate: 10, Burst: 20}, BlobBytes: Limit{Rate: 1 << 20}}, false},
+		{Config{Manifests: Limit{Rate: -1}}, true},
+		{Config{BlobBytes: Limit{Burst: 10}}, true},
+	}
+	for i, tc := range cases {
+		if err := tc.c.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("#%d: want error %v, but got %v", i, tc.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action represents what is replicated.
+type Action string
+
+const (
+	// ActionPush replicates the manifest and blobs which are referenced by it.
+	ActionPush Action = "push"
+	// ActionDelete deletes the manifest on the target.
+	ActionDelete Action = "delete"
+)
+
+// Job is a unit of the replication.
+type Job struct {
+	Action     Action    `json:"action"`
+	Repository string    `json:"repository"`
+	Reference  string    `json:"reference"`
+	Attempts   int       `json:"attempts"`
+	CreatedAt  time.Time `json:"createdAt"`
+
+	// file is the path where the job is persisted.
+	file string
+}
+
+// queue is the persistent FIFO queue of jobs. Each job is stored as a file in the
+// directory, whose name is ordered by the time the job is enqueued.
+type queue struct {
+	dir string
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+func newQueue(dir string) (*queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &queue{dir: dir}, nil
+}
+
+// push persists the job at the tail of the queue.
+func (q *queue) push(job *Job) error {
+	q.mu.Lock()
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), q.seq%1000000)
+	q.mu.Unlock()
+	job.file = filepath.Join(q.dir, name)
+	return q.save(job)
+}
+
+// save writes the job via a temporary file, so that a crash never leaves a broken job.
+func (q *queue) save(job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(q.dir, "."+filepath.Base(job.file))
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, job.file)
+}
+
+// peek returns the job at the head of the queue. It returns nil if the queue is empty.
+func (q *queue) peek() (*Job, error) {
+	files, err := q.files()
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(b, &job); err != nil {
+		// a broken job can never be processed, so drop it.
+		os.Remove(files[0])
+		return nil, fmt.Errorf("dropped broken job %q: %w", files[0], err)
+	}
+	job.file = files[0]
+	return &job, nil
+}
+
+// remove removes the job from the queue.
+func (q *queue) remove(job *Job) error {
+	return os.Remove(job.file)
+}
+
+// len returns the number of jobs in the queue.
+func (q *queue) len() int {
+	files, _ := q.files()
+	return len(files)
+}
+
+func (q *queue) files() ([]string, error) {
+	fis, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		files = append(files, filepath.Join(q.dir, fi.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
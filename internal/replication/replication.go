@@ -0,0 +1,575 @@
+// Package replication replicates pushed images to downstream registries.
+//
+// Replicator receives events of pushed and deleted manifests as a notifications.Sink.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/client"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Target represents a registry which images are replicated to.
+type Target struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Include is a list of repository name patterns to replicate. If empty,
+	// every repository is included. Patterns are matched by path.Match,
+	// e.g. "team-a/*".
+	Include []string `json:"include,omitempty"`
+	// Exclude is a list of repository name patterns which are not replicated.
+	// Exclude takes precedence over Include.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Match reports whether the repository is replicated to the target.
+func (t *Target) Match(repository string) bool {
+	for _, pattern := range t.Exclude {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return false
+		}
+	}
+	if len(t.Include) == 0 {
+		return true
+	}
+	for _, pattern := range t.Include {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Config is the configuration of the replication.
+type Config struct {
+	Targets []Target `json:"targets"`
+}
+
+// LoadConfig loads the configuration from json file.
+func LoadConfig(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	seen := make(map[string]bool)
+	for _, t := range c.Targets {
+		if t.Name == "" || t.URL == "" {
+			return fmt.Errorf("target must have name and url")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return nil
+}
+
+// Status represents the replication status of a target.
+type Status struct {
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	Pending     int        `json:"pending"`
+	Succeeded   int        `json:"succeeded"`
+	Failed      int        `json:"failed"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Default values of the retry policy.
+const (
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = 5 * time.Minute
+	DefaultMaxAttempts = 10
+)
+
+// Replicator replicates manifests and blobs in the local storage to targets.
+//
+// Jobs are persisted in the queue directory per target, so that they
+// survive restarts. Jobs of a target are processed in order.
+type Replicator struct {
+	// MinBackoff and MaxBackoff are the range of the delay before retrying a failed job.
+	// The delay is doubled on every failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is the number of attempts before a job is given up.
+	MaxAttempts int
+
+	local   *storage.Local
+	targets []*target
+}
+
+type target struct {
+	Target
+	client *client.Client
+	queue  *queue
+	wake   chan struct{}
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New creates a Replicator. queueDir is the directory where jobs are persisted.
+func New(local *storage.Local, queueDir string, targets []Target) (*Replicator, error) {
+	r := &Replicator{
+		MinBackoff:  DefaultMinBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+		MaxAttempts: DefaultMaxAttempts,
+		local:       local,
+	}
+	for _, t := range targets {
+		q, err := newQueue(filepath.Join(queueDir, t.Name))
+		if err != nil {
+			return nil, err
+		}
+		r.targets = append(r.targets, &target{
+			Target: t,
+			client: &client.Client{
+				URL:      t.URL,
+				Username: t.Username,
+				Password: t.Password,
+			},
+			queue: q,
+			wake:  make(chan struct{}, 1),
+			status: Status{
+				Name: t.Name,
+				URL:  t.URL,
+			},
+		})
+	}
+	return r, nil
+}
+
+// Run processes jobs until ctx is canceled.
+func (r *Replicator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range r.targets {
+		wg.Add(1)
+		go func(t *target) {
+			defer wg.Done()
+			r.run(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// Flush tries every queued job once without backoff. It returns when queues are
+// empty, or ctx is done. Jobs which are failed are kept in the queue, so that
+// they are retried after restart. It must not be called while Run is running.
+func (r *Replicator) Flush(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	for _, t := range r.targets {
+		for ctx.Err() == nil {
+			job, err := t.queue.peek()
+			if err != nil {
+				logger.Error("replication: failed to read the queue", "target", t.Name, "error", err)
+			}
+			if job == nil {
+				break
+			}
+			if err := r.replicate(ctx, t, job); err != nil {
+				// keep the order of jobs, so give up the target.
+				job.Attempts++
+				if err := t.queue.save(job); err != nil {
+					logger.Error("replication: failed to save the job", "target", t.Name, "error", err)
+				}
+				logger.Error("replication: jobs are left", "target", t.Name, "jobs", t.queue.len(), "error", err)
+				break
+			}
+			t.mu.Lock()
+			now := time.Now()
+			t.status.Succeeded++
+			t.status.LastSuccess = &now
+			t.mu.Unlock()
+			t.queue.remove(job)
+		}
+	}
+}
+
+var _ notifications.Sink = (*Replicator)(nil)
+
+// Write implements notifications.Sink. Jobs are enqueued for pushed and deleted manifests.
+func (r *Replicator) Write(e notifications.Event) {
+	if !e.Target.IsManifest() {
+		return
+	}
+	reference := e.Target.Tag
+	if reference == "" {
+		reference = e.Target.Digest
+	}
+	switch e.Action {
+	case notifications.ActionPush:
+		// manifests which are pushed by digest, such as manifests of indexes
+		// and referrers, are replicated with the tagged manifest.
+		if e.Target.Tag == "" {
+			return
+		}
+		r.enqueue(ActionPush, e.Target.Repository, reference)
+	case notifications.ActionDelete:
+		r.enqueue(ActionDelete, e.Target.Repository, reference)
+	}
+}
+
+func (r *Replicator) enqueue(action Action, name, reference string) {
+	for _, t := range r.targets {
+		if !t.Match(name) {
+			continue
+		}
+		job := &Job{
+			Action:     action,
+			Repository: name,
+			Reference:  reference,
+			CreatedAt:  time.Now(),
+		}
+		if err := t.queue.push(job); err != nil {
+			logging.Default.Error("replication: failed to enqueue the job", "target", t.Name, "action", action, "repository", name, "reference", reference, "error", err)
+			continue
+		}
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Status returns the status of every target.
+func (r *Replicator) Status() []Status {
+	ret := make([]Status, 0, len(r.targets))
+	for _, t := range r.targets {
+		t.mu.Lock()
+		st := t.status
+		t.mu.Unlock()
+		st.Pending = t.queue.len()
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+func (r *Replicator) run(ctx context.Context, t *target) {
+	logger := logging.FromContext(ctx).With("target", t.Name)
+	for {
+		job, err := t.queue.peek()
+		if err != nil {
+			logger.Error("replication: failed to read the queue", "error", err)
+		}
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.wake:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+
+		err = r.replicate(ctx, t, job)
+		if ctx.Err() != nil {
+			return
+		}
+		now := time.Now()
+		if err == nil {
+			t.mu.Lock()
+			t.status.Succeeded++
+			t.status.LastSuccess = &now
+			t.mu.Unlock()
+			t.queue.remove(job)
+			continue
+		}
+
+		job.Attempts++
+		t.mu.Lock()
+		t.status.LastError = err.Error()
+		t.status.LastErrorAt = &now
+		if job.Attempts >= r.MaxAttempts {
+			t.status.Failed++
+		}
+		t.mu.Unlock()
+		if job.Attempts >= r.MaxAttempts {
+			logger.Error("replication: gave up the job", "action", job.Action, "repository", job.Repository, "reference", job.Reference, "error", err)
+			t.queue.remove(job)
+			continue
+		}
+		logger.Warn("replication: failed the job", "action", job.Action, "repository", job.Repository, "reference", job.Reference, "attempt", job.Attempts, "error", err)
+		if err := t.queue.save(job); err != nil {
+			logger.Error("replication: failed to save the job", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.backoff(job.Attempts)):
+		}
+	}
+}
+
+func (r *Replicator) backoff(attempts int) time.Duration {
+	d := r.MinBackoff
+	for i := 1; i < attempts && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d
+}
+
+func (r *Replicator) replicate(ctx context.Context, t *target, job *Job) error {
+	switch job.Action {
+	case ActionPush:
+		return r.push(ctx, t, job.Repository, job.Reference)
+	case ActionDelete:
+		return r.delete(ctx, t, job.Repository, job.Reference)
+	}
+	return fmt.Errorf("unknown action %q", job.Action)
+}
+
+// push pushes the manifest with every content which is needed to pull it.
+// Configs, layers, manifests of the index and the subject are pushed before
+// the manifest which refers to them, and referrers are pushed after their
+// subject. Only the manifest of the job is pushed by the reference, and the
+// others are pushed by digest.
+func (r *Replicator) push(ctx context.Context, t *target, name, reference string) error {
+	dgst, contents, err := r.local.ManifestContents(name, reference)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted after it is pushed. The delete job follows.
+			return nil
+		}
+		return err
+	}
+	p := &pusher{
+		r:         r,
+		t:         t,
+		name:      name,
+		manifests: make(map[string][]byte),
+		referrers: make(map[string][]string),
+		done:      make(map[string]bool),
+	}
+	for _, c := range contents {
+		if !c.Manifest {
+			continue
+		}
+		raw, _, err := r.local.FindRawManifestByImage(name, c.Digest)
+		if err != nil {
+			return err
+		}
+		p.manifests[c.Digest] = raw
+		if subject := parseManifest(raw).Subject; subject != nil {
+			p.referrers[subject.Digest.String()] = append(p.referrers[subject.Digest.String()], c.Digest)
+		}
+	}
+	p.tags = map[string]string{dgst: reference}
+	return p.push(ctx, dgst)
+}
+
+// pusher pushes contents of a manifest in the order of dependencies.
+type pusher struct {
+	r    *Replicator
+	t    *target
+	name string
+	// manifests are raw manifests by digest.
+	manifests map[string][]byte
+	// referrers are digests of referrers by the digest of the subject.
+	referrers map[string][]string
+	// tags are references which manifests are pushed by, instead of digests.
+	tags map[string]string
+	done map[string]bool
+}
+
+func (p *pusher) push(ctx context.Context, dgst string) error {
+	if p.done[dgst] {
+		return nil
+	}
+	p.done[dgst] = true
+	raw, ok := p.manifests[dgst]
+	if !ok {
+		if err := p.r.pushBlob(ctx, p.t, p.name, dgst); err != nil {
+			return fmt.Errorf("failed to push blob %s: %w", dgst, err)
+		}
+		return nil
+	}
+	m := parseManifest(raw)
+	for _, dep := range m.dependencies() {
+		if err := p.push(ctx, dep); err != nil {
+			return err
+		}
+	}
+	reference, ok := p.tags[dgst]
+	if !ok {
+		reference = dgst
+	}
+	if err := p.r.pushManifest(ctx, p.t, p.name, reference, m.MediaType, raw); err != nil {
+		return fmt.Errorf("failed to push manifest %s: %w", reference, err)
+	}
+	for _, referrer := range p.referrers[dgst] {
+		if err := p.push(ctx, referrer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifest has fields of image manifests and indexes which refer to other contents.
+type manifest struct {
+	MediaType string               `json:"mediaType"`
+	Config    *ocispec.Descriptor  `json:"config"`
+	Layers    []ocispec.Descriptor `json:"layers"`
+	Manifests []ocispec.Descriptor `json:"manifests"`
+	Subject   *ocispec.Descriptor  `json:"subject"`
+}
+
+// parseManifest parses the raw manifest. Manifests in the storage are already
+// validated, so broken fields are ignored.
+func parseManifest(raw []byte) *manifest {
+	var m manifest
+	json.Unmarshal(raw, &m)
+	return &m
+}
+
+// dependencies returns digests of contents which must exist before the manifest is pushed.
+func (m *manifest) dependencies() []string {
+	var ret []string
+	for _, d := range []*ocispec.Descriptor{m.Subject, m.Config} {
+		if d != nil && d.Digest != "" {
+			ret = append(ret, d.Digest.String())
+		}
+	}
+	for _, ds := range [][]ocispec.Descriptor{m.Manifests, m.Layers} {
+		for _, d := range ds {
+			if d.Digest != "" {
+				ret = append(ret, d.Digest.String())
+			}
+		}
+	}
+	return ret
+}
+
+func (r *Replicator) pushManifest(ctx context.Context, t *target, name, reference, mediaType string, raw []byte) error {
+	req, err := t.client.NewRequest(ctx, http.MethodPut, name, "manifests/"+reference, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	if mediaType == "" {
+		mediaType = registry.PredictDockerContentType("manifest.json")
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := t.client.Do(req, name, "pull,push")
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusCreated, http.StatusOK)
+}
+
+// pushBlob pushes the blob if the target does not have it yet.
+func (r *Replicator) pushBlob(ctx context.Context, t *target, name, dgst string) error {
+	req, err := t.client.NewRequest(ctx, http.MethodHead, name, "blobs/"+dgst, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req, name, "pull,push")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	// POST -> PUT
+	req, err = t.client.NewRequest(ctx, http.MethodPost, name, "blobs/uploads/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err = t.client.Do(req, name, "pull,push")
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return fmt.Errorf("no upload location is returned")
+	}
+
+	f, err := r.local.FindBlobByImage(name, dgst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err = t.client.NewRequestURL(ctx, http.MethodPut, location, f)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Set("digest", dgst)
+	req.URL.RawQuery = q.Encode()
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.GetBody = func() (io.ReadCloser, error) {
+		return r.local.FindBlobByImage(name, dgst)
+	}
+	resp, err = t.client.Do(req, name, "pull,push")
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusCreated)
+}
+
+func (r *Replicator) delete(ctx context.Context, t *target, name, reference string) error {
+	req, err := t.client.NewRequest(ctx, http.MethodDelete, name, "manifests/"+reference, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req, name, "pull,push,delete")
+	if err != nil {
+		return err
+	}
+	// it has been already deleted if the target responds 404.
+	return expectStatus(resp, http.StatusAccepted, http.StatusOK, http.StatusNotFound)
+}
+
+func expectStatus(resp *http.Response, codes ...int) error {
+	defer resp.Body.Close()
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s responded %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bytes.TrimSpace(body))
+}
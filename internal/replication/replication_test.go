@@ -0,0 +1,167 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestTarget_Match(t *testing.T) {
+	target := &Target{
+		Include: []string{"team-a/*", "base"},
+		Exclude: []string{"team-a/private"},
+	}
+	tests := []struct {
+		repository string
+		want       bool
+	}{
+		{repository: "team-a/app", want: true},
+		{repository: "base", want: true},
+		{repository: "team-a/private", want: false},
+		{repository: "team-b/app", want: false},
+		{repository: "team-a/app/nested", want: false},
+	}
+	for _, tt := range tests {
+		if got := target.Match(tt.repository); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.repository, got, tt.want)
+		}
+	}
+	if !(&Target{}).Match("anything") {
+		t.Error("want every repository to be matched without rules")
+	}
+}
+
+func TestReplicator_backoff(t *testing.T) {
+	r := &Replicator{
+		MinBackoff: time.Second,
+		MaxBackoff: 10 * time.Second,
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := r.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"v1", "v2", "v3"} {
+		if err := q.push(&Job{Action: ActionPush, Repository: "app", Reference: ref}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// jobs are persisted, so another queue on the same directory sees them.
+	q, err = newQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := q.len(); got != 3 {
+		t.Fatalf("want 3 jobs, but got %d", got)
+	}
+	for _, want := range []string{"v1", "v2", "v3"} {
+		job, err := q.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Reference != want {
+			t.Fatalf("want %q, but got %q", want, job.Reference)
+		}
+		if err := q.remove(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job, err := q.peek(); job != nil || err != nil {
+		t.Fatalf("want empty queue, but got %v, %v", job, err)
+	}
+}
+
+func TestReplicator_pushIndex(t *testing.T) {
+	local := &storage.Local{Root: t.TempDir()}
+	const name = "team-a/app"
+	layer := digest.FromString("layer")
+	if _, err := local.PutBlobByDigest(name, layer.String(), strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	image := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":"` + layer.String() + `","size":5}]}`
+	_, imageDigest, err := local.PutManifest(strings.NewReader(image), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + imageDigest + `","size":` + fmt.Sprint(len(image)) + `}]}`
+	if _, _, err := local.CreateManifest(strings.NewReader(index), name, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	_, signature, err := local.PutManifest(strings.NewReader(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","subject":{"digest":"`+imageDigest+`"}}`), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost:
+			w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/1")
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+			requests = append(requests, "blob "+r.URL.Query().Get("digest"))
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut:
+			requests = append(requests, "manifest "+path.Base(r.URL.Path))
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer downstream.Close()
+
+	r, err := New(local, t.TempDir(), []Target{{Name: "downstream", URL: downstream.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// manifests which are pushed by digest are not enqueued by themselves.
+	r.Write(notifications.Event{Action: notifications.ActionPush, Target: notifications.Target{
+		MediaType: ocispec.MediaTypeImageManifest, Repository: name, Digest: signature,
+	}})
+	r.Write(notifications.Event{Action: notifications.ActionPush, Target: notifications.Target{
+		MediaType: ocispec.MediaTypeImageIndex, Repository: name, Digest: digest.FromString(index).String(), Tag: "v1",
+	}})
+	if n := r.targets[0].queue.len(); n != 1 {
+		t.Fatalf("want 1 job, but got %d", n)
+	}
+	r.Flush(context.Background())
+
+	want := []string{
+		"blob " + layer.String(),
+		"manifest " + imageDigest,
+		"manifest " + signature,
+		"manifest v1",
+	}
+	if !reflect.DeepEqual(want, requests) {
+		t.Errorf("want %q, but got %q", want, requests)
+	}
+}
@@ -0,0 +1,399 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/google/uuid"
+)
+
+// saveInterval is the interval of saving pulls while running.
+const saveInterval = time.Minute
+
+// actorName is the name of the actor of events which are emitted by the engine.
+const actorName = "retention"
+
+// Tag is a tag which is deleted, or which would be deleted on the dry run.
+type Tag struct {
+	storage.TagInfo
+	// Reason describes why the tag is deleted.
+	Reason string `json:"reason"`
+}
+
+// RepositoryReport is what is deleted from a repository.
+type RepositoryReport struct {
+	Repository string `json:"repository"`
+	// Tags are deleted tags.
+	Tags []Tag `json:"tags,omitempty"`
+	// KeptTags is the number of tags which are kept.
+	KeptTags int `json:"keptTags"`
+	// Manifests are digests of manifests which are deleted because no tag points to them anymore.
+	Manifests []string `json:"manifests,omitempty"`
+	// Blobs are blobs which are deleted by the garbage collection.
+	Blobs []storage.Content `json:"blobs,omitempty"`
+	// Bytes is the total size of Blobs.
+	Bytes int64 `json:"bytes"`
+	// Error is the error which stopped processing the repository.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the result of an execution.
+type Report struct {
+	DryRun       bool                `json:"dryRun"`
+	StartedAt    time.Time           `json:"startedAt"`
+	FinishedAt   time.Time           `json:"finishedAt"`
+	Repositories []*RepositoryReport `json:"repositories"`
+}
+
+// Totals returns the numbers of deleted tags, manifests and blobs, and freed bytes.
+func (r *Report) Totals() (tags, manifests, blobs int, bytes int64) {
+	for _, rr := range r.Repositories {
+		tags += len(rr.Tags)
+		manifests += len(rr.Manifests)
+		blobs += len(rr.Blobs)
+		bytes += rr.Bytes
+	}
+	return tags, manifests, blobs, bytes
+}
+
+// Engine applies policies to repositories periodically.
+//
+// Engine receives events as a notifications.Sink to remember when manifests are
+// pulled last time, which is used by KeepPulledWithin.
+type Engine struct {
+	local    *storage.Local
+	config   *Config
+	sink     notifications.Sink
+	filename string
+
+	// OnReport is called with the report of every execution. It must be set before Run.
+	OnReport func(*Report)
+
+	// execMu serializes executions.
+	execMu sync.Mutex
+
+	mu    sync.Mutex
+	pulls map[string]time.Time // keyed by repository and digest such as "app@sha256:..."
+	dirty bool
+	last  *Report
+}
+
+var _ notifications.Sink = (*Engine)(nil)
+
+// New creates an Engine. Pulls are saved to the file, and events of deleted
+// manifests and blobs are written to the sink.
+func New(local *storage.Local, filename string, c *Config, sink notifications.Sink) (*Engine, error) {
+	if sink == nil {
+		sink = notifications.Discard
+	}
+	e := &Engine{
+		local:    local,
+		config:   c,
+		sink:     sink,
+		filename: filename,
+		pulls:    make(map[string]time.Time),
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return e, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &e.pulls); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", filename, err)
+	}
+	return e, nil
+}
+
+func pullKey(repository, dgst string) string {
+	return repository + "@" + dgst
+}
+
+// Write implements notifications.Sink. Pulls of manifests are recorded.
+func (e *Engine) Write(ev notifications.Event) {
+	if ev.Action != notifications.ActionPull || !ev.Target.IsManifest() || ev.Target.Digest == "" {
+		return
+	}
+	e.mu.Lock()
+	e.pulls[pullKey(ev.Target.Repository, ev.Target.Digest)] = ev.Timestamp
+	e.dirty = true
+	e.mu.Unlock()
+}
+
+// PulledAt returns when the manifest is pulled last time, or zero time if it is not known.
+func (e *Engine) PulledAt(repository, dgst string) time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pulls[pullKey(repository, dgst)]
+}
+
+// LastReport returns the report of the last execution which is not the dry run, or nil.
+func (e *Engine) LastReport() *Report {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.last
+}
+
+// Run executes policies at the interval until ctx is done.
+func (e *Engine) Run(ctx context.Context) {
+	execute := time.NewTicker(e.config.interval())
+	defer execute.Stop()
+	save := time.NewTicker(saveInterval)
+	defer save.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-save.C:
+			e.Flush(ctx)
+		case <-execute.C:
+			if _, err := e.Execute(ctx, e.config.DryRun); err != nil {
+				logging.FromContext(ctx).Error("retention: failed to execute the retention", "error", err)
+			}
+		}
+	}
+}
+
+// Flush saves pulls which are recorded since the last save.
+func (e *Engine) Flush(ctx context.Context) {
+	if err := e.save(); err != nil {
+		logging.FromContext(ctx).Error("retention: failed to save pulls", "error", err)
+	}
+}
+
+func (e *Engine) save() error {
+	e.mu.Lock()
+	if !e.dirty {
+		e.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(e.pulls)
+	e.dirty = false
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(e.filename), 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(e.filename), "."+filepath.Base(e.filename))
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.filename)
+}
+
+// Execute applies policies to every repository, deletes manifests which are
+// not tagged anymore, then collects blobs which are not referred to anymore.
+// Nothing is deleted on the dry run, but the report is the same.
+//
+// Errors of repositories are reported in the report, and they do not stop the execution.
+func (e *Engine) Execute(ctx context.Context, dryRun bool) (*Report, error) {
+	e.execMu.Lock()
+	defer e.execMu.Unlock()
+	local := e.local.WithContext(storage.WithActor(ctx, storage.Actor{Name: actorName}))
+	repos, err := local.ListRepositories()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{
+		DryRun:       dryRun,
+		StartedAt:    time.Now(),
+		Repositories: []*RepositoryReport{},
+	}
+	for _, name := range repos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rr := e.execute(local, name, dryRun, report.StartedAt)
+		if rr.Error != "" {
+			logging.FromContext(ctx).Error("retention: failed to execute the retention", "repository", name, "error", rr.Error)
+		}
+		if len(rr.Tags) > 0 || len(rr.Manifests) > 0 || len(rr.Blobs) > 0 || rr.Error != "" {
+			report.Repositories = append(report.Repositories, rr)
+		}
+	}
+	report.FinishedAt = time.Now()
+	if !dryRun {
+		e.forget(report)
+		e.mu.Lock()
+		e.last = report
+		e.mu.Unlock()
+	}
+	if e.OnReport != nil {
+		e.OnReport(report)
+	}
+	return report, nil
+}
+
+func (e *Engine) execute(local *storage.Local, name string, dryRun bool, now time.Time) *RepositoryReport {
+	rr := &RepositoryReport{Repository: name}
+	tags, err := local.StatTags(name)
+	if err != nil {
+		rr.Error = err.Error()
+		return rr
+	}
+	if p := e.config.policyFor(name); p != nil {
+		rr.Tags = e.evaluate(local, p, name, tags, now)
+	}
+	rr.KeptTags = len(tags) - len(rr.Tags)
+
+	deleted := make(map[string]bool, len(rr.Tags))
+	for i := 0; i < len(rr.Tags); i++ {
+		t := rr.Tags[i]
+		if !dryRun {
+			err := local.DeleteTag(name, t.Tag)
+			if err != nil && !os.IsNotExist(err) {
+				rr.Error = err.Error()
+				rr.Tags = append(rr.Tags[:i], rr.Tags[i+1:]...)
+				rr.KeptTags++
+				i--
+				continue
+			}
+			if err == nil {
+				e.emit(notifications.Target{
+					Repository: name,
+					Tag:        t.Tag,
+					URL:        fmt.Sprintf("/v2/%s/manifests/%s", name, t.Tag),
+				})
+			}
+		}
+		deleted[t.Tag] = true
+	}
+
+	// manifests are deleted if every tag which points to them is deleted and
+	// no other manifest such as an index refers to them.
+	tagged := make(map[string]bool)
+	candidates := make(map[string]bool)
+	for _, t := range tags {
+		if deleted[t.Tag] {
+			candidates[t.Digest] = true
+		} else {
+			tagged[t.Digest] = true
+		}
+	}
+	refs, err := local.References(name)
+	if err != nil {
+		rr.Error = err.Error()
+		return rr
+	}
+	for _, t := range tags {
+		dgst := t.Digest
+		if !candidates[dgst] || tagged[dgst] || refs[dgst] {
+			continue
+		}
+		delete(candidates, dgst)
+		if !dryRun {
+			ok, err := local.DeleteUntaggedManifest(name, dgst)
+			if err != nil {
+				rr.Error = err.Error()
+				return rr
+			}
+			if !ok {
+				continue
+			}
+			e.emit(notifications.Target{
+				Repository: name,
+				Digest:     dgst,
+				URL:        fmt.Sprintf("/v2/%s/manifests/%s", name, dgst),
+			})
+		}
+		rr.Manifests = append(rr.Manifests, dgst)
+	}
+
+	opts := storage.GCOptions{
+		DryRun: dryRun,
+		MinAge: time.Duration(e.config.GCMinAge),
+	}
+	if dryRun {
+		opts.IgnoreManifests = rr.Manifests
+	}
+	result, err := local.GarbageCollect(name, opts)
+	if result != nil {
+		rr.Blobs, rr.Bytes = result.Blobs, result.Bytes
+		if !dryRun {
+			for _, b := range result.Blobs {
+				e.emit(notifications.Target{
+					Repository: name,
+					Digest:     b.Digest,
+					Size:       b.Size,
+					URL:        fmt.Sprintf("/v2/%s/blobs/%s", name, b.Digest),
+				})
+			}
+		}
+	}
+	if err != nil {
+		rr.Error = err.Error()
+	}
+	return rr
+}
+
+// evaluate returns tags which are deleted by the policy. tags must be sorted by
+// the push time in descending order.
+func (e *Engine) evaluate(local *storage.Local, p *Policy, name string, tags []storage.TagInfo, now time.Time) []Tag {
+	var deleted []Tag
+	for i, t := range tags {
+		switch {
+		case i < p.KeepLast:
+			continue
+		case p.keep(t.Tag):
+			continue
+		case local.ImmutableTags.Match(name, t.Tag) != nil:
+			continue
+		case p.KeepPulledWithin > 0 && now.Sub(e.PulledAt(name, t.Digest)) < time.Duration(p.KeepPulledWithin):
+			continue
+		}
+		var reason string
+		switch {
+		case p.MaxAge > 0:
+			if now.Sub(t.PushedAt) < time.Duration(p.MaxAge) {
+				continue
+			}
+			reason = fmt.Sprintf("pushed more than %s ago", time.Duration(p.MaxAge))
+		default:
+			reason = fmt.Sprintf("not in the last %d tags", p.KeepLast)
+		}
+		deleted = append(deleted, Tag{TagInfo: t, Reason: reason})
+	}
+	return deleted
+}
+
+// forget removes pulls of deleted manifests and pulls which are too old to keep anything.
+func (e *Engine) forget(report *Report) {
+	deadline := report.StartedAt.Add(-e.config.maxPulledWithin())
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rr := range report.Repositories {
+		for _, dgst := range rr.Manifests {
+			delete(e.pulls, pullKey(rr.Repository, dgst))
+			e.dirty = true
+		}
+	}
+	for key, t := range e.pulls {
+		if t.Before(deadline) {
+			delete(e.pulls, key)
+			e.dirty = true
+		}
+	}
+}
+
+func (e *Engine) emit(target notifications.Target) {
+	e.sink.Write(notifications.Event{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
+		Action:    notifications.ActionDelete,
+		Target:    target,
+		Request:   notifications.Request{Method: "DELETE"},
+		Actor:     notifications.Actor{Name: actorName},
+	})
+}
@@ -0,0 +1,144 @@
+// Package retention deletes tags and manifests which are not needed anymore by
+// policies, then deletes blobs which are not referred to anymore by the garbage collection.
+package retention
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/duration"
+)
+
+// Policy decides which tags of repositories are deleted.
+//
+// Tags which are kept by KeepLast, Keep or KeepPulledWithin are never deleted.
+// Other tags are deleted if they are older than MaxAge, or if MaxAge is zero.
+type Policy struct {
+	// Repositories are glob patterns of repository names such as "team-a/*".
+	// The syntax is the one of path.Match. If empty, every repository matches.
+	Repositories []string `json:"repositories,omitempty"`
+	// KeepLast keeps the last N tags by the push time.
+	KeepLast int `json:"keepLast,omitempty"`
+	// MaxAge deletes tags which are pushed before it.
+	MaxAge duration.Duration `json:"maxAge,omitempty"`
+	// Keep are regular expressions which match the whole tag to keep, such as "latest" or "v.*".
+	Keep []string `json:"keep,omitempty"`
+	// KeepPulledWithin keeps tags whose manifests are pulled within it.
+	KeepPulledWithin duration.Duration `json:"keepPulledWithin,omitempty"`
+
+	// keepPatterns are Keep which are compiled by Validate.
+	keepPatterns []*regexp.Regexp
+}
+
+// compileKeep compiles patterns of tags to keep, which match the whole tag.
+func compileKeep(patterns []string) ([]*regexp.Regexp, error) {
+	ret := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keep pattern %q: %w", pattern, err)
+		}
+		ret[i] = re
+	}
+	return ret, nil
+}
+
+func (p *Policy) match(repository string) bool {
+	if len(p.Repositories) == 0 {
+		return true
+	}
+	for _, pattern := range p.Repositories {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) keep(tag string) bool {
+	patterns := p.keepPatterns
+	if len(patterns) != len(p.Keep) {
+		// the policy is not validated.
+		patterns, _ = compileKeep(p.Keep)
+	}
+	for _, re := range patterns {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultInterval is the default interval of the scheduled execution.
+const DefaultInterval = 24 * time.Hour
+
+// Config is the configuration of the retention.
+type Config struct {
+	// Policies are evaluated in order, and the first one which matches the
+	// repository is applied. Tags of repositories which match none are kept.
+	Policies []Policy `json:"policies"`
+	// Interval is the interval of the scheduled execution. If zero, DefaultInterval is used.
+	Interval duration.Duration `json:"interval,omitempty"`
+	// DryRun only reports what would be deleted on the scheduled execution.
+	DryRun bool `json:"dryRun,omitempty"`
+	// GCMinAge protects blobs which are pushed within it from the garbage collection.
+	// If zero, storage.DefaultGCMinAge is used.
+	GCMinAge duration.Duration `json:"gcMinAge,omitempty"`
+}
+
+// Validate validates the configuration, and compiles patterns of policies.
+func (c *Config) Validate() error {
+	if c.Interval < 0 || c.GCMinAge < 0 {
+		return fmt.Errorf("interval and gcMinAge must not be negative")
+	}
+	for i := range c.Policies {
+		p := &c.Policies[i]
+		for _, pattern := range p.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("policies[%d]: invalid pattern %q: %w", i, pattern, err)
+			}
+		}
+		keep, err := compileKeep(p.Keep)
+		if err != nil {
+			return fmt.Errorf("policies[%d]: %w", i, err)
+		}
+		p.keepPatterns = keep
+		if p.KeepLast < 0 || p.MaxAge < 0 || p.KeepPulledWithin < 0 {
+			return fmt.Errorf("policies[%d]: keepLast, maxAge and keepPulledWithin must not be negative", i)
+		}
+		if p.KeepLast == 0 && p.MaxAge == 0 {
+			return fmt.Errorf("policies[%d]: keepLast or maxAge must be specified", i)
+		}
+	}
+	return nil
+}
+
+// policyFor returns the policy which is applied to the repository, or nil.
+func (c *Config) policyFor(repository string) *Policy {
+	for i := range c.Policies {
+		if p := &c.Policies[i]; p.match(repository) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (c *Config) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval)
+	}
+	return DefaultInterval
+}
+
+// maxPulledWithin returns the longest KeepPulledWithin of policies. Older pulls are forgotten.
+func (c *Config) maxPulledWithin() time.Duration {
+	var max duration.Duration
+	for _, p := range c.Policies {
+		if p.KeepPulledWithin > max {
+			max = p.KeepPulledWithin
+		}
+	}
+	return time.Duration(max)
+}
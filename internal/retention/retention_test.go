@@ -0,0 +1,216 @@
+package retention
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/duration"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type recorder struct {
+	events []notifications.Event
+}
+
+func (r *recorder) Write(e notifications.Event) { r.events = append(r.events, e) }
+
+// push pushes the manifest which refers to a new blob, and tags it at the time.
+func push(t *testing.T, l *storage.Local, name, tag string, age time.Duration) (manifest, blob string) {
+	t.Helper()
+	blob = digest.FromString(name + tag).String()
+	if _, err := l.PutBlobByDigest(name, blob, strings.NewReader(name+tag)); err != nil {
+		t.Fatal(err)
+	}
+	raw := `{"schemaVersion":2,"config":{"digest":"` + blob + `"}}`
+	return pushTag(t, l, name, tag, raw, age), blob
+}
+
+// pushTag pushes the manifest by the tag at the time.
+func pushTag(t *testing.T, l *storage.Local, name, tag, raw string, age time.Duration) string {
+	t.Helper()
+	_, manifest, err := l.CreateManifest(strings.NewReader(raw), name, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(l.Root, name, "tags", tag), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestEngine_Execute(t *testing.T) {
+	l := &storage.Local{Root: t.TempDir()}
+	day := 24 * time.Hour
+	push(t, l, "app", "v3", 0)
+	push(t, l, "app", "v2", time.Hour)
+	m1, b1 := push(t, l, "app", "v1", 2*day)
+	m0, _ := push(t, l, "app", "v0", 3*day)
+	pushTag(t, l, "app", "stable", `{"schemaVersion":2,"config":{"digest":"`+b1+`"}}`, 4*day)
+	mOld, bOld := push(t, l, "app", "old", 5*day)
+	push(t, l, "other", "old", 5*day)
+
+	sink := new(recorder)
+	filename := filepath.Join(t.TempDir(), "pulls.json")
+	e, err := New(l, filename, &Config{
+		Policies: []Policy{{
+			Repositories:     []string{"app"},
+			KeepLast:         2,
+			MaxAge:           duration.Duration(day),
+			Keep:             []string{"stable"},
+			KeepPulledWithin: duration.Duration(7 * day),
+		}},
+		GCMinAge: duration.Duration(time.Nanosecond),
+	}, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Write(notifications.Event{
+		Timestamp: time.Now(),
+		Action:    notifications.ActionPull,
+		Target:    notifications.Target{Repository: "app", Digest: m0, URL: "/v2/app/manifests/v0"},
+	})
+
+	check := func(report *Report) {
+		t.Helper()
+		if len(report.Repositories) != 1 {
+			t.Fatalf("want a repository, but got %+v", report.Repositories)
+		}
+		rr := report.Repositories[0]
+		var tags []string
+		for _, tag := range rr.Tags {
+			tags = append(tags, tag.Tag)
+		}
+		if want := []string{"v1", "old"}; !reflect.DeepEqual(want, tags) {
+			t.Errorf("want deleted tags %v, but got %v", want, tags)
+		}
+		if rr.KeptTags != 4 {
+			t.Errorf("want 4 kept tags, but got %d", rr.KeptTags)
+		}
+		if want := []string{mOld}; !reflect.DeepEqual(want, rr.Manifests) {
+			t.Errorf("want deleted manifests %v, but got %v", want, rr.Manifests)
+		}
+		if len(rr.Blobs) != 1 || rr.Blobs[0].Digest != bOld {
+			t.Errorf("want the deleted blob %s, but got %+v", bOld, rr.Blobs)
+		}
+	}
+
+	report, err := e.Execute(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report)
+	if _, err := l.CheckBlobByReference("app", bOld); err != nil {
+		t.Errorf("the blob is deleted on the dry run: %v", err)
+	}
+	if len(sink.events) != 0 || e.LastReport() != nil {
+		t.Errorf("the dry run must not emit events nor be the last report: %+v", sink.events)
+	}
+
+	report, err = e.Execute(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report)
+	if e.LastReport() != report {
+		t.Error("want the last report")
+	}
+	tags, err := l.StatTags("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, tag := range tags {
+		kept = append(kept, tag.Tag)
+	}
+	if want := []string{"v3", "v2", "v0", "stable"}; !reflect.DeepEqual(want, kept) {
+		t.Errorf("want tags %v, but got %v", want, kept)
+	}
+	for dgst, want := range map[string]bool{m1: true, mOld: false, bOld: false} {
+		_, err := l.CheckBlobByReference("app", dgst)
+		if got := err == nil; got != want {
+			t.Errorf("%s: want exists %v, but got %v", dgst, want, got)
+		}
+	}
+	if _, err := l.FindManifestByImage("other", "old"); err != nil {
+		t.Errorf("repositories without policies must be kept: %v", err)
+	}
+	var targets []string
+	for _, event := range sink.events {
+		if event.Action != notifications.ActionDelete || event.Target.Repository != "app" {
+			t.Errorf("unexpected event: %+v", event)
+		}
+		targets = append(targets, event.Target.URL)
+	}
+	want := []string{
+		"/v2/app/manifests/v1",
+		"/v2/app/manifests/old",
+		"/v2/app/manifests/" + mOld,
+		"/v2/app/blobs/" + bOld,
+	}
+	if !reflect.DeepEqual(want, targets) {
+		t.Errorf("want delete events of %v, but got %v", want, targets)
+	}
+}
+
+func TestEngine_Flush(t *testing.T) {
+	l := &storage.Local{Root: t.TempDir()}
+	filename := filepath.Join(t.TempDir(), "pulls.json")
+	c := &Config{Policies: []Policy{{KeepLast: 1}}}
+	e, err := New(l, filename, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	e.Write(notifications.Event{
+		Timestamp: now,
+		Action:    notifications.ActionPull,
+		Target:    notifications.Target{Repository: "app", Digest: "sha256:abc", URL: "/v2/app/manifests/latest"},
+	})
+	// blobs are not recorded.
+	e.Write(notifications.Event{
+		Timestamp: now,
+		Action:    notifications.ActionPull,
+		Target:    notifications.Target{Repository: "app", Digest: "sha256:def", URL: "/v2/app/blobs/sha256:def"},
+	})
+	e.Flush(context.Background())
+
+	e, err = New(l, filename, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.PulledAt("app", "sha256:abc"); !got.Equal(now) {
+		t.Errorf("want %v, but got %v", now, got)
+	}
+	if got := e.PulledAt("app", "sha256:def"); !got.IsZero() {
+		t.Errorf("want zero, but got %v", got)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cases := []struct {
+		c       Config
+		wantErr bool
+	}{
+		{Config{}, false},
+		{Config{Policies: []Policy{{KeepLast: 10}}}, false},
+		{Config{Policies: []Policy{{MaxAge: duration.Duration(time.Hour), Keep: []string{"v.*"}}}}, false},
+		{Config{Policies: []Policy{{Keep: []string{"latest"}}}}, true},
+		{Config{Policies: []Policy{{KeepLast: 1, Keep: []string{"("}}}}, true},
+		{Config{Policies: []Policy{{KeepLast: 1, Repositories: []string{"["}}}}, true},
+		{Config{Policies: []Policy{{KeepLast: -1, MaxAge: duration.Duration(time.Hour)}}}, true},
+		{Config{Interval: duration.Duration(-time.Hour)}, true},
+	}
+	for i, tc := range cases {
+		if err := tc.c.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("#%d: want error %v, but got %v", i, tc.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/google/uuid"
+)
+
+// subjectOf returns the digest of the subject of the manifest, or empty string.
+func subjectOf(raw []byte) string {
+	var m struct {
+		Subject *descriptor `json:"subject"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil || m.Subject == nil {
+		return ""
+	}
+	return m.Subject.Digest
+}
+
+// ManifestContents resolves the reference, and returns the digest of the manifest
+// and every content which is needed to pull it: the manifest itself, manifests
+// of the index, configs and layers. Referrers of those manifests, which have
+// them as the subject, are included as well.
+func (l *Local) ManifestContents(name, ref string) (string, []Content, error) {
+	l, span := l.startSpan("ManifestContents", "repository", name)
+	defer span.Finish()
+	_, dgst, err := l.FindRawManifestByImage(name, ref)
+	if err != nil {
+		return "", nil, err
+	}
+
+	referrers := make(map[string][]string)
+	err = l.WalkContents(name, func(c Content) error {
+		if !c.Manifest {
+			return nil
+		}
+		raw, err := ioutil.ReadFile(l.path(name, c.Digest, "manifest.json"))
+		if err != nil {
+			return nil
+		}
+		if subject := subjectOf(raw); subject != "" {
+			referrers[subject] = append(referrers[subject], c.Digest)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	var contents []Content
+	seen := make(map[string]bool)
+	queue := []string{dgst}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		fi, err := registry.PickupFileinfo(l.path(name, d))
+		if err != nil {
+			return "", nil, errors.Wrap(
+				fmt.Errorf("%q which is referred to by the manifest is not found in %q", d, name),
+				errors.WithCodeManifestBlobUnknown(),
+				errors.WithDetail(map[string]interface{}{"repository": name, "digest": d}),
+			)
+		}
+		c := Content{
+			Repository: name,
+			Digest:     d,
+			Size:       fi.Size(),
+			Manifest:   fi.Name() == "manifest.json",
+			ModTime:    fi.ModTime(),
+		}
+		contents = append(contents, c)
+		if !c.Manifest {
+			continue
+		}
+		raw, err := ioutil.ReadFile(l.path(name, d, "manifest.json"))
+		if err != nil {
+			return "", nil, err
+		}
+		queue = append(queue, references(raw)...)
+		queue = append(queue, referrers[d]...)
+	}
+	return dgst, contents, nil
+}
+
+// CopyResult is the result of CopyManifest.
+type CopyResult struct {
+	// Digest is the digest of the copied manifest.
+	Digest string `json:"digest"`
+	// Size is the size of the copied manifest.
+	Size int64 `json:"size"`
+	// Contents are contents which did not exist in the destination and are linked to it.
+	Contents []Content `json:"contents"`
+}
+
+// CopyManifest makes the manifest of the source repository which the reference
+// points to available in the destination repository with tags, without pulling
+// and pushing it. The source and the destination may be the same repository to retag it.
+//
+// Contents which are returned by ManifestContents are hard linked rather than
+// copied if the filesystem supports it, so they do not use the disk twice.
+func (l *Local) CopyManifest(src, ref, dst string, tags []string) (*CopyResult, error) {
+	l, span := l.startSpan("CopyManifest", "repository", dst, "source", src)
+	defer span.Finish()
+	dgst, contents, err := l.ManifestContents(src, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := l.LockRepository(dst)
+	defer unlock()
+	for _, tag := range tags {
+		if err := l.checkTagUpdate(dst, tag, dgst); err != nil {
+			return nil, err
+		}
+	}
+	// the first content is the manifest itself.
+	result := &CopyResult{Digest: dgst, Size: contents[0].Size, Contents: []Content{}}
+	if src != dst {
+		for _, c := range contents {
+			linked, err := l.linkContent(src, dst, c.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if linked {
+				c.Repository = dst
+				result.Contents = append(result.Contents, c)
+			}
+		}
+	}
+	for _, tag := range tags {
+		if err := l.writeTag(dst, tag, dgst); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// linkContent links the content of the source repository to the destination.
+// It reports false if the destination already has it. The caller must hold
+// the lock of the destination repository.
+func (l *Local) linkContent(src, dst, dgst string) (bool, error) {
+	unlock := l.LockDigest(dst, dgst)
+	defer unlock()
+	to := l.path(dst, dgst)
+	if blobExists(to) {
+		return false, nil
+	}
+	runlock := l.RLockDigest(src, dgst)
+	defer runlock()
+	from := l.path(src, dgst)
+	fi, err := registry.PickupFileinfo(from)
+	if err != nil {
+		return false, err
+	}
+	// the content is visible only after it is linked completely.
+	tmp := l.path(dst, "."+uuid.New().String())
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := linkOrCopy(filepath.Join(from, fi.Name()), filepath.Join(tmp, fi.Name())); err != nil {
+		return false, err
+	}
+	os.RemoveAll(to)
+	if err := os.Rename(tmp, to); err != nil {
+		return false, errors.Wrap(err, errors.WithStatusCode(http.StatusInternalServerError))
+	}
+	return true, nil
+}
+
+// linkOrCopy makes a hard link, or copies the file if the link is not supported.
+func linkOrCopy(from, to string) error {
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+	r, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
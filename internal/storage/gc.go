@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/registry"
+)
+
+// TagInfo is a tag and the manifest which it points to.
+type TagInfo struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+	// PushedAt is when the tag is pushed last time.
+	PushedAt time.Time `json:"pushedAt"`
+}
+
+// StatTags returns every tag of the repository, which is sorted by the push time
+// in descending order.
+func (l *Local) StatTags(name string) ([]TagInfo, error) {
+	l, span := l.startSpan("StatTags", "repository", name)
+	defer span.Finish()
+	runlock := l.RLockRepository(name)
+	defer runlock()
+	fis, err := ioutil.ReadDir(l.path(name, baseTagDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	tags := make([]TagInfo, 0, len(fis))
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		dgst, err := l.readTag(name, fi.Name())
+		if err != nil {
+			continue
+		}
+		tags = append(tags, TagInfo{
+			Tag:      fi.Name(),
+			Digest:   dgst,
+			PushedAt: fi.ModTime(),
+		})
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].PushedAt.After(tags[j].PushedAt)
+	})
+	return tags, nil
+}
+
+// DeleteTag deletes only the tag. The manifest which it points to is kept.
+func (l *Local) DeleteTag(name, tag string) error {
+	l, span := l.startSpan("DeleteTag", "repository", name)
+	defer span.Finish()
+	unlock := l.LockRepository(name)
+	defer unlock()
+	if err := l.checkTagDelete(name, tag); err != nil {
+		return err
+	}
+	if l.Trash {
+		dgst, err := l.readTag(name, tag)
+		if err != nil {
+			return err
+		}
+		if err := l.moveToTrash(&TrashEntry{
+			Kind:       TrashKindTag,
+			Repository: name,
+			Digest:     dgst,
+			Tags:       []string{tag},
+		}, ""); err != nil {
+			return err
+		}
+	}
+	return l.removeTag(name, tag)
+}
+
+// DeleteUntaggedManifest deletes the manifest only if no tag points to it.
+// It reports whether the manifest is deleted.
+func (l *Local) DeleteUntaggedManifest(name, dgst string) (bool, error) {
+	l, span := l.startSpan("DeleteUntaggedManifest", "repository", name)
+	defer span.Finish()
+	unlock := l.LockRepository(name)
+	defer unlock()
+	if len(l.tagsPointingTo(name, dgst)) > 0 {
+		return false, nil
+	}
+	dir := l.path(name, dgst)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if l.Trash {
+		return true, l.trashContent(TrashKindManifest, name, dgst, nil)
+	}
+	return true, os.RemoveAll(dir)
+}
+
+// descriptor is the part of descriptors in manifests which is needed to follow references.
+type descriptor struct {
+	Digest string `json:"digest"`
+}
+
+// references returns digests which the manifest refers to: the config, layers,
+// manifests of the index and the subject.
+func references(raw []byte) []string {
+	var m struct {
+		Config    *descriptor  `json:"config"`
+		Layers    []descriptor `json:"layers"`
+		Manifests []descriptor `json:"manifests"`
+		Subject   *descriptor  `json:"subject"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil
+	}
+	var refs []string
+	for _, d := range []*descriptor{m.Config, m.Subject} {
+		if d != nil && d.Digest != "" {
+			refs = append(refs, d.Digest)
+		}
+	}
+	for _, ds := range [][]descriptor{m.Layers, m.Manifests} {
+		for _, d := range ds {
+			if d.Digest != "" {
+				refs = append(refs, d.Digest)
+			}
+		}
+	}
+	return refs
+}
+
+// References returns digests which are referred to by manifests in the repository.
+func (l *Local) References(name string) (map[string]bool, error) {
+	l, span := l.startSpan("References", "repository", name)
+	defer span.Finish()
+	refs := make(map[string]bool)
+	err := l.WalkContents(name, func(c Content) error {
+		if !c.Manifest {
+			return nil
+		}
+		raw, err := ioutil.ReadFile(l.path(name, c.Digest, "manifest.json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, d := range references(raw) {
+			refs[d] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// DefaultGCMinAge is the default age of blobs which can be deleted by the garbage collection.
+const DefaultGCMinAge = time.Hour
+
+// GCOptions is the options of the garbage collection.
+type GCOptions struct {
+	// DryRun only reports blobs which would be deleted.
+	DryRun bool
+	// MinAge protects blobs which are written within it, because clients push
+	// blobs before the manifest which refers to them. If zero, DefaultGCMinAge is used.
+	MinAge time.Duration
+	// IgnoreManifests are manifests whose references are not marked, so that the
+	// dry run can report blobs which would be deleted together with them.
+	IgnoreManifests []string
+}
+
+// GCResult is the result of the garbage collection of a repository.
+type GCResult struct {
+	Repository string `json:"repository"`
+	// Blobs are blobs which are deleted, or which would be deleted on the dry run.
+	Blobs []Content `json:"blobs,omitempty"`
+	// Bytes is the total size of Blobs.
+	Bytes int64 `json:"bytes"`
+}
+
+// GarbageCollect deletes blobs of the repository which are not referred to by
+// any manifest in it or in the trash. Manifests are never deleted by the garbage
+// collection, and blobs are removed permanently even if the trash is enabled.
+func (l *Local) GarbageCollect(name string, opts GCOptions) (*GCResult, error) {
+	l, span := l.startSpan("GarbageCollect", "repository", name)
+	defer span.Finish()
+	minAge := opts.MinAge
+	if minAge <= 0 {
+		minAge = DefaultGCMinAge
+	}
+	// manifests must not be pushed while marking and sweeping, otherwise blobs
+	// which are referred to by them may be deleted.
+	unlock := l.LockRepository(name)
+	defer unlock()
+
+	ignored := make(map[string]bool, len(opts.IgnoreManifests))
+	for _, dgst := range opts.IgnoreManifests {
+		ignored[dgst] = true
+	}
+	// blobs of manifests in the trash are kept until they are purged.
+	refs := l.trashedReferences(name)
+	var blobs []Content
+	err := l.WalkContents(name, func(c Content) error {
+		if !c.Manifest {
+			blobs = append(blobs, c)
+			return nil
+		}
+		if ignored[c.Digest] {
+			return nil
+		}
+		raw, err := ioutil.ReadFile(l.path(name, c.Digest, "manifest.json"))
+		if err != nil {
+			return err
+		}
+		for _, d := range references(raw) {
+			refs[d] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GCResult{Repository: name}
+	deadline := time.Now().Add(-minAge)
+	for _, b := range blobs {
+		if refs[b.Digest] || b.ModTime.After(deadline) {
+			continue
+		}
+		if !opts.DryRun {
+			unlockDigest := l.LockDigest(name, b.Digest)
+			// the blob may be pushed again after it is walked.
+			fi, err := registry.PickupFileinfo(l.path(name, b.Digest))
+			if err != nil || fi.ModTime().After(deadline) {
+				unlockDigest()
+				continue
+			}
+			err = os.RemoveAll(l.path(name, b.Digest))
+			unlockDigest()
+			if err != nil {
+				return result, err
+			}
+		}
+		result.Blobs = append(result.Blobs, b)
+		result.Bytes += b.Size
+	}
+	if len(result.Blobs) > 0 {
+		l.logger().Debug("garbage collected",
+			"repository", name, "blobs", len(result.Blobs), "bytes", result.Bytes, "dry_run", opts.DryRun)
+	}
+	return result, nil
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// CheckWritable checks whether files can be created on the root directory.
+func (l *Local) CheckWritable() error {
+	root := l.path("")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+	// files which start with "." are ignored as temporary files.
+	f, err := ioutil.TempFile(root, ".healthcheck-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// CheckReadable checks whether the root directory, which has repositories
+// and their tags, can be listed.
+func (l *Local) CheckReadable() error {
+	_, err := ioutil.ReadDir(l.path(""))
+	if os.IsNotExist(err) {
+		// nothing has been pushed yet.
+		return nil
+	}
+	return err
+}
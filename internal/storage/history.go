@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+)
+
+// historyDir is the directory in the repository which has the history of every tag.
+// Path components of repository names never start with "_", so it never conflicts.
+const historyDir = "_history"
+
+// Actions of the tag history.
+const (
+	TagCreate = "create"
+	TagUpdate = "update"
+	TagDelete = "delete"
+)
+
+// Actor is who changes tags, which is recorded in the tag history.
+type Actor struct {
+	Name string
+	// Addr is the address of the client.
+	Addr string
+}
+
+type actorKey struct{}
+
+// WithActor returns the context which has the actor. Tags which are changed by
+// the storage with the context are recorded as the changes of the actor.
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, a)
+}
+
+func (l *Local) actor() Actor {
+	if l.ctx == nil {
+		return Actor{}
+	}
+	a, _ := l.ctx.Value(actorKey{}).(Actor)
+	return a
+}
+
+// TagHistoryEntry is a change of the tag.
+type TagHistoryEntry struct {
+	Action string `json:"action"`
+	// Previous is the digest which the tag pointed to before the change. It is empty if the tag is created.
+	Previous string `json:"previous,omitempty"`
+	// Digest is the digest which the tag points to after the change. It is empty if the tag is deleted.
+	Digest    string    `json:"digest,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+}
+
+// recordTag appends the change of the tag to the history. Nothing is recorded
+// if the digest is not changed. The caller must hold the repository lock.
+func (l *Local) recordTag(name, tag, previous, dgst string) {
+	if previous == dgst {
+		return
+	}
+	action := TagUpdate
+	switch {
+	case previous == "":
+		action = TagCreate
+	case dgst == "":
+		action = TagDelete
+	}
+	actor := l.actor()
+	entry := &TagHistoryEntry{
+		Action:    action,
+		Previous:  previous,
+		Digest:    dgst,
+		Timestamp: time.Now(),
+		Actor:     actor.Name,
+		Addr:      actor.Addr,
+	}
+	// the history is best effort, so the change of the tag is not rolled back.
+	if err := l.appendHistory(name, tag, entry); err != nil {
+		l.logger().Error("failed to record the tag history", "repository", name, "tag", tag, "error", err)
+	}
+}
+
+func (l *Local) appendHistory(name, tag string, entry *TagHistoryEntry) error {
+	dir := l.path(name, historyDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, tag), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	// a line is written by a call, so that lines are not interleaved.
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// TagHistory returns changes of the tag from the newest one. It returns the
+// error if the tag has never been changed.
+func (l *Local) TagHistory(name, tag string) ([]TagHistoryEntry, error) {
+	l, span := l.startSpan("TagHistory", "repository", name)
+	defer span.Finish()
+	runlock := l.RLockRepository(name)
+	defer runlock()
+	f, err := os.Open(l.path(name, historyDir, tag))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Wrap(err,
+				errors.WithCodeManifestUnknown(),
+				errors.WithStatusCode(http.StatusNotFound),
+			)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []TagHistoryEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e TagHistoryEntry
+		// lines which are broken by crashes are skipped.
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
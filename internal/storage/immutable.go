@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+)
+
+// checkTagUpdate returns TAG_INVALID error if the tag is immutable and it
+// already points to another digest. Pushing the same digest again is allowed.
+// The caller must hold the repository lock.
+func (l *Local) checkTagUpdate(name, tag, dgst string) error {
+	rule := l.ImmutableTags.Match(name, tag)
+	if rule == nil {
+		return nil
+	}
+	current, err := l.readTag(name, tag)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if current == dgst {
+		return nil
+	}
+	err = fmt.Errorf("tag %q is immutable, it can not be changed from %q", tag, current)
+	return errors.Wrap(err,
+		errors.WithCodeTagInvalid(),
+		errors.WithDetail(map[string]interface{}{
+			"repository": name,
+			"tag":        tag,
+			"current":    current,
+			"rule":       rule,
+		}),
+	)
+}
+
+// checkTagDelete returns DENIED error if any of tags is immutable.
+// The caller must hold the repository lock.
+func (l *Local) checkTagDelete(name string, tags ...string) error {
+	for _, tag := range tags {
+		rule := l.ImmutableTags.Match(name, tag)
+		if rule == nil {
+			continue
+		}
+		err := fmt.Errorf("tag %q is immutable, it can not be deleted", tag)
+		return errors.Wrap(err,
+			errors.WithCodeDenied(),
+			errors.WithDetail(map[string]interface{}{
+				"repository": name,
+				"tag":        tag,
+				"rule":       rule,
+			}),
+		)
+	}
+	return nil
+}
+
+// tagsPointingTo returns every tag which points to the digest.
+// The caller must hold the repository lock.
+func (l *Local) tagsPointingTo(name, dgst string) []string {
+	fis, err := ioutil.ReadDir(l.path(name, baseTagDir))
+	if err != nil {
+		return nil
+	}
+	var tags []string
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if current, err := l.readTag(name, fi.Name()); err == nil && current == dgst {
+			tags = append(tags, fi.Name())
+		}
+	}
+	return tags
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"sync"
+)
+
+// keyedLocker provides read/write locks which are identified by a key.
+//
+// Entries are reference counted and removed from the map when nobody
+// holds or waits for them, so the map does not grow with every
+// repository or digest which has ever been seen.
+type keyedLocker struct {
+	mu    sync.Mutex
+	locks map[string]*refLock
+}
+
+type refLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newKeyedLocker() *keyedLocker {
+	return &keyedLocker{
+		locks: make(map[string]*refLock),
+	}
+}
+
+func (k *keyedLocker) acquire(key string) *refLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = new(refLock)
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (k *keyedLocker) release(key string, l *refLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// Lock locks the key for writing. The returned function unlocks it.
+func (k *keyedLocker) Lock(key string) (unlock func()) {
+	l := k.acquire(key)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.release(key, l)
+	}
+}
+
+// RLock locks the key for reading. The returned function unlocks it.
+func (k *keyedLocker) RLock(key string) (runlock func()) {
+	l := k.acquire(key)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		k.release(key, l)
+	}
+}
+
+// Locks are keyed by the path on the storage, so that Local instances which
+// have the same root share them.
+var (
+	repositoryLocks = newKeyedLocker()
+	digestLocks     = newKeyedLocker()
+)
+
+// LockRepository locks the repository for writing. It must be held while
+// tags or manifests of the repository are modified.
+func (l *Local) LockRepository(name string) (unlock func()) {
+	return repositoryLocks.Lock(l.path(name))
+}
+
+// RLockRepository locks the repository for reading.
+func (l *Local) RLockRepository(name string) (runlock func()) {
+	return repositoryLocks.RLock(l.path(name))
+}
+
+// LockDigest locks the content addressed by digest in the repository for writing.
+func (l *Local) LockDigest(name, digest string) (unlock func()) {
+	return digestLocks.Lock(l.path(name, digest))
+}
+
+// RLockDigest locks the content addressed by digest in the repository for reading.
+func (l *Local) RLockDigest(name, digest string) (runlock func()) {
+	return digestLocks.RLock(l.path(name, digest))
+}
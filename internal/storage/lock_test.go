@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyedLocker(t *testing.T) {
+	k := newKeyedLocker()
+
+	var wg sync.WaitGroup
+	counter := map[string]*int{
+		"a": new(int),
+		"b": new(int),
+		"c": new(int),
+	}
+	for i := 0; i < 100; i++ {
+		for key := range counter {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				unlock := k.Lock(key)
+				defer unlock()
+				*counter[key]++
+			}(key)
+		}
+	}
+	wg.Wait()
+	for key, v := range counter {
+		if *v != 100 {
+			t.Errorf("key %q: want 100, but got %d", key, *v)
+		}
+	}
+	if len(k.locks) != 0 {
+		t.Fatalf("want all locks released, but %d remain", len(k.locks))
+	}
+}
+
+func TestKeyedLocker_RLock(t *testing.T) {
+	k := newKeyedLocker()
+	runlock1 := k.RLock("a")
+	runlock2 := k.RLock("a")
+	if got := k.locks["a"].refs; got != 2 {
+		t.Fatalf("want 2 refs, but got %d", got)
+	}
+	runlock1()
+	runlock2()
+	if _, ok := k.locks["a"]; ok {
+		t.Fatal("want lock to be released")
+	}
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+// Stats is the usage of the storage.
+type Stats struct {
+	Repositories int
+	Manifests    int
+	Blobs        int
+	// BlobBytes is the total size of blobs, which does not include manifests.
+	BlobBytes int64
+	// UploadSessions is the number of upload sessions which have uploaded any content.
+	UploadSessions int
+}
+
+// Stats walks the root directory and counts the usage of the storage.
+//
+// A blob which is shared by repositories is counted in each repository,
+// because it is stored in each of them.
+func (l *Local) Stats() (*Stats, error) {
+	l, span := l.startSpan("Stats")
+	defer span.Finish()
+	root := l.path("")
+	st := new(Stats)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() || path == root {
+			return nil
+		}
+		base := fi.Name()
+		if strings.HasPrefix(base, ".") || base == baseTagDir || base == historyDir {
+			return filepath.SkipDir
+		}
+		if filepath.Dir(path) == root && strings.HasPrefix(base, "_") {
+			return filepath.SkipDir
+		}
+		if _, err := uuid.Parse(base); err == nil {
+			st.UploadSessions++
+			return filepath.SkipDir
+		}
+		if _, err := digest.Parse(base); err == nil {
+			files, err := ioutil.ReadDir(path)
+			if err != nil || len(files) == 0 {
+				return filepath.SkipDir
+			}
+			if files[0].Name() == "manifest.json" {
+				st.Manifests++
+			} else {
+				st.Blobs++
+				st.BlobBytes += files[0].Size()
+			}
+			return filepath.SkipDir
+		}
+		if isRepository(path) {
+			st.Repositories++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Content is a blob or a manifest in a repository.
+type Content struct {
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+	// Manifest reports whether the content is a manifest.
+	Manifest bool `json:"manifest,omitempty"`
+	// ModTime is when the content is written.
+	ModTime time.Time `json:"-"`
+}
+
+// WalkContents calls fn for every blob and manifest in the repository.
+// If name is empty, contents of every repository are walked.
+func (l *Local) WalkContents(name string, fn func(c Content) error) error {
+	l, span := l.startSpan("WalkContents", "repository", name)
+	defer span.Finish()
+	root := l.path("")
+	return filepath.Walk(l.path(name), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() || path == root {
+			return nil
+		}
+		base := fi.Name()
+		if strings.HasPrefix(base, ".") || base == baseTagDir || base == historyDir {
+			return filepath.SkipDir
+		}
+		if filepath.Dir(path) == root && strings.HasPrefix(base, "_") {
+			return filepath.SkipDir
+		}
+		if _, err := digest.Parse(base); err != nil {
+			return nil
+		}
+		repo, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		repo = filepath.ToSlash(repo)
+		// nested repositories are not contents of the repository.
+		if name != "" && repo != name {
+			return filepath.SkipDir
+		}
+		files, err := ioutil.ReadDir(path)
+		if err != nil || len(files) == 0 {
+			return filepath.SkipDir
+		}
+		if err := fn(Content{
+			Repository: repo,
+			Digest:     base,
+			Size:       files[0].Size(),
+			Manifest:   files[0].Name() == "manifest.json",
+			ModTime:    files[0].ModTime(),
+		}); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
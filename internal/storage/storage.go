@@ -1,18 +1,24 @@
 package storage
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/immutable"
+	"github.com/Code-Hex/container-registry/internal/logging"
 	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/Code-Hex/container-registry/internal/tracing"
 	"github.com/google/uuid"
 	"github.com/opencontainers/go-digest"
 )
@@ -23,6 +29,7 @@ type Repository interface {
 	IssueSession() string
 	PutBlobByReference(ref string, imgName string, body io.Reader) (int64, error)
 	EnsurePutBlobBySession(sessionID string, imgName string, digest string) error
+	PutBlobByDigest(imgName string, digest string, body io.Reader) (int64, error)
 	CheckBlobByReference(imgName string, ref string) (os.FileInfo, error)
 	CreateManifest(body io.Reader, name string, tag string) (*registry.Manifest, string, error)
 
@@ -40,7 +47,51 @@ const baseTagDir = "tags"
 var _ Repository = (*Local)(nil)
 
 // Local implemented Repository using local storage.
-type Local struct{}
+type Local struct {
+	// Root is the directory where images are stored.
+	// If empty, registry.BasePath is used.
+	Root string
+	// MaxManifestSize is the maximum size of manifest json which is accepted.
+	// If zero, DefaultMaxManifestSize is used.
+	MaxManifestSize int64
+	// ImmutableTags makes tags which match its rules immutable if it is not nil.
+	ImmutableTags *immutable.Config
+	// Trash moves deleted tags, manifests and blobs to the trash instead of
+	// removing them, so that they can be restored until they are purged.
+	Trash bool
+
+	// ctx is the context of the request which the storage is used for.
+	ctx context.Context
+}
+
+// WithContext returns a shallow copy of l which logs with the logger in ctx.
+func (l *Local) WithContext(ctx context.Context) *Local {
+	l2 := *l
+	l2.ctx = ctx
+	return &l2
+}
+
+func (l *Local) logger() *logging.Logger {
+	return logging.FromContext(l.ctx)
+}
+
+// startSpan starts a span of the operation. The returned Local has the context
+// of the span, so that spans of nested operations are its children.
+func (l *Local) startSpan(op string, kv ...interface{}) (*Local, *tracing.Span) {
+	ctx, span := tracing.Start(l.ctx, "storage."+op, kv...)
+	if span == nil {
+		return l, nil
+	}
+	return l.WithContext(ctx), span
+}
+
+// path joins any number of path elements with the root directory.
+func (l *Local) path(name string, p ...string) string {
+	if l.Root == "" {
+		return registry.PathJoinWithBase(name, p...)
+	}
+	return filepath.Join(append([]string{l.Root, name}, p...)...)
+}
 
 // IssueSession issues session ID.
 func (l *Local) IssueSession() string {
@@ -52,36 +103,176 @@ func (l *Local) IssueSession() string {
 // first, this method creates directory like "testdata/<image-name>/<reference>"
 // then, put the layer file onto it.
 func (l *Local) PutBlobByReference(ref string, imgName string, body io.Reader) (int64, error) {
-	path := registry.PathJoinWithBase(imgName, ref)
+	l, span := l.startSpan("PutBlobByReference", "repository", imgName)
+	defer span.Finish()
+	unlock := l.LockDigest(imgName, ref)
+	defer unlock()
+	path := l.path(imgName, ref)
 	os.MkdirAll(path, 0700)
 	return registry.CreateLayer(body, path)
 }
 
+// CancelSession removes the file which has been put by the session.
+func (l *Local) CancelSession(sessionID string, imgName string) error {
+	l, span := l.startSpan("CancelSession", "repository", imgName)
+	defer span.Finish()
+	unlock := l.LockDigest(imgName, sessionID)
+	defer unlock()
+	return os.RemoveAll(l.path(imgName, sessionID))
+}
+
+// AppendBlobByReference appends a chunk to the file which has been put by PutBlobByReference.
+func (l *Local) AppendBlobByReference(ref string, imgName string, body io.Reader) (int64, error) {
+	l, span := l.startSpan("AppendBlobByReference", "repository", imgName)
+	defer span.Finish()
+	unlock := l.LockDigest(imgName, ref)
+	defer unlock()
+	dir := l.path(imgName, ref)
+	fi, err := registry.PickupFileinfo(dir)
+	if err != nil {
+		return 0, errors.Wrap(err,
+			errors.WithCodeBlobUploadUnknown(),
+		)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, fi.Name()), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(f, body)
+}
+
 // EnsurePutBlobBySession ensures the temporary path created by PutBlobBySession.
 //
 // this method moves from the temporary directory to "testdata/<image-name>/<digest>" directory
+// after the uploaded content is verified against the digest. If the blob is already
+// present, the uploaded content is discarded instead of rewriting the existing one,
+// and the existing one is touched so that the garbage collection keeps it.
+// If the content does not match the digest, DIGEST_INVALID is returned and the
+// session is kept.
 func (l *Local) EnsurePutBlobBySession(sessionID string, imgName string, digest string) error {
-	newDir := registry.PathJoinWithBase(imgName, digest)
-	os.MkdirAll(newDir, 0700)
+	l, span := l.startSpan("EnsurePutBlobBySession", "repository", imgName)
+	defer span.Finish()
+	unlockSession := l.LockDigest(imgName, sessionID)
+	defer unlockSession()
 
-	oldDir := registry.PathJoinWithBase(imgName, sessionID)
+	oldDir := l.path(imgName, sessionID)
 	fi, err := registry.PickupFileinfo(oldDir)
 	if err != nil {
 		return err
 	}
 	filename := fi.Name()
 	oldpath := filepath.Join(oldDir, filename)
+
+	// verify before taking the digest lock so that uploads of the same
+	// blob can be hashed in parallel.
+	f, err := os.Open(oldpath)
+	if err != nil {
+		return err
+	}
+	_, err = verifyBlob(f, digest)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	unlock := l.LockDigest(imgName, digest)
+	defer unlock()
+
+	newDir := l.path(imgName, digest)
+	if touchBlob(newDir) == nil {
+		l.logger().Debug("blob already exists, discarded the upload",
+			"repository", imgName, "digest", digest, "session", sessionID)
+		return os.RemoveAll(oldDir)
+	}
+	os.MkdirAll(newDir, 0700)
 	newpath := filepath.Join(newDir, filename)
 	if err := os.Rename(oldpath, newpath); err != nil {
 		return err
 	}
-	os.Remove(oldDir)
-	return nil
+	// the session is removed only after it is committed, so that the upload
+	// can be completed again if it fails such as by the invalid digest.
+	return os.RemoveAll(oldDir)
+}
+
+// PutBlobByDigest puts the blob which is uploaded monolithically.
+//
+// The body is verified against the digest. If the blob is already present,
+// the body is only verified and the existing blob is touched.
+func (l *Local) PutBlobByDigest(imgName string, digest string, body io.Reader) (int64, error) {
+	l, span := l.startSpan("PutBlobByDigest", "repository", imgName)
+	defer span.Finish()
+	dir := l.path(imgName, digest)
+	unlock := l.LockDigest(imgName, digest)
+	exists := touchBlob(dir) == nil
+	unlock()
+	if exists {
+		return verifyBlob(body, digest)
+	}
+
+	// Put the body onto the session directory first, so that the content
+	// is not visible until it is verified.
+	sessionID := l.IssueSession()
+	size, err := l.PutBlobByReference(sessionID, imgName, body)
+	if err != nil {
+		os.RemoveAll(l.path(imgName, sessionID))
+		return 0, err
+	}
+	if err := l.EnsurePutBlobBySession(sessionID, imgName, digest); err != nil {
+		l.CancelSession(sessionID, imgName)
+		return 0, err
+	}
+	return size, nil
+}
+
+// blobExists reports whether the blob directory contains the blob.
+func blobExists(dir string) bool {
+	_, err := registry.PickupFileinfo(dir)
+	return err == nil
+}
+
+// touchBlob updates the modification time of the blob in the directory, so
+// that the garbage collection treats the blob which is pushed again as a new
+// one until the manifest which refers to it is pushed.
+// The caller must hold the digest lock.
+func touchBlob(dir string) error {
+	fi, err := registry.PickupFileinfo(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(filepath.Join(dir, fi.Name()), now, now)
+}
+
+// verifyBlob reads r until EOF and checks whether the content matches dgst.
+func verifyBlob(r io.Reader, dgst string) (int64, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return 0, errors.Wrap(err,
+			errors.WithCodeDigestInvalid(),
+		)
+	}
+	verifier := d.Verifier()
+	size, err := io.Copy(verifier, r)
+	if err != nil {
+		return 0, err
+	}
+	if !verifier.Verified() {
+		err := fmt.Errorf("content does not match digest %q", dgst)
+		return 0, errors.Wrap(err,
+			errors.WithCodeDigestInvalid(),
+		)
+	}
+	return size, nil
 }
 
 // CheckBlobByReference checks for the existence of a blob with a ref.
 func (l *Local) CheckBlobByReference(imgName string, ref string) (os.FileInfo, error) {
-	dir := registry.PathJoinWithBase(imgName, ref)
+	l, span := l.startSpan("CheckBlobByReference", "repository", imgName)
+	defer span.Finish()
+	runlock := l.RLockDigest(imgName, ref)
+	defer runlock()
+	dir := l.path(imgName, ref)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		return nil, errors.Wrap(err,
 			errors.WithStatusCode(http.StatusNotFound),
@@ -94,54 +285,245 @@ func (l *Local) CheckBlobByReference(imgName string, ref string) (os.FileInfo, e
 //
 // this method creates to "<image-name>/<tag>/manifest.json"
 func (l *Local) CreateManifest(body io.Reader, name string, tag string) (*registry.Manifest, string, error) {
-	hash := sha256.New()
-	reader := io.TeeReader(body, hash)
-	var m registry.Manifest
-	if err := json.NewDecoder(reader).Decode(&m); err != nil {
-		return nil, "", errors.Wrap(err,
-			errors.WithCodeManifestInvalid(),
-		)
+	return l.CreateManifestIfMatch(body, name, tag, "")
+}
+
+// CreateManifestIfMatch is like CreateManifest, but the tag is updated only if
+// it currently points to the ifMatch digest. This allows clients to update tags
+// with optimistic concurrency control.
+//
+// If ifMatch is empty, the tag is always updated. If ifMatch is "*", the tag must exist.
+func (l *Local) CreateManifestIfMatch(body io.Reader, name, tag, ifMatch string) (*registry.Manifest, string, error) {
+	l, span := l.startSpan("CreateManifestIfMatch", "repository", name)
+	defer span.Finish()
+	m, sha256sum, err := l.decodeManifest(body)
+	if err != nil {
+		return nil, "", err
 	}
-	sha256sum := fmt.Sprintf("sha256:%x", hash.Sum(nil))
 
-	// create directory
-	path := registry.PathJoinWithBase(name, baseTagDir)
-	os.MkdirAll(path, 0700)
+	unlock := l.LockRepository(name)
+	defer unlock()
+
+	if ifMatch != "" {
+		current, err := l.readTag(name, tag)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, "", err
+		}
+		if ifMatch == "*" && current == "" || ifMatch != "*" && ifMatch != current {
+			err := fmt.Errorf("tag %q does not point to %q", tag, ifMatch)
+			return nil, "", errors.Wrap(err,
+				errors.WithCodeTagInvalid(),
+				errors.WithStatusCode(http.StatusPreconditionFailed),
+				errors.WithDetail(map[string]string{
+					"tag":     tag,
+					"current": current,
+					"ifMatch": ifMatch,
+				}),
+			)
+		}
+	}
+
+	if err := l.checkTagUpdate(name, tag, sha256sum); err != nil {
+		return nil, "", err
+	}
+
+	// create manifest file before the tag points to it.
+	if err := l.writeManifest(name, sha256sum, m); err != nil {
+		return nil, "", err
+	}
 
 	// create tag file
-	tagPath := filepath.Join(path, tag)
-	tagFile, err := os.Create(tagPath)
-	if err != nil {
+	if err := l.writeTag(name, tag, sha256sum); err != nil {
 		return nil, "", errors.Wrap(err,
 			errors.WithCodeTagInvalid(),
 		)
 	}
-	tagFile.Write([]byte(sha256sum))
-	tagFile.Close()
+	return m.Manifest, sha256sum, nil
+}
 
-	manifestPath := registry.PathJoinWithBase(name, sha256sum)
-	os.MkdirAll(manifestPath, 0700)
+// PutManifest puts manifest json file which is not pointed by any tags.
+//
+// this method creates to "<image-name>/<digest>/manifest.json"
+func (l *Local) PutManifest(body io.Reader, name string) (*registry.Manifest, string, error) {
+	l, span := l.startSpan("PutManifest", "repository", name)
+	defer span.Finish()
+	return l.putManifest(body, name, "")
+}
 
-	// create manifest file onto it
-	manifestPath = filepath.Join(manifestPath, "manifest.json")
-	manifestF, err := os.Create(manifestPath)
+// PutManifestByDigest is like PutManifest, but the manifest must match the
+// digest, such as manifests of indexes and referrers which are pushed by
+// their digests. No tag is changed, so immutable tags are never affected.
+func (l *Local) PutManifestByDigest(body io.Reader, name, dgst string) (*registry.Manifest, string, error) {
+	l, span := l.startSpan("PutManifestByDigest", "repository", name)
+	defer span.Finish()
+	return l.putManifest(body, name, dgst)
+}
+
+// putManifest puts the manifest which must match dgst unless it is empty.
+func (l *Local) putManifest(body io.Reader, name, dgst string) (*registry.Manifest, string, error) {
+	m, sha256sum, err := l.decodeManifest(body)
+	if err != nil {
+		return nil, "", err
+	}
+	if dgst != "" && dgst != sha256sum {
+		err := fmt.Errorf("manifest digest %q does not match %q", sha256sum, dgst)
+		return nil, "", errors.Wrap(err, errors.WithCodeDigestInvalid())
+	}
+	unlock := l.LockRepository(name)
+	defer unlock()
+	if err := l.writeManifest(name, sha256sum, m); err != nil {
+		return nil, "", err
+	}
+	return m.Manifest, sha256sum, nil
+}
+
+// DefaultMaxManifestSize is the default maximum size of manifest json which is accepted.
+const DefaultMaxManifestSize = 4 << 20
+
+// rawManifest is a decoded manifest with the original json.
+type rawManifest struct {
+	*registry.Manifest
+	raw []byte
+}
+
+// decodeManifest decodes manifest json and calculates the digest of it.
+func (l *Local) decodeManifest(body io.Reader) (*rawManifest, string, error) {
+	limit := l.MaxManifestSize
+	if limit <= 0 {
+		limit = DefaultMaxManifestSize
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
 	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(raw)) > limit {
+		return nil, "", errors.Wrap(
+			fmt.Errorf("manifest exceeds %d bytes", limit),
+			errors.WithCodeManifestInvalid(),
+			errors.WithStatusCode(http.StatusRequestEntityTooLarge),
+		)
+	}
+	var m registry.Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
 		return nil, "", errors.Wrap(err,
+			errors.WithCodeManifestInvalid(),
+		)
+	}
+	return &rawManifest{Manifest: &m, raw: raw}, fmt.Sprintf("sha256:%x", sha256.Sum256(raw)), nil
+}
+
+// writeManifest writes manifest json file onto the digest directory.
+// The original json is written as it is, so the file matches the digest.
+// The caller must hold the repository lock.
+func (l *Local) writeManifest(name, dgst string, m *rawManifest) error {
+	manifestPath := l.path(name, dgst)
+	os.MkdirAll(manifestPath, 0700)
+	manifestPath = filepath.Join(manifestPath, "manifest.json")
+	if err := writeFileAtomic(manifestPath, func(w io.Writer) error {
+		_, err := w.Write(m.raw)
+		return err
+	}); err != nil {
+		return errors.Wrap(err,
 			errors.WithCodeTagInvalid(),
 		)
 	}
-	defer manifestF.Close()
-	if err := json.NewEncoder(manifestF).Encode(&m); err != nil {
-		return nil, "", err
+	return nil
+}
+
+// StatTag returns the FileInfo of the tag. The modification time of it
+// represents when the tag was pushed last time.
+func (l *Local) StatTag(name, tag string) (os.FileInfo, error) {
+	l, span := l.startSpan("StatTag", "repository", name)
+	defer span.Finish()
+	runlock := l.RLockRepository(name)
+	defer runlock()
+	return os.Stat(l.path(name, baseTagDir, tag))
+}
+
+// readTag reads the digest which the tag points to.
+func (l *Local) readTag(name, tag string) (string, error) {
+	dgst, err := ioutil.ReadFile(l.path(name, baseTagDir, tag))
+	if err != nil {
+		return "", err
+	}
+	return string(dgst), nil
+}
+
+// writeTag points the tag to the digest, and records the change in the history.
+// The caller must hold the repository lock.
+func (l *Local) writeTag(name, tag, dgst string) error {
+	previous, _ := l.readTag(name, tag)
+	path := l.path(name, baseTagDir)
+	os.MkdirAll(path, 0700)
+	err := writeFileAtomic(filepath.Join(path, tag), func(w io.Writer) error {
+		_, err := io.WriteString(w, dgst)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	l.recordTag(name, tag, previous, dgst)
+	return nil
+}
+
+// removeTag removes the tag, and records the change in the history.
+// The caller must hold the repository lock.
+func (l *Local) removeTag(name, tag string) error {
+	previous, err := l.readTag(name, tag)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(l.path(name, baseTagDir, tag)); err != nil {
+		return err
+	}
+	l.recordTag(name, tag, previous, "")
+	return nil
+}
+
+// writeFileAtomic writes a file via a temporary file which is renamed to path,
+// so readers never observe a partially written file.
+//
+// The temporary file name starts with "." which is never valid as a tag or digest.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	dir, base := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeTagsPointingTo removes every tag which points to the digest.
+// The caller must hold the repository lock.
+func (l *Local) removeTagsPointingTo(name, dgst string) {
+	for _, tag := range l.tagsPointingTo(name, dgst) {
+		l.removeTag(name, tag)
 	}
-	return &m, sha256sum, nil
 }
 
 // FindBlobByImage finds blob by docker image name and that's digest.
 //
 // digest format is like <digest-alg>:<digest>. see grammar.Digest
 func (l *Local) FindBlobByImage(name, digest string) (*os.File, error) {
-	dir := registry.PathJoinWithBase(name, digest)
+	l, span := l.startSpan("FindBlobByImage", "repository", name)
+	defer span.Finish()
+	runlock := l.RLockDigest(name, digest)
+	defer runlock()
+	dir := l.path(name, digest)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		return nil, errors.Wrap(err,
 			errors.WithCodeBlobUnknown(),
@@ -157,54 +539,91 @@ func (l *Local) FindBlobByImage(name, digest string) (*os.File, error) {
 
 // FindManifestByImage finds manifest json file by image name and that's tag.
 func (l *Local) FindManifestByImage(name, ref string) (*registry.Manifest, error) {
-	tagFilePath := registry.PathJoinWithBase(name, baseTagDir, ref)
+	l, span := l.startSpan("FindManifestByImage", "repository", name)
+	defer span.Finish()
+	raw, _, err := l.FindRawManifestByImage(name, ref)
+	if err != nil {
+		return nil, err
+	}
+	var m registry.Manifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// FindRawManifestByImage finds manifest json file by image name and that's tag.
+// It returns the json as it is stored and the digest of it.
+func (l *Local) FindRawManifestByImage(name, ref string) ([]byte, string, error) {
+	l, span := l.startSpan("FindRawManifestByImage", "repository", name)
+	defer span.Finish()
+	runlock := l.RLockRepository(name)
+	defer runlock()
+	tagFilePath := l.path(name, baseTagDir, ref)
 	if _, err := os.Stat(tagFilePath); err == nil {
 		digest, err := ioutil.ReadFile(tagFilePath)
 		if err != nil {
-			return nil, errors.Wrap(err)
+			return nil, "", errors.Wrap(err)
 		}
 		ref = string(digest)
 	}
 
-	manifest := registry.PathJoinWithBase(name, ref, "manifest.json")
+	manifest := l.path(name, ref, "manifest.json")
 	if _, err := os.Stat(manifest); os.IsNotExist(err) {
-		return nil, errors.Wrap(err,
+		return nil, "", errors.Wrap(err,
 			errors.WithCodeManifestUnknown(),
 		)
 	}
-	f, err := os.Open(manifest)
+	raw, err := ioutil.ReadFile(manifest)
 	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	var m registry.Manifest
-	if err := json.NewDecoder(f).Decode(&m); err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return &m, nil
+	return raw, ref, nil
 }
 
 // DeleteManifestByImage deletes manifest json file by image name and that's tag.
+//
+// The reference may be a tag or a digest. Every tag which points to the
+// manifest is removed with it, not only the tag of the reference, so that no
+// tag is left pointing to the manifest which does not exist. To remove only a
+// tag, use DeleteTag.
 func (l *Local) DeleteManifestByImage(name, ref string) (err error) {
+	l, span := l.startSpan("DeleteManifestByImage", "repository", name)
+	defer span.Finish()
+	unlock := l.LockRepository(name)
+	defer unlock()
+	var tag string
 	if _, err := digest.Parse(ref); err != nil {
 		// remove tag too
-		tag := registry.PathJoinWithBase(name, baseTagDir, ref)
-		dgst, err := ioutil.ReadFile(tag)
+		tag = ref
+		dgst, err := l.readTag(name, tag)
 		if err != nil {
-			log.Println("-----------", err, tag)
+			l.logger().Debug("failed to read tag", "repository", name, "tag", ref, "error", err)
 			return errors.Wrap(err)
 		}
-		os.Remove(tag)
-		ref = string(dgst)
+		ref = dgst
+	}
+	// tags which point to the manifest are removed with it, so none of them must be immutable.
+	tags := l.tagsPointingTo(name, ref)
+	if err := l.checkTagDelete(name, tags...); err != nil {
+		return err
+	}
+	if tag != "" {
+		l.removeTag(name, tag)
 	}
 
-	manifestDir := registry.PathJoinWithBase(name, ref)
+	manifestDir := l.path(name, ref)
 	manifest := filepath.Join(manifestDir, "manifest.json")
 	if _, err := os.Stat(manifest); os.IsNotExist(err) {
 		return errors.Wrap(err,
 			errors.WithStatusCode(http.StatusAccepted),
 		)
 	}
+	// other tags must not be left pointing to the removed manifest.
+	l.removeTagsPointingTo(name, ref)
+	if l.Trash {
+		return l.trashContent(TrashKindManifest, name, ref, tags)
+	}
 	return os.RemoveAll(manifestDir)
 }
 
@@ -212,18 +631,93 @@ func (l *Local) DeleteManifestByImage(name, ref string) (err error) {
 //
 // digest format is like <digest-alg>:<digest>. see grammar.Digest
 func (l *Local) DeleteBlobByImage(name, digest string) error {
-	dir := registry.PathJoinWithBase(name, digest)
+	l, span := l.startSpan("DeleteBlobByImage", "repository", name)
+	defer span.Finish()
+	unlock := l.LockDigest(name, digest)
+	defer unlock()
+	dir := l.path(name, digest)
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		return errors.Wrap(err,
 			errors.WithCodeBlobUnknown(),
 		)
 	}
+	if l.Trash {
+		return l.trashContent(TrashKindBlob, name, digest, nil)
+	}
 	return os.RemoveAll(dir)
 }
 
+// ListRepositories lists names of repositories in lexical order.
+//
+// A directory is a repository if it has tags or blobs. Directories which
+// start with "_" or "." under the root are not repositories.
+func (l *Local) ListRepositories() ([]string, error) {
+	l, span := l.startSpan("ListRepositories")
+	defer span.Finish()
+	root := l.path("")
+	var names []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() || path == root {
+			return nil
+		}
+		base := fi.Name()
+		if strings.HasPrefix(base, ".") || base == baseTagDir || base == historyDir {
+			return filepath.SkipDir
+		}
+		if filepath.Dir(path) == root && strings.HasPrefix(base, "_") {
+			return filepath.SkipDir
+		}
+		if _, err := digest.Parse(base); err == nil {
+			return filepath.SkipDir
+		}
+		if isRepository(path) {
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func isRepository(dir string) bool {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		if fi.Name() == baseTagDir {
+			return true
+		}
+		if _, err := digest.Parse(fi.Name()); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // ListTags lists tags by image name.
 func (l *Local) ListTags(name string) ([]string, error) {
-	path := registry.PathJoinWithBase(name, baseTagDir)
+	l, span := l.startSpan("ListTags", "repository", name)
+	defer span.Finish()
+	runlock := l.RLockRepository(name)
+	defer runlock()
+	path := l.path(name, baseTagDir)
 	fis, err := ioutil.ReadDir(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -233,9 +727,13 @@ func (l *Local) ListTags(name string) ([]string, error) {
 		}
 		return nil, err
 	}
-	tags := make([]string, len(fis))
-	for i, tag := range fis {
-		tags[i] = tag.Name()
+	tags := make([]string, 0, len(fis))
+	for _, tag := range fis {
+		// skip temporary files which are created by writeTag.
+		if strings.HasPrefix(tag.Name(), ".") {
+			continue
+		}
+		tags = append(tags, tag.Name())
 	}
 	return tags, nil
 }
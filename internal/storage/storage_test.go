@@ -0,0 +1,706 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/immutable"
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		panic(err)
+	}
+	registry.BasePath = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestLocal_EnsurePutBlobBySession_Concurrent(t *testing.T) {
+	l := new(Local)
+	const name = "dedup/concurrent"
+	content := bytes.Repeat([]byte("layer"), 4096)
+	dgst := digest.FromBytes(content).String()
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sessionID := l.IssueSession()
+			if _, err := l.PutBlobByReference(sessionID, name, bytes.NewReader(content)); err != nil {
+				t.Errorf("PutBlobByReference: %v", err)
+				return
+			}
+			if err := l.EnsurePutBlobBySession(sessionID, name, dgst); err != nil {
+				t.Errorf("EnsurePutBlobBySession: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fis, err := ioutil.ReadDir(registry.PathJoinWithBase(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != dgst {
+		t.Fatalf("want only %q directory, but got %d entries", dgst, len(fis))
+	}
+	f, err := l.FindBlobByImage(name, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("stored blob is broken")
+	}
+}
+
+func TestLocal_PutBlobByDigest(t *testing.T) {
+	l := new(Local)
+	const name = "dedup/monolithic"
+	content := []byte(`{"architecture":"amd64"}`)
+	dgst := digest.FromBytes(content).String()
+
+	for i := 0; i < 2; i++ {
+		size, err := l.PutBlobByDigest(name, dgst, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("PutBlobByDigest: %v", err)
+		}
+		if size != int64(len(content)) {
+			t.Fatalf("want size %d, but got %d", len(content), size)
+		}
+	}
+
+	// the existing blob is still verified against the digest.
+	_, err := l.PutBlobByDigest(name, dgst, bytes.NewReader([]byte("broken")))
+	e, ok := err.(*errors.Error)
+	if !ok || e.Code != "DIGEST_INVALID" {
+		t.Fatalf("want DIGEST_INVALID, but got %v", err)
+	}
+}
+
+func TestLocal_EnsurePutBlobBySession_DigestInvalid(t *testing.T) {
+	l := new(Local)
+	const name = "dedup/invalid"
+	sessionID := l.IssueSession()
+	if _, err := l.PutBlobByReference(sessionID, name, bytes.NewReader([]byte("content"))); err != nil {
+		t.Fatal(err)
+	}
+	err := l.EnsurePutBlobBySession(sessionID, name, digest.FromString("other").String())
+	e, ok := err.(*errors.Error)
+	if !ok || e.Code != "DIGEST_INVALID" {
+		t.Fatalf("want DIGEST_INVALID, but got %v", err)
+	}
+	// the session is kept, so that the upload can be completed with the right digest.
+	if _, err := os.Stat(registry.PathJoinWithBase(name, sessionID)); err != nil {
+		t.Fatalf("want session directory to be kept, but got %v", err)
+	}
+	if err := l.EnsurePutBlobBySession(sessionID, name, digest.FromString("content").String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(registry.PathJoinWithBase(name, sessionID)); !os.IsNotExist(err) {
+		t.Fatalf("want session directory to be removed, but got %v", err)
+	}
+
+	// blobs which are put by digest do not leave sessions.
+	if _, err := l.PutBlobByDigest(name, digest.FromString("other").String(), bytes.NewReader([]byte("content"))); err == nil {
+		t.Fatal("want error")
+	}
+	fis, err := ioutil.ReadDir(registry.PathJoinWithBase(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Name() != digest.FromString("content").String() {
+			t.Errorf("unexpected file %q", fi.Name())
+		}
+	}
+}
+
+func TestLocal_ListRepositories(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	for _, name := range []string{"b", "a/b", "a-c", "a"} {
+		if _, _, err := l.CreateManifest(strings.NewReader(`{"schemaVersion":2}`), name, "latest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not repositories
+	for _, dir := range []string{"_replication/x", "empty", "a/" + uuid.New().String()} {
+		if err := os.MkdirAll(filepath.Join(l.Root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := l.ListRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "a-c", "a/b", "b"}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %v, but got %v", want, got)
+	}
+}
+
+func TestLocal_Stats(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	for _, name := range []string{"a", "a/b"} {
+		if _, _, err := l.CreateManifest(strings.NewReader(`{"schemaVersion":2}`), name, "latest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := "content"
+	if _, err := l.PutBlobByDigest("a", digest.FromString(content).String(), strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.PutBlobByReference(l.IssueSession(), "new", strings.NewReader("partial")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := l.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Stats{
+		Repositories:   2,
+		Manifests:      2,
+		Blobs:          1,
+		BlobBytes:      int64(len(content)),
+		UploadSessions: 1,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want %+v, but got %+v", want, got)
+	}
+}
+
+func TestLocal_WalkContents(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	manifest := `{"schemaVersion":2}`
+	for _, name := range []string{"a", "a/b"} {
+		if _, _, err := l.CreateManifest(strings.NewReader(manifest), name, "latest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := "content"
+	blob := digest.FromString(content).String()
+	if _, err := l.PutBlobByDigest("a", blob, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	collect := func(name string) []Content {
+		t.Helper()
+		var got []Content
+		if err := l.WalkContents(name, func(c Content) error {
+			if c.ModTime.IsZero() {
+				t.Errorf("ModTime of %s is not set", c.Digest)
+			}
+			c.ModTime = time.Time{}
+			got = append(got, c)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(got, func(i, j int) bool {
+			return got[i].Repository+got[i].Digest < got[j].Repository+got[j].Digest
+		})
+		return got
+	}
+	m := digest.FromString(manifest).String()
+	want := []Content{
+		{Repository: "a", Digest: m, Size: int64(len(manifest)), Manifest: true},
+		{Repository: "a", Digest: blob, Size: int64(len(content))},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Digest < want[j].Digest })
+	if got := collect("a"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %+v, but got %+v", want, got)
+	}
+	if got := collect(""); len(got) != 3 {
+		t.Errorf("want 3 contents, but got %+v", got)
+	}
+}
+
+func TestLocal_ImmutableTags(t *testing.T) {
+	l := &Local{
+		Root: t.TempDir(),
+		ImmutableTags: &immutable.Config{Rules: []immutable.Rule{
+			{Semver: true},
+		}},
+	}
+	v1, v2 := `{"schemaVersion":2}`, `{"schemaVersion":2,"mediaType":"x"}`
+	code := func(err error) string {
+		t.Helper()
+		e, ok := err.(*errors.Error)
+		if !ok {
+			t.Fatalf("want *errors.Error, but got %v", err)
+		}
+		return e.Code
+	}
+
+	if _, _, err := l.CreateManifest(strings.NewReader(v1), "app", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	// pushing the same manifest again is allowed.
+	if _, _, err := l.CreateManifest(strings.NewReader(v1), "app", "v1.0.0"); err != nil {
+		t.Errorf("want no error, but got %v", err)
+	}
+	_, _, err := l.CreateManifest(strings.NewReader(v2), "app", "v1.0.0")
+	if got := code(err); got != "TAG_INVALID" {
+		t.Errorf("want TAG_INVALID, but got %s", got)
+	}
+	// mutable tags can be moved.
+	for _, m := range []string{v1, v2, v1} {
+		if _, _, err := l.CreateManifest(strings.NewReader(m), "app", "latest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := code(l.DeleteManifestByImage("app", "v1.0.0")); got != "DENIED" {
+		t.Errorf("want DENIED, but got %s", got)
+	}
+	// the manifest can not be deleted by other references while the immutable tag points to it.
+	if got := code(l.DeleteManifestByImage("app", "latest")); got != "DENIED" {
+		t.Errorf("want DENIED, but got %s", got)
+	}
+	if got := code(l.DeleteManifestByImage("app", digest.FromString(v1).String())); got != "DENIED" {
+		t.Errorf("want DENIED, but got %s", got)
+	}
+	tags, err := l.ListTags("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"latest", "v1.0.0"}; !reflect.DeepEqual(want, tags) {
+		t.Errorf("want %v, but got %v", want, tags)
+	}
+}
+
+func TestLocal_ImmutableTags_Repositories(t *testing.T) {
+	l := &Local{
+		Root: t.TempDir(),
+		ImmutableTags: &immutable.Config{Rules: []immutable.Rule{
+			{Repositories: []string{"release/*"}, Semver: true},
+		}},
+	}
+	v1, v2 := `{"schemaVersion":2}`, `{"schemaVersion":2,"mediaType":"x"}`
+	for _, m := range []string{v1, v1} {
+		if _, _, err := l.CreateManifest(strings.NewReader(m), "release/app", "v1.2.3"); err != nil {
+			t.Fatalf("re-push of the same digest: want no error, but got %v", err)
+		}
+	}
+	if _, _, err := l.CreateManifest(strings.NewReader(v2), "release/app", "v1.2.3"); err == nil {
+		t.Error("want error for re-push of another digest")
+	}
+	// other repositories are not affected.
+	for _, m := range []string{v1, v2} {
+		if _, _, err := l.CreateManifest(strings.NewReader(m), "dev/app", "v1.2.3"); err != nil {
+			t.Errorf("want no error, but got %v", err)
+		}
+	}
+	if err := l.DeleteManifestByImage("dev/app", "v1.2.3"); err != nil {
+		t.Errorf("want no error, but got %v", err)
+	}
+}
+
+func TestLocal_GarbageCollect(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	put := func(content string, age time.Duration) string {
+		t.Helper()
+		dgst := digest.FromString(content).String()
+		if _, err := l.PutBlobByDigest("app", dgst, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := l.CheckBlobByReference("app", dgst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(l.path("app", dgst), fi.Name()), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return dgst
+	}
+	referenced := put("referenced", 2*time.Hour)
+	unreferenced := put("unreferenced", 2*time.Hour)
+	fresh := put("fresh", 0)
+	// blobs which are pushed again are new until the manifest is pushed.
+	repushed := put("repushed", 2*time.Hour)
+	if _, err := l.PutBlobByDigest("app", repushed, strings.NewReader("repushed")); err != nil {
+		t.Fatal(err)
+	}
+	uploaded := put("uploaded", 2*time.Hour)
+	sessionID := l.IssueSession()
+	if _, err := l.PutBlobByReference(sessionID, "app", strings.NewReader("uploaded")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.EnsurePutBlobBySession(sessionID, "app", uploaded); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"schemaVersion":2,"config":{"digest":"` + referenced + `"}}`
+	if _, _, err := l.CreateManifest(strings.NewReader(manifest), "app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := l.GarbageCollect("app", GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Blobs) != 1 || result.Blobs[0].Digest != unreferenced || result.Bytes != int64(len("unreferenced")) {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if _, err := l.CheckBlobByReference("app", unreferenced); err != nil {
+		t.Errorf("the blob is deleted on the dry run: %v", err)
+	}
+
+	if _, err := l.GarbageCollect("app", GCOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for dgst, want := range map[string]bool{referenced: true, unreferenced: false, fresh: true, repushed: true, uploaded: true} {
+		_, err := l.CheckBlobByReference("app", dgst)
+		if got := err == nil; got != want {
+			t.Errorf("%s: want exists %v, but got %v", dgst, want, got)
+		}
+	}
+	if _, err := l.FindManifestByImage("app", "latest"); err != nil {
+		t.Errorf("the manifest is deleted: %v", err)
+	}
+}
+
+func TestLocal_PutManifestByDigest(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	manifest := `{"schemaVersion":2}`
+	dgst := digest.FromString(manifest).String()
+	if _, got, err := l.PutManifestByDigest(strings.NewReader(manifest), "app", dgst); err != nil || got != dgst {
+		t.Fatalf("want %s, but got %s, %v", dgst, got, err)
+	}
+	if _, _, err := l.FindRawManifestByImage("app", dgst); err != nil {
+		t.Error(err)
+	}
+	_, _, err := l.PutManifestByDigest(strings.NewReader(`{"schemaVersion":2,"config":{}}`), "app", dgst)
+	if e, ok := err.(*errors.Error); !ok || e.Code != "DIGEST_INVALID" {
+		t.Errorf("want DIGEST_INVALID, but got %v", err)
+	}
+}
+
+func TestLocal_DeleteUntaggedManifest(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	manifest := `{"schemaVersion":2}`
+	_, dgst, err := l.CreateManifest(strings.NewReader(manifest), "app", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.CreateManifest(strings.NewReader(manifest), "app", "b"); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := l.StatTags("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0].Digest != dgst {
+		t.Fatalf("unexpected tags: %+v", tags)
+	}
+	if err := l.DeleteTag("app", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := l.DeleteUntaggedManifest("app", dgst); err != nil || deleted {
+		t.Fatalf("the manifest which is tagged must be kept: %v, %v", deleted, err)
+	}
+	if err := l.DeleteTag("app", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := l.DeleteUntaggedManifest("app", dgst); err != nil || !deleted {
+		t.Fatalf("want deleted, but got %v, %v", deleted, err)
+	}
+}
+
+func TestLocal_DeleteManifestByImage(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	manifest := `{"schemaVersion":2}`
+	for _, tag := range []string{"a", "b", "c"} {
+		if _, _, err := l.CreateManifest(strings.NewReader(manifest), "app", tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`
+	if _, _, err := l.CreateManifest(strings.NewReader(other), "app", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting by the tag removes the other tags which point to the manifest.
+	if err := l.DeleteManifestByImage("app", "a"); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := l.StatTags("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Tag != "other" {
+		t.Fatalf("unexpected tags: %+v", tags)
+	}
+	if _, _, err := l.FindRawManifestByImage("app", digest.FromString(manifest).String()); err == nil {
+		t.Error("the manifest is not deleted")
+	}
+
+	// deleting by the digest removes tags as well.
+	if err := l.DeleteManifestByImage("app", digest.FromString(other).String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.StatTag("app", "other"); err == nil {
+		t.Error("the tag which points to the deleted manifest is left")
+	}
+}
+
+func TestLocal_Trash(t *testing.T) {
+	l := &Local{Root: t.TempDir(), Trash: true}
+	layer := "layer"
+	layerDigest := digest.FromString(layer).String()
+	if _, err := l.PutBlobByDigest("app", layerDigest, strings.NewReader(layer)); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"schemaVersion":2,"layers":[{"digest":"` + layerDigest + `"}]}`
+	_, dgst, err := l.CreateManifest(strings.NewReader(manifest), "app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.CreateManifest(strings.NewReader(manifest), "app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.DeleteManifestByImage("app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.FindManifestByImage("app", dgst); err == nil {
+		t.Error("the deleted manifest must be hidden")
+	}
+	entries, err := l.ListTrash("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Kind != TrashKindManifest || entries[0].Digest != dgst ||
+		!reflect.DeepEqual(entries[0].Tags, []string{"latest", "v1"}) || entries[0].Size != int64(len(manifest)) {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	// blobs of manifests in the trash are not collected.
+	if result, err := l.GarbageCollect("app", GCOptions{MinAge: time.Nanosecond}); err != nil || len(result.Blobs) != 0 {
+		t.Fatalf("want no collected blobs, but got %+v, %v", result, err)
+	}
+
+	// the restore conflicts with the tag which is pushed again.
+	other := `{"schemaVersion":2}`
+	if _, _, err := l.CreateManifest(strings.NewReader(other), "app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.RestoreTrash(entries[0].ID); err == nil {
+		t.Fatal("want conflict error")
+	}
+	if err := l.DeleteManifestByImage("app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.RestoreTrash(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"latest", "v1"} {
+		_, got, err := l.FindRawManifestByImage("app", tag)
+		if err != nil || got != dgst {
+			t.Errorf("%s: want %s, but got %s, %v", tag, dgst, got, err)
+		}
+	}
+	if _, err := l.GetTrash(entries[0].ID); err == nil {
+		t.Error("the restored entry must be removed from the trash")
+	}
+
+	// blobs are restored as well.
+	if err := l.DeleteBlobByImage("app", layerDigest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.CheckBlobByReference("app", layerDigest); err == nil {
+		t.Error("the deleted blob must be hidden")
+	}
+	entries, err = l.ListTrash("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Kind != TrashKindBlob {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if _, err := l.RestoreTrash(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.CheckBlobByReference("app", layerDigest); err != nil {
+		t.Errorf("the blob is not restored: %v", err)
+	}
+
+	// only entries which are deleted before the time are purged.
+	purged, err := l.PurgeTrashBefore(time.Now().Add(-time.Hour))
+	if err != nil || len(purged) != 0 {
+		t.Fatalf("want nothing purged, but got %+v, %v", purged, err)
+	}
+	purged, err = l.PurgeTrashBefore(time.Now())
+	if err != nil || len(purged) != 1 || purged[0].Kind != TrashKindManifest {
+		t.Fatalf("unexpected purged entries: %+v, %v", purged, err)
+	}
+	if entries, _ := l.ListTrash(""); len(entries) != 0 {
+		t.Errorf("want empty trash, but got %+v", entries)
+	}
+}
+
+func TestLocal_TagHistory(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	ctx := WithActor(context.Background(), Actor{Name: "alice", Addr: "192.0.2.1:1234"})
+	la := l.WithContext(ctx)
+	_, first, err := la.CreateManifest(strings.NewReader(`{"schemaVersion":2}`), "app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pushing the same digest is not a change.
+	if _, _, err := la.CreateManifest(strings.NewReader(`{"schemaVersion":2}`), "app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	_, second, err := l.CreateManifest(strings.NewReader(`{"schemaVersion":2,"config":{}}`), "app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := la.DeleteManifestByImage("app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := l.TagHistory("app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range history {
+		if history[i].Timestamp.IsZero() {
+			t.Errorf("#%d: timestamp is not recorded", i)
+		}
+		history[i].Timestamp = time.Time{}
+	}
+	want := []TagHistoryEntry{
+		{Action: TagDelete, Previous: second, Actor: "alice", Addr: "192.0.2.1:1234"},
+		{Action: TagUpdate, Previous: first, Digest: second},
+		{Action: TagCreate, Digest: first, Actor: "alice", Addr: "192.0.2.1:1234"},
+	}
+	if !reflect.DeepEqual(want, history) {
+		t.Errorf("want %+v, but got %+v", want, history)
+	}
+	if _, err := l.TagHistory("app", "unknown"); err == nil {
+		t.Error("want error for the tag which has no history")
+	}
+	// the history is not a repository nor contents.
+	if repos, err := l.ListRepositories(); err != nil || len(repos) != 1 {
+		t.Errorf("unexpected repositories: %v, %v", repos, err)
+	}
+}
+
+func TestLocal_TagHistory_Copy(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	_, stable, err := l.CreateManifest(strings.NewReader(`{"schemaVersion":2}`), "app", "stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, latest, err := l.CreateManifest(strings.NewReader(`{"schemaVersion":2,"config":{}}`), "app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tag which is moved by the copy is an update from the previous digest.
+	if _, err := l.CopyManifest("app", "stable", "app", []string{"latest"}); err != nil {
+		t.Fatal(err)
+	}
+	history, err := l.TagHistory("app", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range history {
+		history[i].Timestamp = time.Time{}
+	}
+	want := []TagHistoryEntry{
+		{Action: TagUpdate, Previous: latest, Digest: stable},
+		{Action: TagCreate, Digest: latest},
+	}
+	if !reflect.DeepEqual(want, history) {
+		t.Errorf("want %+v, but got %+v", want, history)
+	}
+}
+
+func TestLocal_CopyManifest(t *testing.T) {
+	l := &Local{Root: t.TempDir()}
+	layer := digest.FromString("layer").String()
+	if _, err := l.PutBlobByDigest("staging/app", layer, strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	_, image, err := l.PutManifest(strings.NewReader(`{"schemaVersion":2,"layers":[{"digest":"`+layer+`"}]}`), "staging/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, index, err := l.CreateManifest(strings.NewReader(`{"schemaVersion":2,"manifests":[{"digest":"`+image+`"}]}`), "staging/app", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, referrer, err := l.PutManifest(strings.NewReader(`{"schemaVersion":2,"subject":{"digest":"`+index+`"}}`), "staging/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := l.CopyManifest("staging/app", "v1", "prod/app", []string{"v1", "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Digest != index || len(result.Contents) != 4 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	for _, dgst := range []string{layer, image, index, referrer} {
+		src, err := l.CheckBlobByReference("staging/app", dgst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := l.CheckBlobByReference("prod/app", dgst)
+		if err != nil {
+			t.Fatalf("%s is not copied: %v", dgst, err)
+		}
+		if !os.SameFile(src, dst) {
+			t.Errorf("%s is not linked", dgst)
+		}
+	}
+	if tags, err := l.ListTags("prod/app"); err != nil || !reflect.DeepEqual(tags, []string{"latest", "v1"}) {
+		t.Errorf("unexpected tags: %v, %v", tags, err)
+	}
+
+	// retagging in the same repository links nothing.
+	result, err = l.CopyManifest("prod/app", index, "prod/app", []string{"stable"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Contents) != 0 {
+		t.Errorf("unexpected contents: %+v", result.Contents)
+	}
+	if _, dgst, err := l.FindRawManifestByImage("prod/app", "stable"); err != nil || dgst != index {
+		t.Errorf("unexpected manifest: %s, %v", dgst, err)
+	}
+	if tags, err := l.ListTags("prod/app"); err != nil || !reflect.DeepEqual(tags, []string{"latest", "stable", "v1"}) {
+		t.Errorf("unexpected tags: %v, %v", tags, err)
+	}
+
+	if _, _, err := l.CreateManifest(strings.NewReader(`{"schemaVersion":2,"config":{"digest":"`+digest.FromString("missing").String()+`"}}`), "staging/app", "broken"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.CopyManifest("staging/app", "broken", "prod/app", []string{"broken"}); err == nil {
+		t.Error("want error for the missing blob")
+	}
+	if _, err := l.StatTag("prod/app", "broken"); err == nil {
+		t.Error("the tag is created by the failed copy")
+	}
+}
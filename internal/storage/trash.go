@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/google/uuid"
+)
+
+// trashDir is the directory under the root where deleted contents are kept.
+const trashDir = "_trash"
+
+// Kinds of entries in the trash.
+const (
+	TrashKindTag      = "tag"
+	TrashKindManifest = "manifest"
+	TrashKindBlob     = "blob"
+)
+
+// TrashEntry is a tag, a manifest or a blob which is deleted and kept in the trash.
+//
+// An entry is a directory which has entry.json and the content directory which
+// is moved from the repository as it is, so that it can be moved back.
+type TrashEntry struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+	// Tags are the deleted tag of the tag entry, or tags which pointed to the
+	// manifest and which are restored with it.
+	Tags      []string  `json:"tags,omitempty"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+var trashLocks = newKeyedLocker()
+
+func (l *Local) trashPath(id string, p ...string) string {
+	return l.path(trashDir, append([]string{id}, p...)...)
+}
+
+// moveToTrash moves the directory of the content to the trash as the entry.
+// src may be empty for tags, which have no content. The caller must hold the
+// lock of the content.
+func (l *Local) moveToTrash(e *TrashEntry, src string) error {
+	e.ID = uuid.New().String()
+	e.DeletedAt = time.Now()
+	dir := l.trashPath(e.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if src != "" {
+		if err := os.Rename(src, filepath.Join(dir, "content")); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	// entry.json is written last, so entries without it are not listed.
+	err := writeFileAtomic(filepath.Join(dir, "entry.json"), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(e)
+	})
+	if err != nil {
+		return err
+	}
+	l.logger().Debug("moved to the trash",
+		"id", e.ID, "kind", e.Kind, "repository", e.Repository, "digest", e.Digest)
+	return nil
+}
+
+// trashContent moves the directory of the manifest or the blob to the trash.
+func (l *Local) trashContent(kind, name, dgst string, tags []string) error {
+	dir := l.path(name, dgst)
+	var size int64
+	if fi, err := registry.PickupFileinfo(dir); err == nil {
+		size = fi.Size()
+	}
+	return l.moveToTrash(&TrashEntry{
+		Kind:       kind,
+		Repository: name,
+		Digest:     dgst,
+		Tags:       tags,
+		Size:       size,
+	}, dir)
+}
+
+func trashNotFound(id string) error {
+	return errors.Wrap(
+		fmt.Errorf("trash entry %q is not found", id),
+		errors.WithStatusCode(http.StatusNotFound),
+		errors.WithDetail(map[string]interface{}{"id": id}),
+	)
+}
+
+func (l *Local) readTrash(id string) (*TrashEntry, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, trashNotFound(id)
+	}
+	b, err := ioutil.ReadFile(l.trashPath(id, "entry.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, trashNotFound(id)
+		}
+		return nil, err
+	}
+	var e TrashEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ListTrash lists entries of the repository in the trash, which are sorted by
+// the deleted time in descending order. If name is empty, every entry is listed.
+func (l *Local) ListTrash(name string) ([]TrashEntry, error) {
+	l, span := l.startSpan("ListTrash", "repository", name)
+	defer span.Finish()
+	fis, err := ioutil.ReadDir(l.path(trashDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []TrashEntry
+	for _, fi := range fis {
+		e, err := l.readTrash(fi.Name())
+		if err != nil {
+			// entries which are being moved or purged.
+			continue
+		}
+		if name == "" || e.Repository == name {
+			entries = append(entries, *e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+// GetTrash returns the entry in the trash.
+func (l *Local) GetTrash(id string) (*TrashEntry, error) {
+	l, span := l.startSpan("GetTrash")
+	defer span.Finish()
+	return l.readTrash(id)
+}
+
+// RestoreTrash moves the entry back to the repository. Tags are restored only
+// if they do not exist or already point to the digest, otherwise nothing is restored.
+func (l *Local) RestoreTrash(id string) (*TrashEntry, error) {
+	l, span := l.startSpan("RestoreTrash")
+	defer span.Finish()
+	dir := l.trashPath(id)
+	unlockEntry := trashLocks.Lock(dir)
+	defer unlockEntry()
+	e, err := l.readTrash(id)
+	if err != nil {
+		return nil, err
+	}
+	name := e.Repository
+	content := filepath.Join(dir, "content")
+
+	if e.Kind == TrashKindBlob {
+		unlock := l.LockDigest(name, e.Digest)
+		defer unlock()
+		if err := l.restoreContent(content, name, e.Digest); err != nil {
+			return nil, err
+		}
+		return e, os.RemoveAll(dir)
+	}
+
+	unlock := l.LockRepository(name)
+	defer unlock()
+	for _, tag := range e.Tags {
+		if err := l.checkTagRestore(name, tag, e.Digest); err != nil {
+			return nil, err
+		}
+	}
+	switch e.Kind {
+	case TrashKindManifest:
+		if err := l.restoreContent(content, name, e.Digest); err != nil {
+			return nil, err
+		}
+	case TrashKindTag:
+		if _, err := os.Stat(l.path(name, e.Digest, "manifest.json")); os.IsNotExist(err) {
+			return nil, errors.Wrap(
+				fmt.Errorf("manifest %q of the tag is not found, restore it first", e.Digest),
+				errors.WithCodeManifestUnknown(),
+			)
+		}
+	}
+	for _, tag := range e.Tags {
+		if err := l.writeTag(name, tag, e.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return e, os.RemoveAll(dir)
+}
+
+// restoreContent moves the content back unless the same digest is pushed again.
+func (l *Local) restoreContent(content, name, dgst string) error {
+	dst := l.path(name, dgst)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(l.path(name), 0700); err != nil {
+		return err
+	}
+	return os.Rename(content, dst)
+}
+
+// checkTagRestore returns TAG_INVALID error if the tag already points to another digest.
+// The caller must hold the repository lock.
+func (l *Local) checkTagRestore(name, tag, dgst string) error {
+	current, err := l.readTag(name, tag)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if current == dgst {
+		return nil
+	}
+	return errors.Wrap(
+		fmt.Errorf("tag %q already points to %q", tag, current),
+		errors.WithCodeTagInvalid(),
+		errors.WithStatusCode(http.StatusConflict),
+		errors.WithDetail(map[string]interface{}{
+			"repository": name,
+			"tag":        tag,
+			"current":    current,
+		}),
+	)
+}
+
+// PurgeTrash removes the entry from the trash permanently.
+func (l *Local) PurgeTrash(id string) (*TrashEntry, error) {
+	l, span := l.startSpan("PurgeTrash")
+	defer span.Finish()
+	dir := l.trashPath(id)
+	unlock := trashLocks.Lock(dir)
+	defer unlock()
+	e, err := l.readTrash(id)
+	if err != nil {
+		return nil, err
+	}
+	return e, os.RemoveAll(dir)
+}
+
+// PurgeTrashBefore removes entries which are deleted before t permanently,
+// and returns purged entries.
+func (l *Local) PurgeTrashBefore(t time.Time) ([]TrashEntry, error) {
+	l, span := l.startSpan("PurgeTrashBefore")
+	defer span.Finish()
+	fis, err := ioutil.ReadDir(l.path(trashDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var purged []TrashEntry
+	for _, fi := range fis {
+		e, err := l.readTrash(fi.Name())
+		if err != nil {
+			// remove what is left by interrupted moves.
+			if fi.ModTime().Before(t) {
+				os.RemoveAll(l.trashPath(fi.Name()))
+			}
+			continue
+		}
+		if !e.DeletedAt.Before(t) {
+			continue
+		}
+		if e, err := l.PurgeTrash(e.ID); err == nil {
+			purged = append(purged, *e)
+		}
+	}
+	return purged, nil
+}
+
+// trashedReferences returns digests which are referred to by manifests of the
+// repository in the trash, so that they can be restored with their blobs.
+func (l *Local) trashedReferences(name string) map[string]bool {
+	refs := make(map[string]bool)
+	entries, err := l.ListTrash(name)
+	if err != nil {
+		return refs
+	}
+	for _, e := range entries {
+		if e.Kind != TrashKindManifest {
+			continue
+		}
+		raw, err := ioutil.ReadFile(l.trashPath(e.ID, "content", "manifest.json"))
+		if err != nil {
+			continue
+		}
+		for _, d := range references(raw) {
+			refs[d] = true
+		}
+	}
+	return refs
+}
@@ -0,0 +1,133 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files of the development certificates.
+const (
+	DevCAFile   = "ca.pem"
+	DevCAKey    = "ca-key.pem"
+	DevCertFile = "cert.pem"
+	DevKeyFile  = "key.pem"
+)
+
+// GenerateDevCertificates writes a self-signed CA and a server certificate
+// for hosts which is signed by the CA into dir. Clients should trust the CA,
+// which is reused across restarts, so that they trust it only once.
+//
+// It returns paths of the CA, the certificate and the key.
+func GenerateDevCertificates(dir string, hosts []string) (caFile, certFile, keyFile string, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", "", err
+	}
+	caFile = filepath.Join(dir, DevCAFile)
+	certFile = filepath.Join(dir, DevCertFile)
+	keyFile = filepath.Join(dir, DevKeyFile)
+
+	ca, err := loadOrCreateCA(caFile, filepath.Join(dir, DevCAKey))
+	if err != nil {
+		return "", "", "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return "", "", "", err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return "", "", "", err
+	}
+	return caFile, certFile, keyFile, nil
+}
+
+func loadOrCreateCA(caFile, keyFile string) (*tls.Certificate, error) {
+	if ca, err := tls.LoadX509KeyPair(caFile, keyFile); err == nil {
+		ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+		if err == nil && time.Now().Before(ca.Leaf.NotAfter) {
+			return &ca, nil
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "container-registry development CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return nil, err
+	}
+	if err := writePEM(caFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func writeKey(filename string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(filename, "EC PRIVATE KEY", der, 0600)
+}
+
+func writePEM(filename, typ string, der []byte, perm os.FileMode) error {
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	return ioutil.WriteFile(filename, b, perm)
+}
+
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
@@ -0,0 +1,134 @@
+// Package tlsutil provides TLS configurations of the registry server.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkInterval is the interval to check whether certificate files are rotated.
+const checkInterval = time.Second
+
+// CertReloader serves the certificate which is reloaded when the files are changed.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	checkedAt time.Time
+}
+
+// NewCertReloader loads the certificate and the key.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.checkedAt) >= checkInterval {
+		r.checkedAt = now
+		if r.changed() {
+			if err := r.reload(); err != nil {
+				// the files may be in the middle of the rotation, keep serving the old one.
+				log.Printf("tls: failed to reload certificate: %v", err)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *CertReloader) changed() bool {
+	certMod, keyMod, err := modTimes(r.certFile, r.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+}
+
+func (r *CertReloader) reload() error {
+	certMod, keyMod, err := modTimes(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certMod, r.keyMod = certMod, keyMod
+	return nil
+}
+
+func modTimes(certFile, keyFile string) (time.Time, time.Time, error) {
+	cfi, err := os.Stat(certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	kfi, err := os.Stat(keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return cfi.ModTime(), kfi.ModTime(), nil
+}
+
+// ClientAuth is the mode of the client certificate authentication.
+type ClientAuth string
+
+const (
+	// ClientAuthNone does not request client certificates.
+	ClientAuthNone ClientAuth = "none"
+	// ClientAuthOptional verifies client certificates if they are given.
+	ClientAuthOptional ClientAuth = "optional"
+	// ClientAuthRequire requires valid client certificates.
+	ClientAuthRequire ClientAuth = "require"
+)
+
+// ServerConfig returns tls.Config which serves the certificate of r.
+// If clientCAFile is not empty, client certificates are verified with it.
+func ServerConfig(r *CertReloader, clientCAFile string, clientAuth ClientAuth) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	switch clientAuth {
+	case ClientAuthNone, "":
+		return cfg, nil
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth %q", clientAuth)
+	}
+	if clientCAFile == "" {
+		return nil, fmt.Errorf("client CA is required to verify client certificates")
+	}
+	b, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%q has no certificates", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	return cfg, nil
+}
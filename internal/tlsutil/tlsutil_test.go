@@ -0,0 +1,136 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile, err := GenerateDevCertificates(dir, []string{"first.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		t.Helper()
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if got := commonName(); got != "first.example" {
+		t.Fatalf("want first.example, but got %q", got)
+	}
+
+	// rotate
+	if _, _, _, err := GenerateDevCertificates(dir, []string{"second.example"}); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.checkedAt = time.Time{}
+	if got := commonName(); got != "second.example" {
+		t.Fatalf("want second.example, but got %q", got)
+	}
+
+	// broken files are ignored
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.checkedAt = time.Time{}
+	if got := commonName(); got != "second.example" {
+		t.Fatalf("want second.example, but got %q", got)
+	}
+}
+
+func TestServerConfig_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile, certFile, keyFile, err := GenerateDevCertificates(dir, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ServerConfig(r, "", ClientAuthRequire); err == nil {
+		t.Fatal("want error without client CA")
+	}
+	cfg, err := ServerConfig(r, caFile, ClientAuthRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	}))
+	// httptest.Server.StartTLS overrides the certificate, so serve TLS by ourselves.
+	srv.Listener = tls.NewListener(srv.Listener, cfg)
+	srv.Start()
+	defer srv.Close()
+	url := "https://" + srv.Listener.Addr().String()
+
+	ca, err := tls.LoadX509KeyPair(caFile, filepath.Join(dir, DevCAKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: "ci"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.Leaf, &clientKey.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: certs,
+		}}}
+	}
+	if _, err := newClient().Get(url); err == nil {
+		t.Fatal("request without client certificate is accepted")
+	}
+	resp, err := newClient(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: clientKey}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "ci" {
+		t.Fatalf("want ci, but got %q", b)
+	}
+}
@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Exporters which are supported by Config.
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+// DefaultServiceName is the service name if it is not configured.
+const DefaultServiceName = "container-registry"
+
+// Config is the configuration of tracing.
+type Config struct {
+	// ServiceName is exported as service.name. The default is DefaultServiceName.
+	ServiceName string `json:"serviceName,omitempty"`
+	// Exporter is "otlp" or "stdout".
+	Exporter string `json:"exporter"`
+	// Endpoint is the URL of the OTLP/HTTP traces endpoint such as
+	// "http://localhost:4318/v1/traces".
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are added to every request to the endpoint, such as Authorization.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Validate validates the configuration.
+func (c *Config) Validate() error {
+	switch c.Exporter {
+	case ExporterStdout:
+	case ExporterOTLP:
+		u, err := url.Parse(c.Endpoint)
+		if err != nil {
+			return fmt.Errorf("endpoint: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("endpoint must be http or https url")
+		}
+	default:
+		return fmt.Errorf("unsupported exporter %q (otlp, stdout)", c.Exporter)
+	}
+	return nil
+}
+
+// NewTracer creates a Tracer with the exporter. Spans are written to stdout
+// if the exporter is "stdout".
+func (c *Config) NewTracer(stdout io.Writer) *Tracer {
+	name := c.ServiceName
+	if name == "" {
+		name = DefaultServiceName
+	}
+	var e Exporter = &StdoutExporter{W: stdout}
+	if c.Exporter == ExporterOTLP {
+		e = &OTLPExporter{
+			Endpoint:    c.Endpoint,
+			Headers:     c.Headers,
+			ServiceName: name,
+			Client:      &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return NewTracer(name, e)
+}
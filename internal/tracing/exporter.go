@@ -0,0 +1,223 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StdoutExporter writes spans as json lines, so that traces can be read without a collector.
+type StdoutExporter struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+// stdoutSpan is the json representation of a span.
+type stdoutSpan struct {
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	Parent     string                 `json:"parentSpanId,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       int                    `json:"kind"`
+	Start      time.Time              `json:"start"`
+	Duration   float64                `json:"duration"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Export implements Exporter.
+func (e *StdoutExporter) Export(_ context.Context, spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		s.mu.Lock()
+		v := stdoutSpan{
+			TraceID:    s.TraceID.String(),
+			SpanID:     s.SpanID.String(),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      s.Start,
+			Duration:   s.End.Sub(s.Start).Seconds(),
+			Attributes: s.Attributes,
+			Error:      s.Error,
+		}
+		if s.Parent.IsValid() {
+			v.Parent = s.Parent.String()
+		}
+		err := enc.Encode(&v)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.W.Write(buf.Bytes())
+	return err
+}
+
+// OTLPExporter exports spans to the OpenTelemetry collector by OTLP/HTTP in json.
+//
+// see: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type OTLPExporter struct {
+	// Endpoint is the URL of the traces endpoint such as "http://localhost:4318/v1/traces".
+	Endpoint string
+	// Headers are added to every request, such as Authorization.
+	Headers map[string]string
+	// ServiceName is exported as the resource attribute service.name.
+	ServiceName string
+	Client      *http.Client
+}
+
+// scopeName is the name of the instrumentation scope.
+const scopeName = "github.com/Code-Hex/container-registry"
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpAttribute(key string, v interface{}) otlpKeyValue {
+	var value otlpValue
+	switch v := v.(type) {
+	case string:
+		value.StringValue = &v
+	case bool:
+		value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		value.IntValue = &s
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		} else {
+			value.DoubleValue = &v
+		}
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: value}
+}
+
+func toOTLP(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+	}
+	if s.Parent.IsValid() {
+		v.ParentSpanID = s.Parent.String()
+	}
+	for k, a := range s.Attributes {
+		v.Attributes = append(v.Attributes, otlpAttribute(k, a))
+	}
+	if s.Error != "" {
+		v.Status = &otlpStatus{Code: 2, Message: s.Error}
+	}
+	return v
+}
+
+// Export implements Exporter.
+func (e *OTLPExporter) Export(ctx context.Context, spans []*Span) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: scopeName}}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, toOTLP(s))
+	}
+	body, err := json.Marshal(&otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{otlpAttribute("service.name", e.ServiceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{scope},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+// Package tracing records spans of requests and exports them to
+// OpenTelemetry collectors. Span contexts are propagated by W3C traceparent.
+//
+// see: https://www.w3.org/TR/trace-context/
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the header which propagates the span context.
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// IsValid reports whether the id is not zero.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span in a trace.
+type SpanID [8]byte
+
+// IsValid reports whether the id is not zero.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of the span which is propagated to other services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both ids are valid.
+func (sc SpanContext) IsValid() bool { return sc.TraceID.IsValid() && sc.SpanID.IsValid() }
+
+// Traceparent formats the span context as the value of traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses the value of traceparent header.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, fmt.Errorf("tracing: invalid traceparent %q", s)
+	}
+	// future versions may have more fields, but version 00 has exactly four.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, fmt.Errorf("tracing: invalid traceparent %q", s)
+	}
+	if err := decodeHex(sc.TraceID[:], parts[1]); err != nil {
+		return sc, fmt.Errorf("tracing: invalid trace id in %q", s)
+	}
+	if err := decodeHex(sc.SpanID[:], parts[2]); err != nil {
+		return sc, fmt.Errorf("tracing: invalid span id in %q", s)
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return sc, fmt.Errorf("tracing: invalid flags in %q", s)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("tracing: zero id in %q", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return fmt.Errorf("invalid length or case")
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// Extract returns the span context in the traceparent header.
+func Extract(h http.Header) (SpanContext, bool) {
+	v := h.Get(TraceparentHeader)
+	if v == "" {
+		return SpanContext{}, false
+	}
+	sc, err := ParseTraceparent(v)
+	return sc, err == nil
+}
+
+// Inject sets the traceparent header of the span in ctx to h.
+func Inject(ctx context.Context, h http.Header) {
+	if s := SpanFromContext(ctx); s != nil {
+		h.Set(TraceparentHeader, s.SpanContext.Traceparent())
+	}
+}
+
+// Kinds of spans.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span is an operation in a trace. Methods of nil Span do nothing,
+// so that code can be instrumented regardless of whether tracing is enabled.
+type Span struct {
+	SpanContext
+	Parent SpanID
+	Name   string
+	Kind   int
+	Start  time.Time
+	End    time.Time
+	// Attributes are set by SetAttributes.
+	Attributes map[string]interface{}
+	// Error is the message of the error which is set by SetError.
+	Error string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttributes sets alternating keys and values to the span.
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.Attributes[fmt.Sprint(kv[i])] = kv[i+1]
+	}
+}
+
+// SetError marks the span as failed. It does nothing if err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and queues it to export. Only the first call has effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Exporter exports finished spans.
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+// Default values of the tracer.
+const (
+	DefaultQueueSize = 2048
+	maxBatchSize     = 256
+	batchTimeout     = 5 * time.Second
+)
+
+// Tracer starts spans and exports them in the background by Run.
+type Tracer struct {
+	// ServiceName is the name of the service which is exported as service.name.
+	ServiceName string
+	exporter    Exporter
+	queue       chan *Span
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// NewTracer creates a Tracer. Call Run to export spans.
+func NewTracer(serviceName string, e Exporter) *Tracer {
+	return &Tracer{
+		ServiceName: serviceName,
+		exporter:    e,
+		queue:       make(chan *Span, DefaultQueueSize),
+	}
+}
+
+// enqueue queues the span. The span is dropped if the queue is full,
+// so that requests are never blocked by slow collectors.
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+// Dropped returns the number of spans which are dropped.
+func (t *Tracer) Dropped() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+// Run exports queued spans in batches until ctx is canceled.
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(batchTimeout)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case <-ctx.Done():
+			// put back the batch, so that Flush can export it.
+			for _, s := range batch {
+				t.enqueue(s)
+			}
+			return
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < maxBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		t.export(ctx, batch)
+		batch = nil
+	}
+}
+
+// Flush exports every queued span. It returns when the queue is empty or ctx is done.
+func (t *Tracer) Flush(ctx context.Context) {
+	for {
+		var batch []*Span
+	drain:
+		for len(batch) < maxBatchSize {
+			select {
+			case s := <-t.queue:
+				batch = append(batch, s)
+			default:
+				break drain
+			}
+		}
+		if len(batch) == 0 || ctx.Err() != nil {
+			return
+		}
+		t.export(ctx, batch)
+	}
+}
+
+func (t *Tracer) export(ctx context.Context, spans []*Span) {
+	if err := t.exporter.Export(ctx, spans); err != nil {
+		t.mu.Lock()
+		t.dropped += len(spans)
+		t.mu.Unlock()
+		log.Printf("tracing: failed to export %d spans: %v", len(spans), err)
+	}
+}
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// NewContext returns a context which has the tracer. Spans are recorded only
+// if the context has a tracer.
+func NewContext(ctx context.Context, t *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// SpanFromContext returns the current span in the context, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span which is a child of the current span in ctx. If ctx has
+// no tracer, it returns ctx as it is and nil span.
+func Start(ctx context.Context, name string, kv ...interface{}) (context.Context, *Span) {
+	return StartWithRemote(ctx, SpanContext{}, name, KindInternal, kv...)
+}
+
+// StartWithRemote starts a span of the kind. If ctx has no current span, the span
+// is a child of remote, which is typically extracted from the request.
+func StartWithRemote(ctx context.Context, remote SpanContext, name string, kind int, kv ...interface{}) (context.Context, *Span) {
+	if ctx == nil {
+		return ctx, nil
+	}
+	t, ok := ctx.Value(tracerKey{}).(*Tracer)
+	if !ok {
+		return ctx, nil
+	}
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+		tracer:     t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+		s.Sampled = parent.Sampled
+	} else if remote.IsValid() {
+		s.TraceID = remote.TraceID
+		s.Parent = remote.SpanID
+		s.Sampled = remote.Sampled
+	} else {
+		rand.Read(s.TraceID[:])
+		s.Sampled = true
+	}
+	rand.Read(s.SpanID[:])
+	s.SetAttributes(kv...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
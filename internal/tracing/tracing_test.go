@@ -0,0 +1,146 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("unexpected span context: %+v", sc)
+	}
+	if got := sc.Traceparent(); got != valid {
+		t.Errorf("want %q, but got %q", valid, got)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("want error for %q", invalid)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	if ctx, s := Start(context.Background(), "no tracer"); s != nil || SpanFromContext(ctx) != nil {
+		t.Fatal("want nil span without tracer")
+	}
+
+	var buf bytes.Buffer
+	tr := NewTracer("test", &StdoutExporter{W: &buf})
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := NewContext(context.Background(), tr)
+	ctx, parent := StartWithRemote(ctx, remote, "parent", KindServer, "http.method", "GET")
+	_, child := Start(ctx, "child")
+	child.SetError(errors.New("failed"))
+	child.Finish()
+	child.Finish() // ignored
+	parent.Finish()
+
+	h := http.Header{}
+	Inject(ctx, h)
+	if got, want := h.Get(TraceparentHeader), parent.SpanContext.Traceparent(); got != want {
+		t.Errorf("want injected %q, but got %q", want, got)
+	}
+
+	tr.Flush(context.Background())
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 spans, but got %q", buf.String())
+	}
+	var got []stdoutSpan
+	for _, line := range lines {
+		var s stdoutSpan
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	if got[0].Name != "child" || got[0].Error != "failed" || got[0].Parent != parent.SpanID.String() {
+		t.Errorf("unexpected child: %+v", got[0])
+	}
+	if got[1].Name != "parent" || got[1].Parent != remote.SpanID.String() || got[1].Attributes["http.method"] != "GET" {
+		t.Errorf("unexpected parent: %+v", got[1])
+	}
+	for _, s := range got {
+		if s.TraceID != remote.TraceID.String() {
+			t.Errorf("want trace id %s, but got %s", remote.TraceID, s.TraceID)
+		}
+	}
+}
+
+func TestStart_notSampled(t *testing.T) {
+	var buf bytes.Buffer
+	tr := NewTracer("test", &StdoutExporter{W: &buf})
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, s := StartWithRemote(NewContext(context.Background(), tr), remote, "span", KindServer)
+	s.Finish()
+	tr.Flush(context.Background())
+	if buf.Len() != 0 {
+		t.Errorf("want no spans, but got %q", buf.String())
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	c := &Config{
+		Exporter: ExporterOTLP,
+		Endpoint: srv.URL + "/v1/traces",
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tr := c.NewTracer(nil)
+	_, s := Start(NewContext(context.Background(), tr), "storage.FindBlobByImage", "repository", "app", "size", 3)
+	s.SetError(errors.New("not found"))
+	s.Finish()
+	tr.Flush(context.Background())
+	if tr.Dropped() != 0 {
+		t.Fatalf("want no dropped spans, but got %d", tr.Dropped())
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request: %+v", got)
+	}
+	rs := got.ResourceSpans[0]
+	if v := rs.Resource.Attributes[0].Value.StringValue; v == nil || *v != DefaultServiceName {
+		t.Errorf("unexpected resource: %+v", rs.Resource)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "storage.FindBlobByImage" || spans[0].Status == nil || spans[0].Status.Code != 2 {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	if len(spans[0].TraceID) != 32 || len(spans[0].SpanID) != 16 || len(spans[0].Attributes) != 2 {
+		t.Errorf("unexpected span: %+v", spans[0])
+	}
+}
@@ -2,23 +2,42 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/tls"
 	"encoding/json"
 	e "errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/Code-Hex/container-registry/internal/auth"
+	"github.com/Code-Hex/container-registry/internal/client"
+	"github.com/Code-Hex/container-registry/internal/config"
 	"github.com/Code-Hex/container-registry/internal/errors"
 	"github.com/Code-Hex/container-registry/internal/grammar"
+	"github.com/Code-Hex/container-registry/internal/health"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/metrics"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/proxy"
+	"github.com/Code-Hex/container-registry/internal/quota"
 	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/Code-Hex/container-registry/internal/replication"
+	"github.com/Code-Hex/container-registry/internal/retention"
 	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/Code-Hex/container-registry/internal/tlsutil"
+	"github.com/Code-Hex/container-registry/internal/tracing"
 	"github.com/Code-Hex/go-router-simple"
 	digest "github.com/opencontainers/go-digest"
 )
@@ -36,16 +55,375 @@ const (
 	DELETE = http.MethodDelete
 )
 
-const hostname = "localhost:5080"
+// catalogPath is the path to list repositories.
+const catalogPath = "/v2/_catalog"
 
-var unsupportedHandler = Handler(func(w http.ResponseWriter, r *http.Request) error {
-	err := fmt.Errorf("unsupported")
-	return errors.Wrap(err, errors.WithCodeUnsupported())
-})
+// Paths of the liveness and the readiness, which are not authenticated.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
 
 // spec
 // https://github.com/opencontainers/distribution-spec/blob/master/spec.md
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		case "trash":
+			os.Exit(trashCommand(os.Args[2:]))
+		case "copy":
+			os.Exit(copyCommand(os.Args[2:]))
+		case "export":
+			os.Exit(exportCommand(os.Args[2:]))
+		case "import":
+			os.Exit(importCommand(os.Args[2:]))
+		}
+	}
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run runs the registry until it receives a signal.
+func run(cfg *config.Config) error {
+	bg := newBackground()
+	defer bg.cancel()
+
+	level, err := logging.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+	logger := logging.New(os.Stderr, level, cfg.Log.Format)
+	logging.Default = logger
+	// logs of packages which use the standard logger are also structured.
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+
+	registry.BasePath = cfg.Storage.Root
+	s := &storage.Local{
+		MaxManifestSize: cfg.Limits.MaxManifestSize,
+		ImmutableTags:   cfg.ImmutableTags,
+		Trash:           cfg.Trash != nil,
+	}
+	opts := &routerOptions{images: cfg.Admin.Images}
+	checker := new(health.Checker)
+	addStorageChecks(checker, s)
+	opts.health = checker
+	if p := cfg.Proxy; p != nil {
+		ttl := time.Duration(p.TTL)
+		if ttl <= 0 {
+			ttl = proxy.DefaultTTL
+		}
+		opts.proxy = proxy.New(s, &client.Client{
+			URL:      p.URL,
+			Username: p.Username,
+			Password: p.Password,
+		}, ttl)
+		logger.Info("proxying", "url", p.URL)
+	}
+	if cfg.Replication != nil {
+		queueDir := filepath.Join(registry.BasePath, "_replication")
+		rep, err := replication.New(s, queueDir, cfg.Replication.Targets)
+		if err != nil {
+			return err
+		}
+		opts.replicator = rep
+		bg.Go(rep.Run, rep)
+	}
+	if cfg.Notifications != nil {
+		var sinks notifications.Broadcaster
+		for _, e := range cfg.Notifications.Endpoints {
+			webhook := notifications.NewWebhook(e)
+			bg.Go(webhook.Run, webhook)
+			sinks = append(sinks, webhook)
+		}
+		opts.events = sinks
+	}
+	if cfg.Quota != nil {
+		m, err := quota.New(s, filepath.Join(registry.BasePath, "_quota", "quotas.json"), cfg.Quota)
+		if err != nil {
+			return err
+		}
+		opts.quotas = m
+		bg.Go(m.Run, nil)
+	}
+	if t := cfg.Trash; t != nil {
+		bg.Go(purgeTrash(s, time.Duration(t.Retention), time.Duration(t.PurgeInterval), logger), nil)
+	}
+	if cfg.Retention != nil {
+		filename := filepath.Join(registry.BasePath, "_retention", "pulls.json")
+		engine, err := retention.New(s, filename, cfg.Retention, opts.sink())
+		if err != nil {
+			return err
+		}
+		engine.OnReport = observeRetention
+		opts.retention = engine
+		bg.Go(engine.Run, engine)
+	}
+
+	adapters := []ServerAdapter{RequestServerAdapter(logger), DrainServerAdapter(checker)}
+	var tracer *tracing.Tracer
+	if cfg.Tracing != nil {
+		tracer = cfg.Tracing.NewTracer(os.Stdout)
+		bg.Go(tracer.Run, tracer)
+		adapters = append(adapters, TracingServerAdapter(tracer))
+	}
+	if cfg.Log.AccessLog {
+		adapters = append(adapters, AccessLogServerAdapter())
+	}
+	if cfg.Metrics.Enabled {
+		registerStorageMetrics(metrics.Default, s, logger)
+		opts.metrics = metrics.Default
+		adapters = append(adapters, MetricsServerAdapter())
+	}
+	adapters = append(adapters, SetHeaderServerAdapter())
+	controller, err := newAuthController(cfg, opts)
+	if err != nil {
+		return err
+	}
+	if controller != nil {
+		adapters = append(adapters, AuthServerAdapter(controller))
+	} else if opts.images {
+		logger.Warn("the admin API of images is served without the authentication")
+	}
+	if cfg.Limits.Rate != nil {
+		adapters = append(adapters, RateLimitServerAdapter(cfg.Limits.Rate))
+	}
+	if opts.quotas != nil {
+		adapters = append(adapters, QuotaServerAdapter(opts.quotas, s))
+	}
+	if tracer != nil {
+		adapters = append(adapters, HandlerSpanServerAdapter())
+	}
+
+	tlsConfig, err := newTLSConfig(cfg.HTTP.Addr, &cfg.HTTP.TLS)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           ServerApply(newRouter(s, opts), adapters...),
+		ReadHeaderTimeout: time.Duration(cfg.HTTP.ReadHeaderTimeout),
+		IdleTimeout:       time.Duration(cfg.HTTP.IdleTimeout),
+	}
+	// flip to not ready as soon as the shutdown begins.
+	srv.RegisterOnShutdown(checker.Shutdown)
+	errCh := make(chan error, 1)
+	go func() {
+		addr := cfg.HTTP.Addr
+		logger.Info("running", "addr", addr)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-sig:
+	case err := <-errCh:
+		return err
+	}
+
+	// stop accepting new uploads and become not ready, then wait for load
+	// balancers to notice it before closing the listener.
+	timeout := time.Duration(cfg.HTTP.ShutdownTimeout)
+	logger.Info("shutting down", "timeout", timeout)
+	checker.Shutdown()
+	time.Sleep(time.Duration(cfg.HTTP.ShutdownDelay))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		// upload sessions which are interrupted are kept in the storage,
+		// so clients can resume them after restart.
+		logger.Error("in-flight requests are aborted", "error", err)
+		srv.Close()
+	}
+	if err := bg.Shutdown(ctx); err != nil {
+		logger.Error("queues are not flushed", "error", err)
+	}
+	logger.Info("shut down")
+	return nil
+}
+
+// newAuthController creates the controller which authorizes requests as configured.
+// It returns nil if the authentication is disabled.
+func newAuthController(cfg *config.Config, opts *routerOptions) (auth.Controller, error) {
+	if cfg.Auth.Policy != nil {
+		opts.authorizer = cfg.Auth.Policy
+	}
+	var controller auth.Controller
+	if c := cfg.Auth.Token; c != nil {
+		key, err := loadTokenKey(c.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if opts.authorizer == nil {
+			opts.authorizer = auth.AllowAuthenticated
+		}
+		opts.issuer = auth.NewIssuer(c.Issuer, c.Service, key, c.Users, opts.authorizer)
+		if c.Expiration != "" {
+			opts.issuer.Expiration, _ = time.ParseDuration(c.Expiration)
+		}
+		tc := auth.NewTokenController(c.Realm, c.Service, c.Issuer, opts.issuer.PublicKey())
+		tc.Authorizer = opts.authorizer
+		controller = tc
+	}
+	if c := cfg.Auth.Basic; c != nil {
+		htpasswd, err := auth.NewHtpasswd(c.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		if opts.authorizer == nil {
+			opts.authorizer = &c.Roles
+		} else {
+			opts.authorizer = auth.Intersect(&c.Roles, opts.authorizer)
+		}
+		controller = auth.NewBasicController(c.Realm, htpasswd, opts.authorizer)
+	}
+	if tlsCfg := cfg.HTTP.TLS; tlsCfg.ClientCA != "" {
+		if opts.authorizer == nil {
+			opts.authorizer = auth.AllowAuthenticated
+		}
+		controller = &auth.ClientCertController{
+			Identities: tlsCfg.ClientIdentities,
+			Authorizer: opts.authorizer,
+			Next:       controller,
+		}
+	}
+	if controller == nil {
+		return nil, nil
+	}
+	store, err := auth.NewTokenStore(filepath.Join(registry.BasePath, "_auth", "tokens.json"))
+	if err != nil {
+		return nil, err
+	}
+	opts.apiTokens = store
+	if opts.issuer != nil {
+		opts.issuer.APITokens = store
+	}
+	return &auth.APITokenController{
+		Store:      store,
+		Authorizer: opts.authorizer,
+		Next:       controller,
+	}, nil
+}
+
+// newTLSConfig returns the configuration to serve TLS. It returns nil if TLS is not enabled.
+//
+// If c.Dev is not empty, a self-signed certificate for the host of addr is generated into it.
+func newTLSConfig(addr string, c *config.TLS) (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	certFile, keyFile := c.Cert, c.Key
+	if c.Dev != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		if host == "" {
+			host = "localhost"
+		}
+		caFile, cert, key, err := tlsutil.GenerateDevCertificates(c.Dev, []string{host, "127.0.0.1", "::1"})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("tls: development CA is written to %q, trust it on clients such as /etc/docker/certs.d/%s/ca.crt", caFile, addr)
+		certFile, keyFile = cert, key
+	}
+	reloader, err := tlsutil.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := c.ClientAuth
+	if c.ClientCA == "" {
+		clientAuth = tlsutil.ClientAuthNone
+	}
+	return tlsutil.ServerConfig(reloader, c.ClientCA, clientAuth)
+}
+
+// loadTokenKey loads the key to sign tokens. If filename is empty, the key is generated,
+// so that tokens are invalidated on restart.
+func loadTokenKey(filename string) (crypto.Signer, error) {
+	if filename == "" {
+		log.Println("auth: private key is not specified, generating an ephemeral key")
+		return auth.GenerateKey()
+	}
+	return auth.LoadPrivateKey(filename)
+}
+
+// addStorageChecks adds checks of the storage to the readiness. They are not
+// the liveness, because restarting the registry never fixes the storage such as
+// the full disk.
+func addStorageChecks(c *health.Checker, s *storage.Local) {
+	c.AddReadiness("storage", func(context.Context) error { return s.CheckWritable() })
+	c.AddReadiness("metadata", func(context.Context) error { return s.CheckReadable() })
+}
+
+// routerOptions represents optional components which handlers depend on.
+type routerOptions struct {
+	// proxy is used to pull content if this registry runs as a pull-through cache.
+	proxy *proxy.Proxy
+	// replicator replicates pushed manifests to other registries.
+	replicator *replication.Replicator
+	// events receives events which handlers emit.
+	events notifications.Sink
+	// quotas keeps the usage of repositories and serves quotas on the admin API if it is not nil.
+	quotas *quota.Manager
+	// retention records pulls and executes retention policies on the admin API if it is not nil.
+	retention *retention.Engine
+	// images copies, exports and imports images on the admin API if it is true.
+	images bool
+	// issuer issues tokens on the token endpoint if it is not nil.
+	issuer *auth.Issuer
+	// authorizer filters repositories in the catalog if it is not nil.
+	authorizer auth.Authorizer
+	// apiTokens stores API tokens which are managed by the admin API if it is not nil.
+	apiTokens *auth.TokenStore
+	// metrics serves metrics on metricsPath if it is not nil.
+	metrics http.Handler
+	// health serves the liveness and the readiness if it is not nil.
+	health *health.Checker
+}
+
+// sink returns the sink which receives events of handlers.
+func (opts *routerOptions) sink() notifications.Broadcaster {
+	var sink notifications.Broadcaster
+	if opts.events != nil {
+		sink = append(sink, opts.events)
+	}
+	if opts.replicator != nil {
+		sink = append(sink, opts.replicator)
+	}
+	if opts.quotas != nil {
+		sink = append(sink, opts.quotas)
+	}
+	if opts.retention != nil {
+		sink = append(sink, opts.retention)
+	}
+	return sink
+}
+
+// newRouter creates the router which serves the registry API.
+func newRouter(s *storage.Local, opts *routerOptions) *router.Router {
+	if opts == nil {
+		opts = new(routerOptions)
+	}
+	sink := opts.sink()
 	rs := router.New()
 
 	// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#endpoints
@@ -57,7 +435,7 @@ func main() {
 			`/v2/{name:%s}/blobs/{digest:%s}`,
 			grammar.Name, grammar.Digest,
 		),
-		PullingBlobs(),
+		PullingBlobs(s, opts.proxy, sink),
 	)
 
 	// /v2/:name/manifests/:reference
@@ -66,7 +444,7 @@ func main() {
 			`/v2/{name:%s}/manifests/{reference:%s}`,
 			grammar.Name, grammar.Reference,
 		),
-		PullingManifests(),
+		PullingManifests(s, opts.proxy, sink),
 	)
 
 	// /?digest=<digest>
@@ -75,7 +453,7 @@ func main() {
 			`/v2/{name:%s}/blobs/uploads/`,
 			grammar.Name,
 		),
-		PushBlobPost(),
+		PushBlobPost(s, sink),
 	)
 
 	rs.PATCH(
@@ -83,7 +461,15 @@ func main() {
 			`/v2/{name:%s}/blobs/uploads/{reference:%s}`,
 			grammar.Name, grammar.Reference,
 		),
-		PushBlobPatch(),
+		PushBlobPatch(s),
+	)
+
+	rs.GET(
+		fmt.Sprintf(
+			`/v2/{name:%s}/blobs/uploads/{reference:%s}`,
+			grammar.Name, grammar.Reference,
+		),
+		GetBlobUpload(s),
 	)
 
 	// /?digest=<digest>
@@ -92,7 +478,7 @@ func main() {
 			`/v2/{name:%s}/blobs/uploads/{reference:%s}`,
 			grammar.Name, grammar.Reference,
 		),
-		PushBlobPut(),
+		PushBlobPut(s, sink),
 	)
 
 	rs.HEAD(
@@ -100,7 +486,7 @@ func main() {
 			`/v2/{name:%s}/blobs/{digest:%s}`,
 			grammar.Name, grammar.Digest,
 		),
-		PushBlobHead(),
+		PushBlobHead(s),
 	)
 
 	// Group -- /v2/<name>/manifests/<reference>
@@ -109,24 +495,35 @@ func main() {
 			`/v2/{name:%s}/manifests/{tag:%s}`,
 			grammar.Name, grammar.Tag,
 		),
-		PushManifestPut(),
+		PushManifestPut(s, sink),
 	)
 	rs.PUT(
 		fmt.Sprintf(
 			`/v2/{name:%s}/manifests/{digest:%s}`,
 			grammar.Name, grammar.Digest,
 		),
-		unsupportedHandler,
+		PushManifestPutByDigest(s, sink),
 	)
 	// Group End
 
+	// /?n=<integer>&last=<name>
+	rs.GET(catalogPath, ListCatalog(s, opts.authorizer))
+
 	// /?n=<integer>&last=<integer>
 	rs.GET(
 		fmt.Sprintf(
 			"/v2/{name:%s}/tags/list",
 			grammar.Name,
 		),
-		ListTags(),
+		ListTags(s),
+	)
+
+	rs.GET(
+		fmt.Sprintf(
+			"/v2/{name:%s}/_history/{tag:%s}",
+			grammar.Name, grammar.Tag,
+		),
+		TagHistory(s),
 	)
 
 	rs.DELETE(
@@ -134,7 +531,7 @@ func main() {
 			`/v2/{name:%s}/manifests/{reference:%s}`,
 			grammar.Name, grammar.Reference,
 		),
-		DeleteManifest(),
+		DeleteManifest(s, sink),
 	)
 
 	rs.DELETE(
@@ -142,43 +539,63 @@ func main() {
 			"/v2/{name:%s}/blobs/{digest:%s}",
 			grammar.Name, grammar.Digest,
 		),
-		DeleteBlob(),
+		DeleteBlob(s, sink),
 	)
 
-	srv := &http.Server{
-		Handler: ServerApply(rs, AccessLogServerAdapter(), SetHeaderServerAdapter()),
+	if opts.replicator != nil {
+		rs.GET("/admin/replication", ReplicationStatus(opts.replicator))
 	}
-	errCh := make(chan struct{})
-	go func() {
-		addr := hostname
-		log.Printf("running %q", addr)
-		ln, err := net.Listen("tcp", addr)
-		if err != nil {
-			log.Printf("error: %v", err)
-			close(errCh)
-			return
-		}
-		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
-			log.Fatal(err)
-		}
-	}()
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	if opts.quotas != nil {
+		quotaPath := fmt.Sprintf("/admin/quotas/{kind:%s|%s}/{name:%s}",
+			quota.KindRepository, quota.KindNamespace, grammar.Name)
+		rs.GET("/admin/quotas", ListQuotas(opts.quotas))
+		rs.GET(quotaPath, GetQuota(opts.quotas))
+		rs.PUT(quotaPath, SetQuota(opts.quotas))
+		rs.DELETE(quotaPath, DeleteQuota(opts.quotas))
+	}
+	if opts.images {
+		rs.POST("/admin/copy", CopyManifest(s, opts.quotas, sink))
+		rs.GET("/admin/export", ExportImages(s))
+		rs.POST("/admin/import", ImportImages(s, opts.quotas, sink))
+	}
+	if s.Trash {
+		rs.GET("/admin/trash", ListTrash(s))
+		rs.POST("/admin/trash/{id:[0-9a-f-]+}/restore", RestoreTrash(s, sink))
+		rs.DELETE("/admin/trash/{id:[0-9a-f-]+}", PurgeTrash(s))
+	}
+	if opts.retention != nil {
+		rs.GET("/admin/retention", RetentionReport(opts.retention))
+		rs.POST("/admin/retention", RunRetention(opts.retention))
+	}
+	if opts.apiTokens != nil {
+		rs.GET("/admin/tokens", ListAPITokens(opts.apiTokens))
+		rs.POST("/admin/tokens", CreateAPIToken(opts.apiTokens))
+		rs.DELETE("/admin/tokens/{id:[0-9a-f-]+}", RevokeAPIToken(opts.apiTokens))
+	}
 
-	select {
-	case <-sig:
-	case <-errCh:
+	if opts.issuer != nil {
+		rs.GET(tokenPath, IssueToken(opts.issuer))
+		rs.POST(tokenPath, IssueToken(opts.issuer))
+	}
+
+	if opts.metrics != nil {
+		rs.GET(metricsPath, opts.metrics)
 	}
 
-	if err := srv.Shutdown(context.Background()); err != nil {
-		log.Printf("shutdown error: %v\n", err)
+	if opts.health != nil {
+		rs.GET(healthzPath, opts.health.LivenessHandler())
+		rs.GET(readyzPath, opts.health.ReadinessHandler())
 	}
+
+	return rs
 }
 
 // DeterminingSupport to check whether or not the registry implements this specification.
 // If the response is 200 OK, then the registry implements this specification.
 // This endpoint MAY be used for authentication/authorization purposes, but this is out of the purview of this specification.
+//
+// If the authentication is enabled, AuthServerAdapter responds 401 to unauthenticated requests before this.
 func DeterminingSupport() http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
 		w.Header().Set("Content-Type", "application/json")
@@ -191,9 +608,11 @@ func DeterminingSupport() http.Handler {
 //
 // To pull a blob, perform a GET request to a url in the following form: /v2/<name>/blobs/<digest>
 // <name> is the namespace of the repository, and <digest> is the blob's digest.
-func PullingBlobs() http.Handler {
-	s := new(storage.Local)
+//
+// If p is not nil, the blob which is missing in s is pulled from the upstream.
+func PullingBlobs(s *storage.Local, p *proxy.Proxy, sink notifications.Sink) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		ctx := r.Context()
 		dq := router.ParamFromContext(ctx, "digest")
 		dgst, err := digest.Parse(dq)
@@ -203,14 +622,30 @@ func PullingBlobs() http.Handler {
 			)
 		}
 		name := router.ParamFromContext(ctx, "name")
-		f, err := s.FindBlobByImage(name, dgst.String())
+		var f proxy.Blob
+		if p != nil {
+			f, err = p.FindBlobByImage(ctx, name, dgst.String())
+		} else {
+			f, err = s.FindBlobByImage(name, dgst.String())
+		}
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		w.Header().Set("Content-Type", registry.PredictDockerContentType(f.Name()))
-		_, err = io.Copy(w, f)
-		return err
+		contentType := registry.PredictDockerContentType(f.Name())
+		w.Header().Set("Content-Type", contentType)
+		size, err := io.Copy(w, f)
+		if err != nil {
+			return err
+		}
+		sink.Write(newEvent(r, notifications.ActionPull, notifications.Target{
+			MediaType:  contentType,
+			Size:       size,
+			Digest:     dgst.String(),
+			Repository: name,
+			URL:        r.URL.Path,
+		}))
+		return nil
 	})
 }
 
@@ -218,18 +653,51 @@ func PullingBlobs() http.Handler {
 //
 // To pull a manifest, perform a GET request to a url in the following form: /v2/<name>/manifests/<reference>
 // <name> refers to the namespace of the repository. <reference> is a tag name.
-func PullingManifests() http.Handler {
-	s := new(storage.Local)
+//
+// If p is not nil, the manifest which is missing in s or stale is pulled from the upstream.
+func PullingManifests(s *storage.Local, p *proxy.Proxy, sink notifications.Sink) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		ctx := r.Context()
 		name := router.ParamFromContext(ctx, "name")
 		ref := router.ParamFromContext(ctx, "reference")
-		m, err := s.FindManifestByImage(name, ref)
+		var (
+			raw  []byte
+			dgst string
+			err  error
+		)
+		if p != nil {
+			raw, dgst, err = p.FindRawManifestByImage(ctx, name, ref)
+		} else {
+			raw, dgst, err = s.FindRawManifestByImage(name, ref)
+		}
 		if err != nil {
 			return err
 		}
-		w.Header().Set("Content-Type", registry.PredictDockerContentType("manifest.json"))
-		return json.NewEncoder(w).Encode(m)
+		// serve the manifest as it is pushed, so that it matches the digest.
+		var m registry.Manifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		contentType := m.MediaType
+		if contentType == "" {
+			contentType = registry.PredictDockerContentType("manifest.json")
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+		sink.Write(newEvent(r, notifications.ActionPull, notifications.Target{
+			MediaType:  contentType,
+			Size:       int64(len(raw)),
+			Digest:     dgst,
+			Repository: name,
+			Tag:        tagOf(ref),
+			URL:        r.URL.Path,
+		}))
+		return nil
 	})
 }
 
@@ -237,9 +705,9 @@ func PullingManifests() http.Handler {
 //
 // To push a blob monolithically by using a single POST request, perform a POST request to a URL in the following form: /v2/<name>/blobs/uploads
 // <name> refers to the namespace of the repository.
-func PushBlobPost() http.Handler {
-	s := new(storage.Local)
+func PushBlobPost(s *storage.Local, sink notifications.Sink) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		name := router.ParamFromContext(r.Context(), "name")
 		if r.Header.Get("Content-Type") != "application/octet-stream" {
 			sessionID := s.IssueSession()
@@ -259,10 +727,17 @@ func PushBlobPost() http.Handler {
 		}
 		d := dgst.String()
 
-		if _, err := s.PutBlobByReference(d, name, r.Body); err != nil {
+		size, err := s.PutBlobByDigest(name, d, r.Body)
+		if err != nil {
 			return err
 		}
 		pullableLoc := "/v2/" + name + "/blobs/" + d
+		sink.Write(newEvent(r, notifications.ActionPush, notifications.Target{
+			Size:       size,
+			Digest:     d,
+			Repository: name,
+			URL:        pullableLoc,
+		}))
 		w.Header().Set("Location", pullableLoc)
 		w.WriteHeader(http.StatusCreated)
 		return nil
@@ -274,9 +749,9 @@ func PushBlobPost() http.Handler {
 // Pushing a blob in chunks: POST (Obtain a session ID) -> PATCH (Upload the chunks) -> PUT (Close the session)
 // perform a PATCH request to a URL in the following form: /v2/<name>/blobs/uploads/<reference>
 // <name> refers to the namespace of the repository, <reference> will be session ID.
-func PushBlobPatch() http.Handler {
-	s := new(storage.Local)
+func PushBlobPatch(s *storage.Local) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		ctx := r.Context()
 		name := router.ParamFromContext(ctx, "name")
 		sessionID := router.ParamFromContext(ctx, "reference")
@@ -326,16 +801,20 @@ func PushBlobPatch() http.Handler {
 		info, err := s.CheckBlobByReference(name, sessionID)
 		if err == nil {
 			fsize = info.Size()
-		}
-		if !os.IsNotExist(e.Unwrap(err)) {
+		} else if !os.IsNotExist(e.Unwrap(err)) {
 			return err
 		}
 		// Example of range request:
 		// Content-Range: bytes 21010-47021/47022
 		// Content-Length: 26012
 		if int64(start) != fsize || int64(end-start+1) != bodyLen {
+			// the client can resume from the size which is uploaded.
+			w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+sessionID)
+			w.Header().Set("Range", uploadedRange(fsize))
+			err := fmt.Errorf("range %d-%d does not follow the uploaded size %d", start, end, fsize)
 			return errors.Wrap(err,
-				errors.WithCodeBlobUploadUnknown(),
+				errors.WithCodeBlobUploadInvalid(),
+				errors.WithStatusCode(http.StatusRequestedRangeNotSatisfiable),
 			)
 		}
 		if start == 0 {
@@ -346,13 +825,7 @@ func PushBlobPatch() http.Handler {
 			w.Header().Set("Accept-Ranges", "bytes")
 			w.Header().Set("Range", fmt.Sprintf("0-%d", size))
 		} else {
-			path := registry.PathJoinWithBase(name, sessionID)
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			size, err := io.Copy(f, r.Body)
+			size, err := s.AppendBlobByReference(sessionID, name, r.Body)
 			if err != nil {
 				return err
 			}
@@ -368,14 +841,49 @@ func PushBlobPatch() http.Handler {
 	})
 }
 
+// GetBlobUpload a handler to get the status of the upload session, so that the upload
+// which is interrupted such as by the restart can be resumed.
+//
+// perform a GET request to a URL in the following form: /v2/<name>/blobs/uploads/<reference>
+// The Range header has the range which is uploaded, and the next chunk starts from the end of it + 1.
+func GetBlobUpload(s *storage.Local) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
+		ctx := r.Context()
+		name := router.ParamFromContext(ctx, "name")
+		sessionID := router.ParamFromContext(ctx, "reference")
+		info, err := s.CheckBlobByReference(name, sessionID)
+		if err != nil {
+			return errors.Wrap(err,
+				errors.WithCodeBlobUploadUnknown(),
+				errors.WithStatusCode(http.StatusNotFound),
+			)
+		}
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+sessionID)
+		w.Header().Set("Docker-Upload-UUID", sessionID)
+		w.Header().Set("Range", uploadedRange(info.Size()))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+// uploadedRange formats the range of the uploaded content for the Range header.
+// The range is inclusive, so the next chunk starts from size.
+func uploadedRange(size int64) string {
+	if size == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", size-1)
+}
+
 // PushBlobPut a handler to push a blob. this handler moves image to ensured storage
 // from has been put to storage by session ID before.
 //
 // perform a PUT request to a URL in the following form: /v2/<name>/blobs/uploads/<reference>?digest=<digest>
 // <name> refers to the namespace of the repository, <reference> will be session ID. <digest> is digest.
-func PushBlobPut() http.Handler {
-	s := new(storage.Local)
+func PushBlobPut(s *storage.Local, sink notifications.Sink) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		dgst, err := digest.Parse(r.URL.Query().Get("digest"))
 		if err != nil {
 			return errors.Wrap(err,
@@ -388,13 +896,19 @@ func PushBlobPut() http.Handler {
 
 		// For Pushing a blob monolithically: // POST -> PUT
 		// https://github.com/opencontainers/distribution-spec/blob/master/spec.md#pushing-a-blob-monolithically
+		pullableLoc := "/v2/" + name + "/blobs/" + dgst.String()
 		contentType := r.Header.Get("Content-Type")
 		if contentType == "application/octet-stream" {
-			_, err := s.PutBlobByReference(dgst.String(), name, r.Body)
+			size, err := s.PutBlobByDigest(name, dgst.String(), r.Body)
 			if err != nil {
 				return err
 			}
-			pullableLoc := "/v2/" + name + "/blobs/" + dgst.String()
+			sink.Write(newEvent(r, notifications.ActionPush, notifications.Target{
+				Size:       size,
+				Digest:     dgst.String(),
+				Repository: name,
+				URL:        pullableLoc,
+			}))
 			w.Header().Set("Location", pullableLoc)
 			w.WriteHeader(http.StatusCreated)
 			return nil
@@ -405,6 +919,16 @@ func PushBlobPut() http.Handler {
 		if err := s.EnsurePutBlobBySession(sessionID, name, dgst.String()); err != nil {
 			return err
 		}
+		target := notifications.Target{
+			Digest:     dgst.String(),
+			Repository: name,
+			URL:        pullableLoc,
+		}
+		if fi, err := s.CheckBlobByReference(name, dgst.String()); err == nil {
+			target.MediaType = registry.PredictDockerContentType(fi.Name())
+			target.Size = fi.Size()
+		}
+		sink.Write(newEvent(r, notifications.ActionPush, target))
 		w.WriteHeader(http.StatusCreated)
 		return nil
 	})
@@ -414,9 +938,9 @@ func PushBlobPut() http.Handler {
 //
 // perform a HEAD request to a URL in the following form: /v2/<name>/blobs/<digest>
 // <name> refers to the namespace of the repository, <digest> is digest.
-func PushBlobHead() http.Handler {
-	s := new(storage.Local)
+func PushBlobHead(s *storage.Local) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		ctx := r.Context()
 		dq := router.ParamFromContext(ctx, "digest")
 		dgst, err := digest.Parse(dq)
@@ -442,17 +966,64 @@ func PushBlobHead() http.Handler {
 //
 // perform a PUT request to a URL in the following form: /v2/<name>/manifests/<reference>
 // <name> refers to the namespace of the repository. <reference> is a tag name.
-func PushManifestPut() http.Handler {
-	s := new(storage.Local)
+//
+// If the request has If-Match header, the tag is updated only if it currently
+// points to the digest in the header. Otherwise responds 412 Precondition Failed.
+func PushManifestPut(s *storage.Local, sink notifications.Sink) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(withActor(r))
 		ctx := r.Context()
 		name := router.ParamFromContext(ctx, "name")
 		tag := router.ParamFromContext(ctx, "tag")
-		_, sha256sum, err := s.CreateManifest(r.Body, name, tag)
+		ifMatch := strings.Trim(r.Header.Get("If-Match"), `"`)
+		// the size is counted, because chunked requests have no Content-Length.
+		body := &countingReader{ReadCloser: r.Body}
+		m, sha256sum, err := s.CreateManifestIfMatch(body, name, tag, ifMatch)
 		if err != nil {
 			return err
 		}
 		pullableLoc := "/v2/" + name + "/manifests/" + tag
+		target := notifications.Target{
+			MediaType:  m.MediaType,
+			Digest:     sha256sum,
+			Repository: name,
+			Tag:        tag,
+			URL:        pullableLoc,
+			Size:       body.n,
+		}
+		sink.Write(newEvent(r, notifications.ActionPush, target))
+		w.Header().Set("Docker-Content-Digest", sha256sum)
+		w.Header().Set("ETag", `"`+sha256sum+`"`)
+		w.Header().Set("Location", pullableLoc)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	})
+}
+
+// PushManifestPutByDigest a handler to push a manifest json file which is not pointed by any tags.
+//
+// perform a PUT request to a URL in the following form: /v2/<name>/manifests/<digest>
+// <name> refers to the namespace of the repository. <digest> must match the manifest.
+func PushManifestPutByDigest(s *storage.Local, sink notifications.Sink) http.Handler {
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(withActor(r))
+		ctx := r.Context()
+		name := router.ParamFromContext(ctx, "name")
+		dgst := router.ParamFromContext(ctx, "digest")
+		body := &countingReader{ReadCloser: r.Body}
+		m, sha256sum, err := s.PutManifestByDigest(body, name, dgst)
+		if err != nil {
+			return err
+		}
+		pullableLoc := "/v2/" + name + "/manifests/" + sha256sum
+		target := notifications.Target{
+			MediaType:  m.MediaType,
+			Digest:     sha256sum,
+			Repository: name,
+			URL:        pullableLoc,
+			Size:       body.n,
+		}
+		sink.Write(newEvent(r, notifications.ActionPush, target))
 		w.Header().Set("Docker-Content-Digest", sha256sum)
 		w.Header().Set("Location", pullableLoc)
 		w.WriteHeader(http.StatusCreated)
@@ -464,15 +1035,24 @@ func PushManifestPut() http.Handler {
 //
 // perform a DELETE request to a URL in the following form: /v2/<name>/manifests/<tag>
 // <name> refers to the namespace of the repository. <tag> is the name of the tag to be deleted.
-func DeleteManifest() http.Handler {
-	s := new(storage.Local)
+func DeleteManifest(s *storage.Local, sink notifications.Sink) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(withActor(r))
 		ctx := r.Context()
 		name := router.ParamFromContext(ctx, "name")
 		tag := router.ParamFromContext(ctx, "reference")
 		if err := s.DeleteManifestByImage(name, tag); err != nil {
 			return err
 		}
+		target := notifications.Target{
+			Repository: name,
+			Tag:        tagOf(tag),
+			URL:        r.URL.Path,
+		}
+		if target.Tag == "" {
+			target.Digest = tag
+		}
+		sink.Write(newEvent(r, notifications.ActionDelete, target))
 		w.WriteHeader(http.StatusAccepted)
 		return nil
 	})
@@ -482,31 +1062,91 @@ func DeleteManifest() http.Handler {
 //
 // perform a DELETE request to a URL in the following form: /v2/<name>/blobs/<digest>
 // <name> refers to the namespace of the repository, <digest> is digest.
-func DeleteBlob() http.Handler {
-	s := new(storage.Local)
+func DeleteBlob(s *storage.Local, sink notifications.Sink) http.Handler {
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		ctx := r.Context()
 		name := router.ParamFromContext(ctx, "name")
 		digest := router.ParamFromContext(ctx, "digest")
 		if err := s.DeleteBlobByImage(name, digest); err != nil {
 			return err
 		}
+		sink.Write(newEvent(r, notifications.ActionDelete, notifications.Target{
+			Digest:     digest,
+			Repository: name,
+			URL:        r.URL.Path,
+		}))
 		w.WriteHeader(http.StatusAccepted)
 		return nil
 	})
 }
 
+// ListCatalog a handler to list repositories.
+//
+// perform a GET request to a path in the following format: /v2/_catalog?n=<integer>&last=<name>
+// Repositories after <last> are listed in lexical order, and at most <integer> repositories
+// are listed. If there are more, the Link header has the url of the next page.
+//
+// If authz is not nil, only repositories which the user can pull are listed.
+func ListCatalog(s *storage.Local, authz auth.Authorizer) http.Handler {
+	type Catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
+		q := r.URL.Query()
+		nq, last := q.Get("n"), q.Get("last")
+		names, err := s.ListRepositories()
+		if err != nil {
+			return err
+		}
+		user := auth.UserFromContext(r.Context())
+		repos := make([]string, 0, len(names))
+		for _, name := range names {
+			if name <= last {
+				continue
+			}
+			if authz != nil {
+				pull := []auth.Access{{Type: auth.TypeRepository, Name: name, Actions: []string{auth.ActionPull}}}
+				if len(authz.Authorize(user, pull)) == 0 {
+					continue
+				}
+			}
+			repos = append(repos, name)
+		}
+		if nq != "" {
+			n, err := strconv.Atoi(nq)
+			if err != nil || n < 0 {
+				return errors.Wrap(
+					fmt.Errorf("invalid n: %q", nq),
+					errors.WithCodeUnsupported(),
+					errors.WithStatusCode(http.StatusBadRequest),
+				)
+			}
+			if n < len(repos) {
+				repos = repos[:n]
+				if n > 0 {
+					next := url.Values{"n": {nq}, "last": {repos[n-1]}}
+					w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, catalogPath, next.Encode()))
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&Catalog{Repositories: repos})
+	})
+}
+
 // ListTags a handler to list tags.
 //
 // perform a GET request to a path in the following format: /v2/<name>/tags/list
 // <name> is the namespace of the repository.
-func ListTags() http.Handler {
+func ListTags(s *storage.Local) http.Handler {
 	type Tags struct {
 		Name string   `json:"name"`
 		Tags []string `json:"tags"`
 	}
-	s := new(storage.Local)
 	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
 		ctx := r.Context()
 		name := router.ParamFromContext(ctx, "name")
 		q := r.URL.Query()
@@ -537,3 +1177,44 @@ func ListTags() http.Handler {
 		return json.NewEncoder(w).Encode(resp)
 	})
 }
+
+// TagHistory a handler to show changes of the tag from the newest one.
+//
+// perform a GET request to a path in the following format: /v2/<name>/_history/<tag>?n=<integer>
+// At most <integer> changes are listed if n is specified.
+func TagHistory(s *storage.Local) http.Handler {
+	type History struct {
+		Name    string                    `json:"name"`
+		Tag     string                    `json:"tag"`
+		History []storage.TagHistoryEntry `json:"history"`
+	}
+	return Handler(func(w http.ResponseWriter, r *http.Request) error {
+		s := s.WithContext(r.Context())
+		ctx := r.Context()
+		name := router.ParamFromContext(ctx, "name")
+		tag := router.ParamFromContext(ctx, "tag")
+		history, err := s.TagHistory(name, tag)
+		if err != nil {
+			return err
+		}
+		if nq := r.URL.Query().Get("n"); nq != "" {
+			n, err := strconv.Atoi(nq)
+			if err != nil || n < 0 {
+				return errors.Wrap(
+					fmt.Errorf("invalid n: %q", nq),
+					errors.WithCodeUnsupported(),
+					errors.WithStatusCode(http.StatusBadRequest),
+				)
+			}
+			if n < len(history) {
+				history = history[:n]
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(&History{
+			Name:    name,
+			Tag:     tag,
+			History: history,
+		})
+	})
+}
@@ -0,0 +1,1804 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/auth"
+	"github.com/Code-Hex/container-registry/internal/client"
+	"github.com/Code-Hex/container-registry/internal/duration"
+	"github.com/Code-Hex/container-registry/internal/health"
+	"github.com/Code-Hex/container-registry/internal/immutable"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/metrics"
+	"github.com/Code-Hex/container-registry/internal/notifications"
+	"github.com/Code-Hex/container-registry/internal/ocilayout"
+	"github.com/Code-Hex/container-registry/internal/proxy"
+	"github.com/Code-Hex/container-registry/internal/quota"
+	"github.com/Code-Hex/container-registry/internal/ratelimit"
+	"github.com/Code-Hex/container-registry/internal/registry"
+	"github.com/Code-Hex/container-registry/internal/replication"
+	"github.com/Code-Hex/container-registry/internal/retention"
+	"github.com/Code-Hex/container-registry/internal/storage"
+	"github.com/Code-Hex/container-registry/internal/tracing"
+	digest "github.com/opencontainers/go-digest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		panic(err)
+	}
+	registry.BasePath = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newTestServer(t *testing.T, s *storage.Local) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(ServerApply(newRouter(s, nil), SetHeaderServerAdapter()))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestStorage(t *testing.T) *storage.Local {
+	t.Helper()
+	return &storage.Local{Root: t.TempDir()}
+}
+
+func testManifest(t *testing.T, layer string) []byte {
+	t.Helper()
+	m := &registry.Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+	}
+	m.Config.Digest = digest.Digest("sha256:" + layer)
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// doRequest sends the request and stops the test on errors, so it must be
+// called from the goroutine running the test. Other goroutines use sendRequest.
+func doRequest(t *testing.T, method, url string, body []byte, header http.Header) *http.Response {
+	t.Helper()
+	resp, err := sendRequest(method, url, body, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// sendRequest sends the request and returns the response whose body is drained.
+func sendRequest(method, url string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestPushManifestPut_Concurrent(t *testing.T) {
+	srv := newTestServer(t, newTestStorage(t))
+	url := srv.URL + "/v2/stress/concurrent/manifests/latest"
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		body := testManifest(t, fmt.Sprintf("%064d", i))
+		go func() {
+			defer wg.Done()
+			resp, err := sendRequest(PUT, url, body, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp := doRequest(t, GET, url, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	resp = doRequest(t, GET, srv.URL+"/v2/stress/concurrent/tags/list", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestPushManifestPut_ConcurrentWithDelete(t *testing.T) {
+	srv := newTestServer(t, newTestStorage(t))
+	base := srv.URL + "/v2/stress/delete/manifests/"
+
+	const n = 30
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		body := testManifest(t, fmt.Sprintf("%064d", i%3))
+		go func() {
+			defer wg.Done()
+			if _, err := sendRequest(PUT, base+"latest", body, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := sendRequest(DELETE, base+"latest", nil, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the tag is deleted or points to an existing manifest.
+	resp := doRequest(t, GET, base+"latest", nil, nil)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		t.Errorf("tag %q is dangling: status %d", "latest", resp.StatusCode)
+	}
+}
+
+func TestPushManifestPut_IfMatch(t *testing.T) {
+	srv := newTestServer(t, newTestStorage(t))
+	url := srv.URL + "/v2/stress/ifmatch/manifests/latest"
+
+	resp := doRequest(t, PUT, url, testManifest(t, fmt.Sprintf("%064d", 1)), http.Header{
+		"If-Match": {"*"},
+	})
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("want %d, but got %d", http.StatusPreconditionFailed, resp.StatusCode)
+	}
+
+	resp = doRequest(t, PUT, url, testManifest(t, fmt.Sprintf("%064d", 1)), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	prev := resp.Header.Get("Docker-Content-Digest")
+
+	// Only one of the concurrent updates based on prev can win.
+	const n = 20
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		won int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		body := testManifest(t, fmt.Sprintf("%064d", i+2))
+		go func() {
+			defer wg.Done()
+			resp, err := sendRequest(PUT, url, body, http.Header{
+				"If-Match": {`"` + prev + `"`},
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch resp.StatusCode {
+			case http.StatusCreated:
+				mu.Lock()
+				won++
+				mu.Unlock()
+			case http.StatusPreconditionFailed:
+			default:
+				t.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Fatalf("want exactly 1 successful update, but got %d", won)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream := newTestServer(t, newTestStorage(t))
+
+	local := newTestStorage(t)
+	p := proxy.New(local, &client.Client{URL: upstream.URL}, time.Hour)
+	srv := httptest.NewServer(ServerApply(newRouter(local, &routerOptions{proxy: p}), SetHeaderServerAdapter()))
+	t.Cleanup(srv.Close)
+
+	const name = "proxy/image"
+	layer := bytes.Repeat([]byte{0x1f, 0x8b, 0x8}, 1024)
+	layerDigest := digest.FromBytes(layer).String()
+	resp := doRequest(t, POST, upstream.URL+"/v2/"+name+"/blobs/uploads/?digest="+layerDigest, layer, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("push blob: want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	resp = doRequest(t, PUT, upstream.URL+"/v2/"+name+"/manifests/latest", testManifest(t, fmt.Sprintf("%064d", 1)), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("push manifest: want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	// pull through the proxy.
+	resp = doRequest(t, GET, srv.URL+"/v2/"+name+"/manifests/latest", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pull manifest: want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	got, err := http.Get(srv.URL + "/v2/" + name + "/blobs/" + layerDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(got.Body)
+	got.Body.Close()
+	if !bytes.Equal(body, layer) {
+		t.Fatalf("pulled blob does not match")
+	}
+
+	// the content is cached, so it is served after the upstream is gone.
+	upstream.Close()
+	resp = doRequest(t, GET, srv.URL+"/v2/"+name+"/blobs/"+layerDigest, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pull cached blob: want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	// stale tags are served if the upstream is unavailable.
+	p.TTL = 0
+	resp = doRequest(t, GET, srv.URL+"/v2/"+name+"/manifests/latest", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pull stale manifest: want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestProxy_TTL(t *testing.T) {
+	upstream := newTestServer(t, newTestStorage(t))
+	local := newTestStorage(t)
+	p := proxy.New(local, &client.Client{URL: upstream.URL}, time.Hour)
+	srv := httptest.NewServer(ServerApply(newRouter(local, &routerOptions{proxy: p}), SetHeaderServerAdapter()))
+	t.Cleanup(srv.Close)
+
+	const name = "proxy/ttl"
+	url := upstream.URL + "/v2/" + name + "/manifests/latest"
+	first := doRequest(t, PUT, url, testManifest(t, fmt.Sprintf("%064d", 1)), nil).Header.Get("Docker-Content-Digest")
+	doRequest(t, GET, srv.URL+"/v2/"+name+"/manifests/latest", nil, nil)
+	second := doRequest(t, PUT, url, testManifest(t, fmt.Sprintf("%064d", 2)), nil).Header.Get("Docker-Content-Digest")
+
+	pullDigest := func() string {
+		t.Helper()
+		return doRequest(t, GET, srv.URL+"/v2/"+name+"/manifests/latest", nil, nil).Header.Get("Docker-Content-Digest")
+	}
+	if got := pullDigest(); got != first {
+		t.Fatalf("fresh tag: want %q, but got %q", first, got)
+	}
+	p.TTL = 0
+	if got := pullDigest(); got != second {
+		t.Fatalf("stale tag: want %q, but got %q", second, got)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	downstream := newTestStorage(t)
+	downstreamSrv := newTestServer(t, downstream)
+
+	local := newTestStorage(t)
+	queueDir := t.TempDir()
+	rep, err := replication.New(local, queueDir, []replication.Target{
+		{Name: "downstream", URL: downstreamSrv.URL, Include: []string{"replicated/*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep.MinBackoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rep.Run(ctx)
+
+	srv := httptest.NewServer(ServerApply(newRouter(local, &routerOptions{replicator: rep}), SetHeaderServerAdapter()))
+	t.Cleanup(srv.Close)
+
+	const name = "replicated/image"
+	layer := []byte(`{"architecture":"amd64"}`)
+	layerDigest := digest.FromBytes(layer)
+	doRequest(t, POST, srv.URL+"/v2/"+name+"/blobs/uploads/?digest="+layerDigest.String(), layer, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	m := &registry.Manifest{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+	}
+	m.Config.Digest = layerDigest
+	m.Config.Size = int64(len(layer))
+	body, _ := json.Marshal(m)
+	resp := doRequest(t, PUT, srv.URL+"/v2/"+name+"/manifests/latest", body, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	// excluded by the rule
+	doRequest(t, PUT, srv.URL+"/v2/other/image/manifests/latest", body, nil)
+
+	waitFor(t, func() bool {
+		_, err := downstream.FindManifestByImage(name, "latest")
+		return err == nil
+	})
+	f, err := downstream.FindBlobByImage(name, layerDigest.String())
+	if err != nil {
+		t.Fatalf("blob is not replicated: %v", err)
+	}
+	f.Close()
+	if _, err := downstream.FindManifestByImage("other/image", "latest"); err == nil {
+		t.Fatal("excluded repository is replicated")
+	}
+
+	resp = doRequest(t, DELETE, srv.URL+"/v2/"+name+"/manifests/latest", nil, nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	waitFor(t, func() bool {
+		_, err := downstream.FindManifestByImage(name, "latest")
+		return err != nil
+	})
+	waitFor(t, func() bool {
+		return rep.Status()[0].Pending == 0
+	})
+
+	statusResp, err := http.Get(srv.URL + "/admin/replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statusResp.Body.Close()
+	var status struct {
+		Targets []replication.Status `json:"targets"`
+	}
+	if err := json.NewDecoder(statusResp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Targets) != 1 || status.Targets[0].Succeeded != 2 || status.Targets[0].Pending != 0 {
+		t.Fatalf("unexpected status: %+v", status.Targets)
+	}
+}
+
+func TestReplication_Index(t *testing.T) {
+	downstream := newTestStorage(t)
+	downstreamSrv := newTestServer(t, downstream)
+
+	local := newTestStorage(t)
+	rep, err := replication.New(local, t.TempDir(), []replication.Target{
+		{Name: "downstream", URL: downstreamSrv.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep.MinBackoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rep.Run(ctx)
+	srv := httptest.NewServer(newRouter(local, &routerOptions{replicator: rep}))
+	t.Cleanup(srv.Close)
+
+	const name = "multi/image"
+	put := func(ref string, body []byte) string {
+		t.Helper()
+		resp := doRequest(t, PUT, srv.URL+"/v2/"+name+"/manifests/"+ref, body, nil)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: want %d, but got %d", ref, http.StatusCreated, resp.StatusCode)
+		}
+		return resp.Header.Get("Docker-Content-Digest")
+	}
+	// manifests of platforms and the referrer are pushed by digests.
+	var descs, children []string
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := []byte(`{"architecture":"` + arch + `"}`)
+		doRequest(t, POST, srv.URL+"/v2/"+name+"/blobs/uploads/?digest="+digest.FromBytes(config).String(), config, http.Header{
+			"Content-Type": {"application/octet-stream"},
+		})
+		m := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + digest.FromBytes(config).String() + `","size":` + fmt.Sprint(len(config)) + `}}`)
+		dgst := put(digest.FromBytes(m).String(), m)
+		children = append(children, dgst)
+		descs = append(descs, `{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"`+dgst+`","size":`+fmt.Sprint(len(m))+`}`)
+	}
+	index := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[` + strings.Join(descs, ",") + `]}`)
+	referrer := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","subject":{"mediaType":"application/vnd.oci.image.index.v1+json","digest":"` + digest.FromBytes(index).String() + `","size":` + fmt.Sprint(len(index)) + `}}`)
+	children = append(children, put(digest.FromBytes(referrer).String(), referrer))
+	put("latest", index)
+
+	// the referrer is pushed after the tag.
+	waitFor(t, func() bool {
+		for _, ref := range append(children, "latest") {
+			if _, _, err := downstream.FindRawManifestByImage(name, ref); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if status := rep.Status()[0]; status.Failed != 0 || status.LastError != "" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type recordSink struct {
+	mu     sync.Mutex
+	events []notifications.Event
+}
+
+func (r *recordSink) Write(e notifications.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func TestNotifications(t *testing.T) {
+	sink := new(recordSink)
+	srv := httptest.NewServer(ServerApply(newRouter(newTestStorage(t), &routerOptions{events: sink}), SetHeaderServerAdapter()))
+	t.Cleanup(srv.Close)
+
+	const name = "notified/image"
+	layer := []byte(`{"architecture":"amd64"}`)
+	layerDigest := digest.FromBytes(layer)
+	doRequest(t, POST, srv.URL+"/v2/"+name+"/blobs/uploads/?digest="+layerDigest.String(), layer, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	body := testManifest(t, layerDigest.Hex())
+	// the manifest is sent in chunks without Content-Length.
+	req, err := http.NewRequest(PUT, srv.URL+"/v2/"+name+"/manifests/latest", ioutil.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	doRequest(t, GET, srv.URL+"/v2/"+name+"/manifests/latest", nil, nil)
+	doRequest(t, DELETE, srv.URL+"/v2/"+name+"/manifests/latest", nil, nil)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	want := []struct {
+		action string
+		tag    string
+		digest string
+	}{
+		{notifications.ActionPush, "", layerDigest.String()},
+		{notifications.ActionPush, "latest", digest.FromBytes(body).String()},
+		{notifications.ActionPull, "latest", digest.FromBytes(body).String()},
+		{notifications.ActionDelete, "latest", ""},
+	}
+	if len(sink.events) != len(want) {
+		t.Fatalf("want %d events, but got %+v", len(want), sink.events)
+	}
+	for i, w := range want {
+		e := sink.events[i]
+		if e.Action != w.action || e.Target.Tag != w.tag || e.Target.Digest != w.digest || e.Target.Repository != name {
+			t.Errorf("events[%d]: unexpected event %+v", i, e)
+		}
+	}
+	if got := sink.events[1].Target.Size; got != int64(len(body)) {
+		t.Errorf("want the size %d of the manifest, but got %d", len(body), got)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	key, err := auth.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := auth.NewIssuer("issuer", "registry", key, auth.Users{"alice": string(hash)}, auth.AllowAuthenticated)
+	controller := auth.NewTokenController("", "registry", "issuer", issuer.PublicKey())
+	srv := httptest.NewServer(ServerApply(
+		newRouter(newTestStorage(t), &routerOptions{issuer: issuer}),
+		SetHeaderServerAdapter(),
+		AuthServerAdapter(controller),
+	))
+	t.Cleanup(srv.Close)
+
+	resp := doRequest(t, GET, srv.URL+"/v2/", nil, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want %d, but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	want := fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, srv.URL)
+	if got := resp.Header.Get("WWW-Authenticate"); got != want {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+
+	getToken := func(t *testing.T, username, password, scope string) (string, int) {
+		t.Helper()
+		req, _ := http.NewRequest(GET, srv.URL+"/token?service=registry&scope="+scope, nil)
+		req.SetBasicAuth(username, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var token auth.Token
+		json.NewDecoder(resp.Body).Decode(&token)
+		return token.Token, resp.StatusCode
+	}
+	if _, code := getToken(t, "alice", "wrong", ""); code != http.StatusUnauthorized {
+		t.Fatalf("want %d, but got %d", http.StatusUnauthorized, code)
+	}
+
+	// docker login
+	token, code := getToken(t, "alice", "password", "")
+	if code != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, code)
+	}
+	resp = doRequest(t, GET, srv.URL+"/v2/", nil, http.Header{"Authorization": {"Bearer " + token}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	const name = "auth/image"
+	body := testManifest(t, strings.Repeat("a", 64))
+	pullToken, _ := getToken(t, "alice", "password", "repository:"+name+":pull")
+	resp = doRequest(t, PUT, srv.URL+"/v2/"+name+"/manifests/latest", body, http.Header{"Authorization": {"Bearer " + pullToken}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want %d, but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); !strings.Contains(got, `scope="repository:auth/image:push",error="insufficient_scope"`) {
+		t.Fatalf("unexpected challenge: %q", got)
+	}
+	pushToken, _ := getToken(t, "alice", "password", "repository:"+name+":pull,push")
+	resp = doRequest(t, PUT, srv.URL+"/v2/"+name+"/manifests/latest", body, http.Header{"Authorization": {"Bearer " + pushToken}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	content := "alice:" + string(hash) + "\nbob:" + string(hash) + "\n"
+	if err := ioutil.WriteFile(htpasswd, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := auth.NewHtpasswd(htpasswd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := &auth.Roles{Users: map[string]auth.Role{"alice": auth.RoleReadWrite}}
+	srv := httptest.NewServer(ServerApply(
+		newRouter(newTestStorage(t), nil),
+		SetHeaderServerAdapter(),
+		AuthServerAdapter(auth.NewBasicController("registry", h, roles)),
+	))
+	t.Cleanup(srv.Close)
+
+	basic := func(username string) http.Header {
+		req, _ := http.NewRequest(GET, "/", nil)
+		req.SetBasicAuth(username, "password")
+		return req.Header
+	}
+	const name = "basic/image"
+	body := testManifest(t, strings.Repeat("a", 64))
+
+	resp := doRequest(t, GET, srv.URL+"/v2/", nil, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want %d, but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if got := resp.Header.Get("WWW-Authenticate"); got != `Basic realm="registry"` {
+		t.Fatalf("unexpected challenge: %q", got)
+	}
+	resp = doRequest(t, PUT, srv.URL+"/v2/"+name+"/manifests/latest", body, basic("bob"))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("want %d, but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	resp = doRequest(t, PUT, srv.URL+"/v2/"+name+"/manifests/latest", body, basic("alice"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	resp = doRequest(t, GET, srv.URL+"/v2/"+name+"/manifests/latest", nil, basic("bob"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	content := "alice:" + string(hash) + "\nbob:" + string(hash) + "\n"
+	if err := ioutil.WriteFile(htpasswd, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := auth.NewHtpasswd(htpasswd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &auth.Policy{
+		Rules: []auth.Rule{
+			{Users: []string{"alice"}, Repositories: []string{"team-a/*"}, Actions: []string{"*"}},
+			{Users: []string{"bob"}, Repositories: []string{"team-b/*"}, Actions: []string{"*"}},
+			{Users: []string{"*"}, Repositories: []string{"base/*"}, Actions: []string{auth.ActionPull}},
+			{Users: []string{"*"}, Actions: []string{auth.ActionCatalog}},
+		},
+	}
+	authz := auth.Intersect(&auth.Roles{Default: auth.RoleReadWrite}, policy)
+	local := newTestStorage(t)
+	srv := httptest.NewServer(ServerApply(
+		newRouter(local, &routerOptions{authorizer: authz}),
+		SetHeaderServerAdapter(),
+		AuthServerAdapter(auth.NewBasicController("registry", h, authz)),
+	))
+	t.Cleanup(srv.Close)
+
+	basic := func(username string) http.Header {
+		req, _ := http.NewRequest(GET, "/", nil)
+		req.SetBasicAuth(username, "password")
+		return req.Header
+	}
+	body := testManifest(t, strings.Repeat("a", 64))
+	for _, name := range []string{"base/ubuntu", "team-a/app", "team-b/app"} {
+		if _, _, err := local.CreateManifest(bytes.NewReader(body), name, "latest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		method string
+		name   string
+		want   int
+	}{
+		{PUT, "team-a/app", http.StatusCreated},
+		{PUT, "team-b/app", http.StatusForbidden},
+		{PUT, "base/ubuntu", http.StatusForbidden},
+		{GET, "base/ubuntu", http.StatusOK},
+		{GET, "team-b/app", http.StatusForbidden},
+		{DELETE, "team-b/app", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		resp := doRequest(t, c.method, srv.URL+"/v2/"+c.name+"/manifests/latest", body, basic("alice"))
+		if resp.StatusCode != c.want {
+			t.Errorf("%s %s: want %d, but got %d", c.method, c.name, c.want, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequest(GET, srv.URL+"/v2/_catalog?n=1", nil)
+	req.SetBasicAuth("alice", "password")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Repositories) != 1 || catalog.Repositories[0] != "base/ubuntu" {
+		t.Fatalf("unexpected catalog: %v", catalog.Repositories)
+	}
+	if got, want := resp.Header.Get("Link"), `</v2/_catalog?last=base%2Fubuntu&n=1>; rel="next"`; got != want {
+		t.Fatalf("want %q, but got %q", want, got)
+	}
+
+	req, _ = http.NewRequest(GET, srv.URL+"/v2/_catalog?last=base%2Fubuntu", nil)
+	req.SetBasicAuth("alice", "password")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Repositories) != 1 || catalog.Repositories[0] != "team-a/app" {
+		t.Fatalf("unexpected catalog: %v", catalog.Repositories)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz := &auth.Roles{Users: map[string]auth.Role{"admin": auth.RoleAdmin}, Default: auth.RoleReadWrite}
+	store, err := auth.NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ServerApply(
+		newRouter(newTestStorage(t), &routerOptions{authorizer: authz, apiTokens: store}),
+		SetHeaderServerAdapter(),
+		AuthServerAdapter(&auth.APITokenController{
+			Store:      store,
+			Authorizer: authz,
+			Next:       auth.NewBasicController("registry", auth.Users{"admin": string(hash), "alice": string(hash)}, authz),
+		}),
+	))
+	t.Cleanup(srv.Close)
+
+	do := func(method, path, username, password string, body []byte) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+		req.SetBasicAuth(username, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// users who can push can not use the admin API.
+	if resp := do(POST, "/v2/team-a/app/blobs/uploads/", "alice", "password", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	for _, method := range []string{GET, POST} {
+		if resp := do(method, "/admin/tokens", "alice", "password", []byte(`{}`)); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: want %d, but got %d", method, http.StatusForbidden, resp.StatusCode)
+		}
+	}
+
+	resp := do(POST, "/admin/tokens", "admin", "password", []byte(`{
+		"kind": "robot",
+		"name": "ci",
+		"scopes": ["repository:team-a/app:pull,push"],
+		"expiresIn": "1h"
+	}`))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	var created struct {
+		Token string `json:"token"`
+		ID    string `json:"id"`
+		Hash  string `json:"hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Token == "" || created.Hash != "" {
+		t.Fatalf("unexpected response: %+v", created)
+	}
+
+	body := testManifest(t, strings.Repeat("a", 64))
+	if resp := do(PUT, "/v2/team-a/app/manifests/latest", "robot$ci", created.Token, body); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp := do(PUT, "/v2/team-b/app/manifests/latest", "robot$ci", created.Token, body); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("want %d, but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if resp := do(GET, "/admin/tokens", "robot$ci", created.Token, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("want %d, but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	resp = do(GET, "/admin/tokens", "admin", "password", nil)
+	var list struct {
+		Tokens []auth.APIToken `json:"tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Tokens) != 1 || list.Tokens[0].LastUsedAt.IsZero() || list.Tokens[0].Hash != "" {
+		t.Fatalf("unexpected tokens: %+v", list.Tokens)
+	}
+
+	if resp := do(DELETE, "/admin/tokens/"+created.ID, "admin", "password", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("want %d, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if resp := do(GET, "/v2/team-a/app/manifests/latest", "robot$ci", created.Token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("want %d, but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestStorage(t)
+	reg := metrics.NewRegistry()
+	registerStorageMetrics(reg, s, logging.Default)
+	srv := httptest.NewServer(ServerApply(
+		newRouter(s, &routerOptions{metrics: reg}),
+		MetricsServerAdapter(),
+		SetHeaderServerAdapter(),
+	))
+	t.Cleanup(srv.Close)
+
+	pushed := blobPushedBytes.Value()
+	pulled := blobPulledBytes.Value()
+	requests := httpRequestDuration.Count(routeBlob, GET, "200")
+
+	content := []byte("metrics")
+	dgst := digest.FromBytes(content).String()
+	resp := doRequest(t, POST, srv.URL+"/v2/metrics/blobs/uploads/?digest="+dgst, content, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("push: want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	resp = doRequest(t, GET, srv.URL+"/v2/metrics/blobs/"+dgst, nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pull: want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if got := blobPushedBytes.Value() - pushed; got != float64(len(content)) {
+		t.Errorf("pushed bytes: want %d, but got %v", len(content), got)
+	}
+	if got := blobPulledBytes.Value() - pulled; got != float64(len(content)) {
+		t.Errorf("pulled bytes: want %d, but got %v", len(content), got)
+	}
+	if got := httpRequestDuration.Count(routeBlob, GET, "200") - requests; got != 1 {
+		t.Errorf("requests: want 1, but got %d", got)
+	}
+
+	resp, err := http.Get(srv.URL + metricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != metrics.ContentType {
+		t.Errorf("want content type %q, but got %q", metrics.ContentType, ct)
+	}
+	for _, want := range []string{
+		"registry_storage_repositories 1\n",
+		"registry_storage_blobs 1\n",
+		"registry_storage_blob_bytes 7\n",
+		"registry_storage_upload_sessions 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("want %q in metrics, but got:\n%s", want, body)
+		}
+	}
+}
+
+func TestRouteOf(t *testing.T) {
+	tests := map[string]string{
+		"/v2/":                      routeBase,
+		"/v2/a/b/blobs/uploads/":    routeBlobUpload,
+		"/v2/a/b/blobs/uploads/xxx": routeBlobUpload,
+		"/v2/a/blobs/sha256:abc":    routeBlob,
+		"/v2/a/manifests/latest":    routeManifest,
+		"/v2/a/tags/list":           routeTags,
+		"/v2/_catalog":              routeCatalog,
+		"/admin/tokens":             routeAdmin,
+		"/token":                    routeToken,
+		"/metrics":                  routeMetrics,
+		"/healthz":                  routeHealth,
+		"/favicon.ico":              routeOther,
+	}
+	for path, want := range tests {
+		r := httptest.NewRequest(GET, path, nil)
+		if got := routeOf(r); got != want {
+			t.Errorf("%s: want %q, but got %q", path, want, got)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logging.New(&buf, logging.LevelInfo, logging.FormatJSON)
+	srv := httptest.NewServer(ServerApply(
+		newRouter(newTestStorage(t), nil),
+		RequestServerAdapter(logger),
+		AccessLogServerAdapter(),
+		SetHeaderServerAdapter(),
+	))
+	t.Cleanup(srv.Close)
+
+	content := []byte("access log")
+	dgst := digest.FromBytes(content).String()
+	resp := doRequest(t, POST, srv.URL+"/v2/logging/app/blobs/uploads/?digest="+dgst, content, http.Header{
+		"Content-Type": {"application/octet-stream"},
+		"X-Request-Id": {"req-1"},
+	})
+	if got := resp.Header.Get("X-Request-Id"); got != "req-1" {
+		t.Errorf("want request id %q, but got %q", "req-1", got)
+	}
+	resp = doRequest(t, GET, srv.URL+"/v2/logging/app/blobs/"+digest.FromString("unknown").String(), nil, nil)
+	generated := resp.Header.Get("X-Request-Id")
+	if generated == "" {
+		t.Fatal("want generated request id")
+	}
+
+	type entry struct {
+		Level      string `json:"level"`
+		Msg        string `json:"msg"`
+		RequestID  string `json:"request_id"`
+		Method     string `json:"method"`
+		Status     int    `json:"status"`
+		Repository string `json:"repository"`
+		Digest     string `json:"digest"`
+		ErrorCode  string `json:"error_code"`
+	}
+	var entries []entry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	want := []entry{
+		{Level: "info", Msg: "access", RequestID: "req-1", Method: POST, Status: http.StatusCreated, Repository: "logging/app"},
+		{Level: "info", Msg: "access", RequestID: generated, Method: GET, Status: http.StatusNotFound, Repository: "logging/app", Digest: digest.FromString("unknown").String(), ErrorCode: "BLOB_UNKNOWN"},
+	}
+	if !reflect.DeepEqual(want, entries) {
+		t.Errorf("want %+v, but got %+v", want, entries)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := tracing.NewTracer("test", &tracing.StdoutExporter{W: &buf})
+	srv := httptest.NewServer(ServerApply(
+		newRouter(newTestStorage(t), nil),
+		RequestServerAdapter(logging.New(ioutil.Discard, logging.LevelInfo, logging.FormatText)),
+		TracingServerAdapter(tracer),
+		SetHeaderServerAdapter(),
+		HandlerSpanServerAdapter(),
+	))
+	t.Cleanup(srv.Close)
+
+	content := []byte("tracing")
+	dgst := digest.FromBytes(content).String()
+	resp := doRequest(t, POST, srv.URL+"/v2/tracing/blobs/uploads/?digest="+dgst, content, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("push: want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	tracer.Flush(context.Background())
+	buf.Reset()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	resp = doRequest(t, GET, srv.URL+"/v2/tracing/blobs/"+dgst, nil, http.Header{
+		"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pull: want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	tracer.Flush(context.Background())
+
+	type span struct {
+		TraceID string `json:"traceId"`
+		SpanID  string `json:"spanId"`
+		Parent  string `json:"parentSpanId"`
+		Name    string `json:"name"`
+	}
+	spans := map[string]span{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var s span
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if s.TraceID != traceID {
+			t.Errorf("%s: want trace id %s, but got %s", s.Name, traceID, s.TraceID)
+		}
+		spans[s.Name] = s
+	}
+	// the parent of each span.
+	for name, parent := range map[string]string{
+		"GET blob":                "",
+		"handler.blob":            "GET blob",
+		"storage.FindBlobByImage": "handler.blob",
+	} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("want span %q in %v", name, spans)
+			continue
+		}
+		want := "00f067aa0ba902b7"
+		if parent != "" {
+			want = spans[parent].SpanID
+		}
+		if s.Parent != want {
+			t.Errorf("%s: want parent %s, but got %s", name, want, s.Parent)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestStorage(t)
+	checker := new(health.Checker)
+	addStorageChecks(checker, s)
+	authz := &auth.Roles{Default: auth.RoleReadWrite}
+	srv := httptest.NewServer(ServerApply(
+		newRouter(s, &routerOptions{health: checker}),
+		SetHeaderServerAdapter(),
+		AuthServerAdapter(auth.NewBasicController("registry", auth.Users{"alice": string(hash)}, authz)),
+	))
+	t.Cleanup(srv.Close)
+
+	// health endpoints are not authenticated.
+	for _, path := range []string{healthzPath, readyzPath} {
+		if resp := doRequest(t, GET, srv.URL+path, nil, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: want %d, but got %d", path, http.StatusOK, resp.StatusCode)
+		}
+	}
+	if resp := doRequest(t, GET, srv.URL+"/v2/", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("want %d, but got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	checker.Shutdown()
+	if resp := doRequest(t, GET, srv.URL+readyzPath, nil, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readyz while shutting down: want %d, but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if resp := doRequest(t, GET, srv.URL+healthzPath, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz while shutting down: want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// the storage is not writable if the root is not a directory.
+	if err := os.RemoveAll(s.Root); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.Root, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if resp := doRequest(t, GET, srv.URL+healthzPath, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz with broken storage: want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if report := checker.Ready(context.Background()); report.Checks["storage"].Status == health.StatusOK {
+		t.Errorf("readiness with broken storage: want failure, but got %+v", report)
+	}
+}
+
+func TestShutdown_Drain(t *testing.T) {
+	s := newTestStorage(t)
+	checker := new(health.Checker)
+	srv := httptest.NewServer(ServerApply(
+		newRouter(s, nil),
+		DrainServerAdapter(checker),
+		SetHeaderServerAdapter(),
+	))
+	t.Cleanup(srv.Close)
+
+	resp := doRequest(t, POST, srv.URL+"/v2/drain/blobs/uploads/", nil, nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+
+	checker.Shutdown()
+	resp = doRequest(t, POST, srv.URL+"/v2/drain/blobs/uploads/", nil, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("want %d, but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got == "" {
+		t.Error("want Retry-After header")
+	}
+
+	// the upload which is in progress can be continued.
+	body := []byte("hello")
+	resp = doRequest(t, PATCH, srv.URL+location, body, http.Header{
+		"Content-Range": {fmt.Sprintf("0-%d", len(body)-1)},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("PATCH while shutting down: want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+}
+
+func TestBlobUpload_Resume(t *testing.T) {
+	srv := newTestServer(t, newTestStorage(t))
+
+	resp := doRequest(t, POST, srv.URL+"/v2/resume/blobs/uploads/", nil, nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+
+	// the session which has no content is unknown yet.
+	if resp := doRequest(t, GET, srv.URL+location, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d, but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	content := []byte("hello, world")
+	resp = doRequest(t, PATCH, srv.URL+location, content[:5], http.Header{
+		"Content-Range": {"0-4"},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	// e.g. after the restart, the client asks where to resume from.
+	resp = doRequest(t, GET, srv.URL+location, nil, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("want %d, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Range"), "0-4"; got != want {
+		t.Errorf("want Range %q, but got %q", want, got)
+	}
+
+	// the chunk which does not follow the uploaded content is rejected.
+	resp = doRequest(t, PATCH, srv.URL+location, content[6:], http.Header{
+		"Content-Range": {fmt.Sprintf("6-%d", len(content)-1)},
+	})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("want %d, but got %d", http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Range"), "0-4"; got != want {
+		t.Errorf("want Range %q, but got %q", want, got)
+	}
+
+	resp = doRequest(t, PATCH, srv.URL+location, content[5:], http.Header{
+		"Content-Range": {fmt.Sprintf("5-%d", len(content)-1)},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	dgst := digest.FromBytes(content)
+	resp = doRequest(t, PUT, srv.URL+location+"?digest="+dgst.String(), nil, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	resp, err := http.Get(srv.URL + "/v2/resume/blobs/" + dgst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(got, content) {
+		t.Errorf("want %q, but got %q", content, got)
+	}
+}
+
+type countFlusher struct{ n int32 }
+
+func (f *countFlusher) Flush(context.Context) { atomic.AddInt32(&f.n, 1) }
+
+func TestBackground_Shutdown(t *testing.T) {
+	bg := newBackground()
+	f := new(countFlusher)
+	stopped := make(chan struct{})
+	bg.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	}, f)
+	if err := bg.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("the worker is not stopped")
+	}
+	if got := atomic.LoadInt32(&f.n); got != 1 {
+		t.Errorf("want flushed once, but got %d", got)
+	}
+
+	// the deadline is honored even if the worker does not stop.
+	bg = newBackground()
+	bg.Go(func(context.Context) { select {} }, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := bg.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want %v, but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestStorage(t)
+	srv := httptest.NewServer(ServerApply(
+		newRouter(s, nil),
+		SetHeaderServerAdapter(),
+		RateLimitServerAdapter(&ratelimit.Config{
+			Manifests: ratelimit.Limit{Rate: 0.1, Burst: 2},
+			BlobBytes: ratelimit.Limit{Rate: 1, Burst: 1},
+		}),
+	))
+	t.Cleanup(srv.Close)
+
+	manifest := testManifest(t, "ratelimit")
+	header := http.Header{"Content-Type": {"application/vnd.docker.distribution.manifest.v2+json"}}
+	resp := doRequest(t, PUT, srv.URL+"/v2/limited/manifests/latest", manifest, header)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/v2/limited/manifests/latest", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	before := rateLimitedRequests.Value(limitManifests)
+	req, err := http.NewRequest(GET, srv.URL+"/v2/limited/manifests/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("want %d, but got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Retry-After"), "10"; got != want {
+		t.Errorf("want Retry-After %q, but got %q", want, got)
+	}
+	var body Error
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != "TOOMANYREQUESTS" {
+		t.Errorf("want TOOMANYREQUESTS, but got %+v", body)
+	}
+	if got := rateLimitedRequests.Value(limitManifests) - before; got != 1 {
+		t.Errorf("want 1 rate limited request, but got %v", got)
+	}
+
+	// blobs are limited once the transferred bytes exceed the limit.
+	content := []byte("too large for the bucket")
+	dgst := digest.FromBytes(content)
+	resp = doRequest(t, POST, srv.URL+"/v2/limited/blobs/uploads/?digest="+dgst.String(), content, http.Header{
+		"Content-Type": {"application/octet-stream"},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	resp = doRequest(t, GET, srv.URL+"/v2/limited/blobs/"+dgst.String(), nil, nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("want %d, but got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+	// other repositories are limited by the client IP as well.
+	resp = doRequest(t, GET, srv.URL+"/v2/other/blobs/"+dgst.String(), nil, nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("want %d, but got %d", http.StatusTooManyRequests, resp.StatusCode)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := newTestStorage(t)
+	m, err := quota.New(s, filepath.Join(t.TempDir(), "quotas.json"), &quota.Config{
+		Namespaces: map[string]int64{"team": 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ServerApply(
+		newRouter(s, &routerOptions{quotas: m}),
+		SetHeaderServerAdapter(),
+		QuotaServerAdapter(m, s),
+	))
+	t.Cleanup(srv.Close)
+
+	octet := http.Header{"Content-Type": {"application/octet-stream"}}
+	push := func(name, content string) *http.Response {
+		t.Helper()
+		dgst := digest.FromString(content).String()
+		return doRequest(t, POST, srv.URL+"/v2/"+name+"/blobs/uploads/?digest="+dgst, []byte(content), octet)
+	}
+	if resp := push("team/app", "12345678"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	req, err := http.NewRequest(POST, srv.URL+"/v2/team/app/blobs/uploads/?digest="+digest.FromString("abc").String(), strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = octet
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("want %d, but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	var denied struct {
+		Code   string `json:"code"`
+		Detail struct {
+			Limit int64 `json:"limit"`
+			Usage int64 `json:"usage"`
+		} `json:"detail"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&denied); err != nil {
+		t.Fatal(err)
+	}
+	if denied.Code != "DENIED" || denied.Detail.Limit != 10 || denied.Detail.Usage != 8 {
+		t.Errorf("unexpected error: %+v", denied)
+	}
+	// manifests which are pushed by digests are checked as well.
+	manifest := testManifest(t, "a")
+	if resp := doRequest(t, PUT, srv.URL+"/v2/team/app/manifests/"+digest.FromBytes(manifest).String(), manifest, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want %d, but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// chunks are checked with what is uploaded in the session.
+	resp = doRequest(t, POST, srv.URL+"/v2/team/app/blobs/uploads/", nil, nil)
+	location := resp.Header.Get("Location")
+	if resp := doRequest(t, PATCH, srv.URL+location, []byte("a"), http.Header{"Content-Range": {"0-0"}}); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	if resp := doRequest(t, PATCH, srv.URL+location, []byte("bc"), http.Header{"Content-Range": {"1-2"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want %d, but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	// the admin API raises the limit.
+	resp = doRequest(t, PUT, srv.URL+"/admin/quotas/namespace/team", []byte(`{"limit": 100}`), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp := push("team/app", "abc"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp := doRequest(t, PUT, srv.URL+"/admin/quotas/group/team", []byte(`{"limit": 100}`), nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown kind: want %d, but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if resp := doRequest(t, PUT, srv.URL+"/admin/quotas/repository/team/app", []byte(`{"limit": 0}`), nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid limit: want %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// deletes decrease the usage.
+	if resp := doRequest(t, DELETE, srv.URL+"/v2/team/app/blobs/"+digest.FromString("abc").String(), nil, nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	resp, err = http.Get(srv.URL + "/admin/quotas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Quotas []quota.Quota `json:"quotas"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	want := []quota.Quota{{Kind: quota.KindNamespace, Name: "team", Limit: 100, Usage: 8}}
+	if !reflect.DeepEqual(want, list.Quotas) {
+		t.Errorf("want %+v, but got %+v", want, list.Quotas)
+	}
+
+	if resp := doRequest(t, DELETE, srv.URL+"/admin/quotas/namespace/team", nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("want %d, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/admin/quotas/namespace/team", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d, but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestImmutableTags(t *testing.T) {
+	s := newTestStorage(t)
+	s.ImmutableTags = &immutable.Config{Rules: []immutable.Rule{
+		{Repositories: []string{"release/*"}, Semver: true},
+	}}
+	srv := newTestServer(t, s)
+
+	header := http.Header{"Content-Type": {"application/vnd.docker.distribution.manifest.v2+json"}}
+	url := srv.URL + "/v2/release/app/manifests/v1.2.3"
+	if resp := doRequest(t, PUT, url, testManifest(t, "a"), header); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp := doRequest(t, PUT, url, testManifest(t, "b"), header); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("re-push of another digest: want %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	if resp := doRequest(t, DELETE, url, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete: want %d, but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	s := newTestStorage(t)
+	if _, _, err := s.CreateManifest(bytes.NewReader(testManifest(t, "layer")), "app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := quota.New(s, filepath.Join(t.TempDir(), "quotas.json"), &quota.Config{
+		Repositories: map[string]int64{"app": 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &routerOptions{quotas: m}
+	engine, err := retention.New(s, filepath.Join(t.TempDir(), "pulls.json"), &retention.Config{
+		Policies: []retention.Policy{{KeepLast: 1}},
+		GCMinAge: duration.Duration(time.Nanosecond),
+	}, opts.sink())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.OnReport = observeRetention
+	opts.retention = engine
+	srv := httptest.NewServer(newRouter(s, opts))
+	t.Cleanup(srv.Close)
+
+	content := "unreferenced"
+	dgst := digest.FromString(content).String()
+	octet := http.Header{"Content-Type": {"application/octet-stream"}}
+	if resp := doRequest(t, POST, srv.URL+"/v2/app/blobs/uploads/?digest="+dgst, []byte(content), octet); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/v2/app/manifests/latest", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if engine.PulledAt("app", digest.FromBytes(testManifest(t, "layer")).String()).IsZero() {
+		t.Error("the pull is not recorded")
+	}
+
+	execute := func(method string) *retention.Report {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+"/admin/retention", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+		}
+		var report retention.Report
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Repositories) != 1 || len(report.Repositories[0].Blobs) != 1 || report.Repositories[0].Blobs[0].Digest != dgst {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+		return &report
+	}
+
+	before := gcDeletedBlobs.Value()
+	if report := execute(GET); !report.DryRun {
+		t.Error("want the dry run")
+	}
+	if _, err := s.CheckBlobByReference("app", dgst); err != nil {
+		t.Errorf("the blob is deleted on the dry run: %v", err)
+	}
+	execute(POST)
+	if _, err := s.CheckBlobByReference("app", dgst); err == nil {
+		t.Error("the blob is not deleted")
+	}
+	if got := gcDeletedBlobs.Value() - before; got != 1 {
+		t.Errorf("want 1 deleted blob in metrics, but got %v", got)
+	}
+	// the quota follows the deletion.
+	q, err := m.Get(quota.KindRepository, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(testManifest(t, "layer"))); q.Usage != want {
+		t.Errorf("want usage %d, but got %d", want, q.Usage)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	s := newTestStorage(t)
+	s.Trash = true
+	sink := new(recordSink)
+	srv := httptest.NewServer(newRouter(s, &routerOptions{events: sink}))
+	t.Cleanup(srv.Close)
+
+	manifest := testManifest(t, "layer")
+	if _, _, err := s.CreateManifest(bytes.NewReader(manifest), "app", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := doRequest(t, DELETE, srv.URL+"/v2/app/manifests/latest", nil, nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/v2/app/manifests/latest", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("the deleted manifest must be hidden: want %d, but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	list := func() []storage.TrashEntry {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/admin/trash?repository=app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list struct {
+			Entries []storage.TrashEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list.Entries
+	}
+	entries := list()
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0].Tags, []string{"latest"}) {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	id := entries[0].ID
+
+	if code := trashCommand([]string{"-url", srv.URL, "list", "app"}); code != 0 {
+		t.Errorf("list: want 0, but got %d", code)
+	}
+	if code := trashCommand([]string{"-url", srv.URL, "restore", id}); code != 0 {
+		t.Fatalf("restore: want 0, but got %d", code)
+	}
+	sink.mu.Lock()
+	last := sink.events[len(sink.events)-1]
+	sink.mu.Unlock()
+	if last.Action != notifications.ActionPush || last.Target.Tag != "latest" {
+		t.Errorf("want the push event of the restored tag, but got %+v", last)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/v2/app/manifests/latest", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if code := trashCommand([]string{"-url", srv.URL, "restore", id}); code != 1 {
+		t.Errorf("restore again: want 1, but got %d", code)
+	}
+	if code := trashCommand([]string{"-url", srv.URL, "restore"}); code != 2 {
+		t.Errorf("usage: want 2, but got %d", code)
+	}
+
+	if resp := doRequest(t, DELETE, srv.URL+"/v2/app/manifests/latest", nil, nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+	if entries = list(); len(entries) != 1 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if code := trashCommand([]string{"-url", srv.URL, "purge", entries[0].ID}); code != 0 {
+		t.Fatalf("purge: want 0, but got %d", code)
+	}
+	if entries := list(); len(entries) != 0 {
+		t.Errorf("want empty trash, but got %+v", entries)
+	}
+}
+
+func TestTagHistory(t *testing.T) {
+	srv := newTestServer(t, newTestStorage(t))
+	first, second := testManifest(t, "first"), testManifest(t, "second")
+	for _, m := range [][]byte{first, second} {
+		if resp := doRequest(t, PUT, srv.URL+"/v2/app/manifests/latest", m, nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("want %d, but got %d", http.StatusCreated, resp.StatusCode)
+		}
+	}
+
+	get := func(url string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	resp := get(srv.URL + "/v2/app/_history/latest")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	var got struct {
+		Name    string                    `json:"name"`
+		Tag     string                    `json:"tag"`
+		History []storage.TagHistoryEntry `json:"history"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "app" || got.Tag != "latest" || len(got.History) != 2 {
+		t.Fatalf("unexpected history: %+v", got)
+	}
+	// the client of the request is recorded.
+	if latest := got.History[0]; latest.Digest != digest.FromBytes(second).String() || !strings.HasPrefix(latest.Addr, "127.0.0.1:") {
+		t.Errorf("unexpected entry: %+v", latest)
+	}
+
+	resp = get(srv.URL + "/v2/app/_history/latest?n=1")
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.History) != 1 {
+		t.Errorf("want 1 entry, but got %+v", got.History)
+	}
+	if resp := get(srv.URL + "/v2/app/_history/unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d, but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := newTestStorage(t)
+	m, err := quota.New(s, filepath.Join(t.TempDir(), "quotas.json"), &quota.Config{
+		Repositories: map[string]int64{"small": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := new(recordSink)
+	srv := httptest.NewServer(newRouter(s, &routerOptions{events: sink, quotas: m, images: true}))
+	t.Cleanup(srv.Close)
+
+	layer := digest.FromString("layer")
+	if _, err := s.PutBlobByDigest("staging/app", layer.String(), strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	manifest := testManifest(t, layer.Hex())
+	if _, _, err := s.CreateManifest(bytes.NewReader(manifest), "staging/app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := copyCommand([]string{"-url", srv.URL, "staging/app:v1", "prod/app"}); code != 0 {
+		t.Fatalf("copy: want 0, but got %d", code)
+	}
+	sink.mu.Lock()
+	events := sink.events
+	sink.mu.Unlock()
+	var urls []string
+	for _, ev := range events {
+		if ev.Action == notifications.ActionPush {
+			urls = append(urls, ev.Target.URL)
+		}
+	}
+	want := []string{
+		"/v2/prod/app/manifests/" + digest.FromBytes(manifest).String(),
+		"/v2/prod/app/blobs/" + layer.String(),
+		"/v2/prod/app/manifests/v1",
+	}
+	if !reflect.DeepEqual(want, urls) {
+		t.Errorf("want push events %v, but got %v", want, urls)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/v2/prod/app/manifests/v1", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if code := copyCommand([]string{"-url", srv.URL, "prod/app:v1", "prod/app:stable,latest"}); code != 0 {
+		t.Fatalf("retag: want 0, but got %d", code)
+	}
+	for _, tag := range []string{"stable", "latest"} {
+		if resp := doRequest(t, GET, srv.URL+"/v2/prod/app/manifests/"+tag, nil, nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: want %d, but got %d", tag, http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	if code := copyCommand([]string{"-url", srv.URL, "staging/app:v1", "small"}); code != 1 {
+		t.Errorf("exceeding the quota: want 1, but got %d", code)
+	}
+	if code := copyCommand([]string{"-url", srv.URL, "staging/app:unknown", "prod/app"}); code != 1 {
+		t.Errorf("unknown tag: want 1, but got %d", code)
+	}
+	if code := copyCommand([]string{"-url", srv.URL, "staging/app", "prod/app"}); code != 2 {
+		t.Errorf("usage: want 2, but got %d", code)
+	}
+	resp := doRequest(t, POST, srv.URL+"/admin/copy", []byte(`{"source":"staging/app","reference":"`+digest.FromBytes(manifest).String()+`","repository":"../app"}`), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestExport(t *testing.T) {
+	s := newTestStorage(t)
+	// the admin API of images is served only if it is enabled.
+	if resp := doRequest(t, GET, newTestServer(t, s).URL+"/admin/export?image=team/app:v1", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("want %d, but got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	srv := httptest.NewServer(newRouter(s, &routerOptions{images: true}))
+	t.Cleanup(srv.Close)
+	layer := digest.FromString("layer")
+	if _, err := s.PutBlobByDigest("team/app", layer.String(), strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	manifest := testManifest(t, layer.Hex())
+	if _, _, err := s.CreateManifest(bytes.NewReader(manifest), "team/app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "layout")
+	if code := exportCommand([]string{"-url", srv.URL, "-o", dir, "team/app:v1"}); code != 0 {
+		t.Fatalf("export: want 0, but got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ocilayout.IndexFile)); err != nil {
+		t.Error(err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "images.tar")
+	if code := exportCommand([]string{"-url", srv.URL, "-o", archive, "team/app@" + digest.FromBytes(manifest).String()}); code != 0 {
+		t.Fatalf("export: want 0, but got %d", code)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// the file is the archive of the layout.
+	w, err := ocilayout.NewDirWriter(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ocilayout.Extract(f, w); err != nil {
+		t.Error(err)
+	}
+
+	if code := exportCommand([]string{"-url", srv.URL, "-o", archive, "team/app:unknown"}); code != 1 {
+		t.Errorf("unknown tag: want 1, but got %d", code)
+	}
+	if code := exportCommand([]string{"-url", srv.URL, "team/app:v1"}); code != 2 {
+		t.Errorf("usage: want 2, but got %d", code)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/admin/export?image=team/app", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestImport(t *testing.T) {
+	s := newTestStorage(t)
+	sink := new(recordSink)
+	srv := httptest.NewServer(newRouter(s, &routerOptions{events: sink, images: true}))
+	t.Cleanup(srv.Close)
+	layer := digest.FromString("layer")
+	if _, err := s.PutBlobByDigest("team/app", layer.String(), strings.NewReader("layer")); err != nil {
+		t.Fatal(err)
+	}
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + layer.String() + `","size":5}}`)
+	if _, _, err := s.CreateManifest(bytes.NewReader(manifest), "team/app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "layout")
+	if code := exportCommand([]string{"-url", srv.URL, "-o", dir, "team/app:v1"}); code != 0 {
+		t.Fatalf("export: want 0, but got %d", code)
+	}
+
+	if code := importCommand([]string{"-url", srv.URL, "-repository", "vendor/app", dir}); code != 0 {
+		t.Fatalf("import: want 0, but got %d", code)
+	}
+	sink.mu.Lock()
+	var urls []string
+	for _, ev := range sink.events {
+		if ev.Action == notifications.ActionPush {
+			urls = append(urls, ev.Target.URL)
+		}
+	}
+	sink.mu.Unlock()
+	want := []string{
+		"/v2/vendor/app/blobs/" + layer.String(),
+		"/v2/vendor/app/manifests/" + digest.FromBytes(manifest).String(),
+		"/v2/vendor/app/manifests/v1",
+	}
+	if !reflect.DeepEqual(want, urls) {
+		t.Errorf("want push events %v, but got %v", want, urls)
+	}
+	if resp := doRequest(t, GET, srv.URL+"/v2/vendor/app/manifests/v1", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("want %d, but got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := importCommand([]string{"-url", srv.URL, dir}); code != 1 {
+		t.Errorf("broken layout: want 1, but got %d", code)
+	}
+	if code := importCommand([]string{"-url", srv.URL}); code != 2 {
+		t.Errorf("usage: want 2, but got %d", code)
+	}
+	if resp := doRequest(t, POST, srv.URL+"/admin/import?repository=..", nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want %d, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
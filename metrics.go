@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/grammar"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/metrics"
+	"github.com/Code-Hex/container-registry/internal/retention"
+	"github.com/Code-Hex/container-registry/internal/storage"
+)
+
+// metricsPath is the path to serve metrics.
+const metricsPath = "/metrics"
+
+var (
+	httpRequestDuration = metrics.NewHistogramVec(
+		"registry_http_request_duration_seconds",
+		"Duration of HTTP requests.",
+		nil, "route", "method", "code",
+	)
+	httpRequestBytes = metrics.NewCounterVec(
+		"registry_http_request_size_bytes_total",
+		"Bytes of HTTP request bodies which are read.",
+		"route", "method",
+	)
+	httpResponseBytes = metrics.NewCounterVec(
+		"registry_http_response_size_bytes_total",
+		"Bytes of HTTP response bodies which are written.",
+		"route", "method",
+	)
+	blobPulledBytes = metrics.NewCounterVec(
+		"registry_blob_pulled_bytes_total",
+		"Bytes of blobs which are pulled.",
+	)
+	blobPushedBytes = metrics.NewCounterVec(
+		"registry_blob_pushed_bytes_total",
+		"Bytes of blobs which are pushed.",
+	)
+	rateLimitedRequests = metrics.NewCounterVec(
+		"registry_rate_limited_requests_total",
+		"Requests which are rejected by the rate limiting.",
+		"limit",
+	)
+	retentionDeletedTags = metrics.NewCounterVec(
+		"registry_retention_deleted_tags_total",
+		"Tags which are deleted by retention policies.",
+	)
+	retentionDeletedManifests = metrics.NewCounterVec(
+		"registry_retention_deleted_manifests_total",
+		"Manifests which are deleted because no tag points to them anymore.",
+	)
+	gcRuns = metrics.NewCounterVec(
+		"registry_gc_runs_total",
+		"Executions of the garbage collection.",
+	)
+	gcDeletedBlobs = metrics.NewCounterVec(
+		"registry_gc_deleted_blobs_total",
+		"Blobs which are deleted by the garbage collection.",
+	)
+	gcFreedBytes = metrics.NewCounterVec(
+		"registry_gc_freed_bytes_total",
+		"Bytes which are freed by the garbage collection.",
+	)
+	gcLastRun = metrics.NewGaugeVec(
+		"registry_gc_last_run_timestamp_seconds",
+		"Unix time when the last garbage collection finished.",
+	)
+	gcLastDuration = metrics.NewGaugeVec(
+		"registry_gc_last_duration_seconds",
+		"Duration of the last garbage collection.",
+	)
+)
+
+func init() {
+	metrics.Default.MustRegister(
+		httpRequestDuration,
+		httpRequestBytes,
+		httpResponseBytes,
+		blobPulledBytes,
+		blobPushedBytes,
+		rateLimitedRequests,
+		retentionDeletedTags,
+		retentionDeletedManifests,
+		gcRuns,
+		gcDeletedBlobs,
+		gcFreedBytes,
+		gcLastRun,
+		gcLastDuration,
+	)
+}
+
+// observeRetention records the report of retention policies and the garbage
+// collection. Dry runs are not recorded, because nothing is deleted.
+func observeRetention(report *retention.Report) {
+	if report.DryRun {
+		return
+	}
+	tags, manifests, blobs, bytes := report.Totals()
+	retentionDeletedTags.Add(float64(tags))
+	retentionDeletedManifests.Add(float64(manifests))
+	gcRuns.Inc()
+	gcDeletedBlobs.Add(float64(blobs))
+	gcFreedBytes.Add(float64(bytes))
+	gcLastRun.Set(float64(report.FinishedAt.Unix()))
+	gcLastDuration.Set(report.FinishedAt.Sub(report.StartedAt).Seconds())
+}
+
+// Routes which are used as the label of metrics. Paths are not used
+// as they are, because they have unbounded repository names and digests.
+const (
+	routeBase       = "base"
+	routeBlob       = "blob"
+	routeBlobUpload = "blob_upload"
+	routeManifest   = "manifest"
+	routeTags       = "tags"
+	routeCatalog    = "catalog"
+	routeToken      = "token"
+	routeAdmin      = "admin"
+	routeMetrics    = "metrics"
+	routeHealth     = "health"
+	routeOther      = "other"
+)
+
+var routePath = regexp.MustCompile(
+	fmt.Sprintf(`^/v2/%s/(blobs/uploads|blobs|manifests|tags)/`, grammar.Name),
+)
+
+// routeOf classifies the request into one of routes.
+func routeOf(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case p == "/v2/" || p == "/v2":
+		return routeBase
+	case p == catalogPath:
+		return routeCatalog
+	case p == tokenPath:
+		return routeToken
+	case p == metricsPath:
+		return routeMetrics
+	case p == healthzPath || p == readyzPath:
+		return routeHealth
+	case strings.HasPrefix(p, "/admin/"):
+		return routeAdmin
+	}
+	m := routePath.FindStringSubmatch(p)
+	if m == nil {
+		return routeOther
+	}
+	switch m[1] {
+	case "blobs/uploads":
+		return routeBlobUpload
+	case "blobs":
+		return routeBlob
+	case "manifests":
+		return routeManifest
+	}
+	return routeTags
+}
+
+// countingReader counts the number of bytes which are read from the body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// MetricsServerAdapter records the duration and the bytes of every request.
+func MetricsServerAdapter() ServerAdapter {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			route := routeOf(r)
+			body := &countingReader{ReadCloser: r.Body}
+			if r.Body != nil {
+				r.Body = body
+			}
+			wrapped := newResponse(w)
+			next.ServeHTTP(wrapped, r)
+
+			code := strconv.Itoa(wrapped.statusCode)
+			httpRequestDuration.Observe(time.Since(start).Seconds(), route, r.Method, code)
+			httpRequestBytes.Add(float64(body.n), route, r.Method)
+			httpResponseBytes.Add(float64(wrapped.size), route, r.Method)
+			switch {
+			case route == routeBlob && r.Method == GET:
+				blobPulledBytes.Add(float64(wrapped.size))
+			case route == routeBlobUpload:
+				blobPushedBytes.Add(float64(body.n))
+			}
+		})
+	}
+}
+
+// storageStatsInterval is the minimum interval to walk the storage.
+// Gauges of the storage share the stats which are walked once in the interval.
+const storageStatsInterval = 10 * time.Second
+
+// storageCollector caches the stats of the storage for gauges.
+type storageCollector struct {
+	s      *storage.Local
+	logger *logging.Logger
+
+	mu        sync.Mutex
+	stats     storage.Stats
+	updatedAt time.Time
+}
+
+func (c *storageCollector) get() storage.Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.updatedAt) < storageStatsInterval {
+		return c.stats
+	}
+	st, err := c.s.Stats()
+	if err != nil {
+		c.logger.Error("metrics: failed to walk the storage", "error", err)
+		return c.stats
+	}
+	c.stats = *st
+	c.updatedAt = time.Now()
+	return c.stats
+}
+
+// registerStorageMetrics registers gauges of the storage usage to reg.
+// Errors of walking the storage are logged to logger.
+func registerStorageMetrics(reg *metrics.Registry, s *storage.Local, logger *logging.Logger) {
+	c := &storageCollector{s: s, logger: logger}
+	reg.MustRegister(
+		metrics.NewGaugeFunc(
+			"registry_storage_repositories",
+			"Number of repositories.",
+			func() float64 { return float64(c.get().Repositories) },
+		),
+		metrics.NewGaugeFunc(
+			"registry_storage_manifests",
+			"Number of manifests.",
+			func() float64 { return float64(c.get().Manifests) },
+		),
+		metrics.NewGaugeFunc(
+			"registry_storage_blobs",
+			"Number of blobs.",
+			func() float64 { return float64(c.get().Blobs) },
+		),
+		metrics.NewGaugeFunc(
+			"registry_storage_blob_bytes",
+			"Total size of blobs in bytes.",
+			func() float64 { return float64(c.get().BlobBytes) },
+		),
+		metrics.NewGaugeFunc(
+			"registry_storage_upload_sessions",
+			"Number of upload sessions on disk, which include abandoned ones.",
+			func() float64 { return float64(c.get().UploadSessions) },
+		),
+	)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/Code-Hex/container-registry/internal/quota"
+	"github.com/Code-Hex/container-registry/internal/storage"
+)
+
+// QuotaServerAdapter rejects pushes of blobs and manifests which exceed quotas with DENIED.
+//
+// The size of the push is Content-Length of the request and what is uploaded in
+// the session so far. If Content-Length is not known, only the current usage is checked.
+func QuotaServerAdapter(m *quota.Manager, s *storage.Local) ServerAdapter {
+	return func(next http.Handler) http.Handler {
+		return Handler(func(w http.ResponseWriter, r *http.Request) error {
+			if err := checkQuota(m, s.WithContext(r.Context()), r); err != nil {
+				return err
+			}
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+func checkQuota(m *quota.Manager, s *storage.Local, r *http.Request) error {
+	var n int64
+	if r.ContentLength > 0 {
+		n = r.ContentLength
+	}
+	name, _ := repositoryOf(r.URL.Path)
+	route := routeOf(r)
+	switch {
+	case route == routeManifest && r.Method == PUT:
+		// manifests which are pushed by digests may be in the repository already.
+		var dgst string
+		if ref := path.Base(r.URL.Path); tagOf(ref) == "" {
+			dgst = ref
+		}
+		return m.Check(name, dgst, n)
+	case route == routeBlobUpload && (r.Method == POST || r.Method == PATCH || r.Method == PUT):
+		if r.Method != POST {
+			sessionID := path.Base(r.URL.Path)
+			if fi, err := s.CheckBlobByReference(name, sessionID); err == nil {
+				n += fi.Size()
+			}
+		}
+		return m.Check(name, r.URL.Query().Get("digest"), n)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/ratelimit"
+)
+
+// Names of limits which are used as the label of metrics.
+const (
+	limitManifests = "manifests"
+	limitBlobBytes = "blob_bytes"
+)
+
+// rateLimitKeys returns keys of buckets of the request: the client IP,
+// the authenticated user and the repository.
+func rateLimitKeys(r *http.Request) []string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	keys := []string{"ip:" + ip}
+	if user := requestInfoFromContext(r.Context()).user; user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	if name, _ := repositoryOf(r.URL.Path); name != "" {
+		keys = append(keys, "repository:"+name)
+	}
+	return keys
+}
+
+// RateLimitServerAdapter limits requests of manifests and bytes of blobs.
+// Requests over the limit are responded 429 with Retry-After.
+//
+// The size of blobs is known after they are transferred, so it is charged after
+// the request and following requests are limited until the bucket is refilled.
+//
+// This must be applied after AuthServerAdapter to limit each authenticated user.
+func RateLimitServerAdapter(c *ratelimit.Config) ServerAdapter {
+	var manifests, blobBytes *ratelimit.Limiter
+	if c.Manifests.Enabled() {
+		manifests = ratelimit.NewLimiter(c.Manifests)
+	}
+	if c.BlobBytes.Enabled() {
+		blobBytes = ratelimit.NewLimiter(c.BlobBytes)
+	}
+	return func(next http.Handler) http.Handler {
+		return Handler(func(w http.ResponseWriter, r *http.Request) error {
+			route := routeOf(r)
+			switch {
+			case route == routeManifest && manifests != nil:
+				if d := manifests.Allow(1, rateLimitKeys(r)...); d > 0 {
+					return tooManyRequests(w, limitManifests, d)
+				}
+			case (route == routeBlob || route == routeBlobUpload) && blobBytes != nil:
+				keys := rateLimitKeys(r)
+				if d := blobBytes.Allow(0, keys...); d > 0 {
+					return tooManyRequests(w, limitBlobBytes, d)
+				}
+				body := &countingReader{ReadCloser: r.Body}
+				if r.Body != nil {
+					r.Body = body
+				}
+				wrapped := newResponse(w)
+				next.ServeHTTP(wrapped, r)
+				n := body.n
+				if r.Method == GET {
+					n += wrapped.size
+				}
+				blobBytes.Charge(float64(n), keys...)
+				return nil
+			}
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, limit string, retryAfter time.Duration) error {
+	rateLimitedRequests.Inc(limit)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return errors.Wrap(
+		fmt.Errorf("rate limit of %s is exceeded", limit),
+		errors.WithCodeTooManyRequests(),
+	)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Code-Hex/container-registry/internal/errors"
+	"github.com/Code-Hex/container-registry/internal/health"
+)
+
+// flusher delivers what is queued. Flush returns when the queue is empty or ctx is done.
+type flusher interface {
+	Flush(ctx context.Context)
+}
+
+// background runs workers such as webhooks and the replicator until the shutdown,
+// then flushes what they have queued.
+type background struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	flushers []flusher
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel}
+}
+
+// Go runs the worker in a goroutine. f is flushed on the shutdown if it is not nil.
+func (b *background) Go(run func(ctx context.Context), f flusher) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		run(b.ctx)
+	}()
+	if f != nil {
+		b.flushers = append(b.flushers, f)
+	}
+}
+
+// Shutdown stops workers and flushes queues in the order of Go until ctx is done.
+func (b *background) Shutdown(ctx context.Context) error {
+	b.cancel()
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, f := range b.flushers {
+		f.Flush(ctx)
+	}
+	return ctx.Err()
+}
+
+// DrainServerAdapter rejects requests to start new upload sessions while the
+// server is shutting down. Uploads which are in progress can be continued.
+func DrainServerAdapter(c *health.Checker) ServerAdapter {
+	return func(next http.Handler) http.Handler {
+		return Handler(func(w http.ResponseWriter, r *http.Request) error {
+			if c.ShuttingDown() && r.Method == POST && strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+				w.Header().Set("Retry-After", "5")
+				return errors.Wrap(
+					fmt.Errorf("the registry is shutting down"),
+					errors.WithCodeUnavailable(),
+				)
+			}
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Code-Hex/container-registry/internal/config"
+	"github.com/Code-Hex/container-registry/internal/logging"
+	"github.com/Code-Hex/container-registry/internal/storage"
+)
+
+// purgeTrash returns the worker which purges entries of the trash which are
+// deleted before retention at the interval. Results are logged to logger.
+func purgeTrash(s *storage.Local, retention, interval time.Duration, logger *logging.Logger) func(ctx context.Context) {
+	if interval <= 0 {
+		interval = config.DefaultPurgeInterval
+	}
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			purged, err := s.WithContext(ctx).PurgeTrashBefore(time.Now().Add(-retention))
+			if err != nil {
+				logger.Error("trash: failed to purge", "error", err)
+			}
+			if len(purged) > 0 {
+				logger.Info("trash: entries are purged", "count", len(purged))
+			}
+		}
+	}
+}
+
+// trashCommand runs "registry trash <subcommand>" and returns the exit code.
+//
+//	registry trash [flags] list [repository]
+//	registry trash [flags] restore <id>
+//	registry trash [flags] purge <id>
+//
+// Subcommands are performed on the admin API of the running registry.
+func trashCommand(args []string) int {
+	fs := flag.NewFlagSet("trash", flag.ContinueOnError)
+	c := newAdminClient(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: registry trash [flags] list [repository] | restore <id> | purge <id>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	args = fs.Args()
+	ctx := context.Background()
+	var err error
+	switch {
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "list":
+		var res struct {
+			Entries []storage.TrashEntry `json:"entries"`
+		}
+		path := "/admin/trash"
+		if len(args) == 2 {
+			path += "?repository=" + url.QueryEscape(args[1])
+		}
+		if err = c.do(ctx, GET, path, nil, &res); err == nil {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tKIND\tREPOSITORY\tDIGEST\tTAGS\tDELETED")
+			for _, e := range res.Entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					e.ID, e.Kind, e.Repository, e.Digest, strings.Join(e.Tags, ","), e.DeletedAt.Format(time.RFC3339))
+			}
+			w.Flush()
+		}
+	case len(args) == 2 && args[0] == "restore":
+		var e storage.TrashEntry
+		if err = c.do(ctx, POST, "/admin/trash/"+args[1]+"/restore", nil, &e); err == nil {
+			fmt.Printf("restored %s %s@%s\n", e.Kind, e.Repository, e.Digest)
+		}
+	case len(args) == 2 && args[0] == "purge":
+		if err = c.do(ctx, DELETE, "/admin/trash/"+args[1], nil, nil); err == nil {
+			fmt.Printf("purged %s\n", args[1])
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "trash: %v\n", err)
+		return 1
+	}
+	return 0
+}